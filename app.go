@@ -0,0 +1,320 @@
+package app
+
+import (
+	"app/internal/auth"
+	"app/internal/clients"
+	"app/internal/lib/net"
+	"app/internal/mongodb"
+	"app/internal/mongodb/migration"
+	"app/internal/password"
+	"app/internal/store"
+	"app/internal/store/memory"
+	"app/internal/store/sqldb"
+	"app/source/api/oauth"
+	"app/source/api/user"
+	"app/source/api/wellknown"
+	"context"
+	"fmt"
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Config : everything an App is built from, LoadConfig reads it from the environment
+type Config struct {
+	BindAddress string
+	// TrustedProxies are the addresses or CIDRs of the reverse proxies whose
+	// forwarded headers give the client address, nil trusts none
+	TrustedProxies []string
+	// Store is StoreMongo connecting to MongoURI, StorePostgres or StoreSQLite
+	// opening DatabaseURL, or StoreMemory
+	Store       string
+	MongoURI    string
+	MongoDbName string
+	// MongoIndexTimeout bounds the index builds when the mongo store opens
+	MongoIndexTimeout time.Duration
+	DatabaseURL       string
+	// MigrateOnStart applies the pending mongo migrations in New, the SQL
+	// stores always apply theirs when opened
+	MigrateOnStart bool
+	// KeyStore is KeyStoreMongo keeping the keys in Store, whatever its kind,
+	// KeyStoreFile reading KeyDir, or KeyStoreMemory
+	KeyStore  string
+	KeyDir    string
+	KeyPolicy auth.KeyPolicy
+	Claims    auth.ClaimsConfig
+	// LegacyJwt verifies HS256 tokens of the previous issuer, the zero value refuses them
+	LegacyJwt      auth.LegacyConfig
+	PasswordPolicy password.Policy
+	LockoutPolicy  user.LockoutPolicy
+	SessionPolicy  user.SessionPolicy
+	// WebAuthn is the passkey relying party, passkeys are disabled when nil
+	WebAuthn *webauthn.Config
+	// TOTPIssuer names the service in the authenticator apps
+	TOTPIssuer string
+	// OAuthClients are registered at start, logins of other clients are refused
+	OAuthClients []clients.Registration
+	AdminAPIKey  string
+	// LogWriter receives the request log, os.Stdout when nil
+	LogWriter io.Writer
+}
+
+// LoadConfig : read the environment, MONGO_URI or DATABASE_URL only when the
+// store selected by STORE needs it
+func LoadConfig() (Config, error) {
+	var (
+		cfg = Config{
+			BindAddress:    GetBindAddress(),
+			TrustedProxies: GetTrustedProxies(),
+			WebAuthn:       GetWebAuthnConfig(),
+			TOTPIssuer:     GetTOTPIssuer(),
+			AdminAPIKey:    GetAdminAPIKey(),
+		}
+		err error
+	)
+	if cfg.Store, err = GetStore(); err != nil {
+		return cfg, err
+	}
+	switch cfg.Store {
+	case StoreMongo:
+		if cfg.MongoURI, cfg.MongoDbName, err = GetMongoURI(); err != nil {
+			return cfg, err
+		}
+		if cfg.MongoIndexTimeout, err = GetMongoIndexTimeout(); err != nil {
+			return cfg, err
+		}
+		if cfg.MigrateOnStart, err = GetMigrateOnStart(); err != nil {
+			return cfg, err
+		}
+	case StorePostgres, StoreSQLite:
+		if cfg.DatabaseURL, err = GetDatabaseURL(); err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.KeyStore, cfg.KeyDir, err = GetKeyStore(); err != nil {
+		return cfg, err
+	}
+	if cfg.KeyPolicy, err = GetKeyPolicy(); err != nil {
+		return cfg, err
+	}
+	if cfg.Claims, err = GetClaimsConfig(); err != nil {
+		return cfg, err
+	}
+	if cfg.LegacyJwt, err = GetLegacyJwt(); err != nil {
+		return cfg, err
+	}
+	if cfg.PasswordPolicy, err = GetPasswordPolicy(); err != nil {
+		return cfg, err
+	}
+	if cfg.LockoutPolicy, err = GetLockoutPolicy(); err != nil {
+		return cfg, err
+	}
+	if cfg.SessionPolicy, err = GetSessionPolicy(); err != nil {
+		return cfg, err
+	}
+	if cfg.OAuthClients, err = GetOAuthClients(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// App : one MFA server with its own storage, keys and routes. Nothing is
+// shared between apps, several can run in the same process.
+type App struct {
+	cfg        Config
+	closeStore func(ctx context.Context) error
+
+	Store  *store.DB
+	Keys   *auth.KeySet
+	Users  *user.Service
+	OAuth  *oauth.Service
+	Engine *net.Engine
+}
+
+// New : connect the storage and build the services and routes. Close releases
+// the storage, also when Run is never called.
+func New(ctx context.Context, cfg Config) (*App, error) {
+	ins := &App{cfg: cfg}
+	if err := ins.openStore(ctx); err != nil {
+		return nil, err
+	}
+	if err := ins.build(ctx); err != nil {
+		_ = ins.Close(context.Background())
+		return nil, err
+	}
+	return ins, nil
+}
+
+func (ins *App) openStore(ctx context.Context) error {
+	switch ins.cfg.Store {
+	case StoreMemory:
+		ins.Store = memory.New()
+	case StoreMongo, "":
+		conn, err := mongodb.Connect(ins.cfg.MongoURI, ins.cfg.MongoDbName, 30*time.Second, ins.cfg.MongoIndexTimeout, ins.cfg.LockoutPolicy.Retention())
+		if err != nil {
+			return fmt.Errorf("mongodb: %w", err)
+		}
+		ins.closeStore = conn.Close
+		ins.Store = conn.Store()
+		if ins.cfg.MigrateOnStart {
+			if err := ins.migrate(ctx, conn); err != nil {
+				_ = conn.Close(context.Background())
+				return fmt.Errorf("mongodb migrations: %w", err)
+			}
+		}
+	case StorePostgres, StoreSQLite:
+		// the store names are the sqldb dialects
+		conn, err := sqldb.Open(ctx, ins.cfg.Store, ins.cfg.DatabaseURL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ins.cfg.Store, err)
+		}
+		ins.closeStore = func(context.Context) error {
+			return conn.Close()
+		}
+		ins.Store = conn.Store()
+	default:
+		return fmt.Errorf("unknown store %q", ins.cfg.Store)
+	}
+	return nil
+}
+
+// migrate : apply the pending migrations, replicas starting together wait for
+// the one that holds the lock
+func (ins *App) migrate(ctx context.Context, conn *mongodb.DB) error {
+	migrator, err := conn.Migrator(migration.Options{SessionLifetime: ins.cfg.SessionPolicy.Lifetime()})
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(ctx, false)
+	return err
+}
+
+func (ins *App) build(ctx context.Context) error {
+	keyStore, err := ins.keyStore()
+	if err != nil {
+		return err
+	}
+	if ins.Keys, err = auth.NewKeySet(ctx, keyStore, ins.cfg.KeyPolicy); err != nil {
+		return fmt.Errorf("signing keys: %w", err)
+	}
+	var (
+		tokens   = auth.NewIssuer(ins.Keys, ins.cfg.Claims)
+		verifier = auth.NewVerifier(ins.Keys, ins.cfg.Claims, ins.cfg.LegacyJwt)
+		registry = clients.NewRegistry(ins.Store.Clients)
+	)
+	for _, registration := range ins.cfg.OAuthClients {
+		if err := registry.Register(ctx, registration); err != nil {
+			return fmt.Errorf("client %q: %w", registration.ID, err)
+		}
+	}
+
+	var relyingParty *webauthn.WebAuthn
+	if ins.cfg.WebAuthn != nil {
+		if relyingParty, err = webauthn.New(ins.cfg.WebAuthn); err != nil {
+			return fmt.Errorf("webauthn: %w", err)
+		}
+	}
+	if ins.Users, err = user.NewService(user.Config{
+		PasswordPolicy: ins.cfg.PasswordPolicy,
+		WebAuthn:       relyingParty,
+		TOTPIssuer:     ins.cfg.TOTPIssuer,
+		LockoutPolicy:  ins.cfg.LockoutPolicy,
+		SessionPolicy:  ins.cfg.SessionPolicy,
+		AdminAPIKey:    ins.cfg.AdminAPIKey,
+		Tokens:         tokens,
+		Verifier:       verifier,
+		Clients:        registry,
+		Store:          ins.Store,
+	}); err != nil {
+		return err
+	}
+	if ins.OAuth, err = oauth.NewService(oauth.Config{
+		Issuer:   ins.cfg.Claims.Issuer,
+		Clients:  registry,
+		Keys:     ins.Keys,
+		Tokens:   tokens,
+		Verifier: verifier,
+		Users:    ins.Users,
+		Store:    ins.Store,
+	}); err != nil {
+		return err
+	}
+
+	ins.Engine = &net.Engine{
+		Server: http.Server{
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			IdleTimeout:  60 * time.Second,
+		},
+		HandlerEngine: gin.New(),
+	}
+	// the lockout counts failures by client address, a forwarded header set
+	// by anyone but a known proxy would give each guess a new one
+	if err := ins.Engine.UseTrustedProxies(ins.cfg.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted proxies: %w", err)
+	}
+	logWriter := ins.cfg.LogWriter
+	if logWriter == nil {
+		logWriter = os.Stdout
+	}
+	ins.Engine.UseLogWriter(logWriter)
+	ins.Engine.UseCors(cors.Config{
+		AllowAllOrigins:  true,
+		AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodOptions, "*"},
+		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "*"},
+		AllowCredentials: false,
+		AllowWebSockets:  true,
+		MaxAge:           12 * time.Hour,
+	})
+	for _, apply := range []func(engine *gin.Engine){
+		user.New(ins.Users).Apply,
+		wellknown.New(ins.Keys).Apply,
+		oauth.New(ins.OAuth).Apply,
+	} {
+		if err := ins.Engine.AddHandler(apply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ins *App) keyStore() (auth.KeyStore, error) {
+	switch ins.cfg.KeyStore {
+	case KeyStoreFile:
+		keyStore, err := auth.NewFileKeyStore(ins.cfg.KeyDir)
+		if err != nil {
+			return nil, fmt.Errorf("signing key store: %w", err)
+		}
+		return keyStore, nil
+	case KeyStoreMemory:
+		return auth.NewMemoryKeyStore(), nil
+	case KeyStoreMongo, "":
+		return ins.Store.Keys, nil
+	default:
+		return nil, fmt.Errorf("unknown signing key store %q", ins.cfg.KeyStore)
+	}
+}
+
+// Run : rotate the signing keys and serve on the bind address until ctx is
+// done, then shut the server down
+func (ins *App) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go ins.Keys.Run(ctx)
+	return ins.Engine.Serve(ctx, ins.cfg.BindAddress)
+}
+
+// Close : disconnect the storage
+func (ins *App) Close(ctx context.Context) error {
+	if ins.closeStore == nil {
+		return nil
+	}
+	if err := ins.closeStore(ctx); err != nil {
+		return fmt.Errorf("%s: %w", ins.cfg.Store, err)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package app
+
+import (
+	"app/internal/auth"
+	"app/internal/clients"
+	"app/internal/password"
+	"app/source/api/user"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	testClientID = "test-app"
+	testPassword = "Correct-horse-1"
+)
+
+// testConfig : the memory stores with a public client logging in with passwords
+func testConfig(configure ...func(cfg *Config)) Config {
+	gin.SetMode(gin.TestMode)
+	cfg := Config{
+		Store:          StoreMemory,
+		KeyStore:       KeyStoreMemory,
+		KeyPolicy:      auth.DefaultKeyPolicy,
+		Claims:         auth.DefaultClaimsConfig,
+		PasswordPolicy: password.DefaultPolicy,
+		LockoutPolicy:  user.DefaultLockoutPolicy,
+		SessionPolicy:  user.DefaultSessionPolicy,
+		OAuthClients: []clients.Registration{{
+			ID:     testClientID,
+			Type:   clients.TypePublic,
+			Grants: []string{clients.GrantPassword, clients.GrantRefreshToken},
+		}},
+		LogWriter: io.Discard,
+	}
+	for _, apply := range configure {
+		apply(&cfg)
+	}
+	return cfg
+}
+
+// newTestApp : an app of testConfig, closed with the test
+func newTestApp(t *testing.T, configure ...func(cfg *Config)) *App {
+	t.Helper()
+	app, err := New(context.Background(), testConfig(configure...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = app.Close(context.Background()) })
+	return app
+}
+
+// login : post the credentials from remoteAddr with the headers, returning the
+// status and the response code
+func login(t *testing.T, app *App, remoteAddr string, header http.Header, username, pwd string) (int, int) {
+	t.Helper()
+	body, err := json.Marshal(map[string]string{"username": username, "password": pwd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login?cId="+testClientID, bytes.NewReader(body))
+	req.RemoteAddr = remoteAddr
+	req.Header = header.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	app.Engine.HandlerEngine.ServeHTTP(rec, req)
+	var resp struct {
+		Code int `json:"code"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("login: %s: %s", err, rec.Body.String())
+	}
+	return rec.Code, resp.Code
+}
+
+// TestLockoutSpoofedForwardedFor : without a trusted proxy a client setting
+// X-Forwarded-For itself still counts against its own address
+func TestLockoutSpoofedForwardedFor(t *testing.T) {
+	const maxIPFailures = 3
+	app := newTestApp(t, func(cfg *Config) {
+		cfg.LockoutPolicy.MaxIPFailures = maxIPFailures
+	})
+	for i := 0; i < maxIPFailures; i++ {
+		header := http.Header{"X-Forwarded-For": {fmt.Sprintf("198.51.100.%d", i+1)}}
+		if status, code := login(t, app, "203.0.113.7:4000", header, fmt.Sprintf("user%d", i), "wrong password"); status != http.StatusUnauthorized || code != 41 {
+			t.Fatalf("failure %d: %d %d", i+1, status, code)
+		}
+	}
+	header := http.Header{"X-Forwarded-For": {"198.51.100.99"}}
+	if status, code := login(t, app, "203.0.113.7:4000", header, "someone", "wrong password"); status != http.StatusTooManyRequests || code != 49 {
+		t.Fatalf("locked address with a new X-Forwarded-For: %d %d", status, code)
+	}
+}
+
+// TestLockoutTrustedProxy : behind a trusted proxy the forwarded address is
+// the one counted, the clients of the proxy do not lock each other out
+func TestLockoutTrustedProxy(t *testing.T) {
+	const maxIPFailures = 3
+	app := newTestApp(t, func(cfg *Config) {
+		cfg.LockoutPolicy.MaxIPFailures = maxIPFailures
+		cfg.TrustedProxies = []string{"10.0.0.1"}
+	})
+	for i := 0; i <= maxIPFailures; i++ {
+		header := http.Header{"X-Forwarded-For": {fmt.Sprintf("198.51.100.%d", i+1)}}
+		if status, code := login(t, app, "10.0.0.1:4000", header, fmt.Sprintf("user%d", i), "wrong password"); status != http.StatusUnauthorized || code != 41 {
+			t.Fatalf("failure %d: %d %d", i+1, status, code)
+		}
+	}
+}
+
+// register : create the account through the routes of app
+func register(t *testing.T, app *App, username string) {
+	t.Helper()
+	body, err := json.Marshal(map[string]string{"username": username, "password": testPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/register?cId="+testClientID, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	app.Engine.HandlerEngine.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register %s: %d %s", username, rec.Code, rec.Body.String())
+	}
+}
+
+func get(app *App, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	app.Engine.HandlerEngine.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+// TestNew : the memory store is wired to every service and route
+func TestNew(t *testing.T) {
+	app := newTestApp(t)
+	if app.Store == nil || app.Keys == nil || app.Users == nil || app.OAuth == nil || app.Engine == nil {
+		t.Fatalf("app %+v", app)
+	}
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	rec := get(app, "/.well-known/jwks.json")
+	if err := json.Unmarshal(rec.Body.Bytes(), &jwks); rec.Code != http.StatusOK || err != nil || len(jwks.Keys) == 0 {
+		t.Fatalf("jwks: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := get(app, "/.well-known/openid-configuration"); rec.Code != http.StatusOK {
+		t.Fatalf("discovery: %d", rec.Code)
+	}
+	register(t, app, "alice")
+	if status, code := login(t, app, "192.0.2.1:4000", http.Header{}, "alice", testPassword); status != http.StatusOK || code != 0 {
+		t.Fatalf("login: %d %d", status, code)
+	}
+	if err := app.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNewKeysInStore : without a key store of their own the signing keys are
+// kept with the data
+func TestNewKeysInStore(t *testing.T) {
+	app := newTestApp(t, func(cfg *Config) {
+		cfg.KeyStore = ""
+	})
+	keys, err := app.Store.Keys.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) == 0 {
+		t.Fatal("no signing key in the store")
+	}
+}
+
+// TestNewSQLite : Close releases the database, an app opened on it again finds
+// the accounts and the signing keys
+func TestNewSQLite(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "app.db")
+	sqlite := func(cfg *Config) {
+		cfg.Store = StoreSQLite
+		cfg.DatabaseURL = dsn
+		cfg.KeyStore = KeyStoreMongo
+	}
+	first, err := New(context.Background(), testConfig(sqlite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(t, first, "alice")
+	jwks := first.Keys.JWKS()
+	if err := first.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestApp(t, sqlite)
+	if status, code := login(t, second, "192.0.2.1:4000", http.Header{}, "alice", testPassword); status != http.StatusOK || code != 0 {
+		t.Fatalf("login after the reopen: %d %d", status, code)
+	}
+	if !reflect.DeepEqual(second.Keys.JWKS(), jwks) {
+		t.Fatal("signing keys not kept in the database")
+	}
+}
+
+// TestAppsIsolated : apps in the same process share nothing
+func TestAppsIsolated(t *testing.T) {
+	first, second := newTestApp(t), newTestApp(t)
+	register(t, first, "alice")
+	if status, code := login(t, second, "192.0.2.1:4000", http.Header{}, "alice", testPassword); status != http.StatusUnauthorized || code != 41 {
+		t.Fatalf("login on the other app: %d %d", status, code)
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	for name, configure := range map[string]func(cfg *Config){
+		"unknown store":     func(cfg *Config) { cfg.Store = "redis" },
+		"unknown key store": func(cfg *Config) { cfg.KeyStore = "vault" },
+		"invalid client": func(cfg *Config) {
+			cfg.OAuthClients = append(cfg.OAuthClients, clients.Registration{ID: "app", Type: clients.TypePublic, Secret: "secret"})
+		},
+		"invalid trusted proxy": func(cfg *Config) { cfg.TrustedProxies = []string{"not an address"} },
+	} {
+		if app, err := New(context.Background(), testConfig(configure)); err == nil {
+			_ = app.Close(context.Background())
+			t.Fatalf("%s: no error", name)
+		}
+	}
+}
@@ -2,64 +2,47 @@ package main
 
 import (
 	"app"
-	"app/internal/lib/net"
-	"app/internal/mongodb"
-	"app/source/api/user"
-	"github.com/gin-contrib/cors"
-	"github.com/gin-gonic/gin"
+	"context"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
 	"time"
 )
 
-var (
-	bindAddress           string
-	mongoURI, mongoDbName string
-)
-
-func init() {
+func main() {
 	//	Open the .env file
 	if err := app.LoadEnvironmentVariables("./.env"); err != nil {
 		log.Fatalf("- LoadEnvironmentVariables error: %s\n", err.Error())
 	}
-	mongoURI, mongoDbName = app.GetMongoURI()
-
-	bindAddress = app.GetBindAddress()
-	mongoURI, mongoDbName = app.GetMongoURI()
-
-	// Khởi tạo kết nối MongoDB
-	if mongodb.Conn == nil {
-		println("Please implement value of mongodb.Connection!")
-		os.Exit(1)
-	} else {
-		mongodb.Conn.Init(mongoURI, mongoDbName, 30*time.Second)
+	cfg, err := app.LoadConfig()
+	if err != nil {
+		log.Fatalf("- Config error: %s\n", err.Error())
 	}
-}
 
-func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	apiEngine := &net.Engine{
-		Server: http.Server{
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
-			IdleTimeout:  60 * time.Second,
-		},
-		HandlerEngine: gin.New(),
+	// `migrate status|up` manages the mongo migrations instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(ctx, cfg, os.Args[2:]); err != nil {
+			log.Fatalf("- Migrate error: %s\n", err.Error())
+		}
+		return
 	}
 
-	apiEngine.UseLogWriter(os.Stdout)
-	apiEngine.UseCors(cors.Config{
-		AllowAllOrigins:  true,
-		AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodOptions, "*"},
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "*"},
-		AllowCredentials: false,
-		AllowWebSockets:  true,
-		MaxAge:           12 * time.Hour,
-	})
-
-	userSvc := user.NewService()
-
-	apiEngine.AddHandler(user.New(userSvc).Apply)
-	apiEngine.Run(bindAddress)
+	server, err := app.New(ctx, cfg)
+	if err != nil {
+		log.Fatalf("- Startup error: %s\n", err.Error())
+	}
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Close(closeCtx); err != nil {
+			log.Printf("- Shutdown error: %s\n", err.Error())
+		}
+	}()
+
+	if err := server.Run(ctx); err != nil {
+		log.Printf("- Server error: %s\n", err.Error())
+	}
 }
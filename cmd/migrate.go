@@ -0,0 +1,84 @@
+package main
+
+import (
+	"app"
+	"app/internal/mongodb"
+	"app/internal/mongodb/migration"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const migrateUsage = `usage: migrate status
+       migrate up [-dry-run]`
+
+// migrate : `migrate status` lists the mongo migrations and when they were
+// applied, `migrate up` applies the pending ones, with -dry-run it only counts
+// the documents each would change
+func migrate(ctx context.Context, cfg app.Config, args []string) error {
+	if cfg.Store != app.StoreMongo {
+		return fmt.Errorf("store %q applies its migrations when it is opened", cfg.Store)
+	}
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	var (
+		flags  = flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+		dryRun = flags.Bool("dry-run", false, "count the documents the pending migrations would change")
+	)
+	switch args[0] {
+	case "status", "up":
+	default:
+		return errors.New(migrateUsage)
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	conn, err := mongodb.Connect(cfg.MongoURI, cfg.MongoDbName, 30*time.Second, cfg.MongoIndexTimeout, cfg.LockoutPolicy.Retention())
+	if err != nil {
+		return fmt.Errorf("mongodb: %w", err)
+	}
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = conn.Close(closeCtx)
+	}()
+	migrator, err := conn.Migrator(migration.Options{SessionLifetime: cfg.SessionPolicy.Lifetime()})
+	if err != nil {
+		return err
+	}
+
+	var list []migration.Status
+	if args[0] == "status" {
+		list, err = migrator.Status(ctx)
+	} else {
+		list, err = migrator.Up(ctx, *dryRun)
+	}
+	printMigrations(list, args[0] == "up" && *dryRun)
+	return err
+}
+
+func printMigrations(list []migration.Status, dryRun bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if dryRun {
+		_, _ = fmt.Fprintln(w, "VERSION\tDESCRIPTION\tWOULD CHANGE")
+	} else {
+		_, _ = fmt.Fprintln(w, "VERSION\tDESCRIPTION\tAPPLIED AT\tCHANGED")
+	}
+	for _, s := range list {
+		switch {
+		case dryRun:
+			_, _ = fmt.Fprintf(w, "%d\t%s\t%d\n", s.Version, s.Description, s.Changed)
+		case s.Applied():
+			_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%d\n", s.Version, s.Description, s.AppliedAt.Format(time.RFC3339), s.Changed)
+		default:
+			_, _ = fmt.Fprintf(w, "%d\t%s\tpending\t-\n", s.Version, s.Description)
+		}
+	}
+	_ = w.Flush()
+}
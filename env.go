@@ -1,22 +1,98 @@
 package app
 
 import (
+	"app/internal/auth"
+	"app/internal/clients"
+	"app/internal/mongodb"
+	"app/internal/password"
+	"app/source/api/user"
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"github.com/go-webauthn/webauthn/webauthn"
 	uri "go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
-	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	EnvBindServer = "BIND"
 	EnvPortServer = "PORT"
-	EnvMongoURI   = "MONGO_URI"
+	// EnvTrustedProxies : comma separated addresses or CIDRs of the reverse proxies
+	EnvTrustedProxies = "TRUSTED_PROXIES"
+	EnvMongoURI       = "MONGO_URI"
+	// EnvMongoIndexTimeout : how long the index builds at start may take, e.g. "30m"
+	EnvMongoIndexTimeout = "MONGO_INDEX_TIMEOUT"
+	EnvStore             = "STORE"
+	// EnvDatabaseURL : the DSN of the postgres and sqlite stores
+	EnvDatabaseURL = "DATABASE_URL"
+	// EnvMigrateOnStart : apply the pending mongo migrations when the server starts
+	EnvMigrateOnStart = "MIGRATE_ON_START"
 
 	EnvLoadSkip  = "LOAD_SKIP"
 	EnvLoadLimit = "LOAD_LIMIT"
+
+	EnvPasswordMinLength     = "PASSWORD_MIN_LENGTH"
+	EnvPasswordMaxLength     = "PASSWORD_MAX_LENGTH"
+	EnvPasswordRequireUpper  = "PASSWORD_REQUIRE_UPPER"
+	EnvPasswordRequireLower  = "PASSWORD_REQUIRE_LOWER"
+	EnvPasswordRequireDigit  = "PASSWORD_REQUIRE_DIGIT"
+	EnvPasswordRequireSymbol = "PASSWORD_REQUIRE_SYMBOL"
+
+	EnvWebAuthnRPID      = "WEBAUTHN_RP_ID"
+	EnvWebAuthnRPName    = "WEBAUTHN_RP_NAME"
+	EnvWebAuthnRPOrigins = "WEBAUTHN_RP_ORIGINS"
+
+	// EnvTOTPIssuer : the name authenticator apps show next to the account
+	EnvTOTPIssuer = "TOTP_ISSUER"
+
+	EnvLockoutMaxFailures   = "LOCKOUT_MAX_FAILURES"
+	EnvLockoutMaxIPFailures = "LOCKOUT_MAX_IP_FAILURES"
+	EnvLockoutBaseDelay     = "LOCKOUT_BASE_DELAY"
+	EnvLockoutMaxDelay      = "LOCKOUT_MAX_DELAY"
+	EnvLockoutWindow        = "LOCKOUT_WINDOW"
+
+	EnvAdminAPIKey = "ADMIN_API_KEY"
+
+	EnvOAuthClients     = "OAUTH_CLIENTS"
+	EnvOAuthClientsFile = "OAUTH_CLIENTS_FILE"
+
+	EnvSessionMax         = "SESSION_MAX"
+	EnvSessionLimitAction = "SESSION_LIMIT_ACTION"
+	EnvSessionIdleTimeout = "SESSION_IDLE_TIMEOUT"
+	EnvSessionMaxLifetime = "SESSION_MAX_LIFETIME"
+
+	EnvJwtKeyStore       = "JWT_KEY_STORE"
+	EnvJwtKeyDir         = "JWT_KEY_DIR"
+	EnvJwtAlgorithm      = "JWT_ALGORITHM"
+	EnvJwtKeyRotateEvery = "JWT_KEY_ROTATE_EVERY"
+	EnvJwtKeyOverlap     = "JWT_KEY_OVERLAP"
+	EnvJwtKeyReloadEvery = "JWT_KEY_RELOAD_EVERY"
+	EnvJwtIssuer         = "JWT_ISSUER"
+	EnvJwtAudience       = "JWT_AUDIENCE"
+	EnvJwtClockSkew      = "JWT_CLOCK_SKEW"
+	// EnvJwtLegacySecret : HS256 secret of tokens issued before asymmetric keys, unset to refuse them
+	EnvJwtLegacySecret = "SECRET_JWT"
+	// EnvJwtLegacyUntil : RFC 3339 time the legacy tokens are refused from, required with SECRET_JWT
+	EnvJwtLegacyUntil = "SECRET_JWT_UNTIL"
+)
+
+// Stores of users and sessions selected with STORE
+const (
+	StoreMongo    = "mongo"
+	StorePostgres = "postgres"
+	StoreSQLite   = "sqlite"
+	StoreMemory   = "memory"
+)
+
+// Signing key stores selected with JWT_KEY_STORE
+const (
+	KeyStoreMongo  = "mongo"
+	KeyStoreFile   = "file"
+	KeyStoreMemory = "memory"
 )
 
 func LoadEnvironmentVariables(path string) error {
@@ -79,11 +155,29 @@ func GetBindAddress() string {
 	return fmt.Sprintf("%s:%s", envBIND, envPORT)
 }
 
-func GetMongoURI() (dbURI, dbname string) {
+// GetTrustedProxies : unset trusts no proxy, the client address is then the
+// one the connection comes from
+func GetTrustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv(EnvTrustedProxies), ",") {
+		if proxy = strings.TrimSpace(proxy); len(proxy) > 0 {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// GetMongoIndexTimeout : MONGO_INDEX_TIMEOUT, mongodb.DefaultIndexTimeout when unset
+func GetMongoIndexTimeout() (time.Duration, error) {
+	var env envReader
+	timeout := env.duration(EnvMongoIndexTimeout, mongodb.DefaultIndexTimeout)
+	return timeout, env.err
+}
+
+func GetMongoURI() (dbURI, dbname string, err error) {
 	conn, err := uri.ParseAndValidate(os.Getenv(EnvMongoURI))
 	if err != nil {
-		log.Fatalf("- GetMongoURI error: %s\n", err.Error())
-		return
+		return "", "", fmt.Errorf("%s: %w", EnvMongoURI, err)
 	}
 
 	if conn.UsernameSet && !conn.PasswordSet {
@@ -92,17 +186,286 @@ func GetMongoURI() (dbURI, dbname string) {
 			var pwd string
 			print("Enter password of MongoDB: ")
 			if _, err := fmt.Scan(&pwd); err != nil {
-				log.Fatalf("%s\n", err.Error())
+				return "", "", fmt.Errorf("%s: %w", EnvMongoURI, err)
 			}
 			print("\b\rPassword Fingerprint:      " + strings.Repeat("*", len(pwd)) + "\n") // hide password input
 			conn.PasswordSet = true
 			conn.Password = pwd
 			conn.Original = arr[0] + ":" + pwd + "@" + strings.Join(arr[1:], "@")
 			if _, err := uri.ParseAndValidate(conn.Original); err != nil {
-				log.Fatalf("- GetMongoURI error: %s\n", "password invalid format")
-				return
+				return "", "", fmt.Errorf("%s: password invalid format", EnvMongoURI)
 			}
 		}
 	}
-	return conn.String(), conn.Database
+	return conn.String(), conn.Database, nil
+}
+
+func GetPasswordPolicy() (password.Policy, error) {
+	var (
+		policy = password.DefaultPolicy
+		env    envReader
+	)
+	policy.MinLength = env.int(EnvPasswordMinLength, policy.MinLength)
+	policy.MaxLength = env.int(EnvPasswordMaxLength, policy.MaxLength)
+	policy.RequireUpper = env.bool(EnvPasswordRequireUpper, policy.RequireUpper)
+	policy.RequireLower = env.bool(EnvPasswordRequireLower, policy.RequireLower)
+	policy.RequireDigit = env.bool(EnvPasswordRequireDigit, policy.RequireDigit)
+	policy.RequireSymbol = env.bool(EnvPasswordRequireSymbol, policy.RequireSymbol)
+	return policy, env.err
+}
+
+// GetWebAuthnConfig : relying party used for passkeys, origins is a comma
+// separated list defaulting to https://<WEBAUTHN_RP_ID>. Passkeys are disabled,
+// nil, while WEBAUTHN_RP_ID is unset.
+func GetWebAuthnConfig() *webauthn.Config {
+	var (
+		envRPID      = os.Getenv(EnvWebAuthnRPID)
+		envRPName    = os.Getenv(EnvWebAuthnRPName)
+		envRPOrigins = os.Getenv(EnvWebAuthnRPOrigins)
+		origins      []string
+	)
+	if len(envRPID) == 0 {
+		return nil
+	}
+	if len(envRPName) == 0 {
+		envRPName = "MFA"
+	}
+	if len(envRPOrigins) == 0 {
+		envRPOrigins = "https://" + envRPID
+	}
+	for _, origin := range strings.Split(envRPOrigins, ",") {
+		if origin = strings.TrimSpace(origin); len(origin) > 0 {
+			origins = append(origins, origin)
+		}
+	}
+	return &webauthn.Config{
+		RPID:          envRPID,
+		RPDisplayName: envRPName,
+		RPOrigins:     origins,
+	}
+}
+
+// GetLockoutPolicy : durations use time.ParseDuration syntax, e.g. "30s" or "1h"
+func GetLockoutPolicy() (user.LockoutPolicy, error) {
+	var (
+		policy = user.DefaultLockoutPolicy
+		env    envReader
+	)
+	policy.MaxFailures = env.int(EnvLockoutMaxFailures, policy.MaxFailures)
+	policy.MaxIPFailures = env.int(EnvLockoutMaxIPFailures, policy.MaxIPFailures)
+	policy.BaseDelay = env.duration(EnvLockoutBaseDelay, policy.BaseDelay)
+	policy.MaxDelay = env.duration(EnvLockoutMaxDelay, policy.MaxDelay)
+	policy.Window = env.duration(EnvLockoutWindow, policy.Window)
+	return policy, env.err
+}
+
+// GetSessionPolicy : SESSION_LIMIT_ACTION is "evict" (default) or "refuse",
+// SESSION_IDLE_TIMEOUT and SESSION_MAX_LIFETIME are durations, 0 for no limit
+func GetSessionPolicy() (user.SessionPolicy, error) {
+	var (
+		policy = user.DefaultSessionPolicy
+		env    envReader
+	)
+	policy.MaxSessions = env.int(EnvSessionMax, policy.MaxSessions)
+	policy.IdleTimeout = env.duration(EnvSessionIdleTimeout, policy.IdleTimeout)
+	policy.MaxLifetime = env.duration(EnvSessionMaxLifetime, policy.MaxLifetime)
+	if action := os.Getenv(EnvSessionLimitAction); len(action) > 0 {
+		if action != user.SessionLimitEvict && action != user.SessionLimitRefuse {
+			env.fail(EnvSessionLimitAction, fmt.Errorf("unknown action %q", action))
+		}
+		policy.OnLimit = action
+	}
+	return policy, env.err
+}
+
+// GetStore : STORE is "mongo" (default) connecting to MONGO_URI, "postgres" or
+// "sqlite" opening DATABASE_URL, or "memory" for data that is lost on restart
+func GetStore() (string, error) {
+	kind := os.Getenv(EnvStore)
+	switch kind {
+	case "":
+		return StoreMongo, nil
+	case StoreMongo, StorePostgres, StoreSQLite, StoreMemory:
+		return kind, nil
+	default:
+		return "", fmt.Errorf("%s: unknown store %q", EnvStore, kind)
+	}
+}
+
+// GetMigrateOnStart : MIGRATE_ON_START is true by default, set it to false when
+// the migrations are applied with `migrate up` before a release
+func GetMigrateOnStart() (bool, error) {
+	var env envReader
+	migrate := env.bool(EnvMigrateOnStart, true)
+	return migrate, env.err
+}
+
+// GetKeyStore : JWT_KEY_STORE is "mongo" (default) keeping the keys in STORE,
+// "file" reading JWT_KEY_DIR, or "memory" for keys that are lost on restart
+func GetKeyStore() (kind, dir string, err error) {
+	kind = os.Getenv(EnvJwtKeyStore)
+	switch kind {
+	case "":
+		kind = KeyStoreMongo
+	case KeyStoreMongo, KeyStoreFile, KeyStoreMemory:
+	default:
+		return "", "", fmt.Errorf("%s: unknown store %q", EnvJwtKeyStore, kind)
+	}
+	if dir = os.Getenv(EnvJwtKeyDir); len(dir) == 0 {
+		dir = "./keys"
+	}
+	return kind, dir, nil
+}
+
+// GetKeyPolicy : JWT_ALGORITHM is RS256, ES256 (default) or EdDSA
+func GetKeyPolicy() (auth.KeyPolicy, error) {
+	var (
+		policy = auth.DefaultKeyPolicy
+		env    envReader
+	)
+	if alg := os.Getenv(EnvJwtAlgorithm); len(alg) > 0 {
+		policy.Algorithm = alg
+	}
+	policy.RotateEvery = env.duration(EnvJwtKeyRotateEvery, policy.RotateEvery)
+	policy.Overlap = env.duration(EnvJwtKeyOverlap, policy.Overlap)
+	policy.ReloadEvery = env.duration(EnvJwtKeyReloadEvery, policy.ReloadEvery)
+	return policy, env.err
+}
+
+func GetClaimsConfig() (auth.ClaimsConfig, error) {
+	var (
+		cfg = auth.DefaultClaimsConfig
+		env envReader
+	)
+	if issuer := os.Getenv(EnvJwtIssuer); len(issuer) > 0 {
+		cfg.Issuer = issuer
+	}
+	if audience := os.Getenv(EnvJwtAudience); len(audience) > 0 {
+		cfg.Audience = audience
+	}
+	cfg.ClockSkew = env.duration(EnvJwtClockSkew, cfg.ClockSkew)
+	return cfg, env.err
+}
+
+// GetDatabaseURL : a postgres:// URL, or the file of the SQLite database
+func GetDatabaseURL() (string, error) {
+	dsn := os.Getenv(EnvDatabaseURL)
+	if len(dsn) == 0 {
+		return "", fmt.Errorf("%s: required by %s %s or %s", EnvDatabaseURL, EnvStore, StorePostgres, StoreSQLite)
+	}
+	return dsn, nil
+}
+
+// GetLegacyJwt : the grace period of the HS256 tokens, they are never checked
+// against a session and must stop being accepted at some point
+func GetLegacyJwt() (auth.LegacyConfig, error) {
+	secret := os.Getenv(EnvJwtLegacySecret)
+	if len(secret) == 0 {
+		return auth.LegacyConfig{}, nil
+	}
+	value := os.Getenv(EnvJwtLegacyUntil)
+	if len(value) == 0 {
+		return auth.LegacyConfig{}, fmt.Errorf("%s: required by %s", EnvJwtLegacyUntil, EnvJwtLegacySecret)
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return auth.LegacyConfig{}, fmt.Errorf("%s: %w", EnvJwtLegacyUntil, err)
+	}
+	return auth.LegacyConfig{Secret: []byte(secret), Until: until}, nil
+}
+
+// GetOAuthClients : the clients to register at start. OAUTH_CLIENTS_FILE is a
+// JSON array of clients.Registration; OAUTH_CLIENTS adds confidential clients
+// of the code flow as a comma separated list of client_id:client_secret.
+// Logins are refused for any client that is not registered.
+func GetOAuthClients() ([]clients.Registration, error) {
+	var registrations []clients.Registration
+	if path := os.Getenv(EnvOAuthClientsFile); len(path) > 0 {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", EnvOAuthClientsFile, err)
+		}
+		if err := json.Unmarshal(data, &registrations); err != nil {
+			return nil, fmt.Errorf("%s: %w", EnvOAuthClientsFile, err)
+		}
+	}
+	for _, entry := range strings.Split(os.Getenv(EnvOAuthClients), ",") {
+		if entry = strings.TrimSpace(entry); len(entry) == 0 {
+			continue
+		}
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok || len(id) == 0 || len(secret) == 0 {
+			return nil, fmt.Errorf("%s: expected client_id:client_secret", EnvOAuthClients)
+		}
+		registrations = append(registrations, clients.Registration{
+			ID:     id,
+			Secret: secret,
+			Type:   clients.TypeConfidential,
+			Grants: []string{clients.GrantAuthorizationCode, clients.GrantRefreshToken},
+		})
+	}
+	return registrations, nil
+}
+
+// GetTOTPIssuer : defaults to "MFA" like the passkey relying party name
+func GetTOTPIssuer() string {
+	if issuer := os.Getenv(EnvTOTPIssuer); len(issuer) > 0 {
+		return issuer
+	}
+	return "MFA"
+}
+
+func GetAdminAPIKey() string {
+	return os.Getenv(EnvAdminAPIKey)
+}
+
+// envReader : parses optional settings, a value that does not parse is kept
+// as the first error and its fallback is used
+type envReader struct {
+	err error
+}
+
+func (ins *envReader) fail(key string, err error) {
+	if ins.err == nil {
+		ins.err = fmt.Errorf("%s: %w", key, err)
+	}
+}
+
+func (ins *envReader) int(key string, fallback int) int {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		ins.fail(key, err)
+		return fallback
+	}
+	return n
+}
+
+func (ins *envReader) bool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		ins.fail(key, err)
+		return fallback
+	}
+	return b
+}
+
+func (ins *envReader) duration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		ins.fail(key, err)
+		return fallback
+	}
+	return d
 }
@@ -1,83 +1,190 @@
 package auth
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
 	"errors"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"time"
 )
 
-var (
-	JwtSecret = func() []byte {
-		key, err := rsa.GenerateKey(rand.Reader, 256)
-		if err != nil {
-			return nil
-		}
-		return x509.MarshalPKCS1PrivateKey(key)
-	}()
+// validMethods : algorithms accepted when parsing, HMAC and "none" never are
+var validMethods = jwt.WithValidMethods([]string{AlgRS256, AlgES256, AlgEdDSA})
+
+const (
+	// PurposeAccess marks a token that grants access to the API
+	PurposeAccess = "access"
+	// PurposeMFA marks a challenge token that can only be exchanged at /login/mfa
+	PurposeMFA = "mfa"
+)
+
+// Authentication method references (RFC 8176) recorded in access tokens
+const (
+	AmrPassword = "pwd"
+	AmrOTP      = "otp"
+	// AmrHardwareKey : proof of possession of a WebAuthn credential
+	AmrHardwareKey = "hwk"
+	// AmrUserPresence : the authenticator verified the user, used for passwordless passkey logins
+	AmrUserPresence = "user"
+	// AmrRecoveryCode is not registered in RFC 8176, it marks a single-use backup code
+	AmrRecoveryCode = "rcode"
 )
 
+// ClaimsConfig : registered claims put in every token and enforced on parse
+type ClaimsConfig struct {
+	Issuer string
+	// Audience of access tokens, MFA and refresh tokens are only meant for the
+	// issuer itself and carry Issuer as audience instead
+	Audience string
+	// ClockSkew tolerated when checking exp, nbf and iat
+	ClockSkew time.Duration
+}
+
+var DefaultClaimsConfig = ClaimsConfig{
+	Issuer:    "http://localhost:8080",
+	Audience:  "mfa-api",
+	ClockSkew: 30 * time.Second,
+}
+
+// Issuer : signs the tokens of the API with a key set and parses them back
+type Issuer struct {
+	keys   *KeySet
+	claims ClaimsConfig
+}
+
+func NewIssuer(keys *KeySet, claims ClaimsConfig) *Issuer {
+	return &Issuer{
+		keys:   keys,
+		claims: claims,
+	}
+}
+
+// UserClaims : the subject is the hex user id
 type UserClaims struct {
-	UUID     primitive.ObjectID
-	Username string
+	Username string           `json:"preferred_username,omitempty"`
+	Purpose  string           `json:"pur,omitempty"`
+	AMR      []string         `json:"amr,omitempty"`
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	Roles    []string         `json:"roles,omitempty"`
+	// Scope is space separated as in OAuth 2.0
+	Scope string `json:"scope,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateAccessToken(uuid primitive.ObjectID, username string, period time.Duration) (string, error) {
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, UserClaims{
-		UUID:     uuid,
-		Username: username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(period)),
-		},
-	}).SignedString(JwtSecret)
+// UserID : the subject as an ObjectID
+func (c *UserClaims) UserID() (primitive.ObjectID, error) {
+	return primitive.ObjectIDFromHex(c.Subject)
 }
 
-func GenerateRefreshToken(period time.Duration) (
-	string, error) {
-	return jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.RegisteredClaims{
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(period)),
-		},
-	).SignedString(JwtSecret)
+// registeredClaims : claims shared by every token we issue
+func (iss *Issuer) registeredClaims(subject, audience string, period time.Duration) jwt.RegisteredClaims {
+	now := time.Now()
+	return jwt.RegisteredClaims{
+		Issuer:    iss.claims.Issuer,
+		Subject:   subject,
+		Audience:  jwt.ClaimStrings{audience},
+		ExpiresAt: jwt.NewNumericDate(now.Add(period)),
+		NotBefore: jwt.NewNumericDate(now),
+		IssuedAt:  jwt.NewNumericDate(now),
+		ID:        uuid.NewString(),
+	}
+}
+
+// GenerateAccessToken : authTime is when the user authenticated, which stays the
+// same across refreshes
+func (iss *Issuer) GenerateAccessToken(uuid primitive.ObjectID, username string, amr []string, authTime time.Time, period time.Duration) (string, error) {
+	return iss.keys.Sign(UserClaims{
+		Username:         username,
+		Purpose:          PurposeAccess,
+		AMR:              amr,
+		AuthTime:         jwt.NewNumericDate(authTime),
+		RegisteredClaims: iss.registeredClaims(uuid.Hex(), iss.claims.Audience, period),
+	})
+}
+
+// GenerateMFAToken : issue a short-lived challenge token proving the first factor was passed
+func (iss *Issuer) GenerateMFAToken(uuid primitive.ObjectID, username string, period time.Duration) (string, error) {
+	return iss.keys.Sign(UserClaims{
+		Username:         username,
+		Purpose:          PurposeMFA,
+		AMR:              []string{AmrPassword},
+		AuthTime:         jwt.NewNumericDate(time.Now()),
+		RegisteredClaims: iss.registeredClaims(uuid.Hex(), iss.claims.Issuer, period),
+	})
+}
+
+// RefreshClaims : a refresh token belongs to a family started at login, every
+// rotation issues the next generation and retires the previous one
+type RefreshClaims struct {
+	Family     primitive.ObjectID `json:"fam"`
+	Generation int                `json:"gen"`
+	jwt.RegisteredClaims
 }
 
-func ValidateAccessToken(accessToken string) (
-	primitive.ObjectID, string, *jwt.RegisteredClaims, error) {
-	parsedToken, err := jwt.ParseWithClaims(accessToken, &UserClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return JwtSecret, nil
+func (iss *Issuer) GenerateRefreshToken(family primitive.ObjectID, generation int, period time.Duration) (
+	string, error) {
+	return iss.keys.Sign(RefreshClaims{
+		Family:           family,
+		Generation:       generation,
+		RegisteredClaims: iss.registeredClaims("", iss.claims.Issuer, period),
 	})
+}
+
+// ValidateMFAToken : verify a challenge token issued by GenerateMFAToken
+func (iss *Issuer) ValidateMFAToken(mfaToken string) (primitive.ObjectID, string, error) {
+	claims, err := iss.parseUserClaims(mfaToken, PurposeMFA, iss.claims.Issuer)
 	if err != nil {
-		return primitive.NilObjectID, "", nil, err
+		return primitive.NilObjectID, "", err
+	}
+	uuid, err := claims.UserID()
+	if err != nil {
+		return primitive.NilObjectID, "", err
+	}
+
+	return uuid, claims.Username, nil
+}
+
+// parserOptions : enforce iss, aud, exp, nbf and iat with the configured skew,
+// exp is optional for the parser so the callers require it
+func (iss *Issuer) parserOptions(audience string) []jwt.ParserOption {
+	return []jwt.ParserOption{
+		validMethods,
+		jwt.WithIssuer(iss.claims.Issuer),
+		jwt.WithAudience(audience),
+		jwt.WithLeeway(iss.claims.ClockSkew),
+		jwt.WithIssuedAt(),
+	}
+}
+
+func (iss *Issuer) parseUserClaims(token, purpose, audience string) (*UserClaims, error) {
+	parsedToken, err := jwt.ParseWithClaims(token, &UserClaims{}, iss.keys.Keyfunc, iss.parserOptions(audience)...)
+	if err != nil {
+		return nil, err
 	}
 	if parsedToken == nil {
-		return primitive.NilObjectID, "", nil, errors.New("can not parse token")
+		return nil, errors.New("can not parse token")
 	}
 	claims, ok := parsedToken.Claims.(*UserClaims)
-	if !ok {
-		return primitive.NilObjectID, "", nil, errors.New("token invalid")
+	if !ok || claims.ExpiresAt == nil {
+		return nil, errors.New("token invalid")
+	}
+	if claims.Purpose != purpose {
+		return nil, errors.New("token purpose invalid")
 	}
 
-	return claims.UUID, claims.Username, &claims.RegisteredClaims, nil
+	return claims, nil
 }
 
-func ValidateRefreshToken(refreshToken string) (*jwt.RegisteredClaims, error) {
-	parsedToken, err := jwt.ParseWithClaims(refreshToken, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return JwtSecret, nil
-	})
+func (iss *Issuer) ValidateRefreshToken(refreshToken string) (*RefreshClaims, error) {
+	parsedToken, err := jwt.ParseWithClaims(refreshToken, &RefreshClaims{}, iss.keys.Keyfunc, iss.parserOptions(iss.claims.Issuer)...)
 	if err != nil {
 		return nil, err
 	}
 	if parsedToken == nil {
 		return nil, errors.New("can not parse token")
 	}
-	claims, ok := parsedToken.Claims.(*jwt.RegisteredClaims)
-	if !ok {
+	claims, ok := parsedToken.Claims.(*RefreshClaims)
+	if !ok || claims.Family.IsZero() || claims.ExpiresAt == nil {
 		return nil, errors.New("token invalid")
 	}
 
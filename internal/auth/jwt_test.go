@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestIssuer(t *testing.T, claims ClaimsConfig) (*Issuer, *Verifier) {
+	t.Helper()
+	keys, err := NewKeySet(context.Background(), NewMemoryKeyStore(), DefaultKeyPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewIssuer(keys, claims), NewVerifier(keys, claims, LegacyConfig{})
+}
+
+// TestAccessTokenClaims : sub, iss, aud, jti, amr and auth_time of an access
+// token come back from the verifier as issued
+func TestAccessTokenClaims(t *testing.T) {
+	issuer, verifier := newTestIssuer(t, DefaultClaimsConfig)
+	var (
+		uuid     = primitive.NewObjectID()
+		amr      = []string{AmrPassword, AmrOTP}
+		authTime = time.Now().Add(-time.Hour).Truncate(time.Second)
+		jtis     = map[string]bool{}
+	)
+	for i := 0; i < 2; i++ {
+		token, err := issuer.GenerateAccessToken(uuid, "alice", amr, authTime, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := verifier.Verify(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Subject != uuid.Hex() || claims.UserID != uuid || claims.Username != "alice" {
+			t.Fatalf("subject %s %s %s", claims.Subject, claims.UserID.Hex(), claims.Username)
+		}
+		if claims.Issuer != DefaultClaimsConfig.Issuer || !reflect.DeepEqual([]string(claims.Audience), []string{DefaultClaimsConfig.Audience}) {
+			t.Fatalf("iss %s aud %v", claims.Issuer, claims.Audience)
+		}
+		if !reflect.DeepEqual(claims.AMR, amr) || !claims.AuthTime.Equal(authTime) {
+			t.Fatalf("amr %v auth_time %s", claims.AMR, claims.AuthTime)
+		}
+		if len(claims.ID) == 0 || jtis[claims.ID] {
+			t.Fatalf("jti %q not unique", claims.ID)
+		}
+		jtis[claims.ID] = true
+	}
+}
+
+// TestTokenAudience : a token is only accepted by what it was issued for, the
+// issuer and audience of another deployment and the other purposes are refused
+func TestTokenAudience(t *testing.T) {
+	issuer, verifier := newTestIssuer(t, DefaultClaimsConfig)
+	uuid := primitive.NewObjectID()
+	access, err := issuer.GenerateAccessToken(uuid, "alice", []string{AmrPassword}, time.Now(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa, err := issuer.GenerateMFAToken(uuid, "alice", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := issuer.GenerateRefreshToken(primitive.NewObjectID(), 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(mfa); err == nil {
+		t.Fatal("MFA token accepted as an access token")
+	}
+	if _, err := verifier.Verify(refresh); err == nil {
+		t.Fatal("refresh token accepted as an access token")
+	}
+	if _, _, err := issuer.ValidateMFAToken(access); err == nil {
+		t.Fatal("access token accepted as an MFA token")
+	}
+	if _, err := issuer.ValidateRefreshToken(access); err == nil {
+		t.Fatal("access token accepted as a refresh token")
+	}
+	if id, _, err := issuer.ValidateMFAToken(mfa); err != nil || id != uuid {
+		t.Fatalf("MFA token: %s %v", id.Hex(), err)
+	}
+
+	for name, claims := range map[string]ClaimsConfig{
+		"issuer":   {Issuer: "https://other.example", Audience: DefaultClaimsConfig.Audience},
+		"audience": {Issuer: DefaultClaimsConfig.Issuer, Audience: "other-api"},
+	} {
+		// the same keys, only the claims differ
+		other := NewVerifier(verifier.keys, claims, LegacyConfig{})
+		if _, err := other.Verify(access); err == nil {
+			t.Fatalf("access token accepted with another %s", name)
+		}
+	}
+}
+
+func TestAccessTokenExpired(t *testing.T) {
+	issuer, verifier := newTestIssuer(t, ClaimsConfig{
+		Issuer:   DefaultClaimsConfig.Issuer,
+		Audience: DefaultClaimsConfig.Audience,
+	})
+	token, err := issuer.GenerateAccessToken(primitive.NewObjectID(), "alice", []string{AmrPassword}, time.Now(), -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(token); err == nil {
+		t.Fatal("expired access token accepted")
+	}
+}
+
+// TestSSOToken : the login cookie of the provider is accepted for nothing else,
+// and no other token is accepted in its place
+func TestSSOToken(t *testing.T) {
+	issuer, verifier := newTestIssuer(t, DefaultClaimsConfig)
+	var (
+		uuid      = primitive.NewObjectID()
+		sessionID = primitive.NewObjectID().Hex()
+	)
+	sso, err := issuer.GenerateSSOToken(uuid.Hex(), sessionID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := issuer.ValidateSSOToken(sso)
+	if err != nil || claims.Subject != uuid.Hex() || claims.SessionID != sessionID {
+		t.Fatalf("sso token: %+v %v", claims, err)
+	}
+	if _, err := verifier.Verify(sso); err == nil {
+		t.Fatal("sso token accepted as an access token")
+	}
+	if _, _, err := issuer.ValidateMFAToken(sso); err == nil {
+		t.Fatal("sso token accepted as an MFA token")
+	}
+	if _, err := issuer.ValidateRefreshToken(sso); err == nil {
+		t.Fatal("sso token accepted as a refresh token")
+	}
+	mfa, err := issuer.GenerateMFAToken(uuid, "alice", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := issuer.ValidateSSOToken(mfa); err == nil {
+		t.Fatal("MFA token accepted as an sso token")
+	}
+}
@@ -0,0 +1,484 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Signing algorithms a key can be generated for
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+var (
+	ErrUnknownAlgorithm = errors.New("auth: unknown signing algorithm")
+	ErrUnknownKey       = errors.New("auth: unknown signing key")
+	ErrNoSigningKey     = errors.New("auth: no signing key")
+)
+
+// SigningKey : a private key with its life cycle. A retired key no longer signs
+// but still verifies until ExpiresAt so tokens issued before a rotation stay valid.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	CreatedAt time.Time
+	RetiredAt time.Time
+	ExpiresAt time.Time
+}
+
+// GenerateSigningKey : new key for alg, the kid is the RFC 7638 thumbprint of its public key
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	var (
+		private crypto.Signer
+		err     error
+	)
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, ErrUnknownAlgorithm
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := &SigningKey{
+		Algorithm: alg,
+		Private:   private,
+		CreatedAt: time.Now(),
+	}
+	if key.ID, err = key.thumbprint(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ParseSigningKey : load a PKCS #8 DER private key, alg must match its type
+func ParseSigningKey(id, alg string, der []byte) (*SigningKey, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnknownAlgorithm
+	}
+	key := &SigningKey{ID: id, Algorithm: alg, Private: private}
+	if _, err := key.method(); err != nil {
+		return nil, fmt.Errorf("key %s: %w", id, err)
+	}
+	return key, nil
+}
+
+// MarshalPrivateKey : PKCS #8 DER encoding of the private key
+func (k *SigningKey) MarshalPrivateKey() ([]byte, error) {
+	return x509.MarshalPKCS8PrivateKey(k.Private)
+}
+
+// Active : the key may sign
+func (k *SigningKey) Active() bool {
+	return k.RetiredAt.IsZero()
+}
+
+// Expired : the key may no longer verify
+func (k *SigningKey) Expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// method : the jwt signing method, checking that the key type fits the algorithm
+func (k *SigningKey) method() (jwt.SigningMethod, error) {
+	switch k.Private.(type) {
+	case *rsa.PrivateKey:
+		if k.Algorithm == AlgRS256 {
+			return jwt.SigningMethodRS256, nil
+		}
+	case *ecdsa.PrivateKey:
+		if k.Algorithm == AlgES256 {
+			return jwt.SigningMethodES256, nil
+		}
+	case ed25519.PrivateKey:
+		if k.Algorithm == AlgEdDSA {
+			return jwt.SigningMethodEdDSA, nil
+		}
+	}
+	return nil, ErrUnknownAlgorithm
+}
+
+// JWK : the public half of a key as published in the JWKS document (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (k *SigningKey) JWK() JWK {
+	jwk := JWK{Kid: k.ID, Use: "sig", Alg: k.Algorithm}
+	switch pub := k.Private.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64(pub.N.Bytes())
+		jwk.E = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = b64(pub.X.FillBytes(make([]byte, 32)))
+		jwk.Y = b64(pub.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = b64(pub)
+	}
+	return jwk
+}
+
+// thumbprint : RFC 7638, the required members in lexicographic order
+func (k *SigningKey) thumbprint() (string, error) {
+	var (
+		jwk = k.JWK()
+		doc string
+	)
+	switch jwk.Kty {
+	case "RSA":
+		doc = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N)
+	case "EC":
+		doc = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, jwk.Crv, jwk.X, jwk.Y)
+	case "OKP":
+		doc = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, jwk.Crv, jwk.X)
+	default:
+		return "", ErrUnknownAlgorithm
+	}
+	sum := sha256.Sum256([]byte(doc))
+	return b64(sum[:]), nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// KeyStore : where signing keys are persisted so restarts and replicas share them
+type KeyStore interface {
+	Load(ctx context.Context) ([]*SigningKey, error)
+	// Save inserts the key or updates its life cycle
+	Save(ctx context.Context, key *SigningKey) error
+	Delete(ctx context.Context, id string) error
+}
+
+// KeyPolicy : Overlap must cover the longest token lifetime, refresh tokens
+// included, or tokens signed by a retired key are rejected early
+type KeyPolicy struct {
+	Algorithm   string
+	RotateEvery time.Duration
+	Overlap     time.Duration
+	// ReloadEvery is how often keys rotated by other replicas are picked up
+	ReloadEvery time.Duration
+}
+
+var DefaultKeyPolicy = KeyPolicy{
+	Algorithm:   AlgES256,
+	RotateEvery: 30 * 24 * time.Hour,
+	Overlap:     11 * 24 * time.Hour,
+	ReloadEvery: 5 * time.Minute,
+}
+
+// missReloadInterval : the least time between two reloads for an unknown kid,
+// tokens with made-up kids can not hammer the store
+const missReloadInterval = 10 * time.Second
+
+// KeySet : the keys in use, safe for concurrent use
+type KeySet struct {
+	store  KeyStore
+	policy KeyPolicy
+
+	mu   sync.RWMutex
+	keys []*SigningKey // newest first
+
+	// reloads picks up the keys of other replicas on a kid miss, once at a time
+	reloads        singleflight.Group
+	missReloadedAt time.Time // guarded by mu
+}
+
+// NewKeySet : load the keys of store, generating the first one if needed
+func NewKeySet(ctx context.Context, store KeyStore, policy KeyPolicy) (*KeySet, error) {
+	switch policy.Algorithm {
+	case AlgRS256, AlgES256, AlgEdDSA:
+	default:
+		return nil, ErrUnknownAlgorithm
+	}
+	ks := &KeySet{store: store, policy: policy}
+	if err := ks.Maintain(ctx); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Maintain : reload the store, rotate when the signing key is due and drop
+// expired keys. Every replica may run it, a concurrent rotation only leaves an
+// extra key that is retired on the next pass.
+func (ks *KeySet) Maintain(ctx context.Context) error {
+	keys, err := ks.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+
+	var (
+		current *SigningKey
+		live    = make([]*SigningKey, 0, len(keys)+1)
+	)
+	for _, key := range keys {
+		if key.Expired(now) {
+			if err := ks.store.Delete(ctx, key.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if key.Active() {
+			if current == nil && key.Algorithm == ks.policy.Algorithm {
+				current = key
+			} else if err := ks.retire(ctx, key, now); err != nil {
+				return err
+			}
+		}
+		live = append(live, key)
+	}
+	if current != nil && ks.policy.RotateEvery > 0 && now.Sub(current.CreatedAt) >= ks.policy.RotateEvery {
+		if err := ks.retire(ctx, current, now); err != nil {
+			return err
+		}
+		current = nil
+	}
+	if current == nil {
+		key, err := GenerateSigningKey(ks.policy.Algorithm)
+		if err != nil {
+			return err
+		}
+		if err := ks.store.Save(ctx, key); err != nil {
+			return err
+		}
+		log.Printf("auth: signing key %s (%s) created", key.ID, key.Algorithm)
+		live = append([]*SigningKey{key}, live...)
+	}
+
+	ks.mu.Lock()
+	ks.keys = live
+	ks.mu.Unlock()
+	return nil
+}
+
+func (ks *KeySet) retire(ctx context.Context, key *SigningKey, now time.Time) error {
+	key.RetiredAt = now
+	key.ExpiresAt = now.Add(ks.policy.Overlap)
+	return ks.store.Save(ctx, key)
+}
+
+// Algorithm : what new tokens are signed with
+func (ks *KeySet) Algorithm() string {
+	return ks.policy.Algorithm
+}
+
+// Run : call Maintain every ReloadEvery until ctx is done
+func (ks *KeySet) Run(ctx context.Context) {
+	interval := ks.policy.ReloadEvery
+	if interval <= 0 {
+		interval = DefaultKeyPolicy.ReloadEvery
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ks.Maintain(ctx); err != nil {
+				log.Printf("auth: maintain signing keys err %s", err)
+			}
+		}
+	}
+}
+
+func (ks *KeySet) signing() (*SigningKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	for _, key := range ks.keys {
+		if key.Active() {
+			return key, nil
+		}
+	}
+	return nil, ErrNoSigningKey
+}
+
+// reloadMissing : add the keys of the store this set does not have yet, a token
+// may be signed by a key another replica just created. Nothing is loaded when
+// the previous reload is more recent than missReloadInterval.
+func (ks *KeySet) reloadMissing() {
+	_, _, _ = ks.reloads.Do("reload", func() (interface{}, error) {
+		now := time.Now()
+		ks.mu.Lock()
+		if now.Sub(ks.missReloadedAt) < missReloadInterval {
+			ks.mu.Unlock()
+			return nil, nil
+		}
+		ks.missReloadedAt = now
+		ks.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		loaded, err := ks.store.Load(ctx)
+		if err != nil {
+			log.Printf("auth: reload signing keys err %s", err)
+			return nil, err
+		}
+
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		known := make(map[string]bool, len(ks.keys))
+		for _, key := range ks.keys {
+			known[key.ID] = true
+		}
+		// the keys in use are shared with concurrent readers, the slice is replaced
+		keys := append([]*SigningKey(nil), ks.keys...)
+		for _, key := range loaded {
+			if !known[key.ID] && !key.Expired(now) {
+				keys = append(keys, key)
+			}
+		}
+		sort.SliceStable(keys, func(i, j int) bool {
+			return keys[i].CreatedAt.After(keys[j].CreatedAt)
+		})
+		ks.keys = keys
+		return nil, nil
+	})
+}
+
+func (ks *KeySet) lookup(id string) (*SigningKey, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	now := time.Now()
+	for _, key := range ks.keys {
+		if key.ID == id && !key.Expired(now) {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// Sign : sign claims with the current key, its id goes in the kid header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	key, err := ks.signing()
+	if err != nil {
+		return "", err
+	}
+	method, err := key.method()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Keyfunc : resolve the verification key from the kid header, the token
+// algorithm must be the one the key was created for. An unknown kid reloads the
+// store before the token is refused.
+func (ks *KeySet) Keyfunc(t *jwt.Token) (interface{}, error) {
+	id, _ := t.Header["kid"].(string)
+	key, err := ks.lookup(id)
+	if errors.Is(err, ErrUnknownKey) && len(id) > 0 {
+		ks.reloadMissing()
+		key, err = ks.lookup(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("auth: key %s does not sign %s", id, t.Method.Alg())
+	}
+	return key.Private.Public(), nil
+}
+
+// JWKS : the public keys that can still verify tokens
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	var (
+		now  = time.Now()
+		jwks = JWKS{Keys: make([]JWK, 0, len(ks.keys))}
+	)
+	for _, key := range ks.keys {
+		if !key.Expired(now) {
+			jwks.Keys = append(jwks.Keys, key.JWK())
+		}
+	}
+	return jwks
+}
+
+// MemoryKeyStore : keys that live as long as the process, for development
+type MemoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]SigningKey
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: map[string]SigningKey{}}
+}
+
+func (ins *MemoryKeyStore) Load(_ context.Context) ([]*SigningKey, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	keys := make([]*SigningKey, 0, len(ins.keys))
+	for _, key := range ins.keys {
+		key := key
+		keys = append(keys, &key)
+	}
+	return keys, nil
+}
+
+func (ins *MemoryKeyStore) Save(_ context.Context, key *SigningKey) error {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	ins.keys[key.ID] = *key
+	return nil
+}
+
+func (ins *MemoryKeyStore) Delete(_ context.Context, id string) error {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	delete(ins.keys, id)
+	return nil
+}
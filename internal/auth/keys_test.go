@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingKeyStore : counts the loads of the store it wraps
+type countingKeyStore struct {
+	KeyStore
+	loads int32
+}
+
+func (ins *countingKeyStore) Load(ctx context.Context) ([]*SigningKey, error) {
+	atomic.AddInt32(&ins.loads, 1)
+	return ins.KeyStore.Load(ctx)
+}
+
+// TestKeyfuncReloadsUnknownKid : a token signed by a key another replica
+// created verifies before the next Maintain
+func TestKeyfuncReloadsUnknownKid(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		shared = NewMemoryKeyStore()
+	)
+	verifier, err := NewKeySet(ctx, shared, DefaultKeyPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the other replica rotates to a newer key
+	key, err := GenerateSigningKey(DefaultKeyPolicy.Algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.CreatedAt = time.Now().Add(time.Second)
+	if err := shared.Save(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewKeySet(ctx, shared, DefaultKeyPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.Sign(jwt.RegisteredClaims{Subject: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Parse(signed, verifier.Keyfunc)
+	if err != nil || !token.Valid {
+		t.Fatalf("parse: %v", err)
+	}
+	if header, _ := token.Header["kid"].(string); header != key.ID {
+		t.Fatalf("kid %s, want %s", header, key.ID)
+	}
+}
+
+// TestKeyfuncReloadRateLimited : unknown kids load the store once per interval
+// however many tokens carry them
+func TestKeyfuncReloadRateLimited(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		store = &countingKeyStore{KeyStore: NewMemoryKeyStore()}
+	)
+	ks, err := NewKeySet(ctx, store, DefaultKeyPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loads := atomic.LoadInt32(&store.loads)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token := &jwt.Token{Method: jwt.SigningMethodES256, Header: map[string]interface{}{"kid": "made-up"}}
+			if _, err := ks.Keyfunc(token); !errors.Is(err, ErrUnknownKey) {
+				t.Errorf("keyfunc: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if reloads := atomic.LoadInt32(&store.loads) - loads; reloads != 1 {
+		t.Fatalf("%d reloads, want 1", reloads)
+	}
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const pemPrivateKey = "PRIVATE KEY"
+
+// FileKeyStore : one PEM encoded PKCS #8 key per file named <kid>.pem, the
+// life cycle is kept in PEM headers. Replicas need a shared volume to rotate.
+type FileKeyStore struct {
+	Dir string
+}
+
+func NewFileKeyStore(dir string) (*FileKeyStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileKeyStore{Dir: dir}, nil
+}
+
+func (ins *FileKeyStore) Load(_ context.Context) ([]*SigningKey, error) {
+	paths, err := filepath.Glob(filepath.Join(ins.Dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*SigningKey, 0, len(paths))
+	for _, path := range paths {
+		key, err := readKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (ins *FileKeyStore) Save(_ context.Context, key *SigningKey) error {
+	der, err := key.MarshalPrivateKey()
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{
+		"Alg":     key.Algorithm,
+		"Created": key.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if !key.RetiredAt.IsZero() {
+		headers["Retired"] = key.RetiredAt.UTC().Format(time.RFC3339)
+	}
+	if !key.ExpiresAt.IsZero() {
+		headers["Expires"] = key.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: pemPrivateKey, Headers: headers, Bytes: der})
+
+	// write then rename so a replica never reads a partial file
+	tmp, err := os.CreateTemp(ins.Dir, ".key-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), ins.path(key.ID))
+}
+
+func (ins *FileKeyStore) Delete(_ context.Context, id string) error {
+	if err := os.Remove(ins.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (ins *FileKeyStore) path(id string) string {
+	return filepath.Join(ins.Dir, id+".pem")
+}
+
+func readKeyFile(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemPrivateKey {
+		return nil, errors.New("no PKCS #8 private key")
+	}
+	id := strings.TrimSuffix(filepath.Base(path), ".pem")
+	key, err := ParseSigningKey(id, block.Headers["Alg"], block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(path); err == nil {
+		// a key installed by hand counts from when the file was written
+		key.CreatedAt = info.ModTime()
+	}
+	for header, t := range map[string]*time.Time{
+		"Created": &key.CreatedAt,
+		"Retired": &key.RetiredAt,
+		"Expires": &key.ExpiresAt,
+	} {
+		if value, ok := block.Headers[header]; ok {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				return nil, fmt.Errorf("header %s: %w", header, err)
+			}
+		}
+	}
+	return key, nil
+}
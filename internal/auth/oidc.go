@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"time"
+)
+
+// IDTokenClaims : OpenID Connect Core section 2, the audience is the client
+type IDTokenClaims struct {
+	Nonce    string           `json:"nonce,omitempty"`
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	AMR      []string         `json:"amr,omitempty"`
+	// SessionID lets the client match a later logout to this login
+	SessionID string `json:"sid,omitempty"`
+	Username  string `json:"preferred_username,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// GenerateIDToken : username is only set when the profile scope was granted
+func (iss *Issuer) GenerateIDToken(subject, clientID, nonce, sessionID, username string, amr []string, authTime time.Time, period time.Duration) (string, error) {
+	return iss.keys.Sign(IDTokenClaims{
+		Nonce:            nonce,
+		AuthTime:         jwt.NewNumericDate(authTime),
+		AMR:              amr,
+		SessionID:        sessionID,
+		Username:         username,
+		RegisteredClaims: iss.registeredClaims(subject, clientID, period),
+	})
+}
+
+// PurposeSSO marks the cookie of a login at the provider, it opens sessions of
+// other clients without asking for the credentials again
+const PurposeSSO = "sso"
+
+// SSOClaims : the browser's login at the provider, it lasts as long as the
+// session that login opened
+type SSOClaims struct {
+	Purpose   string `json:"pur"`
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// GenerateSSOToken : like the MFA and refresh tokens it is only meant for the
+// issuer itself
+func (iss *Issuer) GenerateSSOToken(subject, sessionID string, period time.Duration) (string, error) {
+	return iss.keys.Sign(SSOClaims{
+		Purpose:          PurposeSSO,
+		SessionID:        sessionID,
+		RegisteredClaims: iss.registeredClaims(subject, iss.claims.Issuer, period),
+	})
+}
+
+func (iss *Issuer) ValidateSSOToken(token string) (*SSOClaims, error) {
+	parsedToken, err := jwt.ParseWithClaims(token, &SSOClaims{}, iss.keys.Keyfunc, iss.parserOptions(iss.claims.Issuer)...)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := parsedToken.Claims.(*SSOClaims)
+	if !ok || claims.ExpiresAt == nil || len(claims.SessionID) == 0 {
+		return nil, errors.New("token invalid")
+	}
+	if claims.Purpose != PurposeSSO {
+		return nil, errors.New("token purpose invalid")
+	}
+	return claims, nil
+}
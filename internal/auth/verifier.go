@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"time"
+)
+
+var ErrTokenInvalid = errors.New("auth: token invalid")
+
+// Claims : the verified identity, the same whichever key signed the token
+type Claims struct {
+	UserID   primitive.ObjectID
+	Username string
+	AMR      []string
+	AuthTime time.Time
+	Roles    []string
+	Scopes   []string
+	// Legacy marks an HS256 token of the previous issuer, it belongs to no session
+	Legacy bool
+	jwt.RegisteredClaims
+}
+
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Claims) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// verifiedClaims : what either kind of token can carry, the legacy fields are
+// the ones of the HS256 tokens signed with SECRET_JWT
+type verifiedClaims struct {
+	UserClaims
+	LegacyID       string `json:"ID,omitempty"`
+	LegacyUsername string `json:"Username,omitempty"`
+	LegacyRole     string `json:"Role,omitempty"`
+}
+
+// LegacyConfig : the HS256 tokens of the previous issuer are accepted until
+// Until, while the users move to the tokens of the key set. Both are required.
+type LegacyConfig struct {
+	Secret []byte
+	Until  time.Time
+}
+
+func (c LegacyConfig) accepted(now time.Time) bool {
+	return len(c.Secret) > 0 && now.Before(c.Until)
+}
+
+// Verifier : checks access tokens signed by any key of the key set, and HS256
+// tokens of the legacy issuer during its grace period
+type Verifier struct {
+	keys   *KeySet
+	claims ClaimsConfig
+	legacy LegacyConfig
+}
+
+// NewVerifier : the zero legacy config refuses HS256 tokens
+func NewVerifier(keys *KeySet, claims ClaimsConfig, legacy LegacyConfig) *Verifier {
+	return &Verifier{
+		keys:   keys,
+		claims: claims,
+		legacy: legacy,
+	}
+}
+
+func (v *Verifier) keyfunc(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+		// a kid always names one of our asymmetric keys
+		if _, hasKid := t.Header["kid"]; hasKid || !v.legacy.accepted(time.Now()) {
+			return nil, ErrUnknownKey
+		}
+		return v.legacy.Secret, nil
+	}
+	return v.keys.Keyfunc(t)
+}
+
+// Verify : check signature, exp, nbf and iat with the configured skew. Our own
+// tokens must also match issuer, audience and purpose; legacy tokens never
+// carried them and are only checked for expiry.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	methods := []string{AlgRS256, AlgES256, AlgEdDSA}
+	if v.legacy.accepted(time.Now()) {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	var raw verifiedClaims
+	parsed, err := jwt.ParseWithClaims(token, &raw, v.keyfunc,
+		jwt.WithValidMethods(methods),
+		jwt.WithLeeway(v.claims.ClockSkew),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if parsed == nil || !parsed.Valid || raw.ExpiresAt == nil {
+		return nil, ErrTokenInvalid
+	}
+
+	if _, legacy := parsed.Method.(*jwt.SigningMethodHMAC); legacy {
+		return raw.legacy()
+	}
+	if raw.Issuer != v.claims.Issuer {
+		return nil, errors.New("auth: token issuer invalid")
+	}
+	if !audienceContains(raw.Audience, v.claims.Audience) {
+		return nil, errors.New("auth: token audience invalid")
+	}
+	if raw.Purpose != PurposeAccess {
+		return nil, errors.New("token purpose invalid")
+	}
+	uuid, err := raw.UserID()
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	claims := &Claims{
+		UserID:           uuid,
+		Username:         raw.Username,
+		AMR:              raw.AMR,
+		Roles:            raw.Roles,
+		Scopes:           strings.Fields(raw.Scope),
+		RegisteredClaims: raw.RegisteredClaims,
+	}
+	if raw.AuthTime != nil {
+		claims.AuthTime = raw.AuthTime.Time
+	}
+	return claims, nil
+}
+
+func (raw *verifiedClaims) legacy() (*Claims, error) {
+	uuid, err := primitive.ObjectIDFromHex(raw.LegacyID)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	claims := &Claims{
+		UserID:           uuid,
+		Username:         raw.LegacyUsername,
+		Legacy:           true,
+		RegisteredClaims: raw.RegisteredClaims,
+	}
+	if len(raw.LegacyRole) > 0 {
+		claims.Roles = []string{raw.LegacyRole}
+	}
+	return claims, nil
+}
+
+func audienceContains(audience jwt.ClaimStrings, want string) bool {
+	for _, aud := range audience {
+		if aud == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+// Package clients is the registry of applications allowed to obtain tokens.
+package clients
+
+import (
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	ErrUnknownClient = errors.New("clients: unknown client")
+	ErrInvalidSecret = errors.New("clients: client authentication failed")
+	ErrInvalidClient = errors.New("clients: client settings invalid")
+)
+
+// Client types of RFC 6749 section 2.1
+const (
+	TypePublic       = "public"
+	TypeConfidential = "confidential"
+)
+
+// Grants a client can be allowed, GrantPassword covers the login API of this
+// service with its second factors and passkeys
+const (
+	GrantPassword          = "password"
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+)
+
+type Client struct {
+	ID             string
+	Name           string
+	Type           string
+	Grants         []string
+	RedirectURIs   []string
+	AllowedOrigins []string
+	// AccessTokenTTL and RefreshTokenTTL override the service defaults when set
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+}
+
+func (c *Client) Public() bool {
+	return c.Type == TypePublic
+}
+
+func (c *Client) AllowsGrant(grant string) bool {
+	return contains(c.Grants, grant)
+}
+
+// AllowsRedirect : redirect URIs must match exactly
+func (c *Client) AllowsRedirect(uri string) bool {
+	return contains(c.RedirectURIs, uri)
+}
+
+// AllowsOrigin : requests without an Origin header do not come from a browser
+func (c *Client) AllowsOrigin(origin string) bool {
+	return len(origin) == 0 || contains(c.AllowedOrigins, origin)
+}
+
+// Registration : the settings of a client as an operator writes them
+type Registration struct {
+	ID              string   `json:"id"`
+	Secret          string   `json:"secret"`
+	Name            string   `json:"name"`
+	Type            string   `json:"type"`
+	Grants          []string `json:"grants"`
+	RedirectURIs    []string `json:"redirectUris"`
+	AllowedOrigins  []string `json:"allowedOrigins"`
+	AccessTokenTTL  int64    `json:"accessTokenTtl"`
+	RefreshTokenTTL int64    `json:"refreshTokenTtl"`
+}
+
+func (r Registration) validate() error {
+	if len(r.ID) == 0 {
+		return ErrInvalidClient
+	}
+	switch r.Type {
+	case TypePublic:
+		if len(r.Secret) > 0 {
+			return ErrInvalidClient
+		}
+	case TypeConfidential:
+		if len(r.Secret) == 0 {
+			return ErrInvalidClient
+		}
+	default:
+		return ErrInvalidClient
+	}
+	for _, grant := range r.Grants {
+		switch grant {
+		case GrantPassword, GrantAuthorizationCode, GrantRefreshToken:
+		default:
+			return ErrInvalidClient
+		}
+	}
+	if r.AccessTokenTTL < 0 || r.RefreshTokenTTL < 0 {
+		return ErrInvalidClient
+	}
+	return nil
+}
+
+type Registry struct {
+	store store.ClientStore
+}
+
+func NewRegistry(clientStore store.ClientStore) *Registry {
+	return &Registry{
+		store: clientStore,
+	}
+}
+
+// Register : create or update a client, the secret is only kept hashed
+func (ins *Registry) Register(ctx context.Context, r Registration) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	client := &models.ClientModel{
+		ID:              r.ID,
+		Name:            r.Name,
+		Type:            r.Type,
+		Grants:          r.Grants,
+		RedirectURIs:    r.RedirectURIs,
+		AllowedOrigins:  r.AllowedOrigins,
+		AccessTokenTTL:  r.AccessTokenTTL,
+		RefreshTokenTTL: r.RefreshTokenTTL,
+	}
+	if len(r.Secret) > 0 {
+		client.SecretHash = hashSecret(r.Secret)
+	}
+	return ins.store.Upsert(ctx, client)
+}
+
+func (ins *Registry) Get(ctx context.Context, id string) (*Client, error) {
+	if len(id) == 0 {
+		return nil, ErrUnknownClient
+	}
+	m, err := ins.store.FindByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrUnknownClient
+		}
+		return nil, err
+	}
+	return newClient(m), nil
+}
+
+// Authenticate : a confidential client must present its secret, a public client
+// must not present any
+func (ins *Registry) Authenticate(ctx context.Context, id, secret string) (*Client, error) {
+	m, err := ins.store.FindByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrUnknownClient
+		}
+		return nil, err
+	}
+	if m.Type == TypePublic {
+		if len(secret) > 0 {
+			return nil, ErrInvalidSecret
+		}
+	} else if len(secret) == 0 || len(m.SecretHash) == 0 ||
+		subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(m.SecretHash)) != 1 {
+		return nil, ErrInvalidSecret
+	}
+	return newClient(m), nil
+}
+
+func newClient(m *models.ClientModel) *Client {
+	return &Client{
+		ID:              m.ID,
+		Name:            m.Name,
+		Type:            m.Type,
+		Grants:          m.Grants,
+		RedirectURIs:    m.RedirectURIs,
+		AllowedOrigins:  m.AllowedOrigins,
+		AccessTokenTTL:  time.Duration(m.AccessTokenTTL) * time.Second,
+		RefreshTokenTTL: time.Duration(m.RefreshTokenTTL) * time.Second,
+	}
+}
+
+// hashSecret : secrets are generated with enough entropy that a fast hash is
+// sufficient, which keeps introspection calls cheap
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
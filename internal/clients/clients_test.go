@@ -0,0 +1,113 @@
+package clients
+
+import (
+	"app/internal/store/memory"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestRegistry(t *testing.T, registrations ...Registration) *Registry {
+	t.Helper()
+	registry := NewRegistry(memory.New().Clients)
+	for _, r := range registrations {
+		if err := registry.Register(context.Background(), r); err != nil {
+			t.Fatalf("register %s: %s", r.ID, err)
+		}
+	}
+	return registry
+}
+
+func TestRegisterInvalid(t *testing.T) {
+	registry := newTestRegistry(t)
+	for name, r := range map[string]Registration{
+		"no id":                     {Type: TypePublic},
+		"no type":                   {ID: "app"},
+		"unknown type":              {ID: "app", Type: "trusted"},
+		"public with a secret":      {ID: "app", Type: TypePublic, Secret: "secret"},
+		"confidential, no secret":   {ID: "app", Type: TypeConfidential},
+		"unknown grant":             {ID: "app", Type: TypePublic, Grants: []string{"implicit"}},
+		"negative access lifetime":  {ID: "app", Type: TypePublic, AccessTokenTTL: -1},
+		"negative refresh lifetime": {ID: "app", Type: TypePublic, RefreshTokenTTL: -1},
+	} {
+		if err := registry.Register(context.Background(), r); !errors.Is(err, ErrInvalidClient) {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if _, err := registry.Get(context.Background(), "app"); !errors.Is(err, ErrUnknownClient) {
+		t.Fatalf("an invalid client was stored: %v", err)
+	}
+}
+
+func TestRegisterHashesSecret(t *testing.T) {
+	db := memory.New()
+	registry := NewRegistry(db.Clients)
+	if err := registry.Register(context.Background(), Registration{ID: "api", Type: TypeConfidential, Secret: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := db.Clients.FindByID(context.Background(), "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SecretHash == "secret" || stored.SecretHash != hashSecret("secret") {
+		t.Fatalf("secret stored as %q", stored.SecretHash)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	registry := newTestRegistry(t,
+		Registration{ID: "app", Type: TypePublic},
+		Registration{ID: "api", Type: TypeConfidential, Secret: "secret"},
+	)
+	ctx := context.Background()
+	for _, c := range []struct {
+		id, secret string
+		err        error
+	}{
+		{"app", "", nil},
+		{"app", "secret", ErrInvalidSecret},
+		{"api", "secret", nil},
+		{"api", "", ErrInvalidSecret},
+		{"api", "other secret", ErrInvalidSecret},
+		{"unknown", "", ErrUnknownClient},
+		{"", "", ErrUnknownClient},
+	} {
+		client, err := registry.Authenticate(ctx, c.id, c.secret)
+		if !errors.Is(err, c.err) || (err == nil && client.ID != c.id) {
+			t.Fatalf("%q with %q: %v %+v", c.id, c.secret, err, client)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	registry := newTestRegistry(t, Registration{
+		ID:              "app",
+		Type:            TypePublic,
+		Grants:          []string{GrantPassword, GrantRefreshToken},
+		RedirectURIs:    []string{"https://app.example/callback"},
+		AllowedOrigins:  []string{"https://app.example"},
+		AccessTokenTTL:  60,
+		RefreshTokenTTL: 3600,
+	})
+	client, err := registry.Get(context.Background(), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client.Public() || client.AccessTokenTTL != time.Minute || client.RefreshTokenTTL != time.Hour {
+		t.Fatalf("client %+v", client)
+	}
+	if !client.AllowsGrant(GrantPassword) || client.AllowsGrant(GrantAuthorizationCode) {
+		t.Fatalf("grants %v", client.Grants)
+	}
+	if !client.AllowsRedirect("https://app.example/callback") || client.AllowsRedirect("https://app.example/callback/") {
+		t.Fatalf("redirect URIs %v", client.RedirectURIs)
+	}
+	// requests without an Origin do not come from a browser
+	if !client.AllowsOrigin("") || !client.AllowsOrigin("https://app.example") || client.AllowsOrigin("https://other.example") {
+		t.Fatalf("origins %v", client.AllowedOrigins)
+	}
+	if _, err := registry.Get(context.Background(), ""); !errors.Is(err, ErrUnknownClient) {
+		t.Fatalf("empty id: %v", err)
+	}
+}
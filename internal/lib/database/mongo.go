@@ -9,11 +9,6 @@ import (
 	"time"
 )
 
-type MongoIndex struct {
-	Keys   interface{}
-	Unique bool
-}
-
 // MongoConnect : create a new connection to mongodb
 func MongoConnect(uri, dbname string, timeout time.Duration) (*mongo.Database, error) {
 	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
@@ -24,27 +19,37 @@ func MongoConnect(uri, dbname string, timeout time.Duration) (*mongo.Database, e
 	}
 	db := client.Database(dbname)
 	if err := client.Ping(ctx, db.ReadPreference()); err != nil {
+		_ = client.Disconnect(context.TODO())
 		return nil, err
 	}
 	if _, err := db.ListCollectionSpecifications(ctx, bson.M{}); err != nil {
+		_ = client.Disconnect(context.TODO())
 		return nil, err
 	}
 	return db, nil
 }
 
-// MongoInit : make collection with indexes
-func MongoInit(db *mongo.Database, collectionName string, index ...MongoIndex) *mongo.Collection {
+// MongoInit : make collection with indexes, failing when a unique one can not be built
+func MongoInit(ctx context.Context, db *mongo.Database, collectionName string, index ...MongoIndex) (*mongo.Collection, error) {
+	return MongoInitValidated(ctx, db, collectionName, MongoValidator{}, index...)
+}
+
+// MongoInitValidated : make collection with indexes, its documents checked by
+// validator from creation on or, for an existing collection, once collMod
+// applied it. Only a unique index that can not be built fails it, the data
+// would not be what the code expects. The indexes are built within ctx, which
+// may have to allow for a large collection, the collection itself is made
+// within a few seconds of it.
+func MongoInitValidated(ctx context.Context, db *mongo.Database, collectionName string, validator MongoValidator, index ...MongoIndex) (*mongo.Collection, error) {
 	var (
-		ctx        context.Context
+		metaCtx    context.Context
 		cancel     context.CancelFunc
 		collection *mongo.Collection
-
-		indexes = make([]mongo.IndexModel, 0)
 	)
-	ctx, cancel = context.WithTimeout(context.TODO(), 5*time.Second)
+	metaCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	var collectionValidate = func() (created bool) {
-		list, err := db.ListCollectionNames(ctx, bson.M{})
+		list, err := db.ListCollectionNames(metaCtx, bson.M{})
 		if err != nil {
 			log.Printf("Log-Error: %+v\r\n", err)
 			return
@@ -59,32 +64,25 @@ func MongoInit(db *mongo.Database, collectionName string, index ...MongoIndex) *
 	}
 	if created := collectionValidate(); created {
 		log.Printf("Log-Debug: Collection `%s` is already available. collectionValidate=%v\r\n", collectionName, created)
+		if err := syncValidator(metaCtx, db, collectionName, validator); err != nil {
+			log.Printf("Log-Error: %+v\r\n", err)
+		}
 	} else {
-		if err := db.CreateCollection(ctx, collectionName); err != nil {
+		opts := options.CreateCollection()
+		if validator.Schema != nil {
+			opts.SetValidator(validator.validator()).
+				SetValidationLevel(validator.level()).
+				SetValidationAction(validator.action())
+		}
+		if err := db.CreateCollection(metaCtx, collectionName, opts); err != nil {
 			log.Printf("Log-Error: %+v\r\n", err)
 		} else {
 			log.Printf("Log-Debug: Collection `%s` is already available\r\n", collectionName)
 		}
 	}
 	collection = db.Collection(collectionName)
-	for _, uq := range index {
-		if uq.Keys == nil {
-			continue
-		}
-		indexes = append(indexes, mongo.IndexModel{
-			Keys:    uq.Keys,
-			Options: options.Index().SetUnique(uq.Unique),
-		})
-	}
-	if len(indexes) > 0 {
-		names, err := collection.Indexes().CreateMany(ctx, indexes)
-		if err != nil {
-			log.Printf("Log-Error: %+v\r\n", err)
-
-		}
-		for _, name := range names {
-			log.Printf("Log-Debug: Index created `%s`\r\n", name)
-		}
+	if err := syncIndexes(ctx, collection, index); err != nil {
+		return nil, err
 	}
-	return collection
+	return collection, nil
 }
@@ -0,0 +1,269 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"strings"
+	"time"
+)
+
+// MongoIndex : one index of a collection. Keys with more than one field must
+// be a bson.D, a map has no order.
+type MongoIndex struct {
+	// Name defaults to the one the server generates, e.g. `user_id_1_created_at_-1`
+	Name   string
+	Keys   interface{}
+	Unique bool
+	// Sparse leaves out documents without the indexed fields
+	Sparse bool
+	// TTL makes Mongo delete a document ExpireAfter past the date in its single key field
+	TTL         bool
+	ExpireAfter time.Duration
+	// PartialFilter only indexes the documents matching it
+	PartialFilter interface{}
+	// Collation must also be given to the queries that should use the index
+	Collation *options.Collation
+}
+
+// indexSpec : an index as listIndexes reports it
+type indexSpec struct {
+	Name               string   `bson:"name"`
+	Key                bson.D   `bson:"key"`
+	Unique             bool     `bson:"unique"`
+	Sparse             bool     `bson:"sparse"`
+	ExpireAfterSeconds *int32   `bson:"expireAfterSeconds"`
+	PartialFilter      bson.Raw `bson:"partialFilterExpression"`
+	Collation          bson.M   `bson:"collation"`
+}
+
+func (ins MongoIndex) model() (mongo.IndexModel, error) {
+	keys, err := toDocument(ins.Keys)
+	if err != nil {
+		return mongo.IndexModel{}, err
+	}
+	opts := options.Index().SetName(ins.name(keys))
+	if ins.Unique {
+		opts.SetUnique(true)
+	}
+	if ins.Sparse {
+		opts.SetSparse(true)
+	}
+	if ins.TTL {
+		opts.SetExpireAfterSeconds(int32(ins.ExpireAfter / time.Second))
+	}
+	if ins.PartialFilter != nil {
+		opts.SetPartialFilterExpression(ins.PartialFilter)
+	}
+	if ins.Collation != nil {
+		opts.SetCollation(ins.Collation)
+	}
+	return mongo.IndexModel{Keys: keys, Options: opts}, nil
+}
+
+func (ins MongoIndex) name(keys bson.D) string {
+	if len(ins.Name) > 0 {
+		return ins.Name
+	}
+	parts := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		parts = append(parts, k.Key, fmt.Sprint(k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// matches : spec is the index that would be created, options the server fills
+// in itself, such as the details of a collation, are not compared
+func (ins MongoIndex) matches(spec indexSpec, keys bson.D) bool {
+	if !sameKeys(spec.Key, keys) || spec.Unique != ins.Unique || spec.Sparse != ins.Sparse {
+		return false
+	}
+	if ins.TTL != (spec.ExpireAfterSeconds != nil) {
+		return false
+	}
+	if ins.TTL && *spec.ExpireAfterSeconds != int32(ins.ExpireAfter/time.Second) {
+		return false
+	}
+	if (ins.PartialFilter == nil) != (spec.PartialFilter == nil) {
+		return false
+	}
+	if ins.PartialFilter != nil {
+		want, err := bson.MarshalExtJSON(ins.PartialFilter, false, false)
+		if err != nil {
+			return false
+		}
+		got, err := bson.MarshalExtJSON(spec.PartialFilter, false, false)
+		if err != nil || string(want) != string(got) {
+			return false
+		}
+	}
+	if ins.Collation == nil {
+		return spec.Collation == nil
+	}
+	if spec.Collation == nil || spec.Collation["locale"] != ins.Collation.Locale {
+		return false
+	}
+	return ins.Collation.Strength == 0 || fmt.Sprint(spec.Collation["strength"]) == fmt.Sprint(ins.Collation.Strength)
+}
+
+// syncIndexes : create the declared indexes that are missing, an index with
+// the declared definition counts whatever its name. One that changed is built
+// first and the index it replaces dropped after, under the declared name when
+// it is free or its `_next` variant otherwise; the server can not rename an
+// index. Only an index on the same keys that differs in other options than its
+// TTL has to be dropped before it is rebuilt. Indexes that are not declared are
+// left alone. A unique index that can not be built, usually because of
+// duplicates in the data, is an error; the others are only logged.
+func syncIndexes(ctx context.Context, collection *mongo.Collection, declared []MongoIndex) error {
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	var existing []indexSpec
+	if err := cursor.All(ctx, &existing); err != nil {
+		return err
+	}
+
+	for _, index := range declared {
+		if index.Keys == nil {
+			continue
+		}
+		model, err := index.model()
+		if err != nil {
+			return err
+		}
+		if err := syncIndex(ctx, collection, existing, index, model); err != nil {
+			if index.Unique {
+				return fmt.Errorf("unique index `%s` of `%s`: %w", *model.Options.Name, collection.Name(), err)
+			}
+			log.Printf("Log-Error: Index `%s` of `%s`: %+v\r\n", *model.Options.Name, collection.Name(), err)
+		}
+	}
+	return nil
+}
+
+func syncIndex(ctx context.Context, collection *mongo.Collection, existing []indexSpec, index MongoIndex, model mongo.IndexModel) error {
+	var (
+		keys, name = model.Keys.(bson.D), *model.Options.Name
+		stale      []indexSpec
+	)
+	for _, spec := range existing {
+		if spec.Name == "_id_" {
+			continue
+		}
+		if index.matches(spec, keys) {
+			return nil
+		}
+		// the server refuses a second index on the same keys, it may have been
+		// declared under another name before
+		if spec.Name == name || spec.Name == name+"_next" || sameKeys(spec.Key, keys) {
+			stale = append(stale, spec)
+		}
+	}
+	if len(stale) == 0 {
+		return createIndex(ctx, collection, model)
+	}
+
+	// only the expiry changed, collMod updates it in place
+	if len(stale) == 1 && stale[0].Name == name && index.TTL && stale[0].ExpireAfterSeconds != nil {
+		ttl := index
+		ttl.ExpireAfter = time.Duration(*stale[0].ExpireAfterSeconds) * time.Second
+		if ttl.matches(stale[0], keys) {
+			log.Printf("Log-Debug: Expiry of index `%s` of `%s` changed, updating it\r\n", name, collection.Name())
+			return collection.Database().RunCommand(ctx, bson.D{
+				{Key: "collMod", Value: collection.Name()},
+				{Key: "index", Value: bson.M{"name": name, "expireAfterSeconds": int32(index.ExpireAfter / time.Second)}},
+			}).Err()
+		}
+	}
+
+	target := name
+	for _, spec := range stale {
+		if spec.Name == name {
+			target = name + "_next"
+		}
+	}
+	next := model
+	next.Options = options.MergeIndexOptions(model.Options).SetName(target)
+	log.Printf("Log-Debug: Index `%s` of `%s` changed, building it as `%s`\r\n", name, collection.Name(), target)
+	err := createIndex(ctx, collection, next)
+	if err == nil {
+		return dropIndexes(ctx, collection, stale, target)
+	}
+	if !sameKeysConflict(err) {
+		// the stale indexes stay in place
+		return err
+	}
+	// the new definition only differs in options from an index on the same
+	// keys, both can not exist at once
+	log.Printf("Log-Debug: Index `%s` of `%s` has the same keys, rebuilding it\r\n", name, collection.Name())
+	if err := dropIndexes(ctx, collection, stale, ""); err != nil {
+		return err
+	}
+	return createIndex(ctx, collection, model)
+}
+
+func createIndex(ctx context.Context, collection *mongo.Collection, model mongo.IndexModel) error {
+	name, err := collection.Indexes().CreateOne(ctx, model)
+	if err != nil {
+		return err
+	}
+	log.Printf("Log-Debug: Index created `%s`\r\n", name)
+	return nil
+}
+
+// dropIndexes : drop the stale indexes except the one named keep
+func dropIndexes(ctx context.Context, collection *mongo.Collection, stale []indexSpec, keep string) error {
+	for _, spec := range stale {
+		if spec.Name == keep {
+			continue
+		}
+		if _, err := collection.Indexes().DropOne(ctx, spec.Name); err != nil {
+			return err
+		}
+		log.Printf("Log-Debug: Index dropped `%s`\r\n", spec.Name)
+	}
+	return nil
+}
+
+// sameKeysConflict : the server refused an index because another one has the
+// same keys with other options (IndexOptionsConflict, IndexKeySpecsConflict)
+func sameKeysConflict(err error) bool {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Code == 85 || cmdErr.Code == 86
+	}
+	return false
+}
+
+func sameKeys(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		// the server may report 1 as an int32, int64 or double
+		if a[i].Key != b[i].Key || fmt.Sprint(a[i].Value) != fmt.Sprint(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func toDocument(v interface{}) (bson.D, error) {
+	if d, ok := v.(bson.D); ok {
+		return d, nil
+	}
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
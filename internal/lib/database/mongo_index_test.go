@@ -0,0 +1,258 @@
+package database
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIndexName(t *testing.T) {
+	keys := bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}
+	if name := (MongoIndex{Keys: keys}).name(keys); name != "user_id_1_created_at_-1" {
+		t.Fatalf("generated name %q", name)
+	}
+	if name := (MongoIndex{Name: "by_user", Keys: keys}).name(keys); name != "by_user" {
+		t.Fatalf("declared name %q", name)
+	}
+}
+
+// TestIndexMatches : the comparison with the index the server reports, which
+// may number the key directions and fill in collation details differently
+func TestIndexMatches(t *testing.T) {
+	var (
+		keys   = bson.D{{Key: "expires_at", Value: 1}}
+		hour   = int32(3600)
+		filter = bson.M{"revoked_at": bson.M{"$exists": true}}
+		raw, _ = bson.Marshal(filter)
+		index  = MongoIndex{Keys: keys, TTL: true, ExpireAfter: time.Hour, PartialFilter: filter}
+		spec   = indexSpec{
+			Key:                bson.D{{Key: "expires_at", Value: int64(1)}},
+			ExpireAfterSeconds: &hour,
+			PartialFilter:      raw,
+		}
+	)
+	if !index.matches(spec, keys) {
+		t.Fatal("same index not matched")
+	}
+	for name, change := range map[string]func(spec *indexSpec){
+		"other keys":   func(spec *indexSpec) { spec.Key = bson.D{{Key: "expires_at", Value: -1}} },
+		"unique":       func(spec *indexSpec) { spec.Unique = true },
+		"sparse":       func(spec *indexSpec) { spec.Sparse = true },
+		"other expiry": func(spec *indexSpec) { minute := int32(60); spec.ExpireAfterSeconds = &minute },
+		"no expiry":    func(spec *indexSpec) { spec.ExpireAfterSeconds = nil },
+		"no filter":    func(spec *indexSpec) { spec.PartialFilter = nil },
+		"other filter": func(spec *indexSpec) { spec.PartialFilter, _ = bson.Marshal(bson.M{"revoked_at": nil}) },
+		"collation":    func(spec *indexSpec) { spec.Collation = bson.M{"locale": "en"} },
+	} {
+		changed := spec
+		change(&changed)
+		if index.matches(changed, keys) {
+			t.Fatalf("%s: matched", name)
+		}
+	}
+
+	collated := MongoIndex{Keys: keys, Collation: &options.Collation{Locale: "en", Strength: 2}}
+	if !collated.matches(indexSpec{Key: keys, Collation: bson.M{"locale": "en", "strength": int32(2), "caseLevel": false}}, keys) {
+		t.Fatal("collation with the server defaults not matched")
+	}
+	if collated.matches(indexSpec{Key: keys, Collation: bson.M{"locale": "en", "strength": int32(3)}}, keys) {
+		t.Fatal("collation of another strength matched")
+	}
+}
+
+// testCollection : a collection in a database of its own on the server of
+// STORE_TEST_MONGO_URI, dropped after the test
+func testCollection(t *testing.T) *mongo.Collection {
+	t.Helper()
+	uri := os.Getenv("STORE_TEST_MONGO_URI")
+	if len(uri) == 0 {
+		t.Skip("STORE_TEST_MONGO_URI is not set")
+	}
+	db, err := MongoConnect(uri, "indextest_"+primitive.NewObjectID().Hex(), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		_ = db.Drop(ctx)
+		_ = db.Client().Disconnect(ctx)
+	})
+	return db.Collection("items")
+}
+
+// listIndexes : the indexes of the collection by name, without `_id_`
+func listIndexes(t *testing.T, collection *mongo.Collection) map[string]indexSpec {
+	t.Helper()
+	ctx := context.Background()
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var specs []indexSpec
+	if err := cursor.All(ctx, &specs); err != nil {
+		t.Fatal(err)
+	}
+	indexes := map[string]indexSpec{}
+	for _, spec := range specs {
+		if spec.Name != "_id_" {
+			indexes[spec.Name] = spec
+		}
+	}
+	return indexes
+}
+
+func sync(t *testing.T, collection *mongo.Collection, declared ...MongoIndex) {
+	t.Helper()
+	if err := syncIndexes(context.Background(), collection, declared); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncIndexesCreate(t *testing.T) {
+	collection := testCollection(t)
+	declared := []MongoIndex{
+		{Name: "token_unique", Keys: bson.D{{Key: "token", Value: 1}}, Unique: true},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Name: "expires_at_ttl", Keys: bson.D{{Key: "expires_at", Value: 1}}, TTL: true},
+		{Name: "no_keys"},
+	}
+	sync(t, collection, declared...)
+	indexes := listIndexes(t, collection)
+	if len(indexes) != 3 {
+		t.Fatalf("indexes %+v", indexes)
+	}
+	if !indexes["token_unique"].Unique {
+		t.Fatalf("unique index %+v", indexes["token_unique"])
+	}
+	if _, ok := indexes["user_id_1_created_at_-1"]; !ok {
+		t.Fatalf("index without a name %+v", indexes)
+	}
+	if ttl := indexes["expires_at_ttl"].ExpireAfterSeconds; ttl == nil || *ttl != 0 {
+		t.Fatalf("TTL index %+v", indexes["expires_at_ttl"])
+	}
+
+	// a second start finds everything in place
+	sync(t, collection, declared...)
+	if again := listIndexes(t, collection); len(again) != 3 {
+		t.Fatalf("indexes after the second sync %+v", again)
+	}
+}
+
+func TestSyncIndexesExpiry(t *testing.T) {
+	collection := testCollection(t)
+	index := MongoIndex{Name: "last_failure_at_ttl", Keys: bson.D{{Key: "last_failure_at", Value: 1}}, TTL: true, ExpireAfter: time.Hour}
+	sync(t, collection, index)
+	index.ExpireAfter = 2 * time.Hour
+	sync(t, collection, index)
+	indexes := listIndexes(t, collection)
+	if ttl := indexes[index.Name].ExpireAfterSeconds; len(indexes) != 1 || ttl == nil || *ttl != 7200 {
+		t.Fatalf("indexes after the expiry changed %+v", indexes)
+	}
+}
+
+// TestSyncIndexesRenamed : an index with the declared definition is kept under
+// its old name, the server would refuse a second one on the same keys
+func TestSyncIndexesRenamed(t *testing.T) {
+	collection := testCollection(t)
+	keys := bson.D{{Key: "family_id", Value: 1}}
+	sync(t, collection, MongoIndex{Name: "family", Keys: keys})
+	sync(t, collection, MongoIndex{Name: "family_id", Keys: keys})
+	if indexes := listIndexes(t, collection); len(indexes) != 1 || indexes["family"].Name != "family" {
+		t.Fatalf("indexes %+v", indexes)
+	}
+}
+
+// TestSyncIndexesChanged : the new definition is built before the one it
+// replaces is dropped
+func TestSyncIndexesChanged(t *testing.T) {
+	collection := testCollection(t)
+	sync(t, collection, MongoIndex{Name: "by_user", Keys: bson.D{{Key: "user_id", Value: 1}}})
+	sync(t, collection, MongoIndex{Name: "by_user", Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "last_used_at", Value: -1}}})
+	indexes := listIndexes(t, collection)
+	next, ok := indexes["by_user_next"]
+	if len(indexes) != 1 || !ok || len(next.Key) != 2 {
+		t.Fatalf("indexes after the keys changed %+v", indexes)
+	}
+	// the following change takes the declared name back
+	sync(t, collection, MongoIndex{Name: "by_user", Keys: bson.D{{Key: "user_id", Value: 1}}})
+	if indexes := listIndexes(t, collection); len(indexes) != 1 || len(indexes["by_user"].Key) != 1 {
+		t.Fatalf("indexes after the second change %+v", indexes)
+	}
+}
+
+// TestSyncIndexesSameKeys : only the options of an index on the same keys
+// changed, it has to be dropped before it is rebuilt
+func TestSyncIndexesSameKeys(t *testing.T) {
+	collection := testCollection(t)
+	keys := bson.D{{Key: "username", Value: 1}}
+	sync(t, collection, MongoIndex{Name: "username", Keys: keys})
+	sync(t, collection, MongoIndex{Name: "username", Keys: keys, Unique: true})
+	indexes := listIndexes(t, collection)
+	if len(indexes) != 1 || !indexes["username"].Unique {
+		t.Fatalf("indexes after the options changed %+v", indexes)
+	}
+}
+
+// TestSyncIndexesDuplicates : a unique index that the data does not allow
+// fails the sync, another index is only logged
+func TestSyncIndexesDuplicates(t *testing.T) {
+	var (
+		ctx        = context.Background()
+		collection = testCollection(t)
+	)
+	if _, err := collection.InsertMany(ctx, []interface{}{
+		bson.M{"username": "alice", "age": "x"},
+		bson.M{"username": "alice", "age": "x"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncIndexes(ctx, collection, []MongoIndex{
+		{Name: "username_unique", Keys: bson.D{{Key: "username", Value: 1}}, Unique: true},
+	}); err == nil {
+		t.Fatal("unique index over duplicates built")
+	}
+	// a collection has at most one text index, the server refuses the second
+	if err := syncIndexes(ctx, collection, []MongoIndex{
+		{Name: "username_text", Keys: bson.D{{Key: "username", Value: "text"}}},
+		{Name: "age_text", Keys: bson.D{{Key: "age", Value: "text"}}},
+		{Name: "age", Keys: bson.D{{Key: "age", Value: 1}}},
+	}); err != nil {
+		t.Fatalf("failure of a non unique index: %v", err)
+	}
+	if indexes := listIndexes(t, collection); len(indexes) != 2 || indexes["age"].Name != "age" {
+		t.Fatalf("indexes %+v", indexes)
+	}
+}
+
+// TestSyncIndexesUndeclared : indexes an operator added are left in place
+func TestSyncIndexesUndeclared(t *testing.T) {
+	collection := testCollection(t)
+	if _, err := collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "report", Value: 1}},
+		Options: options.Index().SetName("report"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sync(t, collection, MongoIndex{Name: "token", Keys: bson.D{{Key: "token", Value: 1}}})
+	if indexes := listIndexes(t, collection); len(indexes) != 2 {
+		t.Fatalf("indexes %+v", indexes)
+	}
+}
+
+// TestMongoInitIndexTimeout : the index builds stop at the deadline of the
+// context they are given
+func TestMongoInitIndexTimeout(t *testing.T) {
+	collection := testCollection(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := MongoInit(ctx, collection.Database(), "items",
+		MongoIndex{Name: "token_unique", Keys: bson.D{{Key: "token", Value: 1}}, Unique: true},
+	); err == nil {
+		t.Fatal("index built after the deadline")
+	}
+}
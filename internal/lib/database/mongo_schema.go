@@ -0,0 +1,214 @@
+package database
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Validation levels and actions of a MongoValidator
+const (
+	ValidationStrict   = "strict"
+	ValidationModerate = "moderate"
+	ValidationError    = "error"
+	ValidationWarn     = "warn"
+)
+
+// MongoValidator : the $jsonSchema every document written to a collection must
+// match, usually MongoSchema of its model
+type MongoValidator struct {
+	Schema bson.M
+	// Level is ValidationStrict (default) checking every insert and update, or
+	// ValidationModerate leaving updates of documents that were invalid before
+	Level string
+	// Action is ValidationError (default) refusing an invalid write, or
+	// ValidationWarn only logging it on the server
+	Action string
+}
+
+func (ins MongoValidator) level() string {
+	if len(ins.Level) == 0 {
+		return ValidationStrict
+	}
+	return ins.Level
+}
+
+func (ins MongoValidator) action() string {
+	if len(ins.Action) == 0 {
+		return ValidationError
+	}
+	return ins.Action
+}
+
+func (ins MongoValidator) validator() bson.M {
+	return bson.M{"$jsonSchema": ins.Schema}
+}
+
+// collectionOptions : the validation options listCollections reports
+type collectionOptions struct {
+	Validator        bson.Raw `bson:"validator"`
+	ValidationLevel  string   `bson:"validationLevel"`
+	ValidationAction string   `bson:"validationAction"`
+}
+
+// syncValidator : replace the validator of the collection with collMod when it
+// differs from the declared one. A collection without a declared validator
+// keeps the one it has, like the indexes that are not declared.
+func syncValidator(ctx context.Context, db *mongo.Database, collectionName string, declared MongoValidator) error {
+	if declared.Schema == nil {
+		return nil
+	}
+	specs, err := db.ListCollectionSpecifications(ctx, bson.M{"name": collectionName})
+	if err != nil {
+		return err
+	}
+	var current collectionOptions
+	if len(specs) > 0 && specs[0].Options != nil {
+		if err := bson.Unmarshal(specs[0].Options, &current); err != nil {
+			return err
+		}
+	}
+	same, err := sameDocument(declared.validator(), current.Validator)
+	if err != nil {
+		return err
+	}
+	// the server omits the defaults
+	level, action := current.ValidationLevel, current.ValidationAction
+	if len(level) == 0 {
+		level = ValidationStrict
+	}
+	if len(action) == 0 {
+		action = ValidationError
+	}
+	if same && level == declared.level() && action == declared.action() {
+		return nil
+	}
+	log.Printf("Log-Debug: Validator of `%s` changed, updating it\r\n", collectionName)
+	return db.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: collectionName},
+		{Key: "validator", Value: declared.validator()},
+		{Key: "validationLevel", Value: declared.level()},
+		{Key: "validationAction", Value: declared.action()},
+	}).Err()
+}
+
+// sameDocument : want as the server would store it equals got, maps have no
+// order so both are compared decoded
+func sameDocument(want interface{}, got bson.Raw) (bool, error) {
+	if got == nil {
+		return false, nil
+	}
+	data, err := bson.Marshal(want)
+	if err != nil {
+		return false, err
+	}
+	var a, b bson.M
+	if err := bson.Unmarshal(data, &a); err != nil {
+		return false, err
+	}
+	if err := bson.Unmarshal(got, &b); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(a, b), nil
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIDType = reflect.TypeOf(primitive.ObjectID{})
+	bytesType    = reflect.TypeOf([]byte(nil))
+)
+
+// MongoSchema : the $jsonSchema of the documents the driver writes for model, a
+// struct or a pointer to one. Properties follow the bson tags, the fields
+// without omitempty are required and nil slices may be stored as null.
+// Properties that are not declared are allowed, older documents may have them.
+func MongoSchema(model interface{}) bson.M {
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return objectSchema(t)
+}
+
+func objectSchema(t reflect.Type) bson.M {
+	var (
+		properties = bson.M{}
+		required   = bson.A{}
+	)
+	addFields(t, properties, &required)
+	schema := bson.M{"bsonType": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func addFields(t reflect.Type, properties bson.M, required *bson.A) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("bson"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") && field.Type.Kind() == reflect.Struct {
+			addFields(field.Type, properties, required)
+			continue
+		}
+		if len(name) == 0 {
+			name = strings.ToLower(field.Name)
+		}
+		properties[name] = valueSchema(field.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func valueSchema(t reflect.Type) bson.M {
+	switch {
+	case t == timeType:
+		return bson.M{"bsonType": "date"}
+	case t == objectIDType:
+		return bson.M{"bsonType": "objectId"}
+	case t == bytesType:
+		return bson.M{"bsonType": bson.A{"binData", "null"}}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return bson.M{"bsonType": "string"}
+	case reflect.Bool:
+		return bson.M{"bsonType": "bool"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// an int is written as an int32 when it fits
+		return bson.M{"bsonType": bson.A{"int", "long"}}
+	case reflect.Float32, reflect.Float64:
+		return bson.M{"bsonType": "double"}
+	case reflect.Slice, reflect.Array:
+		return bson.M{"bsonType": bson.A{"array", "null"}, "items": valueSchema(t.Elem())}
+	case reflect.Map:
+		return bson.M{"bsonType": bson.A{"object", "null"}}
+	case reflect.Struct:
+		return objectSchema(t)
+	case reflect.Ptr:
+		schema := valueSchema(t.Elem())
+		switch types := schema["bsonType"].(type) {
+		case string:
+			schema["bsonType"] = bson.A{types, "null"}
+		case bson.A:
+			schema["bsonType"] = append(types, "null")
+		}
+		return schema
+	default:
+		// an interface holds any value
+		return bson.M{}
+	}
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// SchemaEmbedded : inlined, an unexported embedded type would be skipped like by the driver
+type SchemaEmbedded struct {
+	Source string `bson:"source"`
+}
+
+type schemaItem struct {
+	Name string `bson:"name"`
+	Data []byte `bson:"data,omitempty"`
+}
+
+type schemaModel struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty"`
+	Name           string             `bson:"name"`
+	Count          int                `bson:"count"`
+	Ratio          float64            `bson:"ratio,omitempty"`
+	Active         bool               `bson:"active"`
+	At             time.Time          `bson:"at"`
+	Tags           []string           `bson:"tags,omitempty"`
+	Items          []schemaItem       `bson:"items"`
+	Parent         *schemaItem        `bson:"parent,omitempty"`
+	Attributes     map[string]string  `bson:"attributes,omitempty"`
+	Any            interface{}        `bson:"any,omitempty"`
+	Ignored        string             `bson:"-"`
+	Untagged       string
+	hidden         string
+	SchemaEmbedded `bson:",inline"`
+}
+
+func TestMongoSchema(t *testing.T) {
+	_ = schemaModel{}.hidden
+	want := bson.M{
+		"bsonType": "object",
+		"properties": bson.M{
+			"_id":    bson.M{"bsonType": "objectId"},
+			"name":   bson.M{"bsonType": "string"},
+			"count":  bson.M{"bsonType": bson.A{"int", "long"}},
+			"ratio":  bson.M{"bsonType": "double"},
+			"active": bson.M{"bsonType": "bool"},
+			"at":     bson.M{"bsonType": "date"},
+			"tags":   bson.M{"bsonType": bson.A{"array", "null"}, "items": bson.M{"bsonType": "string"}},
+			"items": bson.M{"bsonType": bson.A{"array", "null"}, "items": bson.M{
+				"bsonType": "object",
+				"properties": bson.M{
+					"name": bson.M{"bsonType": "string"},
+					"data": bson.M{"bsonType": bson.A{"binData", "null"}},
+				},
+				"required": bson.A{"name"},
+			}},
+			"parent": bson.M{
+				"bsonType": bson.A{"object", "null"},
+				"properties": bson.M{
+					"name": bson.M{"bsonType": "string"},
+					"data": bson.M{"bsonType": bson.A{"binData", "null"}},
+				},
+				"required": bson.A{"name"},
+			},
+			"attributes": bson.M{"bsonType": bson.A{"object", "null"}},
+			"any":        bson.M{},
+			"untagged":   bson.M{"bsonType": "string"},
+			"source":     bson.M{"bsonType": "string"},
+		},
+		"required": bson.A{"name", "count", "active", "at", "items", "untagged", "source"},
+	}
+	// a pointer to the model gives the same schema
+	for _, model := range []interface{}{schemaModel{}, &schemaModel{}} {
+		if got := MongoSchema(model); !reflect.DeepEqual(got, want) {
+			t.Fatalf("schema of %T\n got %v\nwant %v", model, got, want)
+		}
+	}
+}
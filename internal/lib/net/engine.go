@@ -2,12 +2,11 @@ package net
 
 import (
 	"context"
+	"errors"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"io"
 	"net/http"
-	"os"
-	"os/signal"
 	"time"
 )
 
@@ -15,6 +14,8 @@ const (
 	defaultAddr string = "0.0.0.0:8080"
 )
 
+var errNoHandlerEngine = errors.New("server HandlerEngine Config invalid")
+
 type Engine struct {
 	http.Server
 	HandlerEngine *gin.Engine
@@ -29,49 +30,51 @@ func (ins *Engine) UseCors(c cors.Config) {
 	ins.HandlerEngine.Use(handlerFunc)
 }
 
-func (ins *Engine) AddHandler(apply func(engine *gin.Engine)) {
+// UseTrustedProxies : the proxies whose X-Forwarded-For and X-Real-IP headers
+// give the client address, nil trusts none and the address is the peer's
+func (ins *Engine) UseTrustedProxies(proxies []string) error {
+	return ins.HandlerEngine.SetTrustedProxies(proxies)
+}
+
+func (ins *Engine) AddHandler(apply func(engine *gin.Engine)) error {
 	if ins.HandlerEngine != nil {
 		apply(ins.HandlerEngine)
-		return
+		return nil
 	}
-	panic("server HandlerEngine Config invalid")
+	return errNoHandlerEngine
 }
 
-func (ins *Engine) Run(addr ...string) {
-	var (
-		interrupt = make(chan os.Signal)
-	)
-	if len(ins.Addr) > 0 {
-		ins.Addr = addr[0]
-	} else {
-		ins.Addr = defaultAddr
-	}
+// Serve : listen on addr until ctx is done, then shut down gracefully. The
+// error is the one that stopped the server, nil after a shutdown.
+func (ins *Engine) Serve(ctx context.Context, addr string) error {
 	if ins.HandlerEngine == nil {
-		ins.HandlerEngine = gin.New()
+		return errNoHandlerEngine
 	}
 	// ghi đè server address
-	if len(addr) > 0 {
-		ins.Addr = addr[0]
+	if ins.Addr = addr; len(ins.Addr) == 0 {
+		ins.Addr = defaultAddr
 	}
-	defer func() {
-		if recover() != nil {
-			println("please call Engine.Init() function")
-		}
-	}()
+	// apply HandlerEngine
+	ins.Handler = ins.HandlerEngine
+
+	stopped := make(chan error, 1)
 	go func() {
-		// apply HandlerEngine
-		ins.Handler = ins.HandlerEngine
 		println("Server starting ... addr:", ins.Addr)
-		if err := ins.ListenAndServe(); err != nil {
-			println("\r\n", err.Error())
-		}
-		interrupt <- os.Interrupt
+		stopped <- ins.ListenAndServe()
 	}()
-	signal.Notify(interrupt, os.Interrupt, os.Kill)
-	<-interrupt
+	select {
+	case err := <-stopped:
+		return err
+	case <-ctx.Done():
+	}
 	// shutdown server
-	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
 	defer cancel()
-	_ = ins.Shutdown(ctx)
-	os.Exit(0)
+	if err := ins.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-stopped; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"app/internal/lib/database"
+	"app/internal/mongodb/db/models"
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// LoginAttempt : failure counters shared by every API instance
+type LoginAttempt struct {
+	co *mongo.Collection
+}
+
+// NewLoginAttempt : the counters are deleted retention after their last
+// failure, they are kept when it is zero
+func NewLoginAttempt(ctx context.Context, db *mongo.Database, retention time.Duration) (*LoginAttempt, error) {
+	var index []database.MongoIndex
+	if retention > 0 {
+		index = append(index, database.MongoIndex{
+			Name:        "last_failure_at_ttl",
+			Keys:        bson.D{{Key: "last_failure_at", Value: 1}},
+			TTL:         true,
+			ExpireAfter: retention,
+		})
+	}
+	co, err := database.MongoInit(
+		ctx,
+		db,
+		"login_attempts",
+		index...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginAttempt{co: co}, nil
+}
+
+// Fail : count a failure under key and return the failures within window,
+// the counter starts over once the previous failure is older than window
+func (ins *LoginAttempt) Fail(ctx context.Context, key string, window time.Duration) (int, error) {
+	var (
+		now    = time.Now()
+		filter = bson.M{
+			"_id":             key,
+			"last_failure_at": bson.M{"$gte": now.Add(-window)},
+		}
+		update = bson.M{
+			"$inc": bson.M{"failures": 1},
+			"$set": bson.M{"last_failure_at": now},
+		}
+		tmp models.AttemptModel
+	)
+	err := ins.co.FindOneAndUpdate(ctx, filter, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&tmp)
+	if err == nil {
+		return tmp.Failures, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, err
+	}
+	// first failure or the window has passed, an active lock is kept
+	update = bson.M{
+		"$set": bson.M{"failures": 1, "last_failure_at": now},
+	}
+	if _, err := ins.co.UpdateOne(ctx, bson.M{"_id": key}, update, options.Update().SetUpsert(true)); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// Lock : keep key locked at least until the given time
+func (ins *LoginAttempt) Lock(ctx context.Context, key string, until time.Time) error {
+	var (
+		update = bson.M{
+			"$max": bson.M{"locked_until": until},
+		}
+	)
+	if _, err := ins.co.UpdateByID(ctx, key, update); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Claim : lock key until the given time unless it is locked already, false
+// when another attempt holds the lock
+func (ins *LoginAttempt) Claim(ctx context.Context, key string, until time.Time) (bool, error) {
+	var (
+		filter = bson.M{
+			"_id": key,
+			"$or": bson.A{
+				bson.M{"locked_until": bson.M{"$exists": false}},
+				bson.M{"locked_until": bson.M{"$lte": time.Now()}},
+			},
+		}
+		update = bson.M{
+			"$set": bson.M{"locked_until": until},
+		}
+	)
+	r, err := ins.co.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return r.MatchedCount > 0, nil
+}
+
+// Release : take back a failure counted by Fail, the lock is kept
+func (ins *LoginAttempt) Release(ctx context.Context, key string) error {
+	var (
+		filter = bson.M{
+			"_id":      key,
+			"failures": bson.M{"$gt": 0},
+		}
+		update = bson.M{
+			"$inc": bson.M{"failures": -1},
+		}
+	)
+	if _, err := ins.co.UpdateOne(ctx, filter, update); err != nil {
+		return err
+	}
+	return nil
+}
+
+// LockedUntil : the latest lock among keys, zero when none of them is locked
+func (ins *LoginAttempt) LockedUntil(ctx context.Context, keys []string) (time.Time, error) {
+	var (
+		filter = bson.M{
+			"_id":          bson.M{"$in": keys},
+			"locked_until": bson.M{"$gt": time.Now()},
+		}
+		list  []models.AttemptModel
+		until time.Time
+	)
+	cursor, err := ins.co.Find(ctx, filter)
+	if err != nil {
+		return until, err
+	}
+	if err := cursor.All(ctx, &list); err != nil {
+		return until, err
+	}
+	for _, a := range list {
+		if a.LockedUntil.After(until) {
+			until = a.LockedUntil
+		}
+	}
+	return until, nil
+}
+
+// Reset : forget failures and locks of keys
+func (ins *LoginAttempt) Reset(ctx context.Context, keys []string) error {
+	if _, err := ins.co.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": keys}}); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"app/internal/lib/database"
+	"app/internal/mongodb/db/models"
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+type Authorization struct {
+	co *mongo.Collection
+}
+
+func NewAuthorization(ctx context.Context, db *mongo.Database) (*Authorization, error) {
+	co, err := database.MongoInit(
+		ctx,
+		db,
+		"oauth_authorizations",
+		database.MongoIndex{Keys: bson.M{"code_hash": 1}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Authorization{co: co}, nil
+}
+
+func (ins *Authorization) Create(ctx context.Context, authorization *models.AuthorizationModel) error {
+	authorization.CreatedAt = time.Now()
+	if _, err := ins.co.InsertOne(ctx, authorization); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetPending : a request the user has not logged in for yet
+func (ins *Authorization) GetPending(ctx context.Context, id string) (*models.AuthorizationModel, error) {
+	var (
+		filter = bson.M{
+			"_id":        id,
+			"code_hash":  bson.M{"$exists": false},
+			"expires_at": bson.M{"$gt": time.Now()},
+		}
+		authorization models.AuthorizationModel
+	)
+	if err := ins.co.FindOne(ctx, filter).Decode(&authorization); err != nil {
+		return nil, err
+	}
+	return &authorization, nil
+}
+
+// Approve : attach the code and the session of the user, false when the request
+// expired or was approved already
+func (ins *Authorization) Approve(ctx context.Context, id, codeHash string, userID, sessionID primitive.ObjectID, expiresAt time.Time) (bool, error) {
+	var (
+		filter = bson.M{
+			"_id":        id,
+			"code_hash":  bson.M{"$exists": false},
+			"expires_at": bson.M{"$gt": time.Now()},
+		}
+		update = bson.M{
+			"$set": bson.M{
+				"code_hash":  codeHash,
+				"user_id":    userID,
+				"session_id": sessionID,
+				"expires_at": expiresAt,
+			},
+		}
+	)
+	r, err := ins.co.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return r.ModifiedCount > 0, nil
+}
+
+// Redeem : take the authorization of a code, a code can be redeemed only once
+func (ins *Authorization) Redeem(ctx context.Context, codeHash string) (*models.AuthorizationModel, error) {
+	var (
+		filter = bson.M{
+			"code_hash":  codeHash,
+			"expires_at": bson.M{"$gt": time.Now()},
+		}
+		authorization models.AuthorizationModel
+	)
+	if err := ins.co.FindOneAndDelete(ctx, filter).Decode(&authorization); err != nil {
+		return nil, err
+	}
+	return &authorization, nil
+}
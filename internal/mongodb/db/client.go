@@ -0,0 +1,62 @@
+package db
+
+import (
+	"app/internal/lib/database"
+	"app/internal/mongodb/db/models"
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type Client struct {
+	co *mongo.Collection
+}
+
+func NewClient(ctx context.Context, db *mongo.Database) (*Client, error) {
+	co, err := database.MongoInit(
+		ctx,
+		db,
+		"oauth_clients",
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{co: co}, nil
+}
+
+func (ins *Client) FindByID(ctx context.Context, id string) (*models.ClientModel, error) {
+	var client models.ClientModel
+	if err := ins.co.FindOne(ctx, bson.M{"_id": id}).Decode(&client); err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// Upsert : create the client or replace its settings, keeping created_at
+func (ins *Client) Upsert(ctx context.Context, client *models.ClientModel) error {
+	var (
+		now    = time.Now()
+		update = bson.M{
+			"$set": bson.M{
+				"name":              client.Name,
+				"secret_hash":       client.SecretHash,
+				"type":              client.Type,
+				"grants":            client.Grants,
+				"redirect_uris":     client.RedirectURIs,
+				"allowed_origins":   client.AllowedOrigins,
+				"access_token_ttl":  client.AccessTokenTTL,
+				"refresh_token_ttl": client.RefreshTokenTTL,
+				"updated_at":        now,
+			},
+			"$setOnInsert": bson.M{
+				"created_at": now,
+			},
+		}
+	)
+	if _, err := ins.co.UpdateByID(ctx, client.ID, update, options.Update().SetUpsert(true)); err != nil {
+		return err
+	}
+	return nil
+}
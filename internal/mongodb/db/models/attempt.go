@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// AttemptModel : failed authentication attempts counted under one key,
+// e.g. "pwd:<username>", "mfa:<userId>" or "ip:<address>"
+type AttemptModel struct {
+	Key           string    `json:"key" bson:"_id"`
+	Failures      int       `json:"failures" bson:"failures"`
+	LastFailureAt time.Time `json:"lastFailureAt" bson:"last_failure_at"`
+	LockedUntil   time.Time `json:"lockedUntil" bson:"locked_until"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// AuthorizationModel : an OIDC authorization request, pending until the user logs
+// in, then holding the hash of the code handed to the client
+type AuthorizationModel struct {
+	ID                  string             `json:"id" bson:"_id"`
+	ClientID            string             `json:"clientId" bson:"client_id"`
+	RedirectURI         string             `json:"redirectUri" bson:"redirect_uri"`
+	Scope               string             `json:"scope" bson:"scope"`
+	State               string             `json:"state" bson:"state"`
+	Nonce               string             `json:"nonce" bson:"nonce"`
+	CodeChallenge       string             `json:"-" bson:"code_challenge"`
+	CodeChallengeMethod string             `json:"-" bson:"code_challenge_method"`
+	CodeHash            string             `json:"-" bson:"code_hash,omitempty"`
+	UserID              primitive.ObjectID `json:"userId" bson:"user_id,omitempty"`
+	SessionID           primitive.ObjectID `json:"sessionId" bson:"session_id,omitempty"`
+	CreatedAt           time.Time          `json:"createdAt" bson:"created_at"`
+	ExpiresAt           time.Time          `json:"expiresAt" bson:"expires_at"`
+}
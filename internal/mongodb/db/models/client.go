@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// ClientModel : a registered client application. TTLs are in seconds, 0 keeps
+// the service defaults.
+type ClientModel struct {
+	ID              string    `json:"id" bson:"_id"`
+	Name            string    `json:"name" bson:"name"`
+	SecretHash      string    `json:"-" bson:"secret_hash,omitempty"`
+	Type            string    `json:"type" bson:"type"`
+	Grants          []string  `json:"grants" bson:"grants"`
+	RedirectURIs    []string  `json:"redirectUris" bson:"redirect_uris"`
+	AllowedOrigins  []string  `json:"allowedOrigins" bson:"allowed_origins"`
+	AccessTokenTTL  int64     `json:"accessTokenTtl" bson:"access_token_ttl"`
+	RefreshTokenTTL int64     `json:"refreshTokenTtl" bson:"refresh_token_ttl"`
+	CreatedAt       time.Time `json:"createdAt" bson:"created_at"`
+	UpdatedAt       time.Time `json:"updatedAt" bson:"updated_at"`
+}
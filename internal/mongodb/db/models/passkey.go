@@ -0,0 +1,34 @@
+package models
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// PasskeyModel : a WebAuthn credential registered by the user
+type PasskeyModel struct {
+	CredentialID    []byte    `json:"credentialId" bson:"credential_id"`
+	PublicKey       []byte    `json:"-" bson:"public_key"`
+	AttestationType string    `json:"attestationType" bson:"attestation_type"`
+	AAGUID          []byte    `json:"aaguid" bson:"aaguid"`
+	SignCount       uint32    `json:"signCount" bson:"sign_count"`
+	Transports      []string  `json:"transports" bson:"transports"`
+	Name            string    `json:"name" bson:"name"`
+	BackupEligible  bool      `json:"backupEligible" bson:"backup_eligible"`
+	BackupState     bool      `json:"backupState" bson:"backup_state"`
+	CreatedAt       time.Time `json:"createdAt" bson:"created_at"`
+	LastUsedAt      time.Time `json:"lastUsedAt" bson:"last_used_at"`
+}
+
+// WebAuthnChallengeModel : state of a registration or assertion ceremony between begin and finish
+type WebAuthnChallengeModel struct {
+	ID                   primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID               primitive.ObjectID `json:"userId" bson:"user_id"` // nil for passwordless login
+	Purpose              string             `json:"purpose" bson:"purpose"`
+	Challenge            string             `json:"challenge" bson:"challenge"`
+	UserHandle           []byte             `json:"userHandle" bson:"user_handle"`
+	AllowedCredentialIDs [][]byte           `json:"allowedCredentialIds" bson:"allowed_credential_ids"`
+	UserVerification     string             `json:"userVerification" bson:"user_verification"`
+	ExpiresAt            time.Time          `json:"expiresAt" bson:"expires_at"`
+	CreatedAt            time.Time          `json:"createdAt" bson:"created_at"`
+}
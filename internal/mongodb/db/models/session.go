@@ -10,5 +10,21 @@ type SessionModel struct {
 	UserID       primitive.ObjectID `json:"userId" bson:"user_id"`
 	AccessToken  string             `json:"accessToken" bson:"access_token"`
 	RefreshToken string             `json:"refreshToken" bson:"refresh_token"`
-	CreatedAt    time.Time          `json:"createdAt" bson:"created_at"`
+	// FamilyID groups the refresh tokens rotated from one login
+	FamilyID primitive.ObjectID `json:"familyId" bson:"family_id"`
+	// Generation of the current refresh token, older ones have been rotated out
+	Generation int      `json:"generation" bson:"refresh_generation"`
+	AMR        []string `json:"amr" bson:"amr"`
+	// AuthTime is when the user authenticated, the auth_time of every access token
+	AuthTime   time.Time `json:"authTime" bson:"auth_time"`
+	ClientID   string    `json:"clientId" bson:"client_id"`
+	ClientIP   string    `json:"clientIp" bson:"client_ip"`
+	UserAgent  string    `json:"userAgent" bson:"user_agent"`
+	CreatedAt  time.Time `json:"createdAt" bson:"created_at"`
+	LastUsedAt time.Time `json:"lastUsedAt" bson:"last_used_at"`
+	// ExpiresAt is the earlier of the idle and the absolute limit, it moves
+	// forward with use and Mongo deletes the session once it is reached
+	ExpiresAt time.Time `json:"expiresAt,omitempty" bson:"expires_at,omitempty"`
+	// RevokedAt is set when the session was signed out
+	RevokedAt time.Time `json:"revokedAt,omitempty" bson:"revoked_at,omitempty"`
 }
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// SigningKeyModel : a token signing key, PrivateKey is PKCS #8 DER so access to
+// this collection must be restricted like any other secret
+type SigningKeyModel struct {
+	ID         string    `json:"kid" bson:"_id"`
+	Algorithm  string    `json:"alg" bson:"alg"`
+	PrivateKey []byte    `json:"-" bson:"private_key"`
+	CreatedAt  time.Time `json:"createdAt" bson:"created_at"`
+	RetiredAt  time.Time `json:"retiredAt" bson:"retired_at"`
+	ExpiresAt  time.Time `json:"expiresAt" bson:"expires_at"`
+}
@@ -6,11 +6,20 @@ import (
 )
 
 type UserModel struct {
-	ID        primitive.ObjectID   `json:"id,omitempty" bson:"_id,omitempty"`
-	Username  string               `json:"username" bson:"username"`
-	Password  string               `json:"-" bson:"password"`
-	Sessions  []primitive.ObjectID `json:"-" bson:"sessions"`
-	MFAActive bool                 `json:"-" bson:"mfa_active"`
-	MFASecret string               `json:"-" bson:"mfa_secret"`
-	CreatedAt time.Time            `json:"createdAt" bson:"created_at"`
+	ID       primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	Username string             `json:"username" bson:"username"`
+	Password string             `json:"-" bson:"password"`
+	// Sessions, like the other arrays, is left out until the first element is
+	// pushed, $push and $pull fail on a null
+	Sessions []primitive.ObjectID `json:"-" bson:"sessions,omitempty"`
+	// MaxSessions overrides the deployment session limit when greater than 0
+	MaxSessions int    `json:"-" bson:"max_sessions,omitempty"`
+	MFAActive   bool   `json:"-" bson:"mfa_active"`
+	MFASecret   string `json:"-" bson:"mfa_secret"`
+	// MFALastStep is the TOTP time step of the last accepted code, older or equal steps are replays
+	MFALastStep int64 `json:"-" bson:"mfa_last_step,omitempty"`
+	// RecoveryCodes holds SHA-256 hashes of the unused single-use codes
+	RecoveryCodes []string       `json:"-" bson:"recovery_codes,omitempty"`
+	Passkeys      []PasskeyModel `json:"-" bson:"passkeys,omitempty"`
+	CreatedAt     time.Time      `json:"createdAt" bson:"created_at"`
 }
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"app/internal/lib/database"
+	"app/internal/mongodb/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// bsonTypes : the $jsonSchema alias of the types the driver writes
+var bsonTypes = map[bsontype.Type]string{
+	bsontype.String:           "string",
+	bsontype.Boolean:          "bool",
+	bsontype.Int32:            "int",
+	bsontype.Int64:            "long",
+	bsontype.Double:           "double",
+	bsontype.DateTime:         "date",
+	bsontype.ObjectID:         "objectId",
+	bsontype.Binary:           "binData",
+	bsontype.Null:             "null",
+	bsontype.Array:            "array",
+	bsontype.EmbeddedDocument: "object",
+}
+
+// conforms : what the server checks of doc against the $jsonSchema subset
+// MongoSchema generates, the required fields and the types of the properties
+func conforms(t *testing.T, path string, schema bson.M, value bson.RawValue) {
+	t.Helper()
+	got := bsonTypes[value.Type]
+	switch allowed := schema["bsonType"].(type) {
+	case string:
+		if got != allowed {
+			t.Fatalf("%s: %s, want %s", path, got, allowed)
+		}
+	case bson.A:
+		found := false
+		for _, alias := range allowed {
+			found = found || alias == got
+		}
+		if !found {
+			t.Fatalf("%s: %s, want one of %v", path, got, allowed)
+		}
+	}
+	switch value.Type {
+	case bsontype.EmbeddedDocument:
+		doc := value.Document()
+		required, _ := schema["required"].(bson.A)
+		for _, name := range required {
+			if _, err := doc.LookupErr(name.(string)); err != nil {
+				t.Fatalf("%s: required %s missing", path, name)
+			}
+		}
+		properties, _ := schema["properties"].(bson.M)
+		elements, err := doc.Elements()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, element := range elements {
+			if property, ok := properties[element.Key()].(bson.M); ok {
+				conforms(t, path+"."+element.Key(), property, element.Value())
+			}
+		}
+	case bsontype.Array:
+		items, _ := schema["items"].(bson.M)
+		values, err := value.Array().Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range values {
+			conforms(t, path+"[]", items, item)
+		}
+	}
+}
+
+// document : model as the driver inserts it
+func document(t *testing.T, model interface{}) bson.RawValue {
+	t.Helper()
+	data, err := bson.Marshal(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bson.RawValue{Type: bsontype.EmbeddedDocument, Value: data}
+}
+
+func required(schema bson.M) []string {
+	var names []string
+	for _, name := range schema["required"].(bson.A) {
+		names = append(names, name.(string))
+	}
+	return names
+}
+
+func TestUserSchema(t *testing.T) {
+	schema := database.MongoSchema(models.UserModel{})
+	// the fields every user has had since the first release, the others are
+	// missing from older documents or left out until set
+	if got, want := required(schema), []string{"username", "password", "mfa_active", "mfa_secret", "created_at"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("required %v, want %v", got, want)
+	}
+
+	registered := document(t, newUserDocument("alice", "$argon2id$hash"))
+	conforms(t, "users", schema, registered)
+	// $push and $pull fail on a null, the arrays must be absent
+	for _, name := range []string{"sessions", "recovery_codes", "passkeys", "mfa_last_step", "max_sessions"} {
+		if _, err := registered.Document().LookupErr(name); err == nil {
+			t.Fatalf("registered user has %s", name)
+		}
+	}
+
+	now := time.Now()
+	conforms(t, "users", schema, document(t, &models.UserModel{
+		ID:            primitive.NewObjectID(),
+		Username:      "alice",
+		Password:      "$argon2id$hash",
+		Sessions:      []primitive.ObjectID{primitive.NewObjectID()},
+		MaxSessions:   3,
+		MFAActive:     true,
+		MFASecret:     "SECRET",
+		MFALastStep:   now.Unix() / 30,
+		RecoveryCodes: []string{"hash"},
+		Passkeys: []models.PasskeyModel{{
+			CredentialID: []byte{1},
+			PublicKey:    []byte{2},
+			SignCount:    1,
+			CreatedAt:    now,
+			LastUsedAt:   now,
+		}},
+		CreatedAt: now,
+	}))
+}
+
+func TestSessionSchema(t *testing.T) {
+	schema := database.MongoSchema(models.SessionModel{})
+	for _, name := range []string{"expires_at", "revoked_at", "_id"} {
+		for _, r := range required(schema) {
+			if r == name {
+				t.Fatalf("%s required", name)
+			}
+		}
+	}
+	now := time.Now()
+	session := &models.SessionModel{
+		UserID:       primitive.NewObjectID(),
+		AccessToken:  "at",
+		RefreshToken: "rt",
+		FamilyID:     primitive.NewObjectID(),
+		AMR:          []string{"pwd", "otp"},
+		AuthTime:     now,
+		ClientID:     "app",
+		ClientIP:     "192.0.2.1",
+		UserAgent:    "test",
+		CreatedAt:    now,
+		LastUsedAt:   now,
+	}
+	// without limits a session has no expiry
+	conforms(t, "login_sessions", schema, document(t, session))
+	session.ExpiresAt = now.Add(time.Hour)
+	session.RevokedAt = now
+	conforms(t, "login_sessions", schema, document(t, session))
+}
@@ -3,10 +3,12 @@ package db
 import (
 	"app/internal/lib/database"
 	"app/internal/mongodb/db/models"
+	"app/internal/store"
 	"context"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"time"
 )
 
@@ -14,49 +16,159 @@ type LoginSession struct {
 	co *mongo.Collection
 }
 
-func NewLoginSession(db *mongo.Database) *LoginSession {
-	return &LoginSession{
-		co: database.MongoInit(
-			db,
-			"login_sessions",
-		),
+func NewLoginSession(ctx context.Context, db *mongo.Database) (*LoginSession, error) {
+	co, err := database.MongoInitValidated(
+		ctx,
+		db,
+		"login_sessions",
+		database.MongoValidator{
+			Schema: database.MongoSchema(models.SessionModel{}),
+			Level:  database.ValidationModerate,
+		},
+		database.MongoIndex{Name: "access_token_unique", Keys: bson.D{{Key: "access_token", Value: 1}}, Unique: true},
+		database.MongoIndex{Name: "family_id", Keys: bson.D{{Key: "family_id", Value: 1}}},
+		database.MongoIndex{
+			Name: "user_id_last_used_at",
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "last_used_at", Value: -1}},
+		},
+		database.MongoIndex{
+			Name: "expires_at_ttl",
+			Keys: bson.D{{Key: "expires_at", Value: 1}},
+			TTL:  true,
+		},
+		database.MongoIndex{
+			Name:          "revoked_at_ttl",
+			Keys:          bson.D{{Key: "revoked_at", Value: 1}},
+			TTL:           true,
+			ExpireAfter:   store.RevokedSessionRetention,
+			PartialFilter: bson.M{"revoked_at": bson.M{"$exists": true}},
+		},
+	)
+	if err != nil {
+		return nil, err
 	}
+	return &LoginSession{co: co}, nil
 }
 
-func (ins *LoginSession) CreateNewSession(ctx context.Context,
-	userID primitive.ObjectID, accessToken, refreshToken string) (primitive.ObjectID, error) {
-	if r, err := ins.co.InsertOne(ctx, &models.SessionModel{
-		ID:           primitive.NewObjectID(),
-		UserID:       userID,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		CreatedAt:    time.Now(),
-	}); err != nil {
+// CreateNewSession : insert the session, ID and timestamps are filled in here
+func (ins *LoginSession) CreateNewSession(ctx context.Context, session *models.SessionModel, lifetime store.SessionLifetime) (primitive.ObjectID, error) {
+	session.ID = primitive.NewObjectID()
+	session.CreatedAt = time.Now()
+	session.LastUsedAt = session.CreatedAt
+	session.ExpiresAt = lifetime.ExpiresAt(session.CreatedAt, session.LastUsedAt)
+	if r, err := ins.co.InsertOne(ctx, session); err != nil {
 		return primitive.NilObjectID, err
 	} else {
 		return r.InsertedID.(primitive.ObjectID), nil
 	}
 }
 
-func (ins *LoginSession) GetByAT(ctx context.Context, accessToken string) (*models.SessionModel, error) {
+func (ins *LoginSession) Delete(ctx context.Context, id primitive.ObjectID) error {
+	if _, err := ins.co.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Touch : record that the session was used, at most once per interval to spare
+// writes, and slide its expiry
+func (ins *LoginSession) Touch(ctx context.Context, session *models.SessionModel, interval time.Duration, lifetime store.SessionLifetime) error {
 	var (
+		now    = time.Now()
 		filter = bson.M{
-			"access_token": accessToken,
+			"_id":          session.ID,
+			"last_used_at": bson.M{"$lt": now.Add(-interval)},
+			"revoked_at":   bson.M{"$exists": false},
+		}
+		update = bson.M{
+			"$set": lastUsed(session, now, lifetime),
 		}
-		session models.SessionModel
 	)
-	println(accessToken)
-	if err := ins.co.FindOne(ctx, filter).Decode(&session); err != nil {
+	if _, err := ins.co.UpdateOne(ctx, filter, update); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Revoke : mark the sessions signed out, they are deleted after a retention period
+func (ins *LoginSession) Revoke(ctx context.Context, ids ...primitive.ObjectID) error {
+	var (
+		filter = bson.M{
+			"_id":        bson.M{"$in": ids},
+			"revoked_at": bson.M{"$exists": false},
+		}
+		update = bson.M{
+			"$set": bson.M{
+				"revoked_at": time.Now(),
+			},
+		}
+	)
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := ins.co.UpdateMany(ctx, filter, update); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RevokeOthers : mark every session of the user except keep signed out
+func (ins *LoginSession) RevokeOthers(ctx context.Context, userID, keep primitive.ObjectID) error {
+	var (
+		filter = bson.M{
+			"user_id":    userID,
+			"_id":        bson.M{"$ne": keep},
+			"revoked_at": bson.M{"$exists": false},
+		}
+		update = bson.M{
+			"$set": bson.M{
+				"revoked_at": time.Now(),
+			},
+		}
+	)
+	if _, err := ins.co.UpdateMany(ctx, filter, update); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ins *LoginSession) GetByID(ctx context.Context, id primitive.ObjectID) (*models.SessionModel, error) {
+	var session models.SessionModel
+	if err := ins.co.FindOne(ctx, bson.M{"_id": id}).Decode(&session); err != nil {
 		return nil, err
 	}
 
 	return &session, nil
 }
 
-func (ins *LoginSession) GetByRT(ctx context.Context, refreshToken string) (*models.SessionModel, error) {
+// FindByIDs : sessions of the user among ids, most recently used first
+func (ins *LoginSession) FindByIDs(ctx context.Context, userID primitive.ObjectID, ids []primitive.ObjectID) ([]models.SessionModel, error) {
 	var (
 		filter = bson.M{
-			"refresh_token": refreshToken,
+			"_id":     bson.M{"$in": ids},
+			"user_id": userID,
+		}
+		opts     = options.Find().SetSort(bson.D{{Key: "last_used_at", Value: -1}})
+		sessions = make([]models.SessionModel, 0, len(ids))
+	)
+	if len(ids) == 0 {
+		return sessions, nil
+	}
+	cursor, err := ins.co.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (ins *LoginSession) GetByAT(ctx context.Context, accessToken string) (*models.SessionModel, error) {
+	var (
+		filter = bson.M{
+			"access_token": accessToken,
 		}
 		session models.SessionModel
 	)
@@ -67,19 +179,52 @@ func (ins *LoginSession) GetByRT(ctx context.Context, refreshToken string) (*mod
 	return &session, nil
 }
 
-func (ins *LoginSession) UpdateAccessToken(ctx context.Context, id primitive.ObjectID, accessToken string) error {
+func (ins *LoginSession) GetByFamily(ctx context.Context, family primitive.ObjectID) ([]models.SessionModel, error) {
+	var sessions []models.SessionModel
+	cursor, err := ins.co.Find(ctx, bson.M{"family_id": family})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Rotate : replace both tokens if the session is still at its generation and
+// not revoked, false means another request rotated or revoked it first
+func (ins *LoginSession) Rotate(ctx context.Context, session *models.SessionModel, accessToken, refreshToken string, lifetime store.SessionLifetime) (bool, error) {
+	set := lastUsed(session, time.Now(), lifetime)
+	set["access_token"] = accessToken
+	set["refresh_token"] = refreshToken
 	var (
 		filter = bson.M{
-			"_id": id,
+			"_id":                session.ID,
+			"refresh_generation": session.Generation,
+			"revoked_at":         bson.M{"$exists": false},
 		}
 		update = bson.M{
-			"$set": bson.M{
-				"access_token": accessToken,
+			"$set": set,
+			"$inc": bson.M{
+				"refresh_generation": 1,
 			},
 		}
 	)
-	if _, err := ins.co.UpdateOne(ctx, filter, update); err != nil {
-		return err
+	r, err := ins.co.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
 	}
-	return nil
+	return r.ModifiedCount > 0, nil
+}
+
+// lastUsed : the fields recording a use of session at now
+func lastUsed(session *models.SessionModel, now time.Time, lifetime store.SessionLifetime) bson.M {
+	set := bson.M{
+		"last_used_at": now,
+	}
+	if expiresAt := lifetime.ExpiresAt(session.CreatedAt, now); !expiresAt.IsZero() {
+		set["expires_at"] = expiresAt
+	}
+	return set
 }
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"app/internal/auth"
+	"app/internal/lib/database"
+	"app/internal/mongodb/db/models"
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SigningKey : auth.KeyStore shared by every API instance
+type SigningKey struct {
+	co *mongo.Collection
+}
+
+func NewSigningKey(ctx context.Context, db *mongo.Database) (*SigningKey, error) {
+	co, err := database.MongoInit(
+		ctx,
+		db,
+		"signing_keys",
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{co: co}, nil
+}
+
+func (ins *SigningKey) Load(ctx context.Context) ([]*auth.SigningKey, error) {
+	var list []models.SigningKeyModel
+	cursor, err := ins.co.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	keys := make([]*auth.SigningKey, 0, len(list))
+	for _, m := range list {
+		key, err := auth.ParseSigningKey(m.ID, m.Algorithm, m.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("signing_keys: %w", err)
+		}
+		key.CreatedAt = m.CreatedAt
+		key.RetiredAt = m.RetiredAt
+		key.ExpiresAt = m.ExpiresAt
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (ins *SigningKey) Save(ctx context.Context, key *auth.SigningKey) error {
+	der, err := key.MarshalPrivateKey()
+	if err != nil {
+		return err
+	}
+	var (
+		update = bson.M{
+			"$set": bson.M{
+				"retired_at": key.RetiredAt,
+				"expires_at": key.ExpiresAt,
+			},
+			"$setOnInsert": bson.M{
+				"alg":         key.Algorithm,
+				"private_key": der,
+				"created_at":  key.CreatedAt,
+			},
+		}
+	)
+	if _, err := ins.co.UpdateByID(ctx, key.ID, update, options.Update().SetUpsert(true)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (ins *SigningKey) Delete(ctx context.Context, id string) error {
+	if _, err := ins.co.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return err
+	}
+	return nil
+}
@@ -3,7 +3,9 @@ package db
 import (
 	"app/internal/lib/database"
 	"app/internal/mongodb/db/models"
+	"app/internal/store"
 	"context"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -15,12 +17,30 @@ type User struct {
 	co *mongo.Collection
 }
 
-func NewUser(db *mongo.Database) *User {
-	return &User{
-		co: database.MongoInit(
-			db, "users",
-		),
+func NewUser(ctx context.Context, db *mongo.Database) (*User, error) {
+	co, err := database.MongoInitValidated(
+		ctx,
+		db, "users",
+		// users created before a field was added lack it, they stay writable
+		database.MongoValidator{
+			Schema: database.MongoSchema(models.UserModel{}),
+			Level:  database.ValidationModerate,
+		},
+		database.MongoIndex{Name: "username_unique", Keys: bson.D{{Key: "username", Value: 1}}, Unique: true},
+		// ValidateSession and the revocations look users up by session
+		database.MongoIndex{Name: "sessions", Keys: bson.D{{Key: "sessions", Value: 1}}},
+		// a credential belongs to one user, users without passkeys are not indexed
+		database.MongoIndex{
+			Name:   "passkeys_credential_id_unique",
+			Keys:   bson.D{{Key: "passkeys.credential_id", Value: 1}},
+			Unique: true,
+			Sparse: true,
+		},
+	)
+	if err != nil {
+		return nil, err
 	}
+	return &User{co: co}, nil
 }
 
 func (ins *User) Count(ctx context.Context, filter interface{}) int64 {
@@ -31,15 +51,24 @@ func (ins *User) Count(ctx context.Context, filter interface{}) int64 {
 	return documents
 }
 
-func (ins *User) CreateUser(ctx context.Context, userName string, passWord string) (primitive.ObjectID, error) {
-	result, err := ins.co.InsertOne(ctx, &models.UserModel{
+// newUserDocument : a user as registered, without sessions, codes or passkeys
+func newUserDocument(userName, passwordHash string) *models.UserModel {
+	return &models.UserModel{
 		Username:  userName,
-		Password:  passWord,
+		Password:  passwordHash,
 		MFAActive: false,
 		MFASecret: "",
 		CreatedAt: time.Now(),
-	})
+	}
+}
+
+// CreateUser : passwordHash must already be encoded by the password package
+func (ins *User) CreateUser(ctx context.Context, userName string, passwordHash string) (primitive.ObjectID, error) {
+	result, err := ins.co.InsertOne(ctx, newUserDocument(userName, passwordHash))
 	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return primitive.NilObjectID, store.ErrUsernameTaken
+		}
 		return primitive.NilObjectID, err
 	}
 
@@ -57,11 +86,11 @@ func (ins *User) FindByID(ctx context.Context, id primitive.ObjectID) (*models.U
 	return &tmp, nil
 }
 
-func (ins *User) Find(ctx context.Context, userName, pwd string) (*models.UserModel, error) {
+// FindByUsername : the password is never part of the filter, callers verify the hash
+func (ins *User) FindByUsername(ctx context.Context, userName string) (*models.UserModel, error) {
 	var (
 		filter = bson.M{
 			"username": userName,
-			"password": pwd,
 		}
 		tmp *models.UserModel
 	)
@@ -73,22 +102,55 @@ func (ins *User) Find(ctx context.Context, userName, pwd string) (*models.UserMo
 	return tmp, nil
 }
 
-func (ins *User) PushSession(ctx context.Context, uuid, sessionID primitive.ObjectID) error {
+// PushSession : link a new session to the user. With maxSessions > 0 the oldest
+// sessions are dropped when evict is set, otherwise the push is refused with
+// store.ErrSessionLimit. Both checks happen in the update itself so concurrent logins
+// cannot exceed the limit.
+func (ins *User) PushSession(ctx context.Context, uuid, sessionID primitive.ObjectID, maxSessions int, evict bool) error {
 	var (
 		filter = bson.M{
 			"_id": uuid,
 		}
+		each = bson.M{
+			"$each": []primitive.ObjectID{sessionID},
+		}
 		update = bson.M{
-			"$set": bson.M{ // only login with 1 device
-				"sessions": []primitive.ObjectID{sessionID},
+			"$push": bson.M{
+				"sessions": each,
 			},
 		}
 	)
-	if _, err := ins.co.UpdateOne(ctx, filter, update, nil); err != nil {
+	if maxSessions > 0 {
+		if evict {
+			each["$slice"] = -maxSessions
+		} else {
+			// the array has fewer than maxSessions elements
+			filter[fmt.Sprintf("sessions.%d", maxSessions-1)] = bson.M{"$exists": false}
+		}
+	}
+	r, err := ins.co.UpdateOne(ctx, filter, update, nil)
+	if err != nil {
 		return err
-	} else {
-		return nil
 	}
+	if r.MatchedCount == 0 {
+		return store.ErrSessionLimit
+	}
+	return nil
+}
+
+func (ins *User) SetMaxSessions(ctx context.Context, id primitive.ObjectID, maxSessions int) error {
+	var (
+		update = bson.M{
+			"$set": bson.M{
+				"max_sessions": maxSessions,
+			},
+		}
+	)
+	_, err := ins.co.UpdateByID(ctx, id, update)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
 func (ins *User) RevokeSession(ctx context.Context, uuid, sessionID primitive.ObjectID) error {
@@ -106,6 +168,22 @@ func (ins *User) RevokeSession(ctx context.Context, uuid, sessionID primitive.Ob
 	}
 }
 
+// RevokeOtherSessions : drop every session of the user except keep
+func (ins *User) RevokeOtherSessions(ctx context.Context, uuid, keep primitive.ObjectID) error {
+	var (
+		update = bson.M{
+			"$pull": bson.M{
+				"sessions": bson.M{"$ne": keep},
+			},
+		}
+	)
+	if _, err := ins.co.UpdateByID(ctx, uuid, update, nil); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
 func (ins *User) ValidateSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
 	var (
 		filter = bson.M{
@@ -119,11 +197,11 @@ func (ins *User) ValidateSession(ctx context.Context, sessionID primitive.Object
 	return n > 0, nil
 }
 
-func (ins *User) ChangePassword(ctx context.Context, id primitive.ObjectID, pwd string) error {
+func (ins *User) ChangePassword(ctx context.Context, id primitive.ObjectID, passwordHash string) error {
 	var (
 		update = bson.M{
 			"$set": bson.M{
-				"password": pwd,
+				"password": passwordHash,
 			},
 		}
 	)
@@ -138,7 +216,8 @@ func (ins *User) UpdateMfaSecret(ctx context.Context, id primitive.ObjectID, sec
 	var (
 		update = bson.M{
 			"$set": bson.M{
-				"mfa_secret": secret,
+				"mfa_secret":    secret,
+				"mfa_last_step": int64(0), // a new enrollment starts without used codes
 			},
 		}
 	)
@@ -149,6 +228,32 @@ func (ins *User) UpdateMfaSecret(ctx context.Context, id primitive.ObjectID, sec
 	return nil
 }
 
+// UseOTPStep : record the TOTP time step of an accepted code. The filter only
+// matches while the stored step is lower and the secret is unchanged, so a code
+// is accepted at most once even when several instances verify it concurrently.
+func (ins *User) UseOTPStep(ctx context.Context, id primitive.ObjectID, secret string, step int64) (bool, error) {
+	var (
+		filter = bson.M{
+			"_id":        id,
+			"mfa_secret": secret,
+			"$or": bson.A{
+				bson.M{"mfa_last_step": bson.M{"$lt": step}},
+				bson.M{"mfa_last_step": bson.M{"$exists": false}},
+			},
+		}
+		update = bson.M{
+			"$set": bson.M{
+				"mfa_last_step": step,
+			},
+		}
+	)
+	r, err := ins.co.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return r.MatchedCount > 0, nil
+}
+
 func (ins *User) UpdateMfaActive(ctx context.Context, id primitive.ObjectID, active bool) error {
 
 	var (
@@ -164,3 +269,120 @@ func (ins *User) UpdateMfaActive(ctx context.Context, id primitive.ObjectID, act
 	}
 	return nil
 }
+
+func (ins *User) SetRecoveryCodes(ctx context.Context, id primitive.ObjectID, hashes []string) error {
+	var (
+		update = bson.M{
+			"$set": bson.M{
+				"recovery_codes": hashes,
+			},
+		}
+	)
+	_, err := ins.co.UpdateByID(ctx, id, update)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UseRecoveryCode : remove the code in a single update so it can be used only once,
+// used is false when the user has no such code
+func (ins *User) UseRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) (bool, error) {
+	var (
+		filter = bson.M{
+			"_id":            id,
+			"recovery_codes": hash,
+		}
+		update = bson.M{
+			"$pull": bson.M{
+				"recovery_codes": hash,
+			},
+		}
+	)
+	r, err := ins.co.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return r.ModifiedCount > 0, nil
+}
+
+// AddPasskey : append a credential unless its ID is already registered to the user
+func (ins *User) AddPasskey(ctx context.Context, id primitive.ObjectID, passkey models.PasskeyModel) error {
+	var (
+		filter = bson.M{
+			"_id":                    id,
+			"passkeys.credential_id": bson.M{"$ne": passkey.CredentialID},
+		}
+		update = bson.M{
+			"$push": bson.M{
+				"passkeys": passkey,
+			},
+		}
+	)
+	r, err := ins.co.UpdateOne(ctx, filter, update)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return store.ErrPasskeyExists
+		}
+		return err
+	}
+	if r.MatchedCount == 0 {
+		return store.ErrPasskeyExists
+	}
+	return nil
+}
+
+func (ins *User) FindByPasskey(ctx context.Context, credentialID []byte) (*models.UserModel, error) {
+	var (
+		filter = bson.M{"passkeys.credential_id": credentialID}
+		tmp    models.UserModel
+	)
+	if err := ins.co.FindOne(ctx, filter).Decode(&tmp); err != nil {
+		return nil, err
+	}
+	return &tmp, nil
+}
+
+// UpdatePasskeySignCount : store the counter of a successful assertion. The update only
+// applies while the stored counter is lower, so a regression that races another
+// login is still detected; authenticators without a counter always report 0.
+func (ins *User) UpdatePasskeySignCount(ctx context.Context, id primitive.ObjectID, credentialID []byte, signCount uint32) (bool, error) {
+	var (
+		match = bson.M{"credential_id": credentialID, "sign_count": bson.M{"$lt": signCount}}
+	)
+	if signCount == 0 {
+		match["sign_count"] = 0
+	}
+	var (
+		filter = bson.M{
+			"_id":      id,
+			"passkeys": bson.M{"$elemMatch": match},
+		}
+		update = bson.M{
+			"$set": bson.M{
+				"passkeys.$.sign_count":   signCount,
+				"passkeys.$.last_used_at": time.Now(),
+			},
+		}
+	)
+	r, err := ins.co.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return r.MatchedCount > 0, nil
+}
+
+func (ins *User) RemovePasskey(ctx context.Context, id primitive.ObjectID, credentialID []byte) (bool, error) {
+	var (
+		update = bson.M{
+			"$pull": bson.M{
+				"passkeys": bson.M{"credential_id": credentialID},
+			},
+		}
+	)
+	r, err := ins.co.UpdateByID(ctx, id, update)
+	if err != nil {
+		return false, err
+	}
+	return r.ModifiedCount > 0, nil
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"app/internal/lib/database"
+	"app/internal/mongodb/db/models"
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+type WebAuthnChallenge struct {
+	co *mongo.Collection
+}
+
+func NewWebAuthnChallenge(ctx context.Context, db *mongo.Database) (*WebAuthnChallenge, error) {
+	co, err := database.MongoInit(
+		ctx,
+		db,
+		"webauthn_challenges",
+		// abandoned ceremonies are deleted once they expire
+		database.MongoIndex{
+			Name: "expires_at_ttl",
+			Keys: bson.D{{Key: "expires_at", Value: 1}},
+			TTL:  true,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnChallenge{co: co}, nil
+}
+
+func (ins *WebAuthnChallenge) Create(ctx context.Context, challenge *models.WebAuthnChallengeModel) (primitive.ObjectID, error) {
+	challenge.ID = primitive.NewObjectID()
+	challenge.CreatedAt = time.Now()
+	if r, err := ins.co.InsertOne(ctx, challenge); err != nil {
+		return primitive.NilObjectID, err
+	} else {
+		return r.InsertedID.(primitive.ObjectID), nil
+	}
+}
+
+// Take : load and delete an unexpired challenge in one operation so every ceremony finishes at most once
+func (ins *WebAuthnChallenge) Take(ctx context.Context, id primitive.ObjectID, purpose string) (*models.WebAuthnChallengeModel, error) {
+	var (
+		filter = bson.M{
+			"_id":        id,
+			"purpose":    purpose,
+			"expires_at": bson.M{"$gt": time.Now()},
+		}
+		challenge models.WebAuthnChallengeModel
+	)
+	if err := ins.co.FindOneAndDelete(ctx, filter).Decode(&challenge); err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
@@ -0,0 +1,85 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"time"
+)
+
+const (
+	lockCollection = "schema_migrations_lock"
+	lockID         = "migrations"
+	// lockTTL : a lock not refreshed for this long belongs to a process that
+	// died, another one may take it over
+	lockTTL = time.Minute
+	// lockWait : how long Up waits for the lock held by another process
+	lockWait = 2 * lockTTL
+)
+
+// lock : a single document, the process whose owner it holds may migrate until
+// expires_at. Taking it is one upsert that only matches an expired lock, while
+// it is held the upsert fails on the duplicate _id.
+type lock struct {
+	co    *mongo.Collection
+	owner string
+}
+
+func newLock(db *mongo.Database) *lock {
+	host, _ := os.Hostname()
+	return &lock{
+		co:    db.Collection(lockCollection),
+		owner: fmt.Sprintf("%s/%d/%s", host, os.Getpid(), primitive.NewObjectID().Hex()),
+	}
+}
+
+// acquire : take the lock, waiting up to lockWait for the current owner
+func (ins *lock) acquire(ctx context.Context) error {
+	deadline := time.Now().Add(lockWait)
+	for {
+		now := time.Now()
+		_, err := ins.co.UpdateOne(ctx,
+			bson.M{"_id": lockID, "expires_at": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"owner": ins.owner, "locked_at": now, "expires_at": now.Add(lockTTL)}},
+			options.Update().SetUpsert(true),
+		)
+		if err == nil {
+			return nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		if now.After(deadline) {
+			return ErrLocked
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// refresh : extend the lock, an error if it expired and another process took it
+func (ins *lock) refresh(ctx context.Context) error {
+	r, err := ins.co.UpdateOne(ctx,
+		bson.M{"_id": lockID, "owner": ins.owner},
+		bson.M{"$set": bson.M{"expires_at": time.Now().Add(lockTTL)}},
+	)
+	if err != nil {
+		return err
+	}
+	if r.MatchedCount == 0 {
+		return ErrLocked
+	}
+	return nil
+}
+
+func (ins *lock) release(ctx context.Context) error {
+	_, err := ins.co.DeleteOne(ctx, bson.M{"_id": lockID, "owner": ins.owner})
+	return err
+}
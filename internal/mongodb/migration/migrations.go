@@ -0,0 +1,218 @@
+package migration
+
+import (
+	"app/internal/password"
+	"app/internal/store"
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"strings"
+)
+
+// Options : the settings some migrations depend on
+type Options struct {
+	// SessionLifetime gives the sessions stored without an expiry one
+	SessionLifetime store.SessionLifetime
+}
+
+// All : the migrations of the collections, in order. A new one is appended
+// with the next version, an applied one is never changed.
+func All(opts Options) []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "hash plaintext passwords",
+			Up:          hashPlaintextPasswords,
+		},
+		{
+			Version:     2,
+			Description: "set the expiry of sessions created without one",
+			Up: func(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+				return expireSessions(ctx, db, dryRun, opts.SessionLifetime)
+			},
+		},
+		{
+			Version:     3,
+			Description: "lower-case usernames",
+			Up:          lowerCaseUsernames,
+		},
+		{
+			Version:     4,
+			Description: "unset the null arrays of users",
+			Up:          unsetNullArrays,
+		},
+	}
+}
+
+// hashPlaintextPasswords : users created before passwords were hashed keep
+// their password in plain text until their next login rehashes it. Each one is
+// hashed here and replaced only if it is still the plaintext one.
+func hashPlaintextPasswords(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+	var (
+		co = db.Collection("users")
+		// an empty password can not be hashed, the dry run must not count it
+		filter = bson.M{"password": bson.M{
+			"$type": "string",
+			"$ne":   "",
+			"$not":  primitive.Regex{Pattern: `^\$(argon2id|2a|2b|2y)\$`},
+		}}
+	)
+	if dryRun {
+		return co.CountDocuments(ctx, filter)
+	}
+	cursor, err := co.Find(ctx, filter, options.Find().SetProjection(bson.M{"password": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	var changed int64
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			Password string             `bson:"password"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return changed, err
+		}
+		// the regex and IsEncoded agree, a hash is never hashed again
+		if len(doc.Password) == 0 || password.IsEncoded(doc.Password) {
+			continue
+		}
+		hash, err := password.Hash(doc.Password)
+		if err != nil {
+			return changed, err
+		}
+		r, err := co.UpdateOne(ctx,
+			bson.M{"_id": doc.ID, "password": doc.Password},
+			bson.M{"$set": bson.M{"password": hash}},
+		)
+		if err != nil {
+			return changed, err
+		}
+		changed += r.ModifiedCount
+	}
+	return changed, cursor.Err()
+}
+
+// expireSessions : sessions created before they had an expiry never end and
+// are never deleted. They get the one of the current lifetime, computed from
+// their own timestamps; nothing changes when the lifetime has no limit.
+func expireSessions(ctx context.Context, db *mongo.Database, dryRun bool, lifetime store.SessionLifetime) (int64, error) {
+	var (
+		co     = db.Collection("login_sessions")
+		filter = bson.M{"expires_at": bson.M{"$exists": false}, "revoked_at": bson.M{"$exists": false}}
+		limits = bson.A{}
+	)
+	if lifetime.IdleTimeout > 0 {
+		// sessions older than last_used_at count as idle since their creation,
+		// $add of a missing field is null and $min would skip the limit
+		lastUsed := bson.M{"$ifNull": bson.A{"$last_used_at", "$created_at"}}
+		limits = append(limits, bson.M{"$add": bson.A{lastUsed, lifetime.IdleTimeout.Milliseconds()}})
+	}
+	if lifetime.MaxLifetime > 0 {
+		limits = append(limits, bson.M{"$add": bson.A{"$created_at", lifetime.MaxLifetime.Milliseconds()}})
+	}
+	if len(limits) == 0 {
+		return 0, nil
+	}
+	if dryRun {
+		return co.CountDocuments(ctx, filter)
+	}
+	// an update pipeline computes the expiry of each session from its fields
+	r, err := co.UpdateMany(ctx, filter, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"expires_at": bson.M{"$min": limits}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return r.ModifiedCount, nil
+}
+
+// lowerCaseUsernames : logins look usernames up lower-cased and trimmed, the
+// ones stored before are rewritten that way. A username whose normalized form
+// belongs to another account too is left as it is and logged, the accounts
+// must be merged or renamed by hand.
+func lowerCaseUsernames(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+	var (
+		co     = db.Collection("users")
+		filter = bson.M{"username": primitive.Regex{Pattern: `[A-Z]|^\s|\s$`}}
+	)
+	cursor, err := co.Find(ctx, filter, options.Find().SetProjection(bson.M{"username": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var docs []struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		Username string             `bson:"username"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return 0, err
+	}
+	// several accounts may normalize to the same username
+	normalized := make(map[string]int, len(docs))
+	for _, doc := range docs {
+		normalized[strings.ToLower(strings.TrimSpace(doc.Username))]++
+	}
+	var changed int64
+	for _, doc := range docs {
+		username := strings.ToLower(strings.TrimSpace(doc.Username))
+		taken, err := co.CountDocuments(ctx, bson.M{"_id": bson.M{"$ne": doc.ID}, "username": username})
+		if err != nil {
+			return changed, err
+		}
+		if taken > 0 || normalized[username] > 1 {
+			log.Printf("Log-Error: Username `%s` of user %s collides with another account as `%s`, left unchanged\r\n",
+				doc.Username, doc.ID.Hex(), username)
+			continue
+		}
+		if dryRun {
+			changed++
+			continue
+		}
+		r, err := co.UpdateOne(ctx,
+			bson.M{"_id": doc.ID, "username": doc.Username},
+			bson.M{"$set": bson.M{"username": username}},
+		)
+		if err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				// registered meanwhile
+				log.Printf("Log-Error: Username `%s` of user %s collides with another account as `%s`, left unchanged\r\n",
+					doc.Username, doc.ID.Hex(), username)
+				continue
+			}
+			return changed, err
+		}
+		changed += r.ModifiedCount
+	}
+	return changed, nil
+}
+
+// unsetNullArrays : users were inserted with null for their empty arrays, on
+// which $push and $pull fail. The field is removed, the first $push creates it.
+// Each field of each user counts as one change.
+func unsetNullArrays(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+	var (
+		co      = db.Collection("users")
+		changed int64
+	)
+	for _, field := range []string{"sessions", "recovery_codes", "passkeys"} {
+		filter := bson.M{field: bson.M{"$type": "null"}}
+		if dryRun {
+			n, err := co.CountDocuments(ctx, filter)
+			if err != nil {
+				return changed, err
+			}
+			changed += n
+			continue
+		}
+		r, err := co.UpdateMany(ctx, filter, bson.M{"$unset": bson.M{field: ""}})
+		if err != nil {
+			return changed, err
+		}
+		changed += r.ModifiedCount
+	}
+	return changed, nil
+}
@@ -0,0 +1,229 @@
+package migration
+
+import (
+	"app/internal/password"
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"testing"
+	"time"
+)
+
+// testDatabase : a database of its own on the server of STORE_TEST_MONGO_URI,
+// dropped after the test
+func testDatabase(t *testing.T) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("STORE_TEST_MONGO_URI")
+	if len(uri) == 0 {
+		t.Skip("STORE_TEST_MONGO_URI is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database("migrationtest_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		ctx := context.Background()
+		_ = db.Drop(ctx)
+		_ = client.Disconnect(ctx)
+	})
+	return db
+}
+
+// insertUsers : one user per document, returning their ids in order
+func insertUsers(t *testing.T, db *mongo.Database, docs ...bson.M) []primitive.ObjectID {
+	t.Helper()
+	ids := make([]primitive.ObjectID, len(docs))
+	for i, doc := range docs {
+		ids[i] = primitive.NewObjectID()
+		doc["_id"] = ids[i]
+		if _, err := db.Collection("users").InsertOne(context.Background(), doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+func userField(t *testing.T, db *mongo.Database, id primitive.ObjectID, field string) interface{} {
+	t.Helper()
+	var doc bson.M
+	if err := db.Collection("users").FindOne(context.Background(), bson.M{"_id": id}).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc[field]
+}
+
+func TestHashPlaintextPasswords(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = testDatabase(t)
+	)
+	argon2id, err := password.Hash("argon2id password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := insertUsers(t, db,
+		bson.M{"username": "plain", "password": "plaintext password"},
+		bson.M{"username": "argon2id", "password": argon2id},
+		bson.M{"username": "bcrypt", "password": string(bcryptHash)},
+		bson.M{"username": "empty", "password": ""},
+		bson.M{"username": "passkey-only"},
+	)
+
+	if changed, err := hashPlaintextPasswords(ctx, db, true); err != nil || changed != 1 {
+		t.Fatalf("dry run: %d %v", changed, err)
+	}
+	if stored := userField(t, db, ids[0], "password"); stored != "plaintext password" {
+		t.Fatalf("dry run changed the password to %v", stored)
+	}
+	if changed, err := hashPlaintextPasswords(ctx, db, false); err != nil || changed != 1 {
+		t.Fatalf("run: %d %v", changed, err)
+	}
+	hashed, _ := userField(t, db, ids[0], "password").(string)
+	if ok, _, err := password.Verify("plaintext password", hashed); !password.IsEncoded(hashed) || !ok || err != nil {
+		t.Fatalf("hashed password %q: %v %v", hashed, ok, err)
+	}
+	// an encoded password is never hashed again
+	for i, want := range []interface{}{argon2id, string(bcryptHash), "", nil} {
+		if stored := userField(t, db, ids[i+1], "password"); stored != want {
+			t.Fatalf("password of user %d changed to %v", i+1, stored)
+		}
+	}
+
+	// a second run finds nothing left, the hash stays the one verified above
+	if changed, err := hashPlaintextPasswords(ctx, db, false); err != nil || changed != 0 {
+		t.Fatalf("second run: %d %v", changed, err)
+	}
+	if again := userField(t, db, ids[0], "password"); again != hashed {
+		t.Fatalf("hash replaced by the second run: %v", again)
+	}
+}
+
+func TestLowerCaseUsernames(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = testDatabase(t)
+		ids = insertUsers(t, db,
+			bson.M{"username": "Alice"},
+			bson.M{"username": " bob "},
+			// collides with an account already lower-cased
+			bson.M{"username": "Carol"},
+			bson.M{"username": "carol"},
+			// collide with each other
+			bson.M{"username": "Dave"},
+			bson.M{"username": "DAVE "},
+			bson.M{"username": "erin"},
+		)
+		want = []string{"alice", "bob", "Carol", "carol", "Dave", "DAVE ", "erin"}
+	)
+	if changed, err := lowerCaseUsernames(ctx, db, true); err != nil || changed != 2 {
+		t.Fatalf("dry run: %d %v", changed, err)
+	}
+	if stored := userField(t, db, ids[0], "username"); stored != "Alice" {
+		t.Fatalf("dry run changed the username to %v", stored)
+	}
+	if changed, err := lowerCaseUsernames(ctx, db, false); err != nil || changed != 2 {
+		t.Fatalf("run: %d %v", changed, err)
+	}
+	for i, username := range want {
+		if stored := userField(t, db, ids[i], "username"); stored != username {
+			t.Fatalf("username %d: %v, want %s", i, stored, username)
+		}
+	}
+
+	// the collisions are left for an operator, a second run changes nothing
+	if changed, err := lowerCaseUsernames(ctx, db, false); err != nil || changed != 0 {
+		t.Fatalf("second run: %d %v", changed, err)
+	}
+	for i, username := range want {
+		if stored := userField(t, db, ids[i], "username"); stored != username {
+			t.Fatalf("username %d after the second run: %v, want %s", i, stored, username)
+		}
+	}
+}
+
+// TestMigratorUpTwice : applied migrations are recorded and not run again
+func TestMigratorUpTwice(t *testing.T) {
+	var (
+		ctx = context.Background()
+		db  = testDatabase(t)
+	)
+	insertUsers(t, db, bson.M{"username": "Alice", "password": "plaintext password"})
+	migrator, err := NewMigrator(db, All(Options{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := migrator.Up(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(All(Options{})) {
+		t.Fatalf("first run applied %+v", done)
+	}
+	if again, err := migrator.Up(ctx, false); err != nil || len(again) != 0 {
+		t.Fatalf("second run applied %+v: %v", again, err)
+	}
+	status, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if !s.Applied() {
+			t.Fatalf("migration %d not recorded", s.Version)
+		}
+	}
+}
+
+func TestUnsetNullArrays(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		db      = testDatabase(t)
+		session = primitive.NewObjectID()
+		ids     = insertUsers(t, db,
+			bson.M{"username": "registered", "sessions": nil, "recovery_codes": nil, "passkeys": nil},
+			bson.M{"username": "signed-in", "sessions": bson.A{session}, "passkeys": nil},
+			bson.M{"username": "new"},
+		)
+	)
+	if changed, err := unsetNullArrays(ctx, db, true); err != nil || changed != 4 {
+		t.Fatalf("dry run: %d %v", changed, err)
+	}
+	if changed, err := unsetNullArrays(ctx, db, false); err != nil || changed != 4 {
+		t.Fatalf("run: %d %v", changed, err)
+	}
+	for _, field := range []string{"sessions", "recovery_codes", "passkeys"} {
+		n, err := db.Collection("users").CountDocuments(ctx, bson.M{field: bson.M{"$exists": true}, "_id": bson.M{"$ne": ids[1]}})
+		if err != nil || n != 0 {
+			t.Fatalf("%s left on %d users: %v", field, n, err)
+		}
+		if n, err := db.Collection("users").CountDocuments(ctx, bson.M{field: bson.M{"$type": "null"}}); err != nil || n != 0 {
+			t.Fatalf("%s null on %d users: %v", field, n, err)
+		}
+	}
+	var signedIn struct {
+		Sessions []primitive.ObjectID `bson:"sessions"`
+	}
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": ids[1]}).Decode(&signedIn); err != nil {
+		t.Fatal(err)
+	}
+	if len(signedIn.Sessions) != 1 || signedIn.Sessions[0] != session {
+		t.Fatalf("sessions of the signed in user %v", signedIn.Sessions)
+	}
+	// the null is gone, a login can push its session
+	if _, err := db.Collection("users").UpdateByID(ctx, ids[0], bson.M{"$push": bson.M{"sessions": session}}); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := unsetNullArrays(ctx, db, false); err != nil || changed != 0 {
+		t.Fatalf("second run: %d %v", changed, err)
+	}
+}
@@ -0,0 +1,169 @@
+// Package migration changes the documents already stored when a model changes.
+// Migrations run in the order of their version, each one once, and are
+// recorded in the schema_migrations collection.
+package migration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"sort"
+	"time"
+)
+
+const collectionName = "schema_migrations"
+
+// Migration : one change of the stored documents. Up must be idempotent, a
+// migration interrupted before it was recorded runs again from the start. With
+// dryRun it changes nothing and returns how many documents it would change.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database, dryRun bool) (changed int64, err error)
+}
+
+// Status : a migration and, once applied, when and how many documents it changed
+type Status struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at,omitempty"`
+	Changed     int64     `bson:"changed"`
+}
+
+func (s Status) Applied() bool {
+	return !s.AppliedAt.IsZero()
+}
+
+type Migrator struct {
+	db         *mongo.Database
+	co         *mongo.Collection
+	migrations []Migration
+	lock       *lock
+}
+
+// NewMigrator : migrations may be given in any order, their versions must be
+// positive and unique
+func NewMigrator(db *mongo.Database, migrations []Migration) (*Migrator, error) {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	for i, m := range sorted {
+		if m.Version <= 0 {
+			return nil, fmt.Errorf("migration %d: version must be positive", m.Version)
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, fmt.Errorf("migration %d: version used twice", m.Version)
+		}
+		if m.Up == nil {
+			return nil, fmt.Errorf("migration %d: no Up", m.Version)
+		}
+	}
+	return &Migrator{
+		db:         db,
+		co:         db.Collection(collectionName),
+		migrations: sorted,
+		lock:       newLock(db),
+	}, nil
+}
+
+// Status : every known migration in order, also the applied ones that are no
+// longer known to this binary
+func (ins *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := ins.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Status, 0, len(ins.migrations))
+	for _, m := range ins.migrations {
+		if s, ok := applied[m.Version]; ok {
+			list = append(list, s)
+			delete(applied, m.Version)
+			continue
+		}
+		list = append(list, Status{Version: m.Version, Description: m.Description})
+	}
+	for _, s := range applied {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Version < list[j].Version
+	})
+	return list, nil
+}
+
+// Up : apply the pending migrations in order and return them with the number
+// of documents each changed. The lock is held meanwhile, a replica starting at
+// the same time waits for it and then finds nothing left to do. A dry run only
+// counts, each migration sees the data as it is now and not as the previous
+// pending ones would leave it.
+func (ins *Migrator) Up(ctx context.Context, dryRun bool) ([]Status, error) {
+	if dryRun {
+		return ins.up(ctx, true)
+	}
+	if err := ins.lock.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := ins.lock.release(context.Background()); err != nil {
+			log.Printf("Log-Error: %+v\r\n", err)
+		}
+	}()
+	return ins.up(ctx, false)
+}
+
+func (ins *Migrator) up(ctx context.Context, dryRun bool) ([]Status, error) {
+	applied, err := ins.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done := []Status{}
+	for _, m := range ins.migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if !dryRun {
+			// the lock expires, a long run must keep it
+			if err := ins.lock.refresh(ctx); err != nil {
+				return done, err
+			}
+		}
+		changed, err := m.Up(ctx, ins.db, dryRun)
+		if err != nil {
+			return done, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		s := Status{Version: m.Version, Description: m.Description, Changed: changed}
+		if !dryRun {
+			s.AppliedAt = time.Now()
+			if _, err := ins.co.InsertOne(ctx, s); err != nil {
+				return done, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+			}
+			log.Printf("Log-Debug: Migration %d `%s` applied, %d documents changed\r\n", m.Version, m.Description, changed)
+		}
+		done = append(done, s)
+	}
+	return done, nil
+}
+
+func (ins *Migrator) applied(ctx context.Context) (map[int]Status, error) {
+	cursor, err := ins.co.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var list []Status
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]Status, len(list))
+	for _, s := range list {
+		applied[s.Version] = s
+	}
+	return applied, nil
+}
+
+// ErrLocked : another replica held the lock for longer than the wait
+var ErrLocked = errors.New("migrations are locked by another process")
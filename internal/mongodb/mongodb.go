@@ -3,27 +3,107 @@ package mongodb
 import (
 	"app/internal/lib/database"
 	"app/internal/mongodb/db"
+	"app/internal/mongodb/migration"
+	"app/internal/store"
+	"context"
+	"go.mongodb.org/mongo-driver/mongo"
 	"time"
 )
 
-var Conn = new(DB)
-
 type DB struct {
-	Session *db.LoginSession
-	User    *db.User
-}
+	Session  *db.LoginSession
+	User     *db.User
+	WebAuthn *db.WebAuthnChallenge
+	Attempt  *db.LoginAttempt
+	Keys     *db.SigningKey
+	OAuth    *db.Authorization
+	Clients  *db.Client
+	Tx       *Transactions
 
-func (ins *DB) Init(uri, dbName string, timeout time.Duration) {
-	Conn = newConn(uri, dbName, timeout)
+	database *mongo.Database
 }
 
-func newConn(uri, dbName string, timeout time.Duration) *DB {
+// DefaultIndexTimeout : how long Connect waits for the indexes to be built
+const DefaultIndexTimeout = 10 * time.Minute
+
+// Connect : open the database within timeout and make its collections with
+// their indexes, failing when a unique index can not be built. Building an index
+// on a large collection takes longer than connecting, the builds have
+// indexTimeout, DefaultIndexTimeout when zero. The login attempts are deleted
+// attemptRetention after their last failure.
+func Connect(uri, dbName string, timeout, indexTimeout, attemptRetention time.Duration) (*DB, error) {
 	connection, err := database.MongoConnect(uri, dbName, timeout)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ins := &DB{
+		Tx:       newTransactions(ctx, connection),
+		database: connection,
+	}
+	if indexTimeout <= 0 {
+		indexTimeout = DefaultIndexTimeout
+	}
+	indexCtx, cancelIndex := context.WithTimeout(context.Background(), indexTimeout)
+	defer cancelIndex()
+	if err := ins.collections(indexCtx, attemptRetention); err != nil {
+		_ = connection.Client().Disconnect(context.Background())
+		return nil, err
+	}
+	return ins, nil
+}
+
+func (ins *DB) collections(ctx context.Context, attemptRetention time.Duration) error {
+	var err error
+	if ins.Session, err = db.NewLoginSession(ctx, ins.database); err != nil {
+		return err
+	}
+	if ins.User, err = db.NewUser(ctx, ins.database); err != nil {
+		return err
+	}
+	if ins.WebAuthn, err = db.NewWebAuthnChallenge(ctx, ins.database); err != nil {
+		return err
 	}
-	return &DB{
-		db.NewLoginSession(connection),
-		db.NewUser(connection),
+	if ins.Attempt, err = db.NewLoginAttempt(ctx, ins.database, attemptRetention); err != nil {
+		return err
 	}
+	if ins.Keys, err = db.NewSigningKey(ctx, ins.database); err != nil {
+		return err
+	}
+	if ins.OAuth, err = db.NewAuthorization(ctx, ins.database); err != nil {
+		return err
+	}
+	if ins.Clients, err = db.NewClient(ctx, ins.database); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Store : the collections behind the store interfaces, without transactions
+// on a standalone server
+func (ins *DB) Store() *store.DB {
+	db := &store.DB{
+		Session:  ins.Session,
+		User:     ins.User,
+		WebAuthn: ins.WebAuthn,
+		Attempt:  ins.Attempt,
+		Keys:     ins.Keys,
+		OAuth:    ins.OAuth,
+		Clients:  ins.Clients,
+	}
+	if ins.Tx.supported {
+		db.Tx = ins.Tx
+	}
+	return db
+}
+
+// Migrator : the migrations of the collections, run against this database
+func (ins *DB) Migrator(opts migration.Options) (*migration.Migrator, error) {
+	return migration.NewMigrator(ins.database, migration.All(opts))
+}
+
+// Close : disconnect the client opened by Connect
+func (ins *DB) Close(ctx context.Context) error {
+	return ins.database.Client().Disconnect(ctx)
 }
@@ -0,0 +1,32 @@
+package mongodb
+
+import (
+	"app/internal/store"
+	"app/internal/store/storetest"
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestStore : runs against the server of STORE_TEST_MONGO_URI, each test in a
+// database of its own
+func TestStore(t *testing.T) {
+	uri := os.Getenv("STORE_TEST_MONGO_URI")
+	if len(uri) == 0 {
+		t.Skip("STORE_TEST_MONGO_URI is not set")
+	}
+	storetest.Run(t, func(t *testing.T) *store.DB {
+		db, err := Connect(uri, "storetest_"+primitive.NewObjectID().Hex(), 10*time.Second, time.Minute, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			ctx := context.Background()
+			_ = db.database.Drop(ctx)
+			_ = db.Close(ctx)
+		})
+		return db.Store()
+	})
+}
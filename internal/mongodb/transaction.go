@@ -0,0 +1,57 @@
+package mongodb
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+)
+
+// Transactions : multi-document transactions of the client. Only a replica set
+// or a sharded cluster has them; on a standalone server fn runs without one,
+// each write applied on its own, and a failure half way leaves the earlier
+// writes in place. Run a single node replica set (`mongod --replSet rs0`,
+// then `rs.initiate()`) to get them in development.
+type Transactions struct {
+	client    *mongo.Client
+	supported bool
+}
+
+// newTransactions : ask the server what it is, `hello` reports a setName for a
+// replica set member and msg "isdbgrid" for a mongos
+func newTransactions(ctx context.Context, db *mongo.Database) *Transactions {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	ins := &Transactions{client: db.Client()}
+	if err := db.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		// servers before 4.4.2 only know the legacy name
+		if err := db.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello); err != nil {
+			log.Printf("Log-Error: %+v\r\n", err)
+			return ins
+		}
+	}
+	ins.supported = len(hello.SetName) > 0 || hello.Msg == "isdbgrid"
+	if !ins.supported {
+		log.Printf("Log-Debug: Standalone server, writes to several collections are not transactional\r\n")
+	}
+	return ins
+}
+
+// InTransaction : fn in a transaction, retried by the driver on transient
+// errors. Called within one, fn joins it.
+func (ins *Transactions) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !ins.supported || mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+	session, err := ins.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
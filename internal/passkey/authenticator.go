@@ -0,0 +1,225 @@
+// Package passkey provides a software WebAuthn authenticator so registration and
+// assertion ceremonies can be exercised without hardware or a browser.
+package passkey
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"strings"
+	"sync"
+)
+
+const (
+	flagUserPresent  byte = 0x01
+	flagUserVerified byte = 0x04
+	flagAttestedData byte = 0x40
+)
+
+var ErrNoCredential = errors.New("passkey: no matching credential")
+
+// SoftAuthenticator : an ES256 authenticator that keeps its keys in memory and
+// returns "none" attestation
+type SoftAuthenticator struct {
+	Origin string
+	AAGUID [16]byte
+
+	mu          sync.Mutex
+	credentials []*softCredential
+}
+
+type softCredential struct {
+	id         []byte
+	key        *ecdsa.PrivateKey
+	rpID       string
+	userHandle []byte
+	signCount  uint32
+}
+
+func NewSoftAuthenticator(origin string) *SoftAuthenticator {
+	return &SoftAuthenticator{Origin: origin}
+}
+
+// Register : answer navigator.credentials.create() with a new credential
+func (ins *SoftAuthenticator) Register(options *protocol.CredentialCreation) (*protocol.CredentialCreationResponse, error) {
+	var (
+		opts = options.Response
+		cred = &softCredential{
+			id:   make([]byte, 32),
+			rpID: opts.RelyingParty.ID,
+		}
+		err error
+	)
+	if _, err = rand.Read(cred.id); err != nil {
+		return nil, err
+	}
+	if cred.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return nil, err
+	}
+	if cred.userHandle, err = userHandle(opts.User.ID); err != nil {
+		return nil, err
+	}
+	clientData, err := ins.clientData(protocol.CreateCeremony, opts.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := webauthncbor.Marshal(map[int]interface{}{
+		1:  int(webauthncose.EllipticKey),
+		3:  int(webauthncose.AlgES256),
+		-1: int(webauthncose.P256),
+		-2: cred.key.X.FillBytes(make([]byte, 32)),
+		-3: cred.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// attested credential data: aaguid | credentialIdLength | credentialId | publicKey
+	attested := bytes.NewBuffer(append([]byte{}, ins.AAGUID[:]...))
+	_ = binary.Write(attested, binary.BigEndian, uint16(len(cred.id)))
+	attested.Write(cred.id)
+	attested.Write(publicKey)
+
+	authData := authenticatorData(cred.rpID, flagUserPresent|flagUserVerified|flagAttestedData, cred.signCount, attested.Bytes())
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ins.mu.Lock()
+	ins.credentials = append(ins.credentials, cred)
+	ins.mu.Unlock()
+
+	return &protocol.CredentialCreationResponse{
+		PublicKeyCredential: protocol.PublicKeyCredential{
+			Credential: protocol.Credential{
+				ID:   base64.RawURLEncoding.EncodeToString(cred.id),
+				Type: string(protocol.PublicKeyCredentialType),
+			},
+			RawID: cred.id,
+		},
+		AttestationResponse: protocol.AuthenticatorAttestationResponse{
+			AuthenticatorResponse: protocol.AuthenticatorResponse{ClientDataJSON: clientData},
+			AttestationObject:     attestation,
+		},
+	}, nil
+}
+
+// Assert : answer navigator.credentials.get(), an empty allow list selects any
+// credential for the relying party as a discoverable credential would
+func (ins *SoftAuthenticator) Assert(options *protocol.CredentialAssertion) (*protocol.CredentialAssertionResponse, error) {
+	opts := options.Response
+
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	cred := ins.find(opts.RelyingPartyID, opts.AllowedCredentials)
+	if cred == nil {
+		return nil, ErrNoCredential
+	}
+	clientData, err := ins.clientData(protocol.AssertCeremony, opts.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	cred.signCount++
+	authData := authenticatorData(cred.rpID, flagUserPresent|flagUserVerified, cred.signCount, nil)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, cred.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocol.CredentialAssertionResponse{
+		PublicKeyCredential: protocol.PublicKeyCredential{
+			Credential: protocol.Credential{
+				ID:   base64.RawURLEncoding.EncodeToString(cred.id),
+				Type: string(protocol.PublicKeyCredentialType),
+			},
+			RawID: cred.id,
+		},
+		AssertionResponse: protocol.AuthenticatorAssertionResponse{
+			AuthenticatorResponse: protocol.AuthenticatorResponse{ClientDataJSON: clientData},
+			AuthenticatorData:     authData,
+			Signature:             signature,
+			UserHandle:            cred.userHandle,
+		},
+	}, nil
+}
+
+// SetSignCount : rewind or advance a credential's counter, e.g. to simulate a cloned authenticator
+func (ins *SoftAuthenticator) SetSignCount(credentialID []byte, signCount uint32) error {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	for _, cred := range ins.credentials {
+		if bytes.Equal(cred.id, credentialID) {
+			cred.signCount = signCount
+			return nil
+		}
+	}
+	return ErrNoCredential
+}
+
+func (ins *SoftAuthenticator) find(rpID string, allowed []protocol.CredentialDescriptor) *softCredential {
+	for _, cred := range ins.credentials {
+		if len(rpID) > 0 && cred.rpID != rpID {
+			continue
+		}
+		if len(allowed) == 0 {
+			return cred
+		}
+		for _, descriptor := range allowed {
+			if bytes.Equal(descriptor.CredentialID, cred.id) {
+				return cred
+			}
+		}
+	}
+	return nil
+}
+
+func (ins *SoftAuthenticator) clientData(ceremony protocol.CeremonyType, challenge protocol.URLEncodedBase64) ([]byte, error) {
+	return json.Marshal(protocol.CollectedClientData{
+		Type:      ceremony,
+		Challenge: challenge.String(),
+		Origin:    ins.Origin,
+	})
+}
+
+// authenticatorData : rpIdHash | flags | signCount | attestedCredentialData
+func authenticatorData(rpID string, flags byte, signCount uint32, attested []byte) []byte {
+	var (
+		rpIDHash = sha256.Sum256([]byte(rpID))
+		data     = bytes.NewBuffer(rpIDHash[:])
+	)
+	data.WriteByte(flags)
+	_ = binary.Write(data, binary.BigEndian, signCount)
+	data.Write(attested)
+	return data.Bytes()
+}
+
+// userHandle : the user id is bytes when the options come straight from the
+// relying party and a base64url string once they went through JSON
+func userHandle(id interface{}) ([]byte, error) {
+	switch v := id.(type) {
+	case protocol.URLEncodedBase64:
+		return v, nil
+	case []byte:
+		return v, nil
+	case string:
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+	default:
+		return nil, errors.New("passkey: user id invalid")
+	}
+}
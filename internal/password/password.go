@@ -0,0 +1,155 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+var (
+	ErrUnknownFormat = errors.New("password hash format unknown")
+	ErrInvalidHash   = errors.New("password hash invalid")
+)
+
+// Params : argon2id cost parameters, see RFC 9106 section 4
+type Params struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultParams is used for every new hash. Raising it makes Verify report
+// older hashes as needing a rehash.
+var DefaultParams = Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// dummyHash is verified against when the user does not exist so that unknown
+// usernames cost the same time as wrong passwords
+var dummyHash = func() string {
+	h, err := Hash("dummy-password-for-timing")
+	if err != nil {
+		panic(err)
+	}
+	return h
+}()
+
+// Hash : encode pwd as a PHC string
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func Hash(pwd string) (string, error) {
+	return hashWithParams(pwd, DefaultParams)
+}
+
+func hashWithParams(pwd string, p Params) (string, error) {
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pwd), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify : compare pwd against an argon2id or bcrypt hash in constant time.
+// needsRehash is true when the hash should be replaced by Hash(pwd). A value
+// that is not a hash at all is a password stored in plain text before passwords
+// were hashed, it is compared as it is and always needs a rehash.
+func Verify(pwd, encoded string) (ok, needsRehash bool, err error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return verifyArgon2id(pwd, encoded)
+	case strings.HasPrefix(encoded, "$2a$"),
+		strings.HasPrefix(encoded, "$2b$"),
+		strings.HasPrefix(encoded, "$2y$"):
+		if err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(pwd)); err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return false, false, nil
+			}
+			return false, false, err
+		}
+		// imported hashes are upgraded to argon2id on first successful login
+		return true, true, nil
+	case len(encoded) == 0 || strings.HasPrefix(encoded, "$"):
+		// a hash of another scheme, never compared as plain text
+		return false, false, ErrUnknownFormat
+	default:
+		ok := subtle.ConstantTimeCompare([]byte(pwd), []byte(encoded)) == 1
+		return ok, ok, nil
+	}
+}
+
+// IsEncoded : encoded is a hash Verify reads, anything else is not a hash at
+// all, e.g. a password stored in plain text
+func IsEncoded(encoded string) bool {
+	for _, prefix := range []string{"$argon2id$", "$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(encoded, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// DummyVerify : burn the same time as Verify for a user that does not exist
+func DummyVerify(pwd string) {
+	_, _, _ = Verify(pwd, dummyHash)
+}
+
+func verifyArgon2id(pwd, encoded string) (bool, bool, error) {
+	p, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	other := argon2.IDKey([]byte(pwd), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return false, false, nil
+	}
+	needsRehash := p.Memory != DefaultParams.Memory ||
+		p.Iterations != DefaultParams.Iterations ||
+		p.Parallelism != DefaultParams.Parallelism ||
+		p.SaltLength != DefaultParams.SaltLength ||
+		p.KeyLength != DefaultParams.KeyLength
+	return true, needsRehash, nil
+}
+
+func decodeArgon2id(encoded string) (p Params, salt, key []byte, err error) {
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrInvalidHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+	if version != argon2.Version {
+		return p, nil, nil, ErrInvalidHash
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+	if p.Iterations == 0 || p.Parallelism == 0 {
+		return p, nil, nil, ErrInvalidHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
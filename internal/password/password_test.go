@@ -0,0 +1,74 @@
+package password
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	current, err := Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	weaker := DefaultParams
+	weaker.Iterations = 1
+	older, err := hashWithParams("correct horse", weaker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		pwd         string
+		encoded     string
+		ok          bool
+		needsRehash bool
+		err         error
+	}{
+		{"argon2id", "correct horse", current, true, false, nil},
+		{"argon2id wrong password", "wrong horse", current, false, false, nil},
+		{"argon2id older params", "correct horse", older, true, true, nil},
+		{"argon2id older params wrong password", "wrong horse", older, false, false, nil},
+		{"argon2id truncated", "correct horse", "$argon2id$v=19$m=65536,t=3,p=2$c2FsdA", false, false, ErrInvalidHash},
+		{"argon2id other version", "correct horse", "$argon2id$v=16$m=65536,t=3,p=2$c2FsdA$a2V5", false, false, ErrInvalidHash},
+		{"argon2id no iterations", "correct horse", "$argon2id$v=19$m=65536,t=0,p=2$c2FsdA$a2V5", false, false, ErrInvalidHash},
+		{"bcrypt", "correct horse", string(imported), true, true, nil},
+		{"bcrypt wrong password", "wrong horse", string(imported), false, false, nil},
+		{"plaintext", "correct horse", "correct horse", true, true, nil},
+		{"plaintext wrong password", "wrong horse", "correct horse", false, false, nil},
+		{"plaintext prefix", "correct", "correct horse", false, false, nil},
+		{"empty", "", "", false, false, ErrUnknownFormat},
+		// the stored value of an unknown scheme must not log in as plain text
+		{"other scheme", "$6$salt$hash", "$6$salt$hash", false, false, ErrUnknownFormat},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ok, needsRehash, err := Verify(test.pwd, test.encoded)
+			if ok != test.ok || needsRehash != test.needsRehash || !errors.Is(err, test.err) {
+				t.Fatalf("Verify = %v, %v, %v; want %v, %v, %v", ok, needsRehash, err, test.ok, test.needsRehash, test.err)
+			}
+		})
+	}
+}
+
+func TestHash(t *testing.T) {
+	a, err := Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatal("two hashes share a salt")
+	}
+	if !IsEncoded(a) || IsEncoded("correct horse") || IsEncoded("$6$salt$hash") {
+		t.Fatal("IsEncoded disagrees with Verify")
+	}
+}
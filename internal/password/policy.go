@@ -0,0 +1,61 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Policy : rules a new password must satisfy
+type Policy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+var DefaultPolicy = Policy{
+	MinLength: 8,
+	MaxLength: 128,
+}
+
+func (p Policy) Validate(pwd string) error {
+	var (
+		length                      = utf8.RuneCountInString(pwd)
+		upper, lower, digit, symbol bool
+	)
+	if length < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf("password must be at most %d characters", p.MaxLength)
+	}
+	for _, r := range pwd {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		return errors.New("password must contain an upper-case letter")
+	}
+	if p.RequireLower && !lower {
+		return errors.New("password must contain a lower-case letter")
+	}
+	if p.RequireDigit && !digit {
+		return errors.New("password must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		return errors.New("password must contain a symbol")
+	}
+	return nil
+}
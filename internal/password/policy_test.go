@@ -0,0 +1,40 @@
+package password
+
+import "testing"
+
+func TestPolicyValidate(t *testing.T) {
+	strict := Policy{
+		MinLength:     10,
+		MaxLength:     16,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+	}
+	tests := []struct {
+		name   string
+		policy Policy
+		pwd    string
+		valid  bool
+	}{
+		{"default", DefaultPolicy, "eightchr", true},
+		{"default too short", DefaultPolicy, "sevench", false},
+		{"default too long", DefaultPolicy, string(make([]byte, 129)), false},
+		{"no maximum", Policy{MinLength: 1}, string(make([]byte, 1000)), true},
+		// the length counts characters, not bytes
+		{"multibyte", Policy{MinLength: 4, MaxLength: 4}, "ñßéü", true},
+		{"strict", strict, "Abcdef12-x", true},
+		{"strict no upper", strict, "abcdef12-x", false},
+		{"strict no lower", strict, "ABCDEF12-X", false},
+		{"strict no digit", strict, "Abcdefgh-x", false},
+		{"strict no symbol", strict, "Abcdef123x", false},
+		{"strict too long", strict, "Abcdef12-xxxxxxxx", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.policy.Validate(test.pwd); (err == nil) != test.valid {
+				t.Fatalf("Validate(%q) = %v, want valid %v", test.pwd, err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package memory
+
+import (
+	"app/internal/mongodb/db/models"
+	"context"
+	"sync"
+	"time"
+)
+
+type Attempts struct {
+	mu       sync.Mutex
+	attempts map[string]*models.AttemptModel
+}
+
+func NewAttempts() *Attempts {
+	return &Attempts{
+		attempts: map[string]*models.AttemptModel{},
+	}
+}
+
+func (ins *Attempts) Fail(_ context.Context, key string, window time.Duration) (int, error) {
+	now := time.Now()
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	a, ok := ins.attempts[key]
+	if !ok {
+		a = &models.AttemptModel{Key: key}
+		ins.attempts[key] = a
+	}
+	if ok && !a.LastFailureAt.Before(now.Add(-window)) {
+		a.Failures++
+	} else {
+		// first failure or the window has passed, an active lock is kept
+		a.Failures = 1
+	}
+	a.LastFailureAt = now
+	return a.Failures, nil
+}
+
+func (ins *Attempts) Lock(_ context.Context, key string, until time.Time) error {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	if a, ok := ins.attempts[key]; ok && until.After(a.LockedUntil) {
+		a.LockedUntil = until
+	}
+	return nil
+}
+
+func (ins *Attempts) Claim(_ context.Context, key string, until time.Time) (bool, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	a, ok := ins.attempts[key]
+	if !ok {
+		return false, nil
+	}
+	if a.LockedUntil.After(time.Now()) {
+		return false, nil
+	}
+	a.LockedUntil = until
+	return true, nil
+}
+
+func (ins *Attempts) Release(_ context.Context, key string) error {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	if a, ok := ins.attempts[key]; ok && a.Failures > 0 {
+		a.Failures--
+	}
+	return nil
+}
+
+func (ins *Attempts) LockedUntil(_ context.Context, keys []string) (time.Time, error) {
+	var (
+		now   = time.Now()
+		until time.Time
+	)
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	for _, key := range keys {
+		if a, ok := ins.attempts[key]; ok && a.LockedUntil.After(now) && a.LockedUntil.After(until) {
+			until = a.LockedUntil
+		}
+	}
+	return until, nil
+}
+
+func (ins *Attempts) Reset(_ context.Context, keys []string) error {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	for _, key := range keys {
+		delete(ins.attempts, key)
+	}
+	return nil
+}
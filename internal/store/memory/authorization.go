@@ -0,0 +1,72 @@
+package memory
+
+import (
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync"
+	"time"
+)
+
+type Authorizations struct {
+	mu             sync.Mutex
+	authorizations map[string]models.AuthorizationModel
+}
+
+func NewAuthorizations() *Authorizations {
+	return &Authorizations{
+		authorizations: map[string]models.AuthorizationModel{},
+	}
+}
+
+func (ins *Authorizations) Create(_ context.Context, authorization *models.AuthorizationModel) error {
+	authorization.CreatedAt = time.Now()
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	for id, a := range ins.authorizations {
+		if !authorization.CreatedAt.Before(a.ExpiresAt) {
+			delete(ins.authorizations, id)
+		}
+	}
+	ins.authorizations[authorization.ID] = *authorization
+	return nil
+}
+
+func (ins *Authorizations) GetPending(_ context.Context, id string) (*models.AuthorizationModel, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	a, ok := ins.authorizations[id]
+	if !ok || len(a.CodeHash) > 0 || !time.Now().Before(a.ExpiresAt) {
+		return nil, store.ErrNotFound
+	}
+	return &a, nil
+}
+
+func (ins *Authorizations) Approve(_ context.Context, id, codeHash string, userID, sessionID primitive.ObjectID, expiresAt time.Time) (bool, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	a, ok := ins.authorizations[id]
+	if !ok || len(a.CodeHash) > 0 || !time.Now().Before(a.ExpiresAt) {
+		return false, nil
+	}
+	a.CodeHash = codeHash
+	a.UserID = userID
+	a.SessionID = sessionID
+	a.ExpiresAt = expiresAt
+	ins.authorizations[id] = a
+	return true, nil
+}
+
+func (ins *Authorizations) Redeem(_ context.Context, codeHash string) (*models.AuthorizationModel, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	now := time.Now()
+	for id, a := range ins.authorizations {
+		if len(codeHash) > 0 && a.CodeHash == codeHash && now.Before(a.ExpiresAt) {
+			delete(ins.authorizations, id)
+			return &a, nil
+		}
+	}
+	return nil, store.ErrNotFound
+}
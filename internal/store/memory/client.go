@@ -0,0 +1,51 @@
+package memory
+
+import (
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"context"
+	"sync"
+	"time"
+)
+
+type Clients struct {
+	mu      sync.RWMutex
+	clients map[string]models.ClientModel
+}
+
+func NewClients() *Clients {
+	return &Clients{
+		clients: map[string]models.ClientModel{},
+	}
+}
+
+func (ins *Clients) FindByID(_ context.Context, id string) (*models.ClientModel, error) {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
+	client, ok := ins.clients[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return cloneClient(client), nil
+}
+
+func (ins *Clients) Upsert(_ context.Context, client *models.ClientModel) error {
+	now := time.Now()
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	tmp := cloneClient(*client)
+	tmp.CreatedAt = now
+	if existing, ok := ins.clients[client.ID]; ok {
+		tmp.CreatedAt = existing.CreatedAt
+	}
+	tmp.UpdatedAt = now
+	ins.clients[client.ID] = *tmp
+	return nil
+}
+
+func cloneClient(client models.ClientModel) *models.ClientModel {
+	client.Grants = cloneStrings(client.Grants)
+	client.RedirectURIs = cloneStrings(client.RedirectURIs)
+	client.AllowedOrigins = cloneStrings(client.AllowedOrigins)
+	return &client
+}
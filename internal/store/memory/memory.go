@@ -0,0 +1,47 @@
+// Package memory keeps every store in process memory, for tests and local
+// development without a database. Nothing survives a restart and each
+// instance has its own data, so it cannot back more than one API replica.
+package memory
+
+import (
+	"app/internal/auth"
+	"app/internal/store"
+)
+
+// New : an empty set of stores. They have no transactions, InTransaction runs
+// its writes one after the other.
+func New() *store.DB {
+	return &store.DB{
+		Session:  NewSessions(),
+		User:     NewUsers(),
+		WebAuthn: NewChallenges(),
+		Attempt:  NewAttempts(),
+		Keys:     auth.NewMemoryKeyStore(),
+		OAuth:    NewAuthorizations(),
+		Clients:  NewClients(),
+	}
+}
+
+// cloneBytes : callers own what they get back, nothing is shared with the store
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+var (
+	_ store.UserStore          = (*Users)(nil)
+	_ store.SessionStore       = (*Sessions)(nil)
+	_ store.AttemptStore       = (*Attempts)(nil)
+	_ store.ChallengeStore     = (*Challenges)(nil)
+	_ store.AuthorizationStore = (*Authorizations)(nil)
+	_ store.ClientStore        = (*Clients)(nil)
+)
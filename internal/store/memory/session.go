@@ -0,0 +1,162 @@
+package memory
+
+import (
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Sessions struct {
+	mu       sync.RWMutex
+	sessions map[primitive.ObjectID]*models.SessionModel
+}
+
+func NewSessions() *Sessions {
+	return &Sessions{
+		sessions: map[primitive.ObjectID]*models.SessionModel{},
+	}
+}
+
+func (ins *Sessions) CreateNewSession(_ context.Context, session *models.SessionModel, lifetime store.SessionLifetime) (primitive.ObjectID, error) {
+	session.ID = primitive.NewObjectID()
+	session.CreatedAt = time.Now()
+	session.LastUsedAt = session.CreatedAt
+	session.ExpiresAt = lifetime.ExpiresAt(session.CreatedAt, session.LastUsedAt)
+
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	ins.purge(session.CreatedAt)
+	ins.sessions[session.ID] = cloneSession(session)
+	return session.ID, nil
+}
+
+func (ins *Sessions) Delete(_ context.Context, id primitive.ObjectID) error {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	delete(ins.sessions, id)
+	return nil
+}
+
+func (ins *Sessions) Touch(_ context.Context, session *models.SessionModel, interval time.Duration, lifetime store.SessionLifetime) error {
+	now := time.Now()
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	s, ok := ins.sessions[session.ID]
+	if !ok || !s.RevokedAt.IsZero() || !s.LastUsedAt.Before(now.Add(-interval)) {
+		return nil
+	}
+	used(s, now, lifetime)
+	return nil
+}
+
+func (ins *Sessions) Revoke(_ context.Context, ids ...primitive.ObjectID) error {
+	now := time.Now()
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	for _, id := range ids {
+		if s, ok := ins.sessions[id]; ok && s.RevokedAt.IsZero() {
+			s.RevokedAt = now
+		}
+	}
+	return nil
+}
+
+func (ins *Sessions) RevokeOthers(_ context.Context, userID, keep primitive.ObjectID) error {
+	now := time.Now()
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	for _, s := range ins.sessions {
+		if s.UserID == userID && s.ID != keep && s.RevokedAt.IsZero() {
+			s.RevokedAt = now
+		}
+	}
+	return nil
+}
+
+func (ins *Sessions) GetByID(_ context.Context, id primitive.ObjectID) (*models.SessionModel, error) {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
+	if s, ok := ins.sessions[id]; ok {
+		return cloneSession(s), nil
+	}
+	return nil, store.ErrNotFound
+}
+
+func (ins *Sessions) FindByIDs(_ context.Context, userID primitive.ObjectID, ids []primitive.ObjectID) ([]models.SessionModel, error) {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
+	sessions := make([]models.SessionModel, 0, len(ids))
+	for _, id := range ids {
+		if s, ok := ins.sessions[id]; ok && s.UserID == userID {
+			sessions = append(sessions, *cloneSession(s))
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, nil
+}
+
+func (ins *Sessions) GetByAT(_ context.Context, accessToken string) (*models.SessionModel, error) {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
+	for _, s := range ins.sessions {
+		if s.AccessToken == accessToken {
+			return cloneSession(s), nil
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+func (ins *Sessions) GetByFamily(_ context.Context, family primitive.ObjectID) ([]models.SessionModel, error) {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
+	var sessions []models.SessionModel
+	for _, s := range ins.sessions {
+		if s.FamilyID == family {
+			sessions = append(sessions, *cloneSession(s))
+		}
+	}
+	return sessions, nil
+}
+
+func (ins *Sessions) Rotate(_ context.Context, session *models.SessionModel, accessToken, refreshToken string, lifetime store.SessionLifetime) (bool, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	s, ok := ins.sessions[session.ID]
+	if !ok || s.Generation != session.Generation || !s.RevokedAt.IsZero() {
+		return false, nil
+	}
+	s.AccessToken = accessToken
+	s.RefreshToken = refreshToken
+	s.Generation++
+	used(s, time.Now(), lifetime)
+	return true, nil
+}
+
+// purge : what the TTL indexes of the Mongo store delete
+func (ins *Sessions) purge(now time.Time) {
+	for id, s := range ins.sessions {
+		if (!s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)) ||
+			(!s.RevokedAt.IsZero() && !now.Before(s.RevokedAt.Add(store.RevokedSessionRetention))) {
+			delete(ins.sessions, id)
+		}
+	}
+}
+
+func used(s *models.SessionModel, now time.Time, lifetime store.SessionLifetime) {
+	s.LastUsedAt = now
+	if expiresAt := lifetime.ExpiresAt(s.CreatedAt, now); !expiresAt.IsZero() {
+		s.ExpiresAt = expiresAt
+	}
+}
+
+func cloneSession(s *models.SessionModel) *models.SessionModel {
+	tmp := *s
+	tmp.AMR = cloneStrings(s.AMR)
+	return &tmp
+}
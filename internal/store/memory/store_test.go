@@ -0,0 +1,59 @@
+package memory
+
+import (
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"app/internal/store/storetest"
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) *store.DB {
+		return New()
+	})
+}
+
+// TestPurge : the memory store deletes what the TTL indexes of the Mongo store
+// would, expired sessions and the revoked ones past their retention
+func TestPurge(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		db    = New()
+		newID = func(lifetime store.SessionLifetime) primitive.ObjectID {
+			session := &models.SessionModel{UserID: primitive.NewObjectID(), AccessToken: primitive.NewObjectID().Hex()}
+			id, err := db.Session.CreateNewSession(ctx, session, lifetime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return id
+		}
+		live = newID(store.SessionLifetime{IdleTimeout: time.Hour})
+		// without limits only the retention deletes it
+		revoked = newID(store.SessionLifetime{})
+	)
+	if err := db.Session.Revoke(ctx, revoked); err != nil {
+		t.Fatal(err)
+	}
+	sessions := db.Session.(*Sessions)
+	sessions.purge(time.Now().Add(30 * time.Minute))
+	for _, id := range []primitive.ObjectID{live, revoked} {
+		if _, err := db.Session.GetByID(ctx, id); err != nil {
+			t.Fatalf("session %s purged early: %v", id.Hex(), err)
+		}
+	}
+	sessions.purge(time.Now().Add(2 * time.Hour))
+	if _, err := db.Session.GetByID(ctx, live); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expired session kept: %v", err)
+	}
+	if _, err := db.Session.GetByID(ctx, revoked); err != nil {
+		t.Fatalf("revoked session purged within its retention: %v", err)
+	}
+	sessions.purge(time.Now().Add(store.RevokedSessionRetention + time.Minute))
+	if _, err := db.Session.GetByID(ctx, revoked); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("revoked session kept past its retention: %v", err)
+	}
+}
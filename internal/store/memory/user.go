@@ -0,0 +1,276 @@
+package memory
+
+import (
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"bytes"
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync"
+	"time"
+)
+
+type Users struct {
+	mu    sync.RWMutex
+	users map[primitive.ObjectID]*models.UserModel
+}
+
+func NewUsers() *Users {
+	return &Users{
+		users: map[primitive.ObjectID]*models.UserModel{},
+	}
+}
+
+func (ins *Users) CreateUser(_ context.Context, username string, passwordHash string) (primitive.ObjectID, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	for _, u := range ins.users {
+		if u.Username == username {
+			return primitive.NilObjectID, store.ErrUsernameTaken
+		}
+	}
+	user := &models.UserModel{
+		ID:        primitive.NewObjectID(),
+		Username:  username,
+		Password:  passwordHash,
+		CreatedAt: time.Now(),
+	}
+	ins.users[user.ID] = user
+	return user.ID, nil
+}
+
+func (ins *Users) FindByID(_ context.Context, id primitive.ObjectID) (*models.UserModel, error) {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
+	user, ok := ins.users[id]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return cloneUser(user), nil
+}
+
+func (ins *Users) FindByUsername(_ context.Context, username string) (*models.UserModel, error) {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
+	for _, user := range ins.users {
+		if user.Username == username {
+			return cloneUser(user), nil
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+func (ins *Users) PushSession(_ context.Context, uuid, sessionID primitive.ObjectID, maxSessions int, evict bool) error {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	user, ok := ins.users[uuid]
+	if !ok {
+		return store.ErrNotFound
+	}
+	if maxSessions > 0 && !evict && len(user.Sessions) >= maxSessions {
+		return store.ErrSessionLimit
+	}
+	user.Sessions = append(user.Sessions, sessionID)
+	if maxSessions > 0 && len(user.Sessions) > maxSessions {
+		user.Sessions = append([]primitive.ObjectID{}, user.Sessions[len(user.Sessions)-maxSessions:]...)
+	}
+	return nil
+}
+
+func (ins *Users) SetMaxSessions(_ context.Context, id primitive.ObjectID, maxSessions int) error {
+	return ins.update(id, func(user *models.UserModel) {
+		user.MaxSessions = maxSessions
+	})
+}
+
+func (ins *Users) RevokeSession(_ context.Context, uuid, sessionID primitive.ObjectID) error {
+	return ins.update(uuid, func(user *models.UserModel) {
+		user.Sessions = removeIDs(user.Sessions, func(id primitive.ObjectID) bool {
+			return id == sessionID
+		})
+	})
+}
+
+func (ins *Users) RevokeOtherSessions(_ context.Context, uuid, keep primitive.ObjectID) error {
+	return ins.update(uuid, func(user *models.UserModel) {
+		user.Sessions = removeIDs(user.Sessions, func(id primitive.ObjectID) bool {
+			return id != keep
+		})
+	})
+}
+
+func (ins *Users) ValidateSession(_ context.Context, sessionID primitive.ObjectID) (bool, error) {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
+	for _, user := range ins.users {
+		for _, id := range user.Sessions {
+			if id == sessionID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (ins *Users) ChangePassword(_ context.Context, id primitive.ObjectID, passwordHash string) error {
+	return ins.update(id, func(user *models.UserModel) {
+		user.Password = passwordHash
+	})
+}
+
+func (ins *Users) UpdateMfaSecret(_ context.Context, id primitive.ObjectID, secret string) error {
+	return ins.update(id, func(user *models.UserModel) {
+		user.MFASecret = secret
+		user.MFALastStep = 0
+	})
+}
+
+func (ins *Users) UseOTPStep(_ context.Context, id primitive.ObjectID, secret string, step int64) (bool, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	user, ok := ins.users[id]
+	if !ok || user.MFASecret != secret || user.MFALastStep >= step {
+		return false, nil
+	}
+	user.MFALastStep = step
+	return true, nil
+}
+
+func (ins *Users) UpdateMfaActive(_ context.Context, id primitive.ObjectID, active bool) error {
+	return ins.update(id, func(user *models.UserModel) {
+		user.MFAActive = active
+	})
+}
+
+func (ins *Users) SetRecoveryCodes(_ context.Context, id primitive.ObjectID, hashes []string) error {
+	return ins.update(id, func(user *models.UserModel) {
+		user.RecoveryCodes = cloneStrings(hashes)
+	})
+}
+
+func (ins *Users) UseRecoveryCode(_ context.Context, id primitive.ObjectID, hash string) (bool, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	user, ok := ins.users[id]
+	if !ok {
+		return false, nil
+	}
+	for i, h := range user.RecoveryCodes {
+		if h == hash {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AddPasskey : a credential belongs to one user, like the unique index of the Mongo store
+func (ins *Users) AddPasskey(_ context.Context, id primitive.ObjectID, passkey models.PasskeyModel) error {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	user, ok := ins.users[id]
+	if !ok {
+		return store.ErrPasskeyExists
+	}
+	for _, u := range ins.users {
+		if findPasskey(u, passkey.CredentialID) >= 0 {
+			return store.ErrPasskeyExists
+		}
+	}
+	user.Passkeys = append(user.Passkeys, clonePasskey(passkey))
+	return nil
+}
+
+func (ins *Users) FindByPasskey(_ context.Context, credentialID []byte) (*models.UserModel, error) {
+	ins.mu.RLock()
+	defer ins.mu.RUnlock()
+	for _, user := range ins.users {
+		if findPasskey(user, credentialID) >= 0 {
+			return cloneUser(user), nil
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+func (ins *Users) UpdatePasskeySignCount(_ context.Context, id primitive.ObjectID, credentialID []byte, signCount uint32) (bool, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	user, ok := ins.users[id]
+	if !ok {
+		return false, nil
+	}
+	i := findPasskey(user, credentialID)
+	if i < 0 {
+		return false, nil
+	}
+	passkey := &user.Passkeys[i]
+	if (signCount == 0 && passkey.SignCount != 0) || (signCount != 0 && passkey.SignCount >= signCount) {
+		return false, nil
+	}
+	passkey.SignCount = signCount
+	passkey.LastUsedAt = time.Now()
+	return true, nil
+}
+
+func (ins *Users) RemovePasskey(_ context.Context, id primitive.ObjectID, credentialID []byte) (bool, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	user, ok := ins.users[id]
+	if !ok {
+		return false, nil
+	}
+	i := findPasskey(user, credentialID)
+	if i < 0 {
+		return false, nil
+	}
+	user.Passkeys = append(user.Passkeys[:i:i], user.Passkeys[i+1:]...)
+	return true, nil
+}
+
+// update : apply fn to the user, an unknown user is not an error like an update matching nothing
+func (ins *Users) update(id primitive.ObjectID, fn func(user *models.UserModel)) error {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	if user, ok := ins.users[id]; ok {
+		fn(user)
+	}
+	return nil
+}
+
+func findPasskey(user *models.UserModel, credentialID []byte) int {
+	for i := range user.Passkeys {
+		if bytes.Equal(user.Passkeys[i].CredentialID, credentialID) {
+			return i
+		}
+	}
+	return -1
+}
+
+func removeIDs(ids []primitive.ObjectID, remove func(id primitive.ObjectID) bool) []primitive.ObjectID {
+	kept := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		if !remove(id) {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+func cloneUser(user *models.UserModel) *models.UserModel {
+	tmp := *user
+	tmp.Sessions = append([]primitive.ObjectID(nil), user.Sessions...)
+	tmp.RecoveryCodes = cloneStrings(user.RecoveryCodes)
+	tmp.Passkeys = make([]models.PasskeyModel, 0, len(user.Passkeys))
+	for _, passkey := range user.Passkeys {
+		tmp.Passkeys = append(tmp.Passkeys, clonePasskey(passkey))
+	}
+	return &tmp
+}
+
+func clonePasskey(passkey models.PasskeyModel) models.PasskeyModel {
+	passkey.CredentialID = cloneBytes(passkey.CredentialID)
+	passkey.PublicKey = cloneBytes(passkey.PublicKey)
+	passkey.AAGUID = cloneBytes(passkey.AAGUID)
+	passkey.Transports = cloneStrings(passkey.Transports)
+	return passkey
+}
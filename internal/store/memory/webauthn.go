@@ -0,0 +1,46 @@
+package memory
+
+import (
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync"
+	"time"
+)
+
+type Challenges struct {
+	mu         sync.Mutex
+	challenges map[primitive.ObjectID]models.WebAuthnChallengeModel
+}
+
+func NewChallenges() *Challenges {
+	return &Challenges{
+		challenges: map[primitive.ObjectID]models.WebAuthnChallengeModel{},
+	}
+}
+
+func (ins *Challenges) Create(_ context.Context, challenge *models.WebAuthnChallengeModel) (primitive.ObjectID, error) {
+	challenge.ID = primitive.NewObjectID()
+	challenge.CreatedAt = time.Now()
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	for id, c := range ins.challenges {
+		if !challenge.CreatedAt.Before(c.ExpiresAt) {
+			delete(ins.challenges, id)
+		}
+	}
+	ins.challenges[challenge.ID] = *challenge
+	return challenge.ID, nil
+}
+
+func (ins *Challenges) Take(_ context.Context, id primitive.ObjectID, purpose string) (*models.WebAuthnChallengeModel, error) {
+	ins.mu.Lock()
+	defer ins.mu.Unlock()
+	challenge, ok := ins.challenges[id]
+	if !ok || challenge.Purpose != purpose || !time.Now().Before(challenge.ExpiresAt) {
+		return nil, store.ErrNotFound
+	}
+	delete(ins.challenges, id)
+	return &challenge, nil
+}
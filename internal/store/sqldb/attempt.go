@@ -0,0 +1,113 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LoginAttempt : failure counters shared by every API instance
+type LoginAttempt struct {
+	*conn
+}
+
+// Fail : count a failure under key and return the failures within window,
+// the counter starts over once the previous failure is older than window.
+// Counters past their window whose lock has ended are deleted first, what the
+// TTL index does for Mongo.
+func (ins *LoginAttempt) Fail(ctx context.Context, key string, window time.Duration) (int, error) {
+	var (
+		now      = time.Now()
+		failures int
+	)
+	if _, err := ins.exec(ctx, ins.db, `DELETE FROM login_attempts
+		WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until <= ?)`,
+		timestamp(now.Add(-window)), timestamp(now)); err != nil {
+		return 0, err
+	}
+	err := ins.queryRow(ctx, ins.db, `UPDATE login_attempts SET failures = failures + 1, last_failure_at = ?
+		WHERE key = ? AND last_failure_at >= ? RETURNING failures`,
+		timestamp(now), key, timestamp(now.Add(-window))).Scan(&failures)
+	if err == nil {
+		return failures, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	// first failure or the window has passed, an active lock is kept
+	if _, err := ins.exec(ctx, ins.db, `INSERT INTO login_attempts (key, failures, last_failure_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET failures = 1, last_failure_at = excluded.last_failure_at`,
+		key, timestamp(now)); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// Lock : keep key locked at least until the given time
+func (ins *LoginAttempt) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := ins.exec(ctx, ins.db, `UPDATE login_attempts SET locked_until = ?
+		WHERE key = ? AND (locked_until IS NULL OR locked_until < ?)`,
+		timestamp(until), key, timestamp(until))
+	return err
+}
+
+// Claim : lock key until the given time unless it is locked already, false
+// when another attempt holds the lock
+func (ins *LoginAttempt) Claim(ctx context.Context, key string, until time.Time) (bool, error) {
+	n, err := ins.exec(ctx, ins.db, `UPDATE login_attempts SET locked_until = ?
+		WHERE key = ? AND (locked_until IS NULL OR locked_until <= ?)`,
+		timestamp(until), key, timestamp(time.Now()))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Release : take back a failure counted by Fail, the lock is kept
+func (ins *LoginAttempt) Release(ctx context.Context, key string) error {
+	_, err := ins.exec(ctx, ins.db, `UPDATE login_attempts SET failures = failures - 1
+		WHERE key = ? AND failures > 0`, key)
+	return err
+}
+
+// LockedUntil : the latest lock among keys, zero when none of them is locked
+func (ins *LoginAttempt) LockedUntil(ctx context.Context, keys []string) (time.Time, error) {
+	var until sql.NullTime
+	if len(keys) == 0 {
+		return time.Time{}, nil
+	}
+	args := []interface{}{timestamp(time.Now())}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	rows, err := ins.query(ctx, ins.db, `SELECT locked_until FROM login_attempts
+		WHERE locked_until > ? AND key IN (`+placeholders(len(keys))+`)`, args...)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var lockedUntil sql.NullTime
+		if err := rows.Scan(&lockedUntil); err != nil {
+			return time.Time{}, err
+		}
+		if lockedUntil.Valid && (!until.Valid || lockedUntil.Time.After(until.Time)) {
+			until = lockedUntil
+		}
+	}
+	return fromNullTime(until), rows.Err()
+}
+
+// Reset : forget failures and locks of keys
+func (ins *LoginAttempt) Reset(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	_, err := ins.exec(ctx, ins.db, `DELETE FROM login_attempts WHERE key IN (`+placeholders(len(keys))+`)`, args...)
+	return err
+}
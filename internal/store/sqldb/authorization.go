@@ -0,0 +1,92 @@
+package sqldb
+
+import (
+	"app/internal/mongodb/db/models"
+	"context"
+	"database/sql"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// Authorization : OpenID Connect authorization requests and their codes
+type Authorization struct {
+	*conn
+}
+
+const authorizationColumns = `id, client_id, redirect_uri, scope, state, nonce, code_challenge, code_challenge_method,
+	code_hash, user_id, session_id, created_at, expires_at`
+
+// Create : expired requests and codes are deleted first
+func (ins *Authorization) Create(ctx context.Context, authorization *models.AuthorizationModel) error {
+	now := time.Now()
+	if _, err := ins.exec(ctx, ins.db, `DELETE FROM authorizations WHERE expires_at <= ?`, timestamp(now)); err != nil {
+		return err
+	}
+	authorization.CreatedAt = now
+	var codeHash interface{}
+	if len(authorization.CodeHash) > 0 {
+		codeHash = authorization.CodeHash
+	}
+	_, err := ins.exec(ctx, ins.db, `INSERT INTO authorizations (`+authorizationColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		authorization.ID, authorization.ClientID, authorization.RedirectURI, authorization.Scope, authorization.State,
+		authorization.Nonce, authorization.CodeChallenge, authorization.CodeChallengeMethod, codeHash,
+		optionalID(authorization.UserID), optionalID(authorization.SessionID),
+		timestamp(authorization.CreatedAt), timestamp(authorization.ExpiresAt))
+	return err
+}
+
+// GetPending : a request the user has not logged in for yet
+func (ins *Authorization) GetPending(ctx context.Context, id string) (*models.AuthorizationModel, error) {
+	authorization, err := scanAuthorization(ins.queryRow(ctx, ins.db, `SELECT `+authorizationColumns+`
+		FROM authorizations WHERE id = ? AND code_hash IS NULL AND expires_at > ?`,
+		id, timestamp(time.Now())))
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return authorization, nil
+}
+
+// Approve : attach the code and the session of the user, false when the request
+// expired or was approved already
+func (ins *Authorization) Approve(ctx context.Context, id, codeHash string, userID, sessionID primitive.ObjectID, expiresAt time.Time) (bool, error) {
+	n, err := ins.exec(ctx, ins.db, `UPDATE authorizations SET code_hash = ?, user_id = ?, session_id = ?, expires_at = ?
+		WHERE id = ? AND code_hash IS NULL AND expires_at > ?`,
+		codeHash, userID.Hex(), sessionID.Hex(), timestamp(expiresAt), id, timestamp(time.Now()))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Redeem : take the authorization of a code, a code can be redeemed only once
+func (ins *Authorization) Redeem(ctx context.Context, codeHash string) (*models.AuthorizationModel, error) {
+	authorization, err := scanAuthorization(ins.queryRow(ctx, ins.db, `DELETE FROM authorizations
+		WHERE code_hash = ? AND expires_at > ? RETURNING `+authorizationColumns,
+		codeHash, timestamp(time.Now())))
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return authorization, nil
+}
+
+func scanAuthorization(row scanner) (*models.AuthorizationModel, error) {
+	var (
+		authorization               models.AuthorizationModel
+		codeHash, userID, sessionID sql.NullString
+		err                         error
+	)
+	if err = row.Scan(&authorization.ID, &authorization.ClientID, &authorization.RedirectURI, &authorization.Scope,
+		&authorization.State, &authorization.Nonce, &authorization.CodeChallenge, &authorization.CodeChallengeMethod,
+		&codeHash, &userID, &sessionID, &authorization.CreatedAt, &authorization.ExpiresAt); err != nil {
+		return nil, err
+	}
+	authorization.CodeHash = codeHash.String
+	if authorization.UserID, err = parseObjectID(userID.String); err != nil {
+		return nil, err
+	}
+	if authorization.SessionID, err = parseObjectID(sessionID.String); err != nil {
+		return nil, err
+	}
+	return &authorization, nil
+}
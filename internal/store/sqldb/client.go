@@ -0,0 +1,58 @@
+package sqldb
+
+import (
+	"app/internal/mongodb/db/models"
+	"context"
+	"time"
+)
+
+// Client : the registered client applications
+type Client struct {
+	*conn
+}
+
+func (ins *Client) FindByID(ctx context.Context, id string) (*models.ClientModel, error) {
+	var (
+		client                               models.ClientModel
+		grants, redirectURIs, allowedOrigins string
+	)
+	if err := ins.queryRow(ctx, ins.db, `SELECT id, name, secret_hash, type, grants, redirect_uris, allowed_origins,
+		access_token_ttl, refresh_token_ttl, created_at, updated_at FROM clients WHERE id = ?`, id).Scan(
+		&client.ID, &client.Name, &client.SecretHash, &client.Type, &grants, &redirectURIs, &allowedOrigins,
+		&client.AccessTokenTTL, &client.RefreshTokenTTL, &client.CreatedAt, &client.UpdatedAt); err != nil {
+		return nil, notFound(err)
+	}
+	if err := decodeList(grants, &client.Grants); err != nil {
+		return nil, err
+	}
+	if err := decodeList(redirectURIs, &client.RedirectURIs); err != nil {
+		return nil, err
+	}
+	if err := decodeList(allowedOrigins, &client.AllowedOrigins); err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// Upsert : create the client or replace its settings, keeping created_at
+func (ins *Client) Upsert(ctx context.Context, client *models.ClientModel) error {
+	var lists [3]string
+	for i, v := range [][]string{client.Grants, client.RedirectURIs, client.AllowedOrigins} {
+		list, err := encodeList(v)
+		if err != nil {
+			return err
+		}
+		lists[i] = list
+	}
+	now := timestamp(time.Now())
+	_, err := ins.exec(ctx, ins.db, `INSERT INTO clients (id, name, secret_hash, type, grants, redirect_uris,
+		allowed_origins, access_token_ttl, refresh_token_ttl, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, secret_hash = excluded.secret_hash,
+		type = excluded.type, grants = excluded.grants, redirect_uris = excluded.redirect_uris,
+		allowed_origins = excluded.allowed_origins, access_token_ttl = excluded.access_token_ttl,
+		refresh_token_ttl = excluded.refresh_token_ttl, updated_at = excluded.updated_at`,
+		client.ID, client.Name, client.SecretHash, client.Type, lists[0], lists[1], lists[2],
+		client.AccessTokenTTL, client.RefreshTokenTTL, now, now)
+	return err
+}
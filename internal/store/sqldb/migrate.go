@@ -0,0 +1,121 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrations : <version>_<name>.sql per dialect, applied in version order and
+// never edited once released, a change to the schema is a new file
+//
+//go:embed migrations
+var migrations embed.FS
+
+// migrationLock : Postgres advisory lock held while migrating, so instances
+// starting together apply each migration once
+const migrationLock = 0x6d6661
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+func loadMigrations(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrations, dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []migration
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("sqldb: migration %s: version prefix expected", name)
+		}
+		b, err := migrations.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, migration{version: version, name: name, sql: string(b)})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].version < list[j].version
+	})
+	for i := 1; i < len(list); i++ {
+		if list[i].version == list[i-1].version {
+			return nil, fmt.Errorf("sqldb: migrations %s and %s share a version", list[i-1].name, list[i].name)
+		}
+	}
+	return list, nil
+}
+
+// migrate : apply the migrations newer than the schema, each one in its own
+// transaction with the version it brings the schema to
+func migrate(ctx context.Context, c *conn) error {
+	list, err := loadMigrations(c.dialect)
+	if err != nil {
+		return err
+	}
+	if err := c.inTx(ctx, func(tx *sql.Tx) error {
+		if err := lockMigrations(ctx, c, tx); err != nil {
+			return err
+		}
+		_, err := c.exec(ctx, tx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)`)
+		return err
+	}); err != nil {
+		return fmt.Errorf("sqldb: schema_migrations: %w", err)
+	}
+	for _, m := range list {
+		if err := c.inTx(ctx, func(tx *sql.Tx) error {
+			if err := lockMigrations(ctx, c, tx); err != nil {
+				return err
+			}
+			var n int
+			if err := c.queryRow(ctx, tx, `SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, m.version).Scan(&n); err != nil {
+				return err
+			}
+			if n > 0 {
+				return nil
+			}
+			if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+				return err
+			}
+			if _, err := c.exec(ctx, tx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+				m.version, m.name, timestamp(time.Now())); err != nil {
+				return err
+			}
+			log.Printf("Log-Debug: Migration `%s` applied\r\n", m.name)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("sqldb: migration %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+func lockMigrations(ctx context.Context, c *conn, tx *sql.Tx) error {
+	if c.dialect != Postgres {
+		return nil
+	}
+	_, err := c.exec(ctx, tx, `SELECT pg_advisory_xact_lock(?)`, migrationLock)
+	return err
+}
@@ -0,0 +1,131 @@
+-- usernames are stored lower-cased and trimmed, the form logins look them up by
+CREATE TABLE users (
+    id            TEXT PRIMARY KEY,
+    username      TEXT      NOT NULL,
+    password      TEXT      NOT NULL,
+    max_sessions  INTEGER   NOT NULL DEFAULT 0,
+    mfa_active    BOOLEAN   NOT NULL DEFAULT 0,
+    mfa_secret    TEXT      NOT NULL DEFAULT '',
+    mfa_last_step INTEGER   NOT NULL DEFAULT 0,
+    created_at    TIMESTAMP NOT NULL,
+    CONSTRAINT username_unique UNIQUE (username),
+    CONSTRAINT username_normalized CHECK (username = LOWER(TRIM(username)))
+);
+
+-- the live sessions of each user in login order, the oldest are evicted first
+CREATE TABLE user_sessions (
+    seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id    TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    session_id TEXT NOT NULL,
+    CONSTRAINT user_sessions_session_id_unique UNIQUE (session_id)
+);
+CREATE INDEX user_sessions_user_id ON user_sessions (user_id, seq);
+
+CREATE TABLE recovery_codes (
+    user_id   TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+-- a credential belongs to one user
+CREATE TABLE passkeys (
+    credential_id    BLOB      PRIMARY KEY,
+    user_id          TEXT      NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    public_key       BLOB      NOT NULL,
+    attestation_type TEXT      NOT NULL DEFAULT '',
+    aaguid           BLOB,
+    sign_count       INTEGER   NOT NULL DEFAULT 0,
+    transports       TEXT      NOT NULL DEFAULT '[]',
+    name             TEXT      NOT NULL DEFAULT '',
+    backup_eligible  BOOLEAN   NOT NULL DEFAULT 0,
+    backup_state     BOOLEAN   NOT NULL DEFAULT 0,
+    created_at       TIMESTAMP NOT NULL,
+    last_used_at     TIMESTAMP
+);
+CREATE INDEX passkeys_user_id ON passkeys (user_id);
+
+CREATE TABLE login_sessions (
+    id                 TEXT PRIMARY KEY,
+    user_id            TEXT      NOT NULL,
+    access_token       TEXT      NOT NULL,
+    refresh_token      TEXT      NOT NULL,
+    family_id          TEXT      NOT NULL,
+    refresh_generation INTEGER   NOT NULL DEFAULT 0,
+    amr                TEXT      NOT NULL DEFAULT '[]',
+    auth_time          TIMESTAMP,
+    client_id          TEXT      NOT NULL DEFAULT '',
+    client_ip          TEXT      NOT NULL DEFAULT '',
+    user_agent         TEXT      NOT NULL DEFAULT '',
+    created_at         TIMESTAMP NOT NULL,
+    last_used_at       TIMESTAMP NOT NULL,
+    expires_at         TIMESTAMP,
+    revoked_at         TIMESTAMP,
+    CONSTRAINT access_token_unique UNIQUE (access_token)
+);
+CREATE INDEX login_sessions_family_id ON login_sessions (family_id);
+CREATE INDEX login_sessions_user_id_last_used_at ON login_sessions (user_id, last_used_at DESC);
+CREATE INDEX login_sessions_expires_at ON login_sessions (expires_at);
+CREATE INDEX login_sessions_revoked_at ON login_sessions (revoked_at) WHERE revoked_at IS NOT NULL;
+
+CREATE TABLE login_attempts (
+    key             TEXT PRIMARY KEY,
+    failures        INTEGER   NOT NULL,
+    last_failure_at TIMESTAMP NOT NULL,
+    locked_until    TIMESTAMP
+);
+-- the purge in Fail looks the counters up by their last failure
+CREATE INDEX login_attempts_last_failure_at ON login_attempts (last_failure_at);
+
+CREATE TABLE webauthn_challenges (
+    id                     TEXT PRIMARY KEY,
+    user_id                TEXT,
+    purpose                TEXT      NOT NULL,
+    challenge              TEXT      NOT NULL,
+    user_handle            BLOB,
+    allowed_credential_ids TEXT      NOT NULL DEFAULT '[]',
+    user_verification      TEXT      NOT NULL DEFAULT '',
+    expires_at             TIMESTAMP NOT NULL,
+    created_at             TIMESTAMP NOT NULL
+);
+CREATE INDEX webauthn_challenges_expires_at ON webauthn_challenges (expires_at);
+
+CREATE TABLE signing_keys (
+    id          TEXT PRIMARY KEY,
+    alg         TEXT      NOT NULL,
+    private_key BLOB      NOT NULL,
+    created_at  TIMESTAMP NOT NULL,
+    retired_at  TIMESTAMP,
+    expires_at  TIMESTAMP
+);
+
+CREATE TABLE authorizations (
+    id                    TEXT PRIMARY KEY,
+    client_id             TEXT      NOT NULL,
+    redirect_uri          TEXT      NOT NULL,
+    scope                 TEXT      NOT NULL DEFAULT '',
+    state                 TEXT      NOT NULL DEFAULT '',
+    nonce                 TEXT      NOT NULL DEFAULT '',
+    code_challenge        TEXT      NOT NULL DEFAULT '',
+    code_challenge_method TEXT      NOT NULL DEFAULT '',
+    code_hash             TEXT,
+    user_id               TEXT,
+    session_id            TEXT,
+    created_at            TIMESTAMP NOT NULL,
+    expires_at            TIMESTAMP NOT NULL,
+    CONSTRAINT code_hash_unique UNIQUE (code_hash)
+);
+CREATE INDEX authorizations_expires_at ON authorizations (expires_at);
+
+CREATE TABLE clients (
+    id                TEXT PRIMARY KEY,
+    name              TEXT      NOT NULL DEFAULT '',
+    secret_hash       TEXT      NOT NULL DEFAULT '',
+    type              TEXT      NOT NULL,
+    grants            TEXT      NOT NULL DEFAULT '[]',
+    redirect_uris     TEXT      NOT NULL DEFAULT '[]',
+    allowed_origins   TEXT      NOT NULL DEFAULT '[]',
+    access_token_ttl  INTEGER   NOT NULL DEFAULT 0,
+    refresh_token_ttl INTEGER   NOT NULL DEFAULT 0,
+    created_at        TIMESTAMP NOT NULL,
+    updated_at        TIMESTAMP NOT NULL
+);
@@ -0,0 +1,180 @@
+package sqldb
+
+import (
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"context"
+	"database/sql"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// LoginSession : the token pairs issued at each login
+type LoginSession struct {
+	*conn
+}
+
+const sessionColumns = `id, user_id, access_token, refresh_token, family_id, refresh_generation, amr, auth_time,
+	client_id, client_ip, user_agent, created_at, last_used_at, expires_at, revoked_at`
+
+// CreateNewSession : insert the session, ID and timestamps are filled in here.
+// Expired sessions and the revoked ones past their retention are deleted
+// first, what the TTL indexes do for Mongo.
+func (ins *LoginSession) CreateNewSession(ctx context.Context, session *models.SessionModel, lifetime store.SessionLifetime) (primitive.ObjectID, error) {
+	now := time.Now()
+	if _, err := ins.exec(ctx, ins.db, `DELETE FROM login_sessions WHERE expires_at <= ? OR revoked_at <= ?`,
+		timestamp(now), timestamp(now.Add(-store.RevokedSessionRetention))); err != nil {
+		return primitive.NilObjectID, err
+	}
+
+	amr, err := encodeList(session.AMR)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	session.ID = primitive.NewObjectID()
+	session.CreatedAt = now
+	session.LastUsedAt = now
+	session.ExpiresAt = lifetime.ExpiresAt(session.CreatedAt, session.LastUsedAt)
+	if _, err := ins.exec(ctx, ins.db, `INSERT INTO login_sessions (`+sessionColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.ID.Hex(), session.UserID.Hex(), session.AccessToken, session.RefreshToken, session.FamilyID.Hex(),
+		session.Generation, amr, optionalTime(session.AuthTime), session.ClientID, session.ClientIP, session.UserAgent,
+		timestamp(session.CreatedAt), timestamp(session.LastUsedAt), optionalTime(session.ExpiresAt),
+		optionalTime(session.RevokedAt)); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return session.ID, nil
+}
+
+func (ins *LoginSession) Delete(ctx context.Context, id primitive.ObjectID) error {
+	_, err := ins.exec(ctx, ins.db, `DELETE FROM login_sessions WHERE id = ?`, id.Hex())
+	return err
+}
+
+// Touch : record that the session was used, at most once per interval so
+// busy sessions do not write on every request, and slide its expiry
+func (ins *LoginSession) Touch(ctx context.Context, session *models.SessionModel, interval time.Duration, lifetime store.SessionLifetime) error {
+	now := time.Now()
+	_, err := ins.exec(ctx, ins.db, `UPDATE login_sessions SET last_used_at = ?, expires_at = COALESCE(?, expires_at)
+		WHERE id = ? AND revoked_at IS NULL AND last_used_at < ?`,
+		timestamp(now), optionalTime(lifetime.ExpiresAt(session.CreatedAt, now)),
+		session.ID.Hex(), timestamp(now.Add(-interval)))
+	return err
+}
+
+// Revoke : mark the sessions signed out, they are kept for RevokedSessionRetention
+func (ins *LoginSession) Revoke(ctx context.Context, ids ...primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := append([]interface{}{timestamp(time.Now())}, objectIDs(ids)...)
+	_, err := ins.exec(ctx, ins.db, `UPDATE login_sessions SET revoked_at = ?
+		WHERE id IN (`+placeholders(len(ids))+`) AND revoked_at IS NULL`, args...)
+	return err
+}
+
+// RevokeOthers : mark every session of the user except keep signed out
+func (ins *LoginSession) RevokeOthers(ctx context.Context, userID, keep primitive.ObjectID) error {
+	_, err := ins.exec(ctx, ins.db, `UPDATE login_sessions SET revoked_at = ?
+		WHERE user_id = ? AND id <> ? AND revoked_at IS NULL`,
+		timestamp(time.Now()), userID.Hex(), keep.Hex())
+	return err
+}
+
+func (ins *LoginSession) GetByID(ctx context.Context, id primitive.ObjectID) (*models.SessionModel, error) {
+	return ins.get(ctx, `SELECT `+sessionColumns+` FROM login_sessions WHERE id = ?`, id.Hex())
+}
+
+// FindByIDs : sessions of the user among ids, most recently used first
+func (ins *LoginSession) FindByIDs(ctx context.Context, userID primitive.ObjectID, ids []primitive.ObjectID) ([]models.SessionModel, error) {
+	if len(ids) == 0 {
+		return []models.SessionModel{}, nil
+	}
+	args := append([]interface{}{userID.Hex()}, objectIDs(ids)...)
+	return ins.list(ctx, `SELECT `+sessionColumns+` FROM login_sessions
+		WHERE user_id = ? AND id IN (`+placeholders(len(ids))+`) ORDER BY last_used_at DESC`, args...)
+}
+
+func (ins *LoginSession) GetByAT(ctx context.Context, accessToken string) (*models.SessionModel, error) {
+	return ins.get(ctx, `SELECT `+sessionColumns+` FROM login_sessions WHERE access_token = ?`, accessToken)
+}
+
+// GetByFamily : every session rotated from one login
+func (ins *LoginSession) GetByFamily(ctx context.Context, family primitive.ObjectID) ([]models.SessionModel, error) {
+	return ins.list(ctx, `SELECT `+sessionColumns+` FROM login_sessions WHERE family_id = ?`, family.Hex())
+}
+
+// Rotate : replace both tokens if the session is still at its generation and
+// not revoked, false means another request rotated or revoked it first
+func (ins *LoginSession) Rotate(ctx context.Context, session *models.SessionModel, accessToken, refreshToken string, lifetime store.SessionLifetime) (bool, error) {
+	now := time.Now()
+	n, err := ins.exec(ctx, ins.db, `UPDATE login_sessions SET access_token = ?, refresh_token = ?,
+		refresh_generation = refresh_generation + 1, last_used_at = ?, expires_at = COALESCE(?, expires_at)
+		WHERE id = ? AND refresh_generation = ? AND revoked_at IS NULL`,
+		accessToken, refreshToken, timestamp(now), optionalTime(lifetime.ExpiresAt(session.CreatedAt, now)),
+		session.ID.Hex(), session.Generation)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (ins *LoginSession) get(ctx context.Context, query string, args ...interface{}) (*models.SessionModel, error) {
+	session, err := scanSession(ins.queryRow(ctx, ins.db, query, args...))
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return session, nil
+}
+
+func (ins *LoginSession) list(ctx context.Context, query string, args ...interface{}) ([]models.SessionModel, error) {
+	rows, err := ins.query(ctx, ins.db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []models.SessionModel{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
+
+// scanner : a row or the current row of rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSession(row scanner) (*models.SessionModel, error) {
+	var (
+		session                      models.SessionModel
+		id, userID, familyID, amr    string
+		authTime, expiresAt, revoked sql.NullTime
+		err                          error
+	)
+	if err = row.Scan(&id, &userID, &session.AccessToken, &session.RefreshToken, &familyID, &session.Generation,
+		&amr, &authTime, &session.ClientID, &session.ClientIP, &session.UserAgent, &session.CreatedAt,
+		&session.LastUsedAt, &expiresAt, &revoked); err != nil {
+		return nil, err
+	}
+	if session.ID, err = parseObjectID(id); err != nil {
+		return nil, err
+	}
+	if session.UserID, err = parseObjectID(userID); err != nil {
+		return nil, err
+	}
+	if session.FamilyID, err = parseObjectID(familyID); err != nil {
+		return nil, err
+	}
+	if err = decodeList(amr, &session.AMR); err != nil {
+		return nil, err
+	}
+	session.AuthTime = fromNullTime(authTime)
+	session.ExpiresAt = fromNullTime(expiresAt)
+	session.RevokedAt = fromNullTime(revoked)
+	return &session, nil
+}
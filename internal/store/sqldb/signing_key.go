@@ -0,0 +1,61 @@
+package sqldb
+
+import (
+	"app/internal/auth"
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// SigningKey : auth.KeyStore shared by every API instance, private keys are
+// PKCS #8 DER so access to the table must be restricted like any other secret
+type SigningKey struct {
+	*conn
+}
+
+func (ins *SigningKey) Load(ctx context.Context) ([]*auth.SigningKey, error) {
+	rows, err := ins.query(ctx, ins.db, `SELECT id, alg, private_key, created_at, retired_at, expires_at FROM signing_keys`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []*auth.SigningKey
+	for rows.Next() {
+		var (
+			id, alg              string
+			der                  []byte
+			createdAt            sql.NullTime
+			retiredAt, expiresAt sql.NullTime
+		)
+		if err := rows.Scan(&id, &alg, &der, &createdAt, &retiredAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		key, err := auth.ParseSigningKey(id, alg, der)
+		if err != nil {
+			return nil, fmt.Errorf("signing_keys: %w", err)
+		}
+		key.CreatedAt = fromNullTime(createdAt)
+		key.RetiredAt = fromNullTime(retiredAt)
+		key.ExpiresAt = fromNullTime(expiresAt)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Save : insert the key or update its life cycle, the key itself never changes
+func (ins *SigningKey) Save(ctx context.Context, key *auth.SigningKey) error {
+	der, err := key.MarshalPrivateKey()
+	if err != nil {
+		return err
+	}
+	_, err = ins.exec(ctx, ins.db, `INSERT INTO signing_keys (id, alg, private_key, created_at, retired_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET retired_at = excluded.retired_at, expires_at = excluded.expires_at`,
+		key.ID, key.Algorithm, der, timestamp(key.CreatedAt), optionalTime(key.RetiredAt), optionalTime(key.ExpiresAt))
+	return err
+}
+
+func (ins *SigningKey) Delete(ctx context.Context, id string) error {
+	_, err := ins.exec(ctx, ins.db, `DELETE FROM signing_keys WHERE id = ?`, id)
+	return err
+}
@@ -0,0 +1,301 @@
+// Package sqldb keeps every store in PostgreSQL or SQLite through database/sql.
+// The schema is created and upgraded by the migrations embedded in the binary
+// when the database is opened.
+package sqldb
+
+import (
+	"app/internal/auth"
+	"app/internal/store"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialects accepted by Open
+const (
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+type DB struct {
+	Session  *LoginSession
+	User     *User
+	WebAuthn *WebAuthnChallenge
+	Attempt  *LoginAttempt
+	Keys     *SigningKey
+	OAuth    *Authorization
+	Clients  *Client
+
+	conn *conn
+}
+
+// Open : connect with dsn, a postgres:// URL or key=value list for Postgres and
+// a file name for SQLite, then apply the pending migrations
+func Open(ctx context.Context, dialect, dsn string) (*DB, error) {
+	var c *conn
+	switch dialect {
+	case Postgres:
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, err
+		}
+		c = &conn{db: db, dialect: dialect}
+	case SQLite:
+		db, err := sql.Open("sqlite", sqliteDSN(dsn))
+		if err != nil {
+			return nil, err
+		}
+		// SQLite has a single writer, one connection avoids busy errors and
+		// keeps an in-memory database shared
+		db.SetMaxOpenConns(1)
+		c = &conn{db: db, dialect: dialect}
+	default:
+		return nil, fmt.Errorf("sqldb: unknown dialect %q", dialect)
+	}
+	if err := c.db.PingContext(ctx); err != nil {
+		_ = c.db.Close()
+		return nil, err
+	}
+	if err := migrate(ctx, c); err != nil {
+		_ = c.db.Close()
+		return nil, err
+	}
+	return &DB{
+		Session:  &LoginSession{c},
+		User:     &User{c},
+		WebAuthn: &WebAuthnChallenge{c},
+		Attempt:  &LoginAttempt{c},
+		Keys:     &SigningKey{c},
+		OAuth:    &Authorization{c},
+		Clients:  &Client{c},
+		conn:     c,
+	}, nil
+}
+
+// Store : the tables behind the store interfaces
+func (ins *DB) Store() *store.DB {
+	return &store.DB{
+		Session:  ins.Session,
+		User:     ins.User,
+		WebAuthn: ins.WebAuthn,
+		Attempt:  ins.Attempt,
+		Keys:     ins.Keys,
+		OAuth:    ins.OAuth,
+		Clients:  ins.Clients,
+		Tx:       ins.conn,
+	}
+}
+
+func (ins *DB) Close() error {
+	return ins.conn.db.Close()
+}
+
+// sqliteDSN : enforce foreign keys and wait for locks held by other processes
+func sqliteDSN(dsn string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite"
+}
+
+// conn : the database with the few differences between dialects. Queries are
+// written with ? placeholders and rebound for Postgres.
+type conn struct {
+	db      *sql.DB
+	dialect string
+}
+
+// querier : a connection or a transaction
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (ins *conn) rebind(query string) string {
+	if ins.dialect != Postgres {
+		return query
+	}
+	var (
+		b strings.Builder
+		n int
+	)
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// txKey : the context key of the transaction opened by InTransaction
+type txKey struct{}
+
+// querier : q, or the transaction of ctx when q is the database, so the
+// stores called in InTransaction write in it
+func (ins *conn) querier(ctx context.Context, q querier) querier {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok && q == querier(ins.db) {
+		return tx
+	}
+	return q
+}
+
+func (ins *conn) exec(ctx context.Context, q querier, query string, args ...interface{}) (int64, error) {
+	r, err := ins.querier(ctx, q).ExecContext(ctx, ins.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+func (ins *conn) query(ctx context.Context, q querier, query string, args ...interface{}) (*sql.Rows, error) {
+	return ins.querier(ctx, q).QueryContext(ctx, ins.rebind(query), args...)
+}
+
+func (ins *conn) queryRow(ctx context.Context, q querier, query string, args ...interface{}) *sql.Row {
+	return ins.querier(ctx, q).QueryRowContext(ctx, ins.rebind(query), args...)
+}
+
+// forUpdate : lock the selected row until the transaction ends, SQLite
+// transactions hold the database lock already
+func (ins *conn) forUpdate() string {
+	if ins.dialect == Postgres {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+// inTx : run fn in a transaction, committed when fn returns nil. Within the one
+// of InTransaction fn joins it.
+func (ins *conn) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return fn(tx)
+	}
+	tx, err := ins.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// InTransaction : fn in one transaction, the stores it calls with ctx write in it
+func (ins *conn) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return ins.inTx(ctx, func(tx *sql.Tx) error {
+		return fn(context.WithValue(ctx, txKey{}, tx))
+	})
+}
+
+// isUniqueViolation : the insert or update hit a unique constraint
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE ||
+			sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	return false
+}
+
+// notFound : sql.ErrNoRows as the error every store returns for a missing row
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return store.ErrNotFound
+	}
+	return err
+}
+
+// placeholders : "?, ?, ?" for n values
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func objectIDs(ids []primitive.ObjectID) []interface{} {
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id.Hex())
+	}
+	return args
+}
+
+// parseObjectID : ids are stored as their hex string, an empty one is the nil id
+func parseObjectID(hex string) (primitive.ObjectID, error) {
+	if len(hex) == 0 {
+		return primitive.NilObjectID, nil
+	}
+	return primitive.ObjectIDFromHex(hex)
+}
+
+// optionalID : NULL for the nil id
+func optionalID(id primitive.ObjectID) interface{} {
+	if id.IsZero() {
+		return nil
+	}
+	return id.Hex()
+}
+
+// timestamp : every time is stored in UTC so SQLite compares them as text correctly
+func timestamp(t time.Time) time.Time {
+	return t.UTC()
+}
+
+// optionalTime : NULL for the zero time
+func optionalTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+func fromNullTime(t sql.NullTime) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return t.Time
+}
+
+// encodeList : lists are stored as a JSON array in a text column
+func encodeList(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func decodeList(s string, v interface{}) error {
+	if len(s) == 0 {
+		return nil
+	}
+	return json.Unmarshal([]byte(s), v)
+}
+
+var (
+	_ store.UserStore          = (*User)(nil)
+	_ store.SessionStore       = (*LoginSession)(nil)
+	_ store.AttemptStore       = (*LoginAttempt)(nil)
+	_ store.ChallengeStore     = (*WebAuthnChallenge)(nil)
+	_ store.AuthorizationStore = (*Authorization)(nil)
+	_ store.ClientStore        = (*Client)(nil)
+	_ auth.KeyStore            = (*SigningKey)(nil)
+	_ store.Transactor         = (*conn)(nil)
+)
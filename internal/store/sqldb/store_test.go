@@ -0,0 +1,56 @@
+package sqldb
+
+import (
+	"app/internal/store"
+	"app/internal/store/storetest"
+	"context"
+	"database/sql"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) *store.DB {
+		db, err := Open(context.Background(), SQLite, ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return db.Store()
+	})
+}
+
+// TestPostgresStore : runs against the server of STORE_TEST_POSTGRES_URL, each
+// test in a schema of its own
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("STORE_TEST_POSTGRES_URL")
+	if len(dsn) == 0 {
+		t.Skip("STORE_TEST_POSTGRES_URL is not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = admin.Close() })
+	storetest.Run(t, func(t *testing.T) *store.DB {
+		ctx := context.Background()
+		schema := "storetest_" + primitive.NewObjectID().Hex()
+		if _, err := admin.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _, _ = admin.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE") })
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		db, err := Open(ctx, Postgres, fmt.Sprintf("%s%ssearch_path=%s", dsn, sep, schema))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return db.Store()
+	})
+}
@@ -0,0 +1,312 @@
+package sqldb
+
+import (
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"context"
+	"database/sql"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// User : users with their live sessions, recovery codes and passkeys in tables of their own
+type User struct {
+	*conn
+}
+
+const userColumns = `id, username, password, max_sessions, mfa_active, mfa_secret, mfa_last_step, created_at`
+
+func (ins *User) CreateUser(ctx context.Context, username string, passwordHash string) (primitive.ObjectID, error) {
+	id := primitive.NewObjectID()
+	_, err := ins.exec(ctx, ins.db, `INSERT INTO users (id, username, password, created_at) VALUES (?, ?, ?, ?)`,
+		id.Hex(), username, passwordHash, timestamp(time.Now()))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return primitive.NilObjectID, store.ErrUsernameTaken
+		}
+		return primitive.NilObjectID, err
+	}
+	return id, nil
+}
+
+func (ins *User) FindByID(ctx context.Context, id primitive.ObjectID) (*models.UserModel, error) {
+	return ins.find(ctx, `SELECT `+userColumns+` FROM users WHERE id = ?`, id.Hex())
+}
+
+// FindByUsername : the password is never part of the filter, callers verify the hash
+func (ins *User) FindByUsername(ctx context.Context, username string) (*models.UserModel, error) {
+	return ins.find(ctx, `SELECT `+userColumns+` FROM users WHERE username = ?`, username)
+}
+
+// find : the user row with its rows in the other tables
+func (ins *User) find(ctx context.Context, query string, args ...interface{}) (*models.UserModel, error) {
+	var user models.UserModel
+	err := ins.inTx(ctx, func(tx *sql.Tx) error {
+		var (
+			id        string
+			createdAt time.Time
+		)
+		if err := ins.queryRow(ctx, tx, query, args...).Scan(&id, &user.Username, &user.Password, &user.MaxSessions,
+			&user.MFAActive, &user.MFASecret, &user.MFALastStep, &createdAt); err != nil {
+			return notFound(err)
+		}
+		var err error
+		if user.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return err
+		}
+		user.CreatedAt = createdAt
+		if user.Sessions, err = ins.sessions(ctx, tx, id); err != nil {
+			return err
+		}
+		if user.RecoveryCodes, err = ins.recoveryCodes(ctx, tx, id); err != nil {
+			return err
+		}
+		user.Passkeys, err = ins.passkeys(ctx, tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (ins *User) sessions(ctx context.Context, tx *sql.Tx, userID string) ([]primitive.ObjectID, error) {
+	rows, err := ins.query(ctx, tx, `SELECT session_id FROM user_sessions WHERE user_id = ? ORDER BY seq`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []primitive.ObjectID
+	for rows.Next() {
+		var hex string
+		if err := rows.Scan(&hex); err != nil {
+			return nil, err
+		}
+		id, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (ins *User) recoveryCodes(ctx context.Context, tx *sql.Tx, userID string) ([]string, error) {
+	rows, err := ins.query(ctx, tx, `SELECT code_hash FROM recovery_codes WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+func (ins *User) passkeys(ctx context.Context, tx *sql.Tx, userID string) ([]models.PasskeyModel, error) {
+	rows, err := ins.query(ctx, tx, `SELECT credential_id, public_key, attestation_type, aaguid, sign_count,
+		transports, name, backup_eligible, backup_state, created_at, last_used_at
+		FROM passkeys WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var passkeys []models.PasskeyModel
+	for rows.Next() {
+		var (
+			passkey    models.PasskeyModel
+			signCount  int64
+			transports string
+			lastUsedAt sql.NullTime
+		)
+		if err := rows.Scan(&passkey.CredentialID, &passkey.PublicKey, &passkey.AttestationType, &passkey.AAGUID,
+			&signCount, &transports, &passkey.Name, &passkey.BackupEligible, &passkey.BackupState,
+			&passkey.CreatedAt, &lastUsedAt); err != nil {
+			return nil, err
+		}
+		if err := decodeList(transports, &passkey.Transports); err != nil {
+			return nil, err
+		}
+		passkey.SignCount = uint32(signCount)
+		passkey.LastUsedAt = fromNullTime(lastUsedAt)
+		passkeys = append(passkeys, passkey)
+	}
+	return passkeys, rows.Err()
+}
+
+// PushSession : link a new session to the user. With maxSessions > 0 the oldest
+// sessions are dropped when evict is set, otherwise the push is refused with
+// store.ErrSessionLimit. The user row is locked so concurrent logins cannot
+// exceed the limit.
+func (ins *User) PushSession(ctx context.Context, uuid, sessionID primitive.ObjectID, maxSessions int, evict bool) error {
+	return ins.inTx(ctx, func(tx *sql.Tx) error {
+		var id string
+		if err := ins.queryRow(ctx, tx, `SELECT id FROM users WHERE id = ?`+ins.forUpdate(), uuid.Hex()).Scan(&id); err != nil {
+			return notFound(err)
+		}
+		if maxSessions > 0 && !evict {
+			var n int
+			if err := ins.queryRow(ctx, tx, `SELECT COUNT(*) FROM user_sessions WHERE user_id = ?`, id).Scan(&n); err != nil {
+				return err
+			}
+			if n >= maxSessions {
+				return store.ErrSessionLimit
+			}
+		}
+		if _, err := ins.exec(ctx, tx, `INSERT INTO user_sessions (user_id, session_id) VALUES (?, ?)`,
+			id, sessionID.Hex()); err != nil {
+			return err
+		}
+		if maxSessions > 0 && evict {
+			if _, err := ins.exec(ctx, tx, `DELETE FROM user_sessions WHERE user_id = ? AND seq NOT IN (
+				SELECT seq FROM user_sessions WHERE user_id = ? ORDER BY seq DESC LIMIT ?)`,
+				id, id, maxSessions); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ins *User) SetMaxSessions(ctx context.Context, id primitive.ObjectID, maxSessions int) error {
+	_, err := ins.exec(ctx, ins.db, `UPDATE users SET max_sessions = ? WHERE id = ?`, maxSessions, id.Hex())
+	return err
+}
+
+func (ins *User) RevokeSession(ctx context.Context, uuid, sessionID primitive.ObjectID) error {
+	_, err := ins.exec(ctx, ins.db, `DELETE FROM user_sessions WHERE user_id = ? AND session_id = ?`,
+		uuid.Hex(), sessionID.Hex())
+	return err
+}
+
+// RevokeOtherSessions : drop every session of the user except keep
+func (ins *User) RevokeOtherSessions(ctx context.Context, uuid, keep primitive.ObjectID) error {
+	_, err := ins.exec(ctx, ins.db, `DELETE FROM user_sessions WHERE user_id = ? AND session_id <> ?`,
+		uuid.Hex(), keep.Hex())
+	return err
+}
+
+func (ins *User) ValidateSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error) {
+	var n int
+	if err := ins.queryRow(ctx, ins.db, `SELECT COUNT(*) FROM user_sessions WHERE session_id = ?`,
+		sessionID.Hex()).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (ins *User) ChangePassword(ctx context.Context, id primitive.ObjectID, passwordHash string) error {
+	_, err := ins.exec(ctx, ins.db, `UPDATE users SET password = ? WHERE id = ?`, passwordHash, id.Hex())
+	return err
+}
+
+// UpdateMfaSecret : a new enrollment starts without used codes
+func (ins *User) UpdateMfaSecret(ctx context.Context, id primitive.ObjectID, secret string) error {
+	_, err := ins.exec(ctx, ins.db, `UPDATE users SET mfa_secret = ?, mfa_last_step = 0 WHERE id = ?`, secret, id.Hex())
+	return err
+}
+
+// UseOTPStep : record the TOTP time step of an accepted code while the stored
+// step is lower and the secret is unchanged, so a code is accepted at most once
+func (ins *User) UseOTPStep(ctx context.Context, id primitive.ObjectID, secret string, step int64) (bool, error) {
+	n, err := ins.exec(ctx, ins.db, `UPDATE users SET mfa_last_step = ? WHERE id = ? AND mfa_secret = ? AND mfa_last_step < ?`,
+		step, id.Hex(), secret, step)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (ins *User) UpdateMfaActive(ctx context.Context, id primitive.ObjectID, active bool) error {
+	_, err := ins.exec(ctx, ins.db, `UPDATE users SET mfa_active = ? WHERE id = ?`, active, id.Hex())
+	return err
+}
+
+func (ins *User) SetRecoveryCodes(ctx context.Context, id primitive.ObjectID, hashes []string) error {
+	return ins.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := ins.exec(ctx, tx, `DELETE FROM recovery_codes WHERE user_id = ?`, id.Hex()); err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			if _, err := ins.exec(ctx, tx, `INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`,
+				id.Hex(), hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UseRecoveryCode : delete the code so it can be used only once, used is false
+// when the user has no such code
+func (ins *User) UseRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) (bool, error) {
+	n, err := ins.exec(ctx, ins.db, `DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?`, id.Hex(), hash)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// AddPasskey : the credential ID is the primary key, so it belongs to one user
+func (ins *User) AddPasskey(ctx context.Context, id primitive.ObjectID, passkey models.PasskeyModel) error {
+	transports, err := encodeList(passkey.Transports)
+	if err != nil {
+		return err
+	}
+	err = ins.inTx(ctx, func(tx *sql.Tx) error {
+		var n int
+		if err := ins.queryRow(ctx, tx, `SELECT COUNT(*) FROM users WHERE id = ?`, id.Hex()).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return store.ErrPasskeyExists
+		}
+		_, err := ins.exec(ctx, tx, `INSERT INTO passkeys (credential_id, user_id, public_key, attestation_type, aaguid,
+			sign_count, transports, name, backup_eligible, backup_state, created_at, last_used_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			passkey.CredentialID, id.Hex(), passkey.PublicKey, passkey.AttestationType, passkey.AAGUID,
+			int64(passkey.SignCount), transports, passkey.Name, passkey.BackupEligible, passkey.BackupState,
+			timestamp(passkey.CreatedAt), optionalTime(passkey.LastUsedAt))
+		return err
+	})
+	if isUniqueViolation(err) {
+		return store.ErrPasskeyExists
+	}
+	return err
+}
+
+func (ins *User) FindByPasskey(ctx context.Context, credentialID []byte) (*models.UserModel, error) {
+	return ins.find(ctx, `SELECT `+userColumns+` FROM users
+		WHERE id = (SELECT user_id FROM passkeys WHERE credential_id = ?)`, credentialID)
+}
+
+// UpdatePasskeySignCount : store the counter of a successful assertion while the
+// stored one is lower, so a regression that races another login is still
+// detected; authenticators without a counter always report 0
+func (ins *User) UpdatePasskeySignCount(ctx context.Context, id primitive.ObjectID, credentialID []byte, signCount uint32) (bool, error) {
+	query := `UPDATE passkeys SET sign_count = ?, last_used_at = ?
+		WHERE user_id = ? AND credential_id = ? AND sign_count < ?`
+	if signCount == 0 {
+		query = `UPDATE passkeys SET sign_count = ?, last_used_at = ?
+		WHERE user_id = ? AND credential_id = ? AND sign_count = ?`
+	}
+	n, err := ins.exec(ctx, ins.db, query,
+		int64(signCount), timestamp(time.Now()), id.Hex(), credentialID, int64(signCount))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (ins *User) RemovePasskey(ctx context.Context, id primitive.ObjectID, credentialID []byte) (bool, error) {
+	n, err := ins.exec(ctx, ins.db, `DELETE FROM passkeys WHERE user_id = ? AND credential_id = ?`, id.Hex(), credentialID)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
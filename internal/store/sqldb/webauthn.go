@@ -0,0 +1,63 @@
+package sqldb
+
+import (
+	"app/internal/mongodb/db/models"
+	"context"
+	"database/sql"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// WebAuthnChallenge : WebAuthn ceremonies between begin and finish
+type WebAuthnChallenge struct {
+	*conn
+}
+
+// Create : expired challenges are deleted first
+func (ins *WebAuthnChallenge) Create(ctx context.Context, challenge *models.WebAuthnChallengeModel) (primitive.ObjectID, error) {
+	now := time.Now()
+	if _, err := ins.exec(ctx, ins.db, `DELETE FROM webauthn_challenges WHERE expires_at <= ?`, timestamp(now)); err != nil {
+		return primitive.NilObjectID, err
+	}
+	allowed, err := encodeList(challenge.AllowedCredentialIDs)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	challenge.ID = primitive.NewObjectID()
+	challenge.CreatedAt = now
+	if _, err := ins.exec(ctx, ins.db, `INSERT INTO webauthn_challenges (id, user_id, purpose, challenge, user_handle,
+		allowed_credential_ids, user_verification, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		challenge.ID.Hex(), optionalID(challenge.UserID), challenge.Purpose, challenge.Challenge, challenge.UserHandle,
+		allowed, challenge.UserVerification, timestamp(challenge.ExpiresAt), timestamp(challenge.CreatedAt)); err != nil {
+		return primitive.NilObjectID, err
+	}
+	return challenge.ID, nil
+}
+
+// Take : load and delete an unexpired challenge in one statement so every ceremony finishes at most once
+func (ins *WebAuthnChallenge) Take(ctx context.Context, id primitive.ObjectID, purpose string) (*models.WebAuthnChallengeModel, error) {
+	var (
+		challenge models.WebAuthnChallengeModel
+		rowID     string
+		userID    sql.NullString
+		allowed   string
+		err       error
+	)
+	if err = ins.queryRow(ctx, ins.db, `DELETE FROM webauthn_challenges
+		WHERE id = ? AND purpose = ? AND expires_at > ?
+		RETURNING id, user_id, purpose, challenge, user_handle, allowed_credential_ids, user_verification, expires_at, created_at`,
+		id.Hex(), purpose, timestamp(time.Now())).Scan(&rowID, &userID, &challenge.Purpose, &challenge.Challenge,
+		&challenge.UserHandle, &allowed, &challenge.UserVerification, &challenge.ExpiresAt, &challenge.CreatedAt); err != nil {
+		return nil, notFound(err)
+	}
+	if challenge.ID, err = parseObjectID(rowID); err != nil {
+		return nil, err
+	}
+	if challenge.UserID, err = parseObjectID(userID.String); err != nil {
+		return nil, err
+	}
+	if err = decodeList(allowed, &challenge.AllowedCredentialIDs); err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
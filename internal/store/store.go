@@ -0,0 +1,185 @@
+// Package store defines what the services need from persistence, so the Mongo
+// collections can be swapped for another backend.
+package store
+
+import (
+	"app/internal/auth"
+	"app/internal/mongodb/db/models"
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+var (
+	// ErrNotFound is what the Mongo driver returns, so both can be checked alike
+	ErrNotFound      = mongo.ErrNoDocuments
+	ErrUsernameTaken = errors.New("username already taken")
+	ErrPasskeyExists = errors.New("passkey already registered")
+	ErrSessionLimit  = errors.New("session limit reached")
+)
+
+// RevokedSessionRetention : how long a signed out session is kept for review
+const RevokedSessionRetention = 7 * 24 * time.Hour
+
+// DB : every store of the application
+type DB struct {
+	Session  SessionStore
+	User     UserStore
+	WebAuthn ChallengeStore
+	Attempt  AttemptStore
+	Keys     auth.KeyStore
+	OAuth    AuthorizationStore
+	Clients  ClientStore
+	// Tx groups writes to several stores, nil when the backend cannot
+	Tx Transactor
+}
+
+// Transactor : runs fn so that the writes it makes through the stores, with the
+// ctx it is given, are applied together or not at all. fn may run more than
+// once when the transaction is retried after a conflict.
+type Transactor interface {
+	InTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// InTransaction : fn in a transaction of Tx. Without one fn runs as it is, each
+// write applied on its own, so fn must undo what it wrote before an error
+// when a partial result would be harmful.
+func (ins *DB) InTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ins.Tx == nil {
+		return fn(ctx)
+	}
+	return ins.Tx.InTransaction(ctx, fn)
+}
+
+// UserStore : accounts with their credentials and the ids of their live sessions
+type UserStore interface {
+	// CreateUser : passwordHash must already be encoded by the password package
+	CreateUser(ctx context.Context, username string, passwordHash string) (primitive.ObjectID, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (*models.UserModel, error)
+	FindByUsername(ctx context.Context, username string) (*models.UserModel, error)
+	// PushSession : link a new session to the user. With maxSessions > 0 the
+	// oldest sessions are dropped when evict is set, otherwise the push is
+	// refused with ErrSessionLimit.
+	PushSession(ctx context.Context, uuid, sessionID primitive.ObjectID, maxSessions int, evict bool) error
+	SetMaxSessions(ctx context.Context, id primitive.ObjectID, maxSessions int) error
+	RevokeSession(ctx context.Context, uuid, sessionID primitive.ObjectID) error
+	// RevokeOtherSessions : drop every session of the user except keep
+	RevokeOtherSessions(ctx context.Context, uuid, keep primitive.ObjectID) error
+	// ValidateSession : the session is still linked to a user
+	ValidateSession(ctx context.Context, sessionID primitive.ObjectID) (bool, error)
+	ChangePassword(ctx context.Context, id primitive.ObjectID, passwordHash string) error
+	// UpdateMfaSecret : a new enrollment also forgets the last used step
+	UpdateMfaSecret(ctx context.Context, id primitive.ObjectID, secret string) error
+	// UseOTPStep : record the step of an accepted code while it is newer than
+	// the stored one and the secret is unchanged, false when it is not
+	UseOTPStep(ctx context.Context, id primitive.ObjectID, secret string, step int64) (bool, error)
+	UpdateMfaActive(ctx context.Context, id primitive.ObjectID, active bool) error
+	SetRecoveryCodes(ctx context.Context, id primitive.ObjectID, hashes []string) error
+	// UseRecoveryCode : remove the code atomically, false when the user has no such code
+	UseRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) (bool, error)
+	// AddPasskey : ErrPasskeyExists when the credential is registered already
+	AddPasskey(ctx context.Context, id primitive.ObjectID, passkey models.PasskeyModel) error
+	FindByPasskey(ctx context.Context, credentialID []byte) (*models.UserModel, error)
+	// UpdatePasskeySignCount : store the counter only while the stored one is
+	// lower, or both are 0; false reports a counter regression
+	UpdatePasskeySignCount(ctx context.Context, id primitive.ObjectID, credentialID []byte, signCount uint32) (bool, error)
+	RemovePasskey(ctx context.Context, id primitive.ObjectID, credentialID []byte) (bool, error)
+}
+
+// SessionStore : the token pairs issued at each login
+type SessionStore interface {
+	// CreateNewSession : insert the session, ID and timestamps are filled in here
+	CreateNewSession(ctx context.Context, session *models.SessionModel, lifetime SessionLifetime) (primitive.ObjectID, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Touch : record that the session was used, at most once per interval, and slide its expiry
+	Touch(ctx context.Context, session *models.SessionModel, interval time.Duration, lifetime SessionLifetime) error
+	Revoke(ctx context.Context, ids ...primitive.ObjectID) error
+	RevokeOthers(ctx context.Context, userID, keep primitive.ObjectID) error
+	GetByID(ctx context.Context, id primitive.ObjectID) (*models.SessionModel, error)
+	// FindByIDs : sessions of the user among ids, most recently used first
+	FindByIDs(ctx context.Context, userID primitive.ObjectID, ids []primitive.ObjectID) ([]models.SessionModel, error)
+	GetByAT(ctx context.Context, accessToken string) (*models.SessionModel, error)
+	GetByFamily(ctx context.Context, family primitive.ObjectID) ([]models.SessionModel, error)
+	// Rotate : replace both tokens if the session is still at its generation
+	// and not revoked, false means another request rotated or revoked it first
+	Rotate(ctx context.Context, session *models.SessionModel, accessToken, refreshToken string, lifetime SessionLifetime) (bool, error)
+}
+
+// AttemptStore : failure counters shared by every API instance
+type AttemptStore interface {
+	// Fail : count a failure under key and return the failures within window
+	Fail(ctx context.Context, key string, window time.Duration) (int, error)
+	// Lock : keep key locked at least until the given time
+	Lock(ctx context.Context, key string, until time.Time) error
+	// Claim : lock key until the given time unless it is locked already, false
+	// when another attempt holds the lock
+	Claim(ctx context.Context, key string, until time.Time) (bool, error)
+	// Release : take back a failure counted by Fail, the lock is kept
+	Release(ctx context.Context, key string) error
+	// LockedUntil : the latest lock among keys, zero when none of them is locked
+	LockedUntil(ctx context.Context, keys []string) (time.Time, error)
+	Reset(ctx context.Context, keys []string) error
+}
+
+// ChallengeStore : WebAuthn ceremonies between begin and finish
+type ChallengeStore interface {
+	Create(ctx context.Context, challenge *models.WebAuthnChallengeModel) (primitive.ObjectID, error)
+	// Take : load and delete an unexpired challenge so every ceremony finishes at most once
+	Take(ctx context.Context, id primitive.ObjectID, purpose string) (*models.WebAuthnChallengeModel, error)
+}
+
+// AuthorizationStore : OpenID Connect authorization requests and their codes
+type AuthorizationStore interface {
+	Create(ctx context.Context, authorization *models.AuthorizationModel) error
+	// GetPending : a request the user has not logged in for yet
+	GetPending(ctx context.Context, id string) (*models.AuthorizationModel, error)
+	// Approve : attach the code and the session, false when the request
+	// expired or was approved already
+	Approve(ctx context.Context, id, codeHash string, userID, sessionID primitive.ObjectID, expiresAt time.Time) (bool, error)
+	// Redeem : take the authorization of a code, a code can be redeemed only once
+	Redeem(ctx context.Context, codeHash string) (*models.AuthorizationModel, error)
+}
+
+// ClientStore : the registered client applications
+type ClientStore interface {
+	FindByID(ctx context.Context, id string) (*models.ClientModel, error)
+	// Upsert : create the client or replace its settings, keeping created_at
+	Upsert(ctx context.Context, client *models.ClientModel) error
+}
+
+// SessionLifetime : a session ends IdleTimeout after its last use and at the
+// latest MaxLifetime after the login, zero disables either limit
+type SessionLifetime struct {
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+}
+
+// ExpiresAt : when the session ends if it is not used again after lastUsed,
+// zero when neither limit is set
+func (l SessionLifetime) ExpiresAt(createdAt, lastUsed time.Time) time.Time {
+	var expiresAt time.Time
+	if l.IdleTimeout > 0 {
+		expiresAt = lastUsed.Add(l.IdleTimeout)
+	}
+	if l.MaxLifetime > 0 {
+		if end := createdAt.Add(l.MaxLifetime); expiresAt.IsZero() || end.Before(expiresAt) {
+			expiresAt = end
+		}
+	}
+	return expiresAt
+}
+
+// Ended : the session was revoked, or has expired under the current limits,
+// which may be shorter than the ones it was created with
+func (l SessionLifetime) Ended(session *models.SessionModel, now time.Time) bool {
+	if !session.RevokedAt.IsZero() {
+		return true
+	}
+	if !session.ExpiresAt.IsZero() && !now.Before(session.ExpiresAt) {
+		return true
+	}
+	expiresAt := l.ExpiresAt(session.CreatedAt, session.LastUsedAt)
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"app/internal/mongodb/db/models"
+	"testing"
+	"time"
+)
+
+func TestSessionLifetimeExpiresAt(t *testing.T) {
+	var (
+		createdAt = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		lastUsed  = createdAt.Add(20 * time.Hour)
+	)
+	for _, c := range []struct {
+		name     string
+		lifetime SessionLifetime
+		want     time.Time
+	}{
+		{"no limits", SessionLifetime{}, time.Time{}},
+		{"idle timeout", SessionLifetime{IdleTimeout: time.Hour}, lastUsed.Add(time.Hour)},
+		{"max lifetime", SessionLifetime{MaxLifetime: 24 * time.Hour}, createdAt.Add(24 * time.Hour)},
+		{"idle before the max", SessionLifetime{IdleTimeout: time.Hour, MaxLifetime: 24 * time.Hour}, lastUsed.Add(time.Hour)},
+		{"max before the idle", SessionLifetime{IdleTimeout: 8 * time.Hour, MaxLifetime: 24 * time.Hour}, createdAt.Add(24 * time.Hour)},
+	} {
+		if got := c.lifetime.ExpiresAt(createdAt, lastUsed); !got.Equal(c.want) {
+			t.Fatalf("%s: %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSessionLifetimeEnded(t *testing.T) {
+	var (
+		now      = time.Now()
+		lifetime = SessionLifetime{IdleTimeout: time.Hour, MaxLifetime: 24 * time.Hour}
+		session  = func(createdAt, lastUsed time.Duration) *models.SessionModel {
+			s := &models.SessionModel{CreatedAt: now.Add(-createdAt), LastUsedAt: now.Add(-lastUsed)}
+			s.ExpiresAt = lifetime.ExpiresAt(s.CreatedAt, s.LastUsedAt)
+			return s
+		}
+	)
+	if live := session(time.Hour, time.Minute); lifetime.Ended(live, now) {
+		t.Fatalf("live session ended: %+v", live)
+	}
+	if idle := session(2*time.Hour, time.Hour); !lifetime.Ended(idle, now) {
+		t.Fatalf("idle session live: %+v", idle)
+	}
+	if old := session(24*time.Hour, time.Minute); !lifetime.Ended(old, now) {
+		t.Fatalf("session past its lifetime live: %+v", old)
+	}
+	revoked := session(time.Hour, time.Minute)
+	revoked.RevokedAt = now.Add(-time.Second)
+	if !lifetime.Ended(revoked, now) {
+		t.Fatalf("revoked session live: %+v", revoked)
+	}
+	// limits shortened since the session was created apply at once
+	live := session(2*time.Hour, 10*time.Minute)
+	if shorter := (SessionLifetime{IdleTimeout: 5 * time.Minute}); !shorter.Ended(live, now) {
+		t.Fatalf("shorter idle timeout ignored: %+v", live)
+	}
+	if shorter := (SessionLifetime{MaxLifetime: time.Hour}); !shorter.Ended(live, now) {
+		t.Fatalf("shorter max lifetime ignored: %+v", live)
+	}
+	// but the expiry stored with the session is not extended by longer ones
+	if (SessionLifetime{}).Ended(live, now) || !(SessionLifetime{}).Ended(session(2*time.Hour, time.Hour), now) {
+		t.Fatal("stored expiry ignored without limits")
+	}
+}
@@ -0,0 +1,557 @@
+// Package storetest checks the behaviour the services rely on from a store
+// backend. Every backend runs it from its own tests, so they can not drift.
+package storetest
+
+import (
+	"app/internal/auth"
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Run : the conformance tests, open gives every test an empty set of stores
+func Run(t *testing.T, open func(t *testing.T) *store.DB) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, db *store.DB)
+	}{
+		{"Users", testUsers},
+		{"UserSessions", testUserSessions},
+		{"OTPSteps", testOTPSteps},
+		{"RecoveryCodes", testRecoveryCodes},
+		{"Passkeys", testPasskeys},
+		{"Sessions", testSessions},
+		{"SessionRotation", testSessionRotation},
+		{"Attempts", testAttempts},
+		{"Challenges", testChallenges},
+		{"Authorizations", testAuthorizations},
+		{"Clients", testClients},
+		{"SigningKeys", testSigningKeys},
+		{"Transactions", testTransactions},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, open(t))
+		})
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createUser(t *testing.T, db *store.DB, username string) primitive.ObjectID {
+	t.Helper()
+	id, err := db.User.CreateUser(context.Background(), username, "$argon2id$hash")
+	must(t, err)
+	return id
+}
+
+func findUser(t *testing.T, db *store.DB, id primitive.ObjectID) *models.UserModel {
+	t.Helper()
+	user, err := db.User.FindByID(context.Background(), id)
+	must(t, err)
+	return user
+}
+
+func testUsers(t *testing.T, db *store.DB) {
+	ctx := context.Background()
+	id := createUser(t, db, "alice")
+	if _, err := db.User.CreateUser(ctx, "alice", "$argon2id$other"); !errors.Is(err, store.ErrUsernameTaken) {
+		t.Fatalf("duplicate username: %v", err)
+	}
+	user, err := db.User.FindByUsername(ctx, "alice")
+	must(t, err)
+	if user.ID != id || user.Password != "$argon2id$hash" || user.CreatedAt.IsZero() {
+		t.Fatalf("find by username: %+v", user)
+	}
+	if _, err := db.User.FindByUsername(ctx, "bob"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("unknown username: %v", err)
+	}
+	if _, err := db.User.FindByID(ctx, primitive.NewObjectID()); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("unknown id: %v", err)
+	}
+
+	must(t, db.User.ChangePassword(ctx, id, "$argon2id$changed"))
+	must(t, db.User.UpdateMfaActive(ctx, id, true))
+	must(t, db.User.SetMaxSessions(ctx, id, 3))
+	user = findUser(t, db, id)
+	if user.Password != "$argon2id$changed" || !user.MFAActive || user.MaxSessions != 3 {
+		t.Fatalf("updated user: %+v", user)
+	}
+}
+
+func testUserSessions(t *testing.T, db *store.DB) {
+	var (
+		ctx        = context.Background()
+		id         = createUser(t, db, "alice")
+		s1, s2, s3 = primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	)
+	must(t, db.User.PushSession(ctx, id, s1, 2, false))
+	must(t, db.User.PushSession(ctx, id, s2, 2, false))
+	if err := db.User.PushSession(ctx, id, s3, 2, false); !errors.Is(err, store.ErrSessionLimit) {
+		t.Fatalf("push past the limit: %v", err)
+	}
+	// evicting drops the oldest
+	must(t, db.User.PushSession(ctx, id, s3, 2, true))
+	for session, want := range map[primitive.ObjectID]bool{s1: false, s2: true, s3: true} {
+		ok, err := db.User.ValidateSession(ctx, session)
+		must(t, err)
+		if ok != want {
+			t.Fatalf("validate %s: %v, want %v", session.Hex(), ok, want)
+		}
+	}
+
+	must(t, db.User.RevokeSession(ctx, id, s2))
+	if ok, _ := db.User.ValidateSession(ctx, s2); ok {
+		t.Fatal("revoked session still valid")
+	}
+	s4 := primitive.NewObjectID()
+	must(t, db.User.PushSession(ctx, id, s4, 0, false))
+	must(t, db.User.RevokeOtherSessions(ctx, id, s4))
+	if ok, _ := db.User.ValidateSession(ctx, s3); ok {
+		t.Fatal("other session still valid")
+	}
+	if ok, _ := db.User.ValidateSession(ctx, s4); !ok {
+		t.Fatal("kept session revoked")
+	}
+}
+
+func testOTPSteps(t *testing.T, db *store.DB) {
+	ctx := context.Background()
+	id := createUser(t, db, "alice")
+	must(t, db.User.UpdateMfaSecret(ctx, id, "SECRET"))
+	for _, step := range []struct {
+		secret string
+		step   int64
+		want   bool
+	}{
+		{"SECRET", 10, true},
+		{"SECRET", 10, false}, // replay
+		{"SECRET", 9, false},  // older
+		{"OTHER", 11, false},  // secret changed meanwhile
+		{"SECRET", 11, true},
+	} {
+		ok, err := db.User.UseOTPStep(ctx, id, step.secret, step.step)
+		must(t, err)
+		if ok != step.want {
+			t.Fatalf("use step %d with %s: %v, want %v", step.step, step.secret, ok, step.want)
+		}
+	}
+	// a new enrollment starts over
+	must(t, db.User.UpdateMfaSecret(ctx, id, "RENEWED"))
+	if ok, _ := db.User.UseOTPStep(ctx, id, "RENEWED", 5); !ok {
+		t.Fatal("first step of a new secret refused")
+	}
+}
+
+func testRecoveryCodes(t *testing.T, db *store.DB) {
+	ctx := context.Background()
+	id := createUser(t, db, "alice")
+	must(t, db.User.SetRecoveryCodes(ctx, id, []string{"a", "b", "c"}))
+	if ok, _ := db.User.UseRecoveryCode(ctx, id, "b"); !ok {
+		t.Fatal("code refused")
+	}
+	if ok, _ := db.User.UseRecoveryCode(ctx, id, "b"); ok {
+		t.Fatal("code used twice")
+	}
+	if ok, _ := db.User.UseRecoveryCode(ctx, id, "z"); ok {
+		t.Fatal("unknown code accepted")
+	}
+	if codes := findUser(t, db, id).RecoveryCodes; !reflect.DeepEqual(codes, []string{"a", "c"}) {
+		t.Fatalf("remaining codes %v", codes)
+	}
+	must(t, db.User.SetRecoveryCodes(ctx, id, []string{"d"}))
+	if codes := findUser(t, db, id).RecoveryCodes; !reflect.DeepEqual(codes, []string{"d"}) {
+		t.Fatalf("regenerated codes %v", codes)
+	}
+}
+
+func testPasskeys(t *testing.T, db *store.DB) {
+	var (
+		ctx     = context.Background()
+		alice   = createUser(t, db, "alice")
+		bob     = createUser(t, db, "bob")
+		cred    = []byte{1, 2, 3}
+		passkey = models.PasskeyModel{
+			CredentialID: cred,
+			PublicKey:    []byte{4, 5},
+			AAGUID:       []byte{6},
+			SignCount:    1,
+			Transports:   []string{"usb"},
+			Name:         "key",
+			CreatedAt:    time.Now(),
+		}
+	)
+	must(t, db.User.AddPasskey(ctx, alice, passkey))
+	if err := db.User.AddPasskey(ctx, bob, passkey); !errors.Is(err, store.ErrPasskeyExists) {
+		t.Fatalf("credential of another user: %v", err)
+	}
+	user, err := db.User.FindByPasskey(ctx, cred)
+	must(t, err)
+	if user.ID != alice || len(user.Passkeys) != 1 || user.Passkeys[0].Name != "key" {
+		t.Fatalf("find by passkey: %+v", user)
+	}
+	if _, err := db.User.FindByPasskey(ctx, []byte{9}); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("unknown credential: %v", err)
+	}
+	for _, count := range []struct {
+		signCount uint32
+		want      bool
+	}{
+		{5, true},
+		{5, false},
+		{4, false},
+		{6, true},
+		{0, false},
+	} {
+		ok, err := db.User.UpdatePasskeySignCount(ctx, alice, cred, count.signCount)
+		must(t, err)
+		if ok != count.want {
+			t.Fatalf("sign count %d: %v, want %v", count.signCount, ok, count.want)
+		}
+	}
+	if ok, _ := db.User.RemovePasskey(ctx, bob, cred); ok {
+		t.Fatal("passkey removed by another user")
+	}
+	if ok, _ := db.User.RemovePasskey(ctx, alice, cred); !ok {
+		t.Fatal("passkey not removed")
+	}
+	if ok, _ := db.User.RemovePasskey(ctx, alice, cred); ok {
+		t.Fatal("passkey removed twice")
+	}
+}
+
+func newSession(t *testing.T, db *store.DB, userID, family primitive.ObjectID, token string, lifetime store.SessionLifetime) *models.SessionModel {
+	t.Helper()
+	session := &models.SessionModel{
+		UserID:       userID,
+		AccessToken:  "at-" + token,
+		RefreshToken: "rt-" + token,
+		FamilyID:     family,
+		AMR:          []string{auth.AmrPassword},
+		AuthTime:     time.Now(),
+		ClientID:     "app",
+	}
+	_, err := db.Session.CreateNewSession(context.Background(), session, lifetime)
+	must(t, err)
+	return session
+}
+
+func testSessions(t *testing.T, db *store.DB) {
+	var (
+		ctx      = context.Background()
+		user     = primitive.NewObjectID()
+		family   = primitive.NewObjectID()
+		lifetime = store.SessionLifetime{IdleTimeout: time.Hour}
+		first    = newSession(t, db, user, family, "1", lifetime)
+	)
+	if first.ID.IsZero() || first.CreatedAt.IsZero() || first.LastUsedAt.IsZero() || first.ExpiresAt.IsZero() {
+		t.Fatalf("created session %+v", first)
+	}
+	got, err := db.Session.GetByAT(ctx, "at-1")
+	must(t, err)
+	if got.ID != first.ID || got.RefreshToken != "rt-1" || !reflect.DeepEqual(got.AMR, []string{auth.AmrPassword}) {
+		t.Fatalf("get by access token %+v", got)
+	}
+	if _, err := db.Session.GetByAT(ctx, "at-unknown"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("unknown access token: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	second := newSession(t, db, user, primitive.NewObjectID(), "2", lifetime)
+	other := newSession(t, db, primitive.NewObjectID(), family, "3", lifetime)
+	listed, err := db.Session.FindByIDs(ctx, user, []primitive.ObjectID{first.ID, second.ID, other.ID})
+	must(t, err)
+	if len(listed) != 2 || listed[0].ID != second.ID || listed[1].ID != first.ID {
+		t.Fatalf("sessions of the user, most recent first: %+v", listed)
+	}
+	byFamily, err := db.Session.GetByFamily(ctx, family)
+	must(t, err)
+	if len(byFamily) != 2 {
+		t.Fatalf("sessions of the family: %+v", byFamily)
+	}
+
+	// touching slides the expiry
+	time.Sleep(10 * time.Millisecond)
+	must(t, db.Session.Touch(ctx, first, 0, lifetime))
+	touched, err := db.Session.GetByID(ctx, first.ID)
+	must(t, err)
+	if !touched.LastUsedAt.After(first.LastUsedAt) || !touched.ExpiresAt.After(first.ExpiresAt) {
+		t.Fatalf("touched session %+v, was %+v", touched, first)
+	}
+
+	must(t, db.Session.RevokeOthers(ctx, user, second.ID))
+	if revoked, _ := db.Session.GetByID(ctx, first.ID); revoked.RevokedAt.IsZero() {
+		t.Fatal("other session not revoked")
+	}
+	if kept, _ := db.Session.GetByID(ctx, second.ID); !kept.RevokedAt.IsZero() {
+		t.Fatal("kept session revoked")
+	}
+	if untouched, _ := db.Session.GetByID(ctx, other.ID); !untouched.RevokedAt.IsZero() {
+		t.Fatal("session of another user revoked")
+	}
+	must(t, db.Session.Revoke(ctx, second.ID))
+	if revoked, _ := db.Session.GetByID(ctx, second.ID); revoked.RevokedAt.IsZero() {
+		t.Fatal("session not revoked")
+	}
+	must(t, db.Session.Delete(ctx, other.ID))
+	if _, err := db.Session.GetByID(ctx, other.ID); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("deleted session: %v", err)
+	}
+}
+
+func testSessionRotation(t *testing.T, db *store.DB) {
+	var (
+		ctx      = context.Background()
+		lifetime = store.SessionLifetime{}
+		session  = newSession(t, db, primitive.NewObjectID(), primitive.NewObjectID(), "1", lifetime)
+		stale    = *session
+	)
+	ok, err := db.Session.Rotate(ctx, session, "at-2", "rt-2", lifetime)
+	must(t, err)
+	if !ok {
+		t.Fatal("rotation refused")
+	}
+	rotated, err := db.Session.GetByID(ctx, session.ID)
+	must(t, err)
+	if rotated.AccessToken != "at-2" || rotated.RefreshToken != "rt-2" || rotated.Generation != stale.Generation+1 {
+		t.Fatalf("rotated session %+v", rotated)
+	}
+	// a concurrent refresh loaded the session at the same generation
+	if ok, _ := db.Session.Rotate(ctx, &stale, "at-3", "rt-3", lifetime); ok {
+		t.Fatal("rotation of a stale generation accepted")
+	}
+	must(t, db.Session.Revoke(ctx, session.ID))
+	if ok, _ := db.Session.Rotate(ctx, rotated, "at-4", "rt-4", lifetime); ok {
+		t.Fatal("rotation of a revoked session accepted")
+	}
+}
+
+func testAttempts(t *testing.T, db *store.DB) {
+	ctx := context.Background()
+	for want := 1; want <= 3; want++ {
+		n, err := db.Attempt.Fail(ctx, "pwd:alice", time.Hour)
+		must(t, err)
+		if n != want {
+			t.Fatalf("failures %d, want %d", n, want)
+		}
+	}
+	must(t, db.Attempt.Release(ctx, "pwd:alice"))
+	if n, _ := db.Attempt.Fail(ctx, "pwd:alice", time.Hour); n != 3 {
+		t.Fatalf("failures after release %d, want 3", n)
+	}
+	// the window has passed
+	time.Sleep(10 * time.Millisecond)
+	if n, _ := db.Attempt.Fail(ctx, "pwd:alice", time.Millisecond); n != 1 {
+		t.Fatalf("failures past the window %d, want 1", n)
+	}
+
+	until := time.Now().Add(time.Hour)
+	must(t, db.Attempt.Lock(ctx, "pwd:alice", until))
+	// a shorter lock does not shorten it
+	must(t, db.Attempt.Lock(ctx, "pwd:alice", time.Now().Add(time.Minute)))
+	locked, err := db.Attempt.LockedUntil(ctx, []string{"ip:192.0.2.1", "pwd:alice"})
+	must(t, err)
+	if locked.Sub(until).Abs() > time.Millisecond {
+		t.Fatalf("locked until %s, want %s", locked, until)
+	}
+	if ok, _ := db.Attempt.Claim(ctx, "pwd:alice", time.Now().Add(time.Hour)); ok {
+		t.Fatal("claim of a locked key")
+	}
+
+	if n, _ := db.Attempt.Fail(ctx, "pwd:bob", time.Hour); n != 1 {
+		t.Fatalf("failures of another key %d", n)
+	}
+	must(t, db.Attempt.Lock(ctx, "pwd:bob", time.Now().Add(-time.Second)))
+	if ok, _ := db.Attempt.Claim(ctx, "pwd:bob", time.Now().Add(time.Minute)); !ok {
+		t.Fatal("claim of an expired lock refused")
+	}
+	if ok, _ := db.Attempt.Claim(ctx, "pwd:bob", time.Now().Add(time.Minute)); ok {
+		t.Fatal("claimed twice")
+	}
+
+	must(t, db.Attempt.Reset(ctx, []string{"pwd:alice", "pwd:bob"}))
+	if locked, _ := db.Attempt.LockedUntil(ctx, []string{"pwd:alice", "pwd:bob"}); !locked.IsZero() {
+		t.Fatalf("locked until %s after reset", locked)
+	}
+	if n, _ := db.Attempt.Fail(ctx, "pwd:alice", time.Hour); n != 1 {
+		t.Fatalf("failures after reset %d", n)
+	}
+}
+
+func testChallenges(t *testing.T, db *store.DB) {
+	ctx := context.Background()
+	challenge := &models.WebAuthnChallengeModel{
+		UserID:               primitive.NewObjectID(),
+		Purpose:              "login",
+		Challenge:            "abc",
+		UserHandle:           []byte{1},
+		AllowedCredentialIDs: [][]byte{{2}, {3}},
+		ExpiresAt:            time.Now().Add(time.Minute),
+	}
+	id, err := db.WebAuthn.Create(ctx, challenge)
+	must(t, err)
+	if _, err := db.WebAuthn.Take(ctx, id, "register"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("take for another purpose: %v", err)
+	}
+	taken, err := db.WebAuthn.Take(ctx, id, "login")
+	must(t, err)
+	if taken.Challenge != "abc" || taken.UserID != challenge.UserID || len(taken.AllowedCredentialIDs) != 2 {
+		t.Fatalf("taken challenge %+v", taken)
+	}
+	if _, err := db.WebAuthn.Take(ctx, id, "login"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("taken twice: %v", err)
+	}
+
+	expired, err := db.WebAuthn.Create(ctx, &models.WebAuthnChallengeModel{
+		Purpose:   "login",
+		Challenge: "def",
+		ExpiresAt: time.Now().Add(-time.Second),
+	})
+	must(t, err)
+	if _, err := db.WebAuthn.Take(ctx, expired, "login"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expired challenge: %v", err)
+	}
+}
+
+func testAuthorizations(t *testing.T, db *store.DB) {
+	ctx := context.Background()
+	must(t, db.OAuth.Create(ctx, &models.AuthorizationModel{
+		ID:          "request",
+		ClientID:    "app",
+		RedirectURI: "https://app.example/callback",
+		Scope:       "openid",
+		ExpiresAt:   time.Now().Add(time.Minute),
+	}))
+	pending, err := db.OAuth.GetPending(ctx, "request")
+	must(t, err)
+	if pending.ClientID != "app" || pending.Scope != "openid" {
+		t.Fatalf("pending authorization %+v", pending)
+	}
+	var (
+		user    = primitive.NewObjectID()
+		session = primitive.NewObjectID()
+	)
+	ok, err := db.OAuth.Approve(ctx, "request", "code-hash", user, session, time.Now().Add(time.Minute))
+	must(t, err)
+	if !ok {
+		t.Fatal("approval refused")
+	}
+	if ok, _ := db.OAuth.Approve(ctx, "request", "other-hash", user, session, time.Now().Add(time.Minute)); ok {
+		t.Fatal("approved twice")
+	}
+	if _, err := db.OAuth.GetPending(ctx, "request"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("approved authorization still pending: %v", err)
+	}
+	redeemed, err := db.OAuth.Redeem(ctx, "code-hash")
+	must(t, err)
+	if redeemed.UserID != user || redeemed.SessionID != session {
+		t.Fatalf("redeemed authorization %+v", redeemed)
+	}
+	if _, err := db.OAuth.Redeem(ctx, "code-hash"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("redeemed twice: %v", err)
+	}
+}
+
+func testClients(t *testing.T, db *store.DB) {
+	ctx := context.Background()
+	must(t, db.Clients.Upsert(ctx, &models.ClientModel{
+		ID:     "app",
+		Name:   "App",
+		Type:   "public",
+		Grants: []string{"password"},
+	}))
+	created, err := db.Clients.FindByID(ctx, "app")
+	must(t, err)
+	time.Sleep(10 * time.Millisecond)
+	must(t, db.Clients.Upsert(ctx, &models.ClientModel{
+		ID:           "app",
+		Name:         "Renamed",
+		Type:         "public",
+		Grants:       []string{"password", "refresh_token"},
+		RedirectURIs: []string{"https://app.example/callback"},
+	}))
+	updated, err := db.Clients.FindByID(ctx, "app")
+	must(t, err)
+	if updated.Name != "Renamed" || len(updated.Grants) != 2 || len(updated.RedirectURIs) != 1 {
+		t.Fatalf("updated client %+v", updated)
+	}
+	if !updated.CreatedAt.Equal(created.CreatedAt) || !updated.UpdatedAt.After(created.UpdatedAt) {
+		t.Fatalf("client timestamps %+v, was %+v", updated, created)
+	}
+	if _, err := db.Clients.FindByID(ctx, "unknown"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("unknown client: %v", err)
+	}
+}
+
+func testSigningKeys(t *testing.T, db *store.DB) {
+	ctx := context.Background()
+	key, err := auth.GenerateSigningKey(auth.AlgES256)
+	must(t, err)
+	must(t, db.Keys.Save(ctx, key))
+	key.RetiredAt = time.Now()
+	key.ExpiresAt = key.RetiredAt.Add(time.Hour)
+	must(t, db.Keys.Save(ctx, key))
+	keys, err := db.Keys.Load(ctx)
+	must(t, err)
+	if len(keys) != 1 || keys[0].ID != key.ID || keys[0].Algorithm != auth.AlgES256 || keys[0].Active() {
+		t.Fatalf("loaded keys %+v", keys)
+	}
+	if keys[0].JWK() != key.JWK() {
+		t.Fatal("loaded key differs")
+	}
+	must(t, db.Keys.Delete(ctx, key.ID))
+	if keys, _ := db.Keys.Load(ctx); len(keys) != 0 {
+		t.Fatalf("keys after delete %+v", keys)
+	}
+}
+
+// testTransactions : a backend with transactions rolls back every write of a
+// failed fn, one without applies them as they come
+func testTransactions(t *testing.T, db *store.DB) {
+	var (
+		ctx    = context.Background()
+		failed = errors.New("failed")
+	)
+	err := db.InTransaction(ctx, func(ctx context.Context) error {
+		id, err := db.User.CreateUser(ctx, "alice", "$argon2id$hash")
+		if err != nil {
+			return err
+		}
+		// a nested call joins the transaction
+		return db.InTransaction(ctx, func(ctx context.Context) error {
+			if err := db.User.UpdateMfaActive(ctx, id, true); err != nil {
+				return err
+			}
+			return failed
+		})
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("transaction: %v", err)
+	}
+	_, err = db.User.FindByUsername(ctx, "alice")
+	if db.Tx != nil && !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("write of a failed transaction kept: %v", err)
+	}
+	if db.Tx == nil && err != nil {
+		t.Fatalf("write without a transaction lost: %v", err)
+	}
+
+	must(t, db.InTransaction(ctx, func(ctx context.Context) error {
+		_, err := db.User.CreateUser(ctx, "bob", "$argon2id$hash")
+		return err
+	}))
+	if _, err := db.User.FindByUsername(ctx, "bob"); err != nil {
+		t.Fatalf("committed write: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package oauth
+
+import (
+	"app/internal/auth"
+	"app/internal/clients"
+	"app/internal/password"
+	"app/internal/store"
+	"app/internal/store/memory"
+	"app/source/api/user"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	testOrigin      = "https://localhost"
+	testPassword    = "Corr3ct-Horse-Battery"
+	testRedirectURI = "https://app.example/callback"
+	// testServer is the confidential client of a resource server introspecting tokens
+	testServer       = "resource-server"
+	testServerSecret = "resource-server-secret"
+)
+
+// testOAuth : the user and OAuth routes over a store, called through HTTP
+type testOAuth struct {
+	t      *testing.T
+	db     *store.DB
+	users  *user.Service
+	engine *gin.Engine
+}
+
+// newTestOAuth : the routes over db, a memory store when nil, with the public
+// clients "app" and "other-app", the confidential testServer and passkeys for
+// the relying party localhost
+func newTestOAuth(t *testing.T, db *store.DB) *testOAuth {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	if db == nil {
+		db = memory.New()
+	}
+	ctx := context.Background()
+	keys, err := auth.NewKeySet(ctx, auth.NewMemoryKeyStore(), auth.DefaultKeyPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := clients.NewRegistry(db.Clients)
+	for _, registration := range []clients.Registration{
+		{
+			ID:           "app",
+			Type:         clients.TypePublic,
+			Grants:       []string{clients.GrantPassword, clients.GrantAuthorizationCode, clients.GrantRefreshToken},
+			RedirectURIs: []string{testRedirectURI},
+		},
+		{
+			ID:     "other-app",
+			Type:   clients.TypePublic,
+			Grants: []string{clients.GrantPassword, clients.GrantRefreshToken},
+		},
+		{
+			ID:     testServer,
+			Secret: testServerSecret,
+			Type:   clients.TypeConfidential,
+		},
+	} {
+		if err := registry.Register(ctx, registration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	relyingParty, err := webauthn.New(&webauthn.Config{
+		RPID:          "localhost",
+		RPDisplayName: "MFA",
+		RPOrigins:     []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		tokens   = auth.NewIssuer(keys, auth.DefaultClaimsConfig)
+		verifier = auth.NewVerifier(keys, auth.DefaultClaimsConfig, auth.LegacyConfig{})
+	)
+	users, err := user.NewService(user.Config{
+		PasswordPolicy: password.DefaultPolicy,
+		WebAuthn:       relyingParty,
+		LockoutPolicy:  user.DefaultLockoutPolicy,
+		SessionPolicy:  user.DefaultSessionPolicy,
+		Tokens:         tokens,
+		Verifier:       verifier,
+		Clients:        registry,
+		Store:          db,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := NewService(Config{
+		Issuer:   auth.DefaultClaimsConfig.Issuer,
+		Clients:  registry,
+		Keys:     keys,
+		Tokens:   tokens,
+		Verifier: verifier,
+		Users:    users,
+		Store:    db,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := gin.New()
+	user.New(users).Apply(engine)
+	New(service).Apply(engine)
+	return &testOAuth{t: t, db: db, users: users, engine: engine}
+}
+
+// serve : send req and return the recorded response
+func (api *testOAuth) serve(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	api.engine.ServeHTTP(rec, req)
+	return rec
+}
+
+// post : send form to path, decode the JSON response into out when given
+func (api *testOAuth) post(path string, form url.Values, out interface{}) int {
+	api.t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := api.serve(req)
+	if out != nil && rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			api.t.Fatalf("%s: %s: %s", path, err, rec.Body.String())
+		}
+	}
+	return rec.Code
+}
+
+// call : send body as JSON to the user API of clientID with the bearer token
+// when given, decode the response into out and return the status
+func (api *testOAuth) call(path, clientID, token string, body, out interface{}) int {
+	api.t.Helper()
+	payload, err := json.Marshal(body)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path+"?cId="+clientID, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := api.serve(req)
+	if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+		api.t.Fatalf("%s: %s: %s", path, err, rec.Body.String())
+	}
+	return rec.Code
+}
+
+func (api *testOAuth) register(username string) {
+	api.t.Helper()
+	var resp user.RegisterResp
+	if status := api.call("/register", "app", "",
+		map[string]string{"username": username, "password": testPassword}, &resp); status != http.StatusCreated || resp.Code != 0 {
+		api.t.Fatalf("register %s: %d %+v", username, status, resp)
+	}
+}
+
+// signIn : register username and log in with the password API of clientID,
+// returning the access and refresh tokens
+func (api *testOAuth) signIn(clientID, username string) (string, string) {
+	api.t.Helper()
+	api.register(username)
+	var resp user.LogInResp
+	if status := api.call("/login", clientID, "",
+		map[string]string{"username": username, "password": testPassword}, &resp); status != http.StatusOK || resp.Code != 0 {
+		api.t.Fatalf("login %s: %d %+v", username, status, resp)
+	}
+	return resp.Result.AccessToken, resp.Result.RefreshToken
+}
+
+func (api *testOAuth) introspect(token string) IntrospectResp {
+	api.t.Helper()
+	var resp IntrospectResp
+	if status := api.post("/oauth/introspect", url.Values{
+		"client_id":     {testServer},
+		"client_secret": {testServerSecret},
+		"token":         {token},
+	}, &resp); status != http.StatusOK {
+		api.t.Fatalf("introspect: %d %+v", status, resp)
+	}
+	return resp
+}
+
+func (api *testOAuth) revoke(clientID, token, hint string) int {
+	api.t.Helper()
+	return api.post("/oauth/revoke", url.Values{
+		"client_id":       {clientID},
+		"token":           {token},
+		"token_type_hint": {hint},
+	}, nil)
+}
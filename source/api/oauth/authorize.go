@@ -0,0 +1,422 @@
+package oauth
+
+import (
+	"app/internal/auth"
+	"app/internal/clients"
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"app/source/api/user"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	authorizationExpired = 10 * time.Minute
+	codeExpired          = time.Minute
+	scopeOpenID          = "openid"
+	scopeProfile         = "profile"
+	pkceS256             = "S256"
+	promptNone           = "none"
+	promptLogin          = "login"
+	// methodWebAuthn is the second factor a registered passkey offers
+	methodWebAuthn = "webauthn"
+	// ssoCookie keeps the browser signed in at the provider for ssoExpired,
+	// and no longer than the session of that login
+	ssoCookie  = "op_session"
+	ssoExpired = 12 * time.Hour
+)
+
+// authorize : OpenID Connect Core section 3.1.2.1. Until the client and its
+// redirect_uri are trusted errors are shown to the user, afterwards they are
+// returned to the client.
+func (ins *Handle) authorize(c *gin.Context) {
+	var (
+		query       = c.Request.URL.Query()
+		client      = ins.service.client(c.Request.Context(), query.Get("client_id"))
+		redirectURI = query.Get("redirect_uri")
+		state       = query.Get("state")
+	)
+	if client == nil {
+		renderError(c, "Unknown client.")
+		return
+	}
+	if !client.AllowsRedirect(redirectURI) {
+		renderError(c, "The redirect URI is not registered for this client.")
+		return
+	}
+	if !client.AllowsGrant(clients.GrantAuthorizationCode) {
+		redirectError(c, redirectURI, state, "unauthorized_client", "the client may not use the code flow")
+		return
+	}
+	if query.Get("response_type") != "code" {
+		redirectError(c, redirectURI, state, "unsupported_response_type", "only the code flow is supported")
+		return
+	}
+	if !hasScope(query.Get("scope"), scopeOpenID) {
+		redirectError(c, redirectURI, state, "invalid_scope", "the openid scope is required")
+		return
+	}
+	if len(query.Get("code_challenge")) == 0 || query.Get("code_challenge_method") != pkceS256 {
+		redirectError(c, redirectURI, state, "invalid_request", "PKCE with S256 is required")
+		return
+	}
+
+	authorization := &models.AuthorizationModel{
+		ClientID:            client.ID,
+		RedirectURI:         redirectURI,
+		Scope:               query.Get("scope"),
+		State:               state,
+		Nonce:               query.Get("nonce"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: pkceS256,
+		ExpiresAt:           time.Now().Add(authorizationExpired),
+	}
+	var err error
+	if authorization.ID, err = randomToken(); err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+		redirectError(c, redirectURI, state, "server_error", "")
+		return
+	}
+	if err := ins.service.db.OAuth.Create(c.Request.Context(), authorization); err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+		redirectError(c, redirectURI, state, "server_error", "")
+		return
+	}
+	prompt := query.Get("prompt")
+	if !hasScope(prompt, promptLogin) {
+		if ins.resume(c, authorization, client) {
+			return
+		}
+		if hasScope(prompt, promptNone) {
+			redirectError(c, redirectURI, state, "login_required", "")
+			return
+		}
+	}
+	renderPage(c, http.StatusOK, "login", pageData{
+		Client:    clientName(client),
+		RequestID: authorization.ID,
+	})
+}
+
+// resume : approve at once when the browser is still signed in at the provider,
+// with a new session for this client that keeps the factors of that login
+func (ins *Handle) resume(c *gin.Context, authorization *models.AuthorizationModel, client *clients.Client) bool {
+	cookie, err := c.Cookie(ssoCookie)
+	if err != nil {
+		return false
+	}
+	claims, err := ins.service.cfg.Tokens.ValidateSSOToken(cookie)
+	if err != nil {
+		ins.forgetLogin(c)
+		return false
+	}
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return false
+	}
+	sessionID, err := primitive.ObjectIDFromHex(claims.SessionID)
+	if err != nil {
+		return false
+	}
+	resp, err := ins.service.cfg.Users.ResumeSession(c.Request.Context(),
+		user.NewResumeSessionReq(c, client, userID, sessionID))
+	if err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+	}
+	if resp == nil || resp.Code != 0 {
+		if resp != nil && resp.Code == 41 {
+			// the login ended, by logout, revocation or its lifetime
+			ins.forgetLogin(c)
+		}
+		return false
+	}
+	// the cookie stays bound to the session of the sign in
+	ins.approve(c, authorization, resp.Result.AccessToken, false)
+	return true
+}
+
+// rememberLogin : set the cookie that signs the browser in for the next
+// authorization requests, bound to session so that it ends with it
+func (ins *Handle) rememberLogin(c *gin.Context, session *models.SessionModel) {
+	token, err := ins.service.cfg.Tokens.GenerateSSOToken(session.UserID.Hex(), session.ID.Hex(), ssoExpired)
+	if err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+		return
+	}
+	ins.setLoginCookie(c, token, int(ssoExpired/time.Second))
+}
+
+func (ins *Handle) forgetLogin(c *gin.Context) {
+	ins.setLoginCookie(c, "", -1)
+}
+
+func (ins *Handle) setLoginCookie(c *gin.Context, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     ssoCookie,
+		Value:    value,
+		Path:     "/oauth/authorize",
+		MaxAge:   maxAge,
+		Secure:   strings.HasPrefix(ins.service.cfg.Issuer, "https://"),
+		HttpOnly: true,
+		// sent on the top level navigation from the client to the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// authorizeLogin : first factor through the regular login, which asks for the second
+// factor when the user has one
+func (ins *Handle) authorizeLogin(c *gin.Context) {
+	authorization, client, ok := ins.pendingAuthorization(c)
+	if !ok {
+		return
+	}
+	resp, err := ins.service.cfg.Users.Login(c.Request.Context(),
+		user.NewLogInReq(c, client, c.PostForm("username"), c.PostForm("password")))
+	if err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+	}
+	switch {
+	case resp != nil && resp.Code == 0:
+		ins.approve(c, authorization, resp.Result.AccessToken, true)
+	case resp != nil && resp.Code == 44:
+		ins.renderMFA(c, http.StatusOK, authorization, client, resp.Result.MFAToken, resp.Result.MFAMethods, "")
+	default:
+		renderPage(c, http.StatusUnauthorized, "login", pageData{
+			Client:    clientName(client),
+			RequestID: authorization.ID,
+			Message:   loginMessage(resp),
+		})
+	}
+}
+
+func (ins *Handle) authorizeMFA(c *gin.Context) {
+	authorization, client, ok := ins.pendingAuthorization(c)
+	if !ok {
+		return
+	}
+	resp, err := ins.service.cfg.Users.LoginMFA(c.Request.Context(),
+		user.NewLogInMFAReq(c, client, c.PostForm("mfa_token"), c.PostForm("otp")))
+	if err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+	}
+	ins.finishMFA(c, authorization, client, resp)
+}
+
+// authorizeWebAuthn : the passkey answering the challenge of the second step
+func (ins *Handle) authorizeWebAuthn(c *gin.Context) {
+	authorization, client, ok := ins.pendingAuthorization(c)
+	if !ok {
+		return
+	}
+	// an id that does not parse names no challenge and fails like an expired one
+	challengeID, _ := primitive.ObjectIDFromHex(c.PostForm("challenge_id"))
+	resp, err := ins.service.cfg.Users.FinishPasskeyLogin(c.Request.Context(),
+		user.NewPasskeyLoginFinishReq(c, client, challengeID, c.PostForm("mfa_token"), json.RawMessage(c.PostForm("credential"))))
+	if err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+	}
+	ins.finishMFA(c, authorization, client, resp)
+}
+
+func (ins *Handle) finishMFA(c *gin.Context, authorization *models.AuthorizationModel, client *clients.Client, resp *user.LogInResp) {
+	switch {
+	case resp != nil && resp.Code == 0:
+		ins.approve(c, authorization, resp.Result.AccessToken, true)
+	case resp != nil && resp.Code == 41:
+		// the challenge expired, start over with the password
+		renderPage(c, http.StatusUnauthorized, "login", pageData{
+			Client:    clientName(client),
+			RequestID: authorization.ID,
+			Message:   "Your sign in expired, please try again.",
+		})
+	default:
+		ins.renderMFA(c, http.StatusUnauthorized, authorization, client,
+			c.PostForm("mfa_token"), strings.Fields(c.PostForm("mfa_methods")), loginMessage(resp))
+	}
+}
+
+// renderMFA : the second step with a form per factor of the user, the code of
+// the authenticator app and a challenge for the passkeys. A user with passkeys
+// only is never asked for a code they can not have.
+func (ins *Handle) renderMFA(c *gin.Context, status int, authorization *models.AuthorizationModel, client *clients.Client,
+	mfaToken string, methods []string, message string) {
+	data := pageData{
+		RequestID: authorization.ID,
+		MFAToken:  mfaToken,
+		Methods:   strings.Join(methods, " "),
+		Message:   message,
+	}
+	for _, method := range methods {
+		switch method {
+		case auth.AmrOTP:
+			data.OTP = true
+		case methodWebAuthn:
+			resp, err := ins.service.cfg.Users.BeginPasskeyLogin(c.Request.Context(),
+				user.NewPasskeyLoginBeginReq(c, client, mfaToken))
+			if err != nil {
+				log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+			}
+			if resp.Code != 0 {
+				if len(data.Message) == 0 {
+					data.Message = codeMessage(resp.Code)
+				}
+				continue
+			}
+			data.ChallengeID = resp.Result.ChallengeID.Hex()
+			data.Options = resp.Result.Options
+		}
+	}
+	renderPage(c, status, "mfa", data)
+}
+
+func (ins *Handle) pendingAuthorization(c *gin.Context) (*models.AuthorizationModel, *clients.Client, bool) {
+	authorization, err := ins.service.db.OAuth.GetPending(c.Request.Context(), c.PostForm("request_id"))
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+		}
+		renderError(c, "This sign in request expired, please go back to the application and try again.")
+		return nil, nil, false
+	}
+	client := ins.service.client(c.Request.Context(), authorization.ClientID)
+	if client == nil {
+		renderError(c, "Unknown client.")
+		return nil, nil, false
+	}
+	return authorization, client, true
+}
+
+// approve : bind a code to the session the login created and send it to the
+// client, remembering the login of the browser after a sign in. The session was
+// opened for this authorization alone, it is ended again when the code can not
+// be issued.
+func (ins *Handle) approve(c *gin.Context, authorization *models.AuthorizationModel, accessToken string, signIn bool) {
+	ctx := c.Request.Context()
+	session, err := ins.service.db.Session.GetByAT(ctx, accessToken)
+	if err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+		redirectError(c, authorization.RedirectURI, authorization.State, "server_error", "")
+		return
+	}
+	code, err := randomToken()
+	if err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+		ins.endSession(c, session)
+		redirectError(c, authorization.RedirectURI, authorization.State, "server_error", "")
+		return
+	}
+	ok, err := ins.service.db.OAuth.Approve(ctx, authorization.ID, hashCode(code),
+		session.UserID, session.ID, time.Now().Add(codeExpired))
+	if err != nil || !ok {
+		if err != nil {
+			log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+		}
+		ins.endSession(c, session)
+		renderError(c, "This sign in request expired, please go back to the application and try again.")
+		return
+	}
+	if signIn {
+		ins.rememberLogin(c, session)
+	}
+	redirect(c, authorization.RedirectURI, url.Values{
+		"code":  {code},
+		"state": {authorization.State},
+	})
+}
+
+func (ins *Handle) endSession(c *gin.Context, session *models.SessionModel) {
+	if err := ins.service.cfg.Users.EndSession(c.Request.Context(), session.UserID, session.ID); err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+	}
+}
+
+func redirectError(c *gin.Context, redirectURI, state, code, description string) {
+	values := url.Values{"error": {code}, "state": {state}}
+	if len(description) > 0 {
+		values.Set("error_description", description)
+	}
+	redirect(c, redirectURI, values)
+}
+
+func redirect(c *gin.Context, redirectURI string, values url.Values) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		renderError(c, "The redirect URI is invalid.")
+		return
+	}
+	query := target.Query()
+	for key, value := range values {
+		if len(value) > 0 && len(value[0]) > 0 {
+			query[key] = value
+		}
+	}
+	target.RawQuery = query.Encode()
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, target.String())
+}
+
+func loginMessage(resp *user.LogInResp) string {
+	if resp == nil {
+		return codeMessage(-1)
+	}
+	return codeMessage(resp.Code)
+}
+
+func codeMessage(code int) string {
+	switch code {
+	case 41:
+		return "Incorrect username or password."
+	case 42:
+		return "Incorrect code."
+	case 43:
+		return "The passkey request expired, please try again."
+	case 46, 47:
+		return "The passkey could not be verified."
+	case 48:
+		return "You are signed in on too many devices, sign out of one first."
+	case 49:
+		return "Too many failed attempts, please try again later."
+	default:
+		return "Sign in failed, please try again."
+	}
+}
+
+func clientName(client *clients.Client) string {
+	if len(client.Name) > 0 {
+		return client.Name
+	}
+	return client.ID
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashCode : codes are stored hashed so a database read does not leak live codes
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,362 @@
+package oauth
+
+import (
+	"app/internal/passkey"
+	"app/internal/store"
+	"app/internal/store/memory"
+	"app/source/api/user"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/go-webauthn/webauthn/protocol"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// browser : a user agent keeping the cookies of the provider between requests
+type browser struct {
+	api     *testOAuth
+	cookies map[string]*http.Cookie
+}
+
+func (api *testOAuth) browser() *browser {
+	return &browser{api: api, cookies: map[string]*http.Cookie{}}
+}
+
+func (b *browser) do(req *http.Request) *httptest.ResponseRecorder {
+	for _, cookie := range b.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := b.api.serve(req)
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(b.cookies, cookie.Name)
+		} else {
+			b.cookies[cookie.Name] = cookie
+		}
+	}
+	return rec
+}
+
+// authorize : open the authorization endpoint of "app" with the PKCE challenge
+// of verifier, params overriding the defaults
+func (b *browser) authorize(verifier string, params url.Values) *httptest.ResponseRecorder {
+	sum := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"client_id":             {"app"},
+		"redirect_uri":          {testRedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid profile"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {pkceS256},
+	}
+	for key, value := range params {
+		query[key] = value
+	}
+	return b.do(httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+query.Encode(), nil))
+}
+
+func (b *browser) post(path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(req)
+}
+
+// signIn : answer the login page with the password, rec is the page
+func (b *browser) signIn(t *testing.T, rec *httptest.ResponseRecorder, username string) *httptest.ResponseRecorder {
+	t.Helper()
+	return b.post("/oauth/authorize/login", url.Values{
+		"request_id": {field(t, rec, "request_id")},
+		"username":   {username},
+		"password":   {testPassword},
+	})
+}
+
+// field : the value of a hidden input of the page
+func field(t *testing.T, rec *httptest.ResponseRecorder, name string) string {
+	t.Helper()
+	match := regexp.MustCompile(`name="` + name + `" value="([^"]*)"`).FindStringSubmatch(rec.Body.String())
+	if match == nil {
+		t.Fatalf("no %s in the page: %d %s", name, rec.Code, rec.Body.String())
+	}
+	return match[1]
+}
+
+// redirected : the query of the redirect back to the client
+func redirected(t *testing.T, rec *httptest.ResponseRecorder) url.Values {
+	t.Helper()
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusFound || err != nil || !strings.HasPrefix(location.String(), testRedirectURI) {
+		t.Fatalf("not redirected to the client: %d %s", rec.Code, rec.Body.String())
+	}
+	return location.Query()
+}
+
+// code : the authorization code of the redirect
+func code(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	query := redirected(t, rec)
+	if len(query.Get("code")) == 0 || query.Get("state") != "xyz" {
+		t.Fatalf("redirect %v", query)
+	}
+	return query.Get("code")
+}
+
+type tokenOrError struct {
+	TokenResp
+	errorResp
+}
+
+func (api *testOAuth) exchange(code, verifier, redirectURI string) (int, tokenOrError) {
+	api.t.Helper()
+	var resp tokenOrError
+	status := api.post("/oauth/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"app"},
+		"code":          {code},
+		"code_verifier": {verifier},
+		"redirect_uri":  {redirectURI},
+	}, &resp)
+	return status, resp
+}
+
+func newVerifier(t *testing.T) string {
+	t.Helper()
+	verifier, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verifier
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	api := newTestOAuth(t, nil)
+	api.register("alice")
+	var (
+		b        = api.browser()
+		verifier = newVerifier(t)
+	)
+	page := b.authorize(verifier, nil)
+	if page.Code != http.StatusOK {
+		t.Fatalf("login page: %d %s", page.Code, page.Body.String())
+	}
+	status, resp := api.exchange(code(t, b.signIn(t, page, "alice")), verifier, testRedirectURI)
+	if status != http.StatusOK || len(resp.AccessToken) == 0 || len(resp.RefreshToken) == 0 || len(resp.IDToken) == 0 {
+		t.Fatalf("exchange: %d %+v", status, resp)
+	}
+	if introspected := api.introspect(resp.AccessToken); !introspected.Active || introspected.ClientID != "app" {
+		t.Fatalf("access token: %+v", introspected)
+	}
+}
+
+// TestAuthorizePKCE : S256 is required, and the code only goes to the holder
+// of the verifier
+func TestAuthorizePKCE(t *testing.T) {
+	api := newTestOAuth(t, nil)
+	api.register("alice")
+	b := api.browser()
+	for name, params := range map[string]url.Values{
+		"no challenge":     {"code_challenge": {""}, "code_challenge_method": {""}},
+		"plain challenge":  {"code_challenge_method": {"plain"}},
+		"no method at all": {"code_challenge_method": {""}},
+	} {
+		if query := redirected(t, b.authorize(newVerifier(t), params)); query.Get("error") != "invalid_request" {
+			t.Fatalf("%s: %v", name, query)
+		}
+	}
+	verifier := newVerifier(t)
+	authorizationCode := code(t, b.signIn(t, b.authorize(verifier, nil), "alice"))
+	if status, resp := api.exchange(authorizationCode, newVerifier(t), testRedirectURI); status != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		t.Fatalf("exchange with another verifier: %d %+v", status, resp)
+	}
+	if status, resp := api.exchange(authorizationCode, "", testRedirectURI); status != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		t.Fatalf("exchange without a verifier: %d %+v", status, resp)
+	}
+}
+
+// TestAuthorizeRedirectURI : a redirect_uri that is not registered is never
+// redirected to, and the code is only exchanged with the one it was issued for
+func TestAuthorizeRedirectURI(t *testing.T) {
+	api := newTestOAuth(t, nil)
+	api.register("alice")
+	b := api.browser()
+	rec := b.authorize(newVerifier(t), url.Values{"redirect_uri": {"https://attacker.example/callback"}})
+	if rec.Code != http.StatusBadRequest || len(rec.Header().Get("Location")) > 0 {
+		t.Fatalf("unregistered redirect_uri: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	verifier := newVerifier(t)
+	authorizationCode := code(t, b.signIn(t, b.authorize(verifier, nil), "alice"))
+	if status, resp := api.exchange(authorizationCode, verifier, testRedirectURI+"/other"); status != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		t.Fatalf("exchange with another redirect_uri: %d %+v", status, resp)
+	}
+}
+
+func TestAuthorizationCodeReuse(t *testing.T) {
+	api := newTestOAuth(t, nil)
+	api.register("alice")
+	var (
+		b        = api.browser()
+		verifier = newVerifier(t)
+	)
+	authorizationCode := code(t, b.signIn(t, b.authorize(verifier, nil), "alice"))
+	if status, resp := api.exchange(authorizationCode, verifier, testRedirectURI); status != http.StatusOK {
+		t.Fatalf("exchange: %d %+v", status, resp)
+	}
+	if status, resp := api.exchange(authorizationCode, verifier, testRedirectURI); status != http.StatusBadRequest || resp.Error != "invalid_grant" {
+		t.Fatalf("code used twice: %d %+v", status, resp)
+	}
+}
+
+// TestAuthorizeSSO : once signed in at the provider the browser gets codes
+// without the login page, until the session of that sign in ends
+func TestAuthorizeSSO(t *testing.T) {
+	api := newTestOAuth(t, nil)
+	api.register("alice")
+	b := api.browser()
+	if query := redirected(t, b.authorize(newVerifier(t), url.Values{"prompt": {promptNone}})); query.Get("error") != "login_required" {
+		t.Fatalf("prompt=none before the sign in: %v", query)
+	}
+	verifier := newVerifier(t)
+	_, first := api.exchange(code(t, b.signIn(t, b.authorize(verifier, nil), "alice")), verifier, testRedirectURI)
+	if len(first.RefreshToken) == 0 {
+		t.Fatalf("exchange: %+v", first)
+	}
+
+	verifier = newVerifier(t)
+	status, second := api.exchange(code(t, b.authorize(verifier, nil)), verifier, testRedirectURI)
+	if status != http.StatusOK || len(second.AccessToken) == 0 {
+		t.Fatalf("exchange after the single sign-on: %d %+v", status, second)
+	}
+	firstSession, secondSession := api.introspect(first.AccessToken), api.introspect(second.AccessToken)
+	if !secondSession.Active || secondSession.SessionID == firstSession.SessionID || secondSession.AuthTime != firstSession.AuthTime {
+		t.Fatalf("sessions %+v and %+v", firstSession, secondSession)
+	}
+	if rec := b.authorize(newVerifier(t), url.Values{"prompt": {promptLogin}}); rec.Code != http.StatusOK || len(field(t, rec, "request_id")) == 0 {
+		t.Fatalf("prompt=login: %d", rec.Code)
+	}
+
+	// signing out of the first client ends the sign in at the provider
+	if status := api.revoke("app", first.RefreshToken, hintRefreshToken); status != http.StatusOK {
+		t.Fatalf("revoke: %d", status)
+	}
+	if rec := b.authorize(newVerifier(t), nil); rec.Code != http.StatusOK || len(field(t, rec, "request_id")) == 0 {
+		t.Fatalf("authorize after the sign out: %d", rec.Code)
+	}
+	if _, ok := b.cookies[ssoCookie]; ok {
+		t.Fatal("login cookie kept after the sign out")
+	}
+}
+
+// TestAuthorizePasskeyOnly : a user whose second factor is a passkey is asked
+// for it, not for a code they do not have
+func TestAuthorizePasskeyOnly(t *testing.T) {
+	api := newTestOAuth(t, nil)
+	accessToken, _ := api.signIn("app", "alice")
+	key := passkey.NewSoftAuthenticator(testOrigin)
+	var begin struct {
+		Code   int `json:"code"`
+		Result struct {
+			ChallengeID primitive.ObjectID          `json:"challengeId"`
+			Options     protocol.CredentialCreation `json:"options"`
+		} `json:"result"`
+	}
+	if status := api.call("/webauthn/register/begin", "app", accessToken,
+		map[string]string{"password": testPassword}, &begin); status != http.StatusOK || begin.Code != 0 {
+		t.Fatalf("register begin: %d %+v", status, begin)
+	}
+	credential, err := key.Register(&begin.Result.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var registered user.PasskeyResp
+	if status := api.call("/webauthn/register/finish", "app", accessToken, map[string]interface{}{
+		"challengeId": begin.Result.ChallengeID,
+		"credential":  credential,
+	}, &registered); status != http.StatusOK || registered.Code != 0 {
+		t.Fatalf("register finish: %d %+v", status, registered)
+	}
+
+	var (
+		b        = api.browser()
+		verifier = newVerifier(t)
+	)
+	page := b.signIn(t, b.authorize(verifier, nil), "alice")
+	if page.Code != http.StatusOK || strings.Contains(page.Body.String(), `name="otp"`) {
+		t.Fatalf("second step: %d %s", page.Code, page.Body.String())
+	}
+	answer := func(page *httptest.ResponseRecorder, credential interface{}) *httptest.ResponseRecorder {
+		t.Helper()
+		form := url.Values{}
+		for _, name := range []string{"request_id", "mfa_token", "mfa_methods", "challenge_id"} {
+			form.Set(name, field(t, page, name))
+		}
+		data, err := json.Marshal(credential)
+		if err != nil {
+			t.Fatal(err)
+		}
+		form.Set("credential", string(data))
+		return b.post("/oauth/authorize/webauthn", form)
+	}
+	// a cancelled ceremony posts no credential and gets a new challenge
+	retry := answer(page, nil)
+	if retry.Code != http.StatusUnauthorized || field(t, retry, "challenge_id") == field(t, page, "challenge_id") {
+		t.Fatalf("empty answer: %d %s", retry.Code, retry.Body.String())
+	}
+	match := regexp.MustCompile(`const publicKey = (.*)\.publicKey;`).FindStringSubmatch(retry.Body.String())
+	if match == nil {
+		t.Fatalf("no passkey options in the page: %s", retry.Body.String())
+	}
+	var options protocol.CredentialAssertion
+	if err := json.Unmarshal([]byte(match[1]), &options); err != nil {
+		t.Fatal(err)
+	}
+	assertion, err := key.Assert(&options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, resp := api.exchange(code(t, answer(retry, assertion)), verifier, testRedirectURI)
+	if status != http.StatusOK || len(resp.AccessToken) == 0 {
+		t.Fatalf("exchange: %d %+v", status, resp)
+	}
+}
+
+// refusingAuthorizations : an authorization store where every approval finds
+// the request gone, as when it expired during the login
+type refusingAuthorizations struct {
+	store.AuthorizationStore
+}
+
+func (ins refusingAuthorizations) Approve(context.Context, string, string, primitive.ObjectID, primitive.ObjectID, time.Time) (bool, error) {
+	return false, nil
+}
+
+// TestAuthorizeApproveFailure : the session of a login whose code can not be
+// issued does not outlive it
+func TestAuthorizeApproveFailure(t *testing.T) {
+	db := memory.New()
+	db.OAuth = refusingAuthorizations{db.OAuth}
+	api := newTestOAuth(t, db)
+	api.register("alice")
+	b := api.browser()
+	if rec := b.signIn(t, b.authorize(newVerifier(t), nil), "alice"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("refused approval: %d %s", rec.Code, rec.Body.String())
+	}
+	found, err := db.User.FindByUsername(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found.Sessions) > 0 {
+		t.Fatalf("%d sessions left", len(found.Sessions))
+	}
+	if _, ok := b.cookies[ssoCookie]; ok {
+		t.Fatal("login cookie set for a refused approval")
+	}
+}
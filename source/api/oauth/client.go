@@ -0,0 +1,57 @@
+package oauth
+
+import (
+	"app/internal/clients"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/url"
+)
+
+var errInvalidClient = errors.New("client authentication failed")
+
+// client : the registered client, nil when unknown or the registry failed
+func (ins *Service) client(ctx context.Context, id string) *clients.Client {
+	client, err := ins.cfg.Clients.Get(ctx, id)
+	if err != nil {
+		if !errors.Is(err, clients.ErrUnknownClient) {
+			log.Printf("oauth: client %q: %s", id, err)
+		}
+		return nil
+	}
+	return client
+}
+
+// authenticateClient : client_secret_basic, or client_secret_post when there is
+// no Authorization header (RFC 6749 section 2.3.1). With allowPublic a public
+// client may identify itself by client_id alone.
+func (ins *Service) authenticateClient(c *gin.Context, allowPublic bool) (*clients.Client, error) {
+	id, secret, ok := c.Request.BasicAuth()
+	if ok {
+		// basic credentials are form encoded before base64
+		var err error
+		if id, err = url.QueryUnescape(id); err != nil {
+			return nil, errInvalidClient
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, errInvalidClient
+		}
+	} else {
+		id, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	if len(id) == 0 {
+		return nil, errInvalidClient
+	}
+	client, err := ins.cfg.Clients.Authenticate(c.Request.Context(), id, secret)
+	if err != nil {
+		if !errors.Is(err, clients.ErrUnknownClient) && !errors.Is(err, clients.ErrInvalidSecret) {
+			log.Printf("oauth: client %q: %s", id, err)
+		}
+		return nil, errInvalidClient
+	}
+	if client.Public() && !allowPublic {
+		return nil, errInvalidClient
+	}
+	return client, nil
+}
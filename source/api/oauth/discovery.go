@@ -0,0 +1,65 @@
+package oauth
+
+import (
+	"app/source/middlewares"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// ProviderMetadata : OpenID Connect Discovery section 3
+type ProviderMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksURI                           string   `json:"jwks_uri"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+func (ins *Handle) discovery(c *gin.Context) {
+	issuer := ins.service.cfg.Issuer
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, ProviderMetadata{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oauth/authorize",
+		TokenEndpoint:                     issuer + "/oauth/token",
+		UserinfoEndpoint:                  issuer + "/userinfo",
+		JwksURI:                           issuer + "/.well-known/jwks.json",
+		RevocationEndpoint:                issuer + "/oauth/revoke",
+		IntrospectionEndpoint:             issuer + "/oauth/introspect",
+		ScopesSupported:                   []string{scopeOpenID, scopeProfile},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{ins.service.cfg.Keys.Algorithm()},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{pkceS256},
+		ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce",
+			"amr", "sid", "preferred_username"},
+	})
+}
+
+// UserinfoResp : OpenID Connect Core section 5.3.2
+type UserinfoResp struct {
+	Sub      string `json:"sub"`
+	Username string `json:"preferred_username,omitempty"`
+}
+
+func (ins *Handle) userinfo(c *gin.Context) {
+	userAccess, _ := c.Get(middlewares.KeyUserContextAccess)
+	uCtx := userAccess.(middlewares.UserCtx)
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, UserinfoResp{
+		Sub:      uCtx.UUID.Hex(),
+		Username: uCtx.Username,
+	})
+}
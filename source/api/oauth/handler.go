@@ -0,0 +1,78 @@
+package oauth
+
+import (
+	"app/source/middlewares"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+)
+
+type Handle struct {
+	service *Service
+}
+
+func New(s *Service) *Handle {
+	return &Handle{
+		service: s,
+	}
+}
+
+func (ins *Handle) Apply(r *gin.Engine) {
+	requireAuth := middlewares.RequireAuth(ins.service.cfg.Verifier, ins.service.db, ins.service.cfg.Users.SessionLifetime())
+	r.GET("/.well-known/openid-configuration", ins.discovery)
+	r.GET("/oauth/authorize", ins.authorize)
+	r.POST("/oauth/authorize/login", ins.authorizeLogin)
+	r.POST("/oauth/authorize/mfa", ins.authorizeMFA)
+	r.POST("/oauth/authorize/webauthn", ins.authorizeWebAuthn)
+	r.POST("/oauth/token", ins.token)
+	r.GET("/userinfo", requireAuth, ins.userinfo)
+	r.POST("/userinfo", requireAuth, ins.userinfo)
+	r.POST("/oauth/revoke", ins.revoke)
+	r.POST("/oauth/introspect", ins.introspect)
+}
+
+// revoke : public clients may revoke too, RFC 7009 section 2.1 only limits
+// any client to its own tokens
+func (ins *Handle) revoke(c *gin.Context) {
+	client, err := ins.service.authenticateClient(c, true)
+	if err != nil {
+		invalidClient(c)
+		return
+	}
+	token := c.PostForm("token")
+	if len(token) == 0 {
+		c.JSON(http.StatusBadRequest, errorResp{"invalid_request", "token is required"})
+		return
+	}
+	if err := ins.service.Revoke(c.Request.Context(), client, token, c.PostForm("token_type_hint")); err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+		c.JSON(http.StatusServiceUnavailable, errorResp{"temporarily_unavailable", ""})
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (ins *Handle) introspect(c *gin.Context) {
+	if _, err := ins.service.authenticateClient(c, false); err != nil {
+		invalidClient(c)
+		return
+	}
+	token := c.PostForm("token")
+	if len(token) == 0 {
+		c.JSON(http.StatusBadRequest, errorResp{"invalid_request", "token is required"})
+		return
+	}
+	resp, err := ins.service.Introspect(c.Request.Context(), token, c.PostForm("token_type_hint"))
+	if err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+		c.JSON(http.StatusServiceUnavailable, errorResp{"temporarily_unavailable", ""})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, resp)
+}
+
+func invalidClient(c *gin.Context) {
+	c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	c.JSON(http.StatusUnauthorized, errorResp{"invalid_client", ""})
+}
@@ -0,0 +1,112 @@
+package oauth
+
+import (
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// pages of the authorization endpoint, kept plain so a deployment can put its
+// own front end in front of the same form posts
+var pages = template.Must(template.New("").Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width">
+<title>Sign in</title></head><body>{{end}}
+{{define "login"}}{{template "head"}}
+<h1>Sign in to {{.Client}}</h1>
+{{if .Message}}<p role="alert">{{.Message}}</p>{{end}}
+<form method="post" action="/oauth/authorize/login">
+<input type="hidden" name="request_id" value="{{.RequestID}}">
+<label>Username <input name="username" autocomplete="username" required autofocus></label>
+<label>Password <input name="password" type="password" autocomplete="current-password" required></label>
+<button type="submit">Continue</button>
+</form></body></html>{{end}}
+{{define "mfa"}}{{template "head"}}
+<h1>Two-step verification</h1>
+{{if .Message}}<p role="alert">{{.Message}}</p>{{end}}
+{{if .OTP}}<form method="post" action="/oauth/authorize/mfa">
+<input type="hidden" name="request_id" value="{{.RequestID}}">
+<input type="hidden" name="mfa_token" value="{{.MFAToken}}">
+<input type="hidden" name="mfa_methods" value="{{.Methods}}">
+<label>Code from your authenticator app or a recovery code
+<input name="otp" autocomplete="one-time-code" required autofocus></label>
+<button type="submit">Verify</button>
+</form>{{end}}
+{{if .ChallengeID}}<form method="post" action="/oauth/authorize/webauthn" id="passkey">
+<input type="hidden" name="request_id" value="{{.RequestID}}">
+<input type="hidden" name="mfa_token" value="{{.MFAToken}}">
+<input type="hidden" name="mfa_methods" value="{{.Methods}}">
+<input type="hidden" name="challenge_id" value="{{.ChallengeID}}">
+<input type="hidden" name="credential">
+<button type="submit">Use a passkey</button>
+</form>
+<script nonce="{{.Nonce}}">
+const form = document.getElementById("passkey");
+const decode = (s) => Uint8Array.from(atob(s.replace(/-/g, "+").replace(/_/g, "/")), (c) => c.charCodeAt(0));
+const encode = (b) => btoa(String.fromCharCode(...new Uint8Array(b)))
+	.replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+form.addEventListener("submit", async (event) => {
+	event.preventDefault();
+	const publicKey = {{.Options}}.publicKey;
+	publicKey.challenge = decode(publicKey.challenge);
+	(publicKey.allowCredentials || []).forEach((c) => { c.id = decode(c.id); });
+	try {
+		const credential = await navigator.credentials.get({publicKey});
+		const r = credential.response;
+		form.credential.value = JSON.stringify({
+			id: credential.id,
+			rawId: encode(credential.rawId),
+			type: credential.type,
+			response: {
+				clientDataJSON: encode(r.clientDataJSON),
+				authenticatorData: encode(r.authenticatorData),
+				signature: encode(r.signature),
+				userHandle: r.userHandle ? encode(r.userHandle) : undefined,
+			},
+		});
+	} catch (e) {
+		// submitted empty the answer is refused and a new challenge shown
+	}
+	form.submit();
+});
+</script>{{end}}
+</body></html>{{end}}
+{{define "error"}}{{template "head"}}
+<h1>Sign in failed</h1><p>{{.Message}}</p></body></html>{{end}}
+`))
+
+type pageData struct {
+	Client    string
+	RequestID string
+	MFAToken  string
+	// Methods are the second factors of the user, space separated
+	Methods string
+	// OTP shows the form for the code of the authenticator app
+	OTP bool
+	// ChallengeID and Options are the passkey challenge, none when empty
+	ChallengeID string
+	Options     interface{}
+	Message     string
+	// Nonce allows the script of the page and no other
+	Nonce string
+}
+
+func renderPage(c *gin.Context, status int, name string, data pageData) {
+	var err error
+	if data.Nonce, err = randomToken(); err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "default-src 'none'; script-src 'nonce-"+data.Nonce+"'; form-action 'self'")
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := pages.ExecuteTemplate(c.Writer, name, data); err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+	}
+}
+
+func renderError(c *gin.Context, message string) {
+	renderPage(c, http.StatusBadRequest, "error", pageData{Message: message})
+}
@@ -0,0 +1,227 @@
+package oauth
+
+import (
+	"app/internal/auth"
+	"app/internal/clients"
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"app/source/api/user"
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+type Service struct {
+	db  *store.DB
+	cfg Config
+}
+
+type Config struct {
+	// Issuer is the public base URL, the iss of every token
+	Issuer string
+	// Clients are the registered relying parties
+	Clients *clients.Registry
+	// Keys are the key set behind Tokens, published in the discovery document
+	Keys *auth.KeySet
+	// Tokens signs the ID tokens and parses refresh tokens
+	Tokens *auth.Issuer
+	// Verifier checks access tokens
+	Verifier *auth.Verifier
+	// Users runs the logins of the authorization endpoint
+	Users *user.Service
+	// Store persists authorizations
+	Store *store.DB
+}
+
+// NewService : every field but Clients is required, Clients defaults to a
+// registry over Store
+func NewService(cfg Config) (*Service, error) {
+	switch {
+	case cfg.Store == nil:
+		return nil, errors.New("oauth: Config.Store is required")
+	case cfg.Keys == nil || cfg.Tokens == nil:
+		return nil, errors.New("oauth: Config.Keys and Config.Tokens are required")
+	case cfg.Verifier == nil:
+		return nil, errors.New("oauth: Config.Verifier is required")
+	case cfg.Users == nil:
+		return nil, errors.New("oauth: Config.Users is required")
+	case len(cfg.Issuer) == 0:
+		return nil, errors.New("oauth: Config.Issuer is required")
+	}
+	if cfg.Clients == nil {
+		cfg.Clients = clients.NewRegistry(cfg.Store.Clients)
+	}
+	return &Service{
+		db:  cfg.Store,
+		cfg: cfg,
+	}, nil
+}
+
+// Revoke : end the sessions the token belongs to when they are the client's
+// own, the token of another client is left alone (RFC 7009 section 2.1).
+// Unknown, expired or already revoked tokens are not an error (section 2.2).
+func (ins *Service) Revoke(ctx context.Context, client *clients.Client, token, hint string) error {
+	sessions, err := ins.sessionsOf(ctx, token, hint)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.ClientID != client.ID {
+			continue
+		}
+		if err := ins.cfg.Users.EndSession(ctx, session.UserID, session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Introspect : describe the token if it is live, i.e. valid and its session not revoked
+func (ins *Service) Introspect(ctx context.Context, token, hint string) (IntrospectResp, error) {
+	if hint == hintRefreshToken {
+		if resp, err := ins.introspectRefreshToken(ctx, token); err != nil || resp.Active {
+			return resp, err
+		}
+		return ins.introspectAccessToken(ctx, token)
+	}
+	if resp, err := ins.introspectAccessToken(ctx, token); err != nil || resp.Active {
+		return resp, err
+	}
+	return ins.introspectRefreshToken(ctx, token)
+}
+
+func (ins *Service) introspectAccessToken(ctx context.Context, token string) (IntrospectResp, error) {
+	claims, err := ins.cfg.Verifier.Verify(token)
+	if err != nil {
+		return IntrospectResp{}, nil
+	}
+	session, err := ins.db.Session.GetByAT(ctx, token)
+	if err != nil {
+		return IntrospectResp{}, ignoreNotFound(err)
+	}
+	if active, err := ins.live(ctx, session); !active {
+		return IntrospectResp{}, err
+	}
+	resp := IntrospectResp{
+		Active:    true,
+		Scope:     strings.Join(claims.Scopes, " "),
+		ClientID:  session.ClientID,
+		Username:  claims.Username,
+		TokenType: "Bearer",
+		Sub:       claims.Subject,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+		Jti:       claims.ID,
+		AMR:       claims.AMR,
+		SessionID: session.ID.Hex(),
+	}
+	if claims.ExpiresAt != nil {
+		resp.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		resp.Iat = claims.IssuedAt.Unix()
+	}
+	if claims.NotBefore != nil {
+		resp.Nbf = claims.NotBefore.Unix()
+	}
+	if !claims.AuthTime.IsZero() {
+		resp.AuthTime = claims.AuthTime.Unix()
+	}
+	return resp, nil
+}
+
+func (ins *Service) introspectRefreshToken(ctx context.Context, token string) (IntrospectResp, error) {
+	rt, err := ins.cfg.Tokens.ValidateRefreshToken(token)
+	if err != nil {
+		return IntrospectResp{}, nil
+	}
+	session, err := ins.currentSession(ctx, rt, token)
+	if err != nil || session == nil {
+		return IntrospectResp{}, err
+	}
+	if active, err := ins.live(ctx, session); !active {
+		return IntrospectResp{}, err
+	}
+	user, err := ins.db.User.FindByID(ctx, session.UserID)
+	if err != nil {
+		return IntrospectResp{}, ignoreNotFound(err)
+	}
+	return IntrospectResp{
+		Active:    true,
+		ClientID:  session.ClientID,
+		Username:  user.Username,
+		TokenType: hintRefreshToken,
+		Exp:       rt.ExpiresAt.Unix(),
+		Iat:       rt.IssuedAt.Unix(),
+		Sub:       session.UserID.Hex(),
+		Iss:       rt.Issuer,
+		Jti:       rt.ID,
+		AMR:       session.AMR,
+		AuthTime:  session.AuthTime.Unix(),
+		SessionID: session.ID.Hex(),
+	}, nil
+}
+
+// sessionsOf : the sessions a token grants access to, empty when it grants none
+func (ins *Service) sessionsOf(ctx context.Context, token, hint string) ([]models.SessionModel, error) {
+	var lookups = []func() ([]models.SessionModel, error){
+		func() ([]models.SessionModel, error) {
+			if _, err := ins.cfg.Verifier.Verify(token); err != nil {
+				return nil, nil
+			}
+			session, err := ins.db.Session.GetByAT(ctx, token)
+			if err != nil {
+				return nil, ignoreNotFound(err)
+			}
+			return []models.SessionModel{*session}, nil
+		},
+		func() ([]models.SessionModel, error) {
+			rt, err := ins.cfg.Tokens.ValidateRefreshToken(token)
+			if err != nil {
+				return nil, nil
+			}
+			// a rotated refresh token still ends its family
+			return ins.db.Session.GetByFamily(ctx, rt.Family)
+		},
+	}
+	if hint == hintRefreshToken {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+	for _, lookup := range lookups {
+		sessions, err := lookup()
+		if err != nil || len(sessions) > 0 {
+			return sessions, err
+		}
+	}
+	return nil, nil
+}
+
+// currentSession : the session whose current refresh token is token, nil once rotated
+func (ins *Service) currentSession(ctx context.Context, rt *auth.RefreshClaims, token string) (*models.SessionModel, error) {
+	sessions, err := ins.db.Session.GetByFamily(ctx, rt.Family)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		if sessions[i].Generation == rt.Generation && sessions[i].RefreshToken == token {
+			return &sessions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// live : the session is still linked to its user and within its lifetime
+func (ins *Service) live(ctx context.Context, session *models.SessionModel) (bool, error) {
+	if ins.cfg.Users.SessionLifetime().Ended(session, time.Now()) {
+		return false, nil
+	}
+	return ins.db.User.ValidateSession(ctx, session.ID)
+}
+
+func ignoreNotFound(err error) error {
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	return err
+}
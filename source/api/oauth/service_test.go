@@ -0,0 +1,79 @@
+package oauth
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestIntrospect(t *testing.T) {
+	api := newTestOAuth(t, nil)
+	accessToken, refreshToken := api.signIn("app", "alice")
+	access := api.introspect(accessToken)
+	if !access.Active || access.ClientID != "app" || access.Username != "alice" || access.TokenType != "Bearer" ||
+		len(access.Sub) == 0 || len(access.SessionID) == 0 || access.Exp == 0 {
+		t.Fatalf("access token: %+v", access)
+	}
+	refresh := api.introspect(refreshToken)
+	if !refresh.Active || refresh.ClientID != "app" || refresh.TokenType != hintRefreshToken ||
+		refresh.Sub != access.Sub || refresh.SessionID != access.SessionID {
+		t.Fatalf("refresh token: %+v", refresh)
+	}
+	if resp := api.introspect("not-a-token"); resp.Active || len(resp.ClientID) > 0 {
+		t.Fatalf("unknown token: %+v", resp)
+	}
+	// a public client can not introspect, it has no secret to prove who asks
+	var resp errorResp
+	if status := api.post("/oauth/introspect", url.Values{"client_id": {"app"}, "token": {accessToken}}, &resp); status != http.StatusUnauthorized || resp.Error != "invalid_client" {
+		t.Fatalf("introspect by a public client: %d %+v", status, resp)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	for _, hint := range []string{hintAccessToken, hintRefreshToken, ""} {
+		t.Run("hint "+hint, func(t *testing.T) {
+			api := newTestOAuth(t, nil)
+			accessToken, refreshToken := api.signIn("app", "alice")
+			token := accessToken
+			if hint == hintRefreshToken {
+				token = refreshToken
+			}
+			if status := api.revoke("app", token, hint); status != http.StatusOK {
+				t.Fatalf("revoke: %d", status)
+			}
+			for _, token := range []string{accessToken, refreshToken} {
+				if resp := api.introspect(token); resp.Active {
+					t.Fatalf("token active after the revocation: %+v", resp)
+				}
+			}
+			// revoking again or an unknown token is not an error
+			if status := api.revoke("app", token, hint); status != http.StatusOK {
+				t.Fatalf("revoke twice: %d", status)
+			}
+			if status := api.revoke("app", "not-a-token", hint); status != http.StatusOK {
+				t.Fatalf("revoke an unknown token: %d", status)
+			}
+		})
+	}
+}
+
+// TestRevokeOtherClient : a client can only revoke its own tokens, the tokens
+// of another client stay active (RFC 7009 section 2.1)
+func TestRevokeOtherClient(t *testing.T) {
+	api := newTestOAuth(t, nil)
+	accessToken, refreshToken := api.signIn("app", "alice")
+	for _, token := range []string{accessToken, refreshToken} {
+		if status := api.revoke("other-app", token, ""); status != http.StatusOK {
+			t.Fatalf("revoke by another client: %d", status)
+		}
+		if resp := api.introspect(token); !resp.Active {
+			t.Fatalf("token of another client revoked: %+v", resp)
+		}
+	}
+	if status := api.revoke("unknown-app", accessToken, ""); status != http.StatusUnauthorized {
+		t.Fatalf("revoke by an unknown client: %d", status)
+	}
+	if resp := api.introspect(accessToken); !resp.Active {
+		t.Fatalf("token revoked by an unknown client: %+v", resp)
+	}
+}
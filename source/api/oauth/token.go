@@ -0,0 +1,168 @@
+package oauth
+
+import (
+	"app/internal/clients"
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"app/source/api/user"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+const idTokenExpired = time.Hour
+
+// TokenResp : RFC 6749 section 5.1 with the id_token of OpenID Connect
+type TokenResp struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+func (ins *Handle) token(c *gin.Context) {
+	client, err := ins.service.authenticateClient(c, true)
+	if err != nil {
+		invalidClient(c)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	grant := c.PostForm("grant_type")
+	if (grant == clients.GrantAuthorizationCode || grant == clients.GrantRefreshToken) && !client.AllowsGrant(grant) {
+		c.JSON(http.StatusBadRequest, errorResp{"unauthorized_client", ""})
+		return
+	}
+	switch grant {
+	case clients.GrantAuthorizationCode:
+		ins.authorizationCodeGrant(c, client)
+	case clients.GrantRefreshToken:
+		ins.refreshTokenGrant(c, client)
+	default:
+		c.JSON(http.StatusBadRequest, errorResp{"unsupported_grant_type", ""})
+	}
+}
+
+func (ins *Handle) authorizationCodeGrant(c *gin.Context, client *clients.Client) {
+	ctx := c.Request.Context()
+	authorization, err := ins.service.db.OAuth.Redeem(ctx, hashCode(c.PostForm("code")))
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+			c.JSON(http.StatusInternalServerError, errorResp{"server_error", ""})
+			return
+		}
+		c.JSON(http.StatusBadRequest, errorResp{"invalid_grant", "code invalid or expired"})
+		return
+	}
+	if authorization.ClientID != client.ID || authorization.RedirectURI != c.PostForm("redirect_uri") {
+		c.JSON(http.StatusBadRequest, errorResp{"invalid_grant", "code was issued to another client or redirect_uri"})
+		return
+	}
+	if !verifyPKCE(authorization, c.PostForm("code_verifier")) {
+		c.JSON(http.StatusBadRequest, errorResp{"invalid_grant", "code_verifier invalid"})
+		return
+	}
+
+	session, err := ins.service.db.Session.GetByID(ctx, authorization.SessionID)
+	if err == nil {
+		var active bool
+		if active, err = ins.service.live(ctx, session); err == nil && !active {
+			c.JSON(http.StatusBadRequest, errorResp{"invalid_grant", "session revoked"})
+			return
+		}
+	}
+	var found *models.UserModel
+	if err == nil {
+		found, err = ins.service.db.User.FindByID(ctx, session.UserID)
+	}
+	if err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+		c.JSON(http.StatusInternalServerError, errorResp{"server_error", ""})
+		return
+	}
+
+	var username string
+	if hasScope(authorization.Scope, scopeProfile) {
+		username = found.Username
+	}
+	idToken, err := ins.service.cfg.Tokens.GenerateIDToken(found.ID.Hex(), client.ID, authorization.Nonce, session.ID.Hex(),
+		username, session.AMR, session.AuthTime, idTokenExpired)
+	if err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+		c.JSON(http.StatusInternalServerError, errorResp{"server_error", ""})
+		return
+	}
+	c.JSON(http.StatusOK, TokenResp{
+		AccessToken:  session.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    ins.service.expiresIn(session.AccessToken),
+		RefreshToken: session.RefreshToken,
+		IDToken:      idToken,
+		Scope:        authorization.Scope,
+	})
+}
+
+// refreshTokenGrant : the regular rotation, limited to refresh tokens of the client's own sessions
+func (ins *Handle) refreshTokenGrant(c *gin.Context, client *clients.Client) {
+	ctx := c.Request.Context()
+	refreshToken := c.PostForm("refresh_token")
+	rt, err := ins.service.cfg.Tokens.ValidateRefreshToken(refreshToken)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errorResp{"invalid_grant", "refresh_token invalid"})
+		return
+	}
+	sessions, err := ins.service.db.Session.GetByFamily(ctx, rt.Family)
+	if err != nil {
+		log.Printf("Path: %s, Error: %s", c.Request.RequestURI, err.Error())
+		c.JSON(http.StatusInternalServerError, errorResp{"server_error", ""})
+		return
+	}
+	if len(sessions) == 0 || sessions[0].ClientID != client.ID {
+		c.JSON(http.StatusBadRequest, errorResp{"invalid_grant", "refresh_token invalid"})
+		return
+	}
+
+	resp, err := ins.service.cfg.Users.RefreshToken(ctx, user.NewRefreshTokenReq(c, client, refreshToken))
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+	}
+	switch resp.Code {
+	case 0:
+		c.JSON(http.StatusOK, TokenResp{
+			AccessToken:  resp.Result.AccessToken,
+			TokenType:    resp.Result.TokenType,
+			ExpiresIn:    resp.Result.ExpiresIn,
+			RefreshToken: resp.Result.RefreshToken,
+		})
+	case 40, 41, 43:
+		c.JSON(http.StatusBadRequest, errorResp{"invalid_grant", "refresh_token invalid"})
+	default:
+		c.JSON(http.StatusInternalServerError, errorResp{"server_error", ""})
+	}
+}
+
+// verifyPKCE : RFC 7636 section 4.6, only S256 is accepted at the authorization endpoint
+func verifyPKCE(authorization *models.AuthorizationModel, verifier string) bool {
+	if authorization.CodeChallengeMethod != pkceS256 || len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(challenge), []byte(authorization.CodeChallenge)) == 1
+}
+
+// expiresIn : seconds left on an access token
+func (ins *Service) expiresIn(accessToken string) int64 {
+	claims, err := ins.cfg.Verifier.Verify(accessToken)
+	if err != nil || claims.ExpiresAt == nil {
+		return 0
+	}
+	return int64(time.Until(claims.ExpiresAt.Time) / time.Second)
+}
@@ -0,0 +1,142 @@
+package user
+
+import (
+	"app/internal/auth"
+	"app/internal/clients"
+	"app/internal/password"
+	"app/internal/store"
+	"app/internal/store/memory"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testClientID = "test-app"
+	testOrigin   = "https://localhost"
+	testPassword = "Corr3ct-Horse-Battery"
+)
+
+// testAPI : the user routes over a store, called through HTTP like a client would
+type testAPI struct {
+	t       *testing.T
+	db      *store.DB
+	service *Service
+	engine  *gin.Engine
+}
+
+// newTestAPI : the routes over db, a memory store when nil, with passkeys for
+// the relying party localhost
+func newTestAPI(t *testing.T, db *store.DB, configure ...func(cfg *Config)) *testAPI {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	if db == nil {
+		db = memory.New()
+	}
+	ctx := context.Background()
+	keys, err := auth.NewKeySet(ctx, auth.NewMemoryKeyStore(), auth.DefaultKeyPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := clients.NewRegistry(db.Clients)
+	if err := registry.Register(ctx, clients.Registration{
+		ID:     testClientID,
+		Type:   clients.TypePublic,
+		Grants: []string{clients.GrantPassword, clients.GrantRefreshToken},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	relyingParty, err := webauthn.New(&webauthn.Config{
+		RPID:          "localhost",
+		RPDisplayName: "MFA",
+		RPOrigins:     []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		PasswordPolicy: password.DefaultPolicy,
+		LockoutPolicy:  DefaultLockoutPolicy,
+		SessionPolicy:  DefaultSessionPolicy,
+		WebAuthn:       relyingParty,
+		Tokens:         auth.NewIssuer(keys, auth.DefaultClaimsConfig),
+		Verifier:       auth.NewVerifier(keys, auth.DefaultClaimsConfig, auth.LegacyConfig{}),
+		Clients:        registry,
+		Store:          db,
+	}
+	for _, apply := range configure {
+		apply(&cfg)
+	}
+	service, err := NewService(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := gin.New()
+	New(service).Apply(engine)
+	return &testAPI{t: t, db: db, service: service, engine: engine}
+}
+
+// call : send body as JSON with the bearer token when given, decode the
+// response into out and return the status
+func (api *testAPI) call(method, path, token string, body, out interface{}) int {
+	api.t.Helper()
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			api.t.Fatal(err)
+		}
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	req := httptest.NewRequest(method, path+sep+"cId="+testClientID, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	api.engine.ServeHTTP(rec, req)
+	if out != nil && rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			api.t.Fatalf("%s %s: %s: %s", method, path, err, rec.Body.String())
+		}
+	}
+	return rec.Code
+}
+
+// register : create the account, failing the test otherwise
+func (api *testAPI) register(username string) {
+	api.t.Helper()
+	var resp RegisterResp
+	if status := api.call(http.MethodPost, "/register", "",
+		map[string]string{"username": username, "password": testPassword}, &resp); status != http.StatusCreated || resp.Code != 0 {
+		api.t.Fatalf("register %s: %d %+v", username, status, resp)
+	}
+}
+
+func (api *testAPI) login(username, password string) (int, LogInResp) {
+	api.t.Helper()
+	var resp LogInResp
+	status := api.call(http.MethodPost, "/login", "",
+		map[string]string{"username": username, "password": password}, &resp)
+	return status, resp
+}
+
+// signIn : register the account and log in, returning the token pair
+func (api *testAPI) signIn(username string) logInResult {
+	api.t.Helper()
+	api.register(username)
+	status, resp := api.login(username, testPassword)
+	if status != http.StatusOK || resp.Code != 0 {
+		api.t.Fatalf("login %s: %d %+v", username, status, resp)
+	}
+	return resp.Result
+}
@@ -0,0 +1,50 @@
+package user
+
+import (
+	"app/internal/clients"
+	"context"
+	"errors"
+	"time"
+)
+
+var errClientUnauthorized = errors.New("client unknown, not authenticated or not allowed")
+
+// authorizeClient : the client named by td must be registered, present its
+// secret when confidential, allow grant and the request origin. A client set by
+// the OIDC provider was authenticated there already.
+func (ins *Service) authorizeClient(ctx context.Context, td trackingData, grant string) (*clients.Client, error) {
+	if td.client != nil {
+		return td.client, nil
+	}
+	client, err := ins.cfg.Clients.Authenticate(ctx, td.ClientID, td.ClientSecret)
+	if err != nil {
+		if errors.Is(err, clients.ErrUnknownClient) || errors.Is(err, clients.ErrInvalidSecret) {
+			return nil, errClientUnauthorized
+		}
+		return nil, err
+	}
+	if !client.AllowsGrant(grant) || !client.AllowsOrigin(td.Origin) {
+		return nil, errClientUnauthorized
+	}
+	return client, nil
+}
+
+// tokenTTLs : the client's lifetimes, or the service defaults
+func tokenTTLs(client *clients.Client) (access, refresh time.Duration) {
+	access, refresh = tokenExpired, refreshTokenExpired
+	if client.AccessTokenTTL > 0 {
+		access = client.AccessTokenTTL
+	}
+	if client.RefreshTokenTTL > 0 {
+		refresh = client.RefreshTokenTTL
+	}
+	return access, refresh
+}
+
+// clientFailure : the response code for an authorizeClient error
+func clientFailure(err error) (int, string) {
+	if errors.Is(err, errClientUnauthorized) {
+		return 50, "CLIENT_UNAUTHORIZED"
+	}
+	return 53, "DATABASE_ERROR"
+}
@@ -0,0 +1,121 @@
+package user
+
+import (
+	"app/internal/clients"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// withClients : register more clients next to the test client
+func withClients(t *testing.T, registrations ...clients.Registration) func(cfg *Config) {
+	return func(cfg *Config) {
+		for _, r := range registrations {
+			if err := cfg.Clients.Register(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// clientLogin : log in on behalf of clientID, with the secret as
+// client_secret_basic and the Origin header when given
+func (api *testAPI) clientLogin(clientID, secret, origin string) (int, LogInResp) {
+	api.t.Helper()
+	body, err := json.Marshal(map[string]string{"username": "alice", "password": testPassword})
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/login?cId="+clientID, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if len(secret) > 0 {
+		req.SetBasicAuth(clientID, secret)
+	}
+	if len(origin) > 0 {
+		req.Header.Set("Origin", origin)
+	}
+	rec := httptest.NewRecorder()
+	api.engine.ServeHTTP(rec, req)
+	var resp LogInResp
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		api.t.Fatalf("%s: %s", err, rec.Body.String())
+	}
+	return rec.Code, resp
+}
+
+// TestClientRejected : only a registered client, allowed the grant and the
+// origin, and authenticated when confidential, gets tokens
+func TestClientRejected(t *testing.T) {
+	api := newTestAPI(t, nil, withClients(t,
+		clients.Registration{ID: "web", Type: clients.TypePublic, Grants: []string{clients.GrantPassword},
+			AllowedOrigins: []string{"https://web.example"}},
+		clients.Registration{ID: "backend", Type: clients.TypeConfidential, Secret: "backend-secret",
+			Grants: []string{clients.GrantPassword}},
+		clients.Registration{ID: "sso-only", Type: clients.TypePublic, Grants: []string{clients.GrantAuthorizationCode}},
+	))
+	api.register("alice")
+	for _, c := range []struct {
+		name, clientID, secret, origin string
+	}{
+		{"unknown client", "unknown", "", ""},
+		{"no client", "", "", ""},
+		{"grant not allowed", "sso-only", "", ""},
+		{"origin not allowed", "web", "", "https://attacker.example"},
+		{"confidential without a secret", "backend", "", ""},
+		{"confidential with a wrong secret", "backend", "wrong", ""},
+	} {
+		if status, resp := api.clientLogin(c.clientID, c.secret, c.origin); status != http.StatusUnauthorized || resp.Code != 50 {
+			t.Fatalf("%s: %d %+v", c.name, status, resp)
+		}
+	}
+	for _, c := range []struct {
+		name, clientID, secret, origin string
+	}{
+		{"allowed origin", "web", "", "https://web.example"},
+		{"confidential", "backend", "backend-secret", ""},
+	} {
+		if status, resp := api.clientLogin(c.clientID, c.secret, c.origin); status != http.StatusOK || resp.Code != 0 {
+			t.Fatalf("%s: %d %+v", c.name, status, resp)
+		}
+	}
+}
+
+// TestClientTokenTTLs : a client's lifetimes override the service defaults,
+// and the session records the client it was opened for
+func TestClientTokenTTLs(t *testing.T) {
+	api := newTestAPI(t, nil, withClients(t, clients.Registration{
+		ID:              "short",
+		Type:            clients.TypePublic,
+		Grants:          []string{clients.GrantPassword},
+		AccessTokenTTL:  60,
+		RefreshTokenTTL: 600,
+	}))
+	api.register("alice")
+	status, resp := api.clientLogin("short", "", "")
+	if status != http.StatusOK || resp.Result.ExpiresIn != 60 {
+		t.Fatalf("login: %d %+v", status, resp)
+	}
+	session, err := api.db.Session.GetByAT(context.Background(), resp.Result.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.ClientID != "short" {
+		t.Fatalf("session of client %q", session.ClientID)
+	}
+	claims, err := api.service.cfg.Tokens.ValidateRefreshToken(resp.Result.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time); lifetime != 10*time.Minute {
+		t.Fatalf("refresh token lifetime %s", lifetime)
+	}
+
+	_, defaults := api.login("alice", testPassword)
+	if defaults.Result.ExpiresIn != int64(tokenExpired/time.Second) {
+		t.Fatalf("default lifetime %d", defaults.Result.ExpiresIn)
+	}
+}
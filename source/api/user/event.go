@@ -0,0 +1,37 @@
+package user
+
+import (
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"time"
+)
+
+var errRefreshTokenReused = errors.New("refresh token reused, session family revoked")
+
+const (
+	// EventRefreshTokenReuse : a rotated refresh token was presented again
+	EventRefreshTokenReuse = "refresh_token_reuse"
+)
+
+// SecurityEvent : something a user or an operator should be told about
+type SecurityEvent struct {
+	Type      string
+	UserID    primitive.ObjectID
+	SessionID primitive.ObjectID
+	ClientIP  string
+	Detail    string
+	At        time.Time
+}
+
+func (ins *Service) securityEvent(event SecurityEvent) {
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	if ins.cfg.SecurityEvents != nil {
+		ins.cfg.SecurityEvents(event)
+		return
+	}
+	log.Printf("SECURITY: %s user %s session %s ip %s: %s",
+		event.Type, event.UserID.Hex(), event.SessionID.Hex(), event.ClientIP, event.Detail)
+}
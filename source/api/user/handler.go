@@ -1,9 +1,13 @@
 package user
 
 import (
+	"app/internal/clients"
 	"app/source/middlewares"
+	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"log"
 	"net/http"
 )
@@ -19,27 +23,124 @@ func New(s *Service) *Handle {
 }
 
 func (ins *Handle) Apply(r *gin.Engine) {
+	requireAuth := middlewares.RequireAuth(ins.service.cfg.Verifier, ins.service.db, ins.service.SessionLifetime())
+
+	r.POST("/register", ins.register)
 	r.POST("/login", ins.login)
-	r.POST("/logout", middlewares.RequireAuth, ins.logout)
+	r.POST("/login/mfa", ins.loginMfa)
+	r.POST("/login/webauthn/begin", ins.beginPasskeyLogin)
+	r.POST("/login/webauthn/finish", ins.finishPasskeyLogin)
+	r.POST("/logout", requireAuth, ins.logout)
 	r.POST("/refresh-token", ins.refreshToken)
+	r.GET("/sessions", requireAuth, ins.sessions)
+	r.GET("/sessions/:id", requireAuth, ins.session)
+	r.POST("/sessions/revoke", requireAuth, ins.revokeSession)
+	r.POST("/sessions/revoke-others", requireAuth, ins.revokeOtherSessions)
+	r.POST("/password/change", requireAuth, ins.changePassword)
 
 	// ins.generateMfaSecret Generates an MFA secret for a user and returns it as a string
 	// and as base64 encoded QR code image.
-	r.POST("/mfa/generate-secret", middlewares.RequireAuth, ins.generateMfaSecret)
-	r.POST("/mfa/active", middlewares.RequireAuth, ins.activeMfa)
-	r.POST("/mfa/validate", middlewares.RequireAuth, ins.validateOTP)
-	r.POST("/mfa/deactivate", middlewares.RequireAuth, ins.deactivateMfa)
+	r.POST("/mfa/generate-secret", requireAuth, ins.generateMfaSecret)
+	r.POST("/mfa/active", requireAuth, ins.activeMfa)
+	r.POST("/mfa/validate", requireAuth, ins.validateOTP)
+	r.POST("/mfa/deactivate", requireAuth, ins.deactivateMfa)
+	r.GET("/mfa/recovery-codes", requireAuth, ins.recoveryCodesStatus)
+	r.POST("/mfa/recovery-codes", requireAuth, ins.regenerateRecoveryCodes)
+
+	r.POST("/webauthn/register/begin", requireAuth, ins.beginPasskeyRegistration)
+	r.POST("/webauthn/register/finish", requireAuth, ins.finishPasskeyRegistration)
+	r.GET("/webauthn/credentials", requireAuth, ins.passkeys)
+	r.POST("/webauthn/credentials/remove", requireAuth, ins.removePasskey)
+
+	if len(ins.service.cfg.AdminAPIKey) > 0 {
+		r.POST("/admin/unlock", middlewares.RequireAdminKey(ins.service.cfg.AdminAPIKey), ins.unlock)
+		r.POST("/admin/session-limit", middlewares.RequireAdminKey(ins.service.cfg.AdminAPIKey), ins.setSessionLimit)
+	}
+
+}
+
+// newTrackingData : request metadata shared by every endpoint
+func newTrackingData(c *gin.Context) trackingData {
+	td := trackingData{
+		ClientID:  c.Query("cId"),
+		RequestID: c.DefaultQuery("reqId", uuid.NewString()),
+		ClientIP:  c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Origin:    c.GetHeader("Origin"),
+	}
+	// confidential clients authenticate with client_secret_basic
+	if id, secret, ok := c.Request.BasicAuth(); ok {
+		td.ClientID, td.ClientSecret = id, secret
+	}
+	return td
+}
+
+// NewLogInReq : a login made on behalf of a client the caller already
+// authenticated, e.g. by the OIDC authorization endpoint
+func NewLogInReq(c *gin.Context, client *clients.Client, username, password string) *LogInReq {
+	return &LogInReq{trackingData: delegatedTrackingData(c, client), Username: username, Password: password}
+}
+
+func NewLogInMFAReq(c *gin.Context, client *clients.Client, mfaToken, otp string) *LogInMFAReq {
+	return &LogInMFAReq{trackingData: delegatedTrackingData(c, client), MFAToken: mfaToken, OTP: otp}
+}
+
+func NewRefreshTokenReq(c *gin.Context, client *clients.Client, refreshToken string) *RefreshTokenReq {
+	return &RefreshTokenReq{trackingData: delegatedTrackingData(c, client), RefreshToken: refreshToken}
+}
+
+func NewResumeSessionReq(c *gin.Context, client *clients.Client, userID, sessionID primitive.ObjectID) *ResumeSessionReq {
+	return &ResumeSessionReq{trackingData: delegatedTrackingData(c, client), UserID: userID, SessionID: sessionID}
+}
 
+func NewPasskeyLoginBeginReq(c *gin.Context, client *clients.Client, mfaToken string) *PasskeyLoginBeginReq {
+	return &PasskeyLoginBeginReq{trackingData: delegatedTrackingData(c, client), MFAToken: mfaToken}
+}
+
+func NewPasskeyLoginFinishReq(c *gin.Context, client *clients.Client, challengeID primitive.ObjectID, mfaToken string, credential json.RawMessage) *PasskeyLoginFinishReq {
+	return &PasskeyLoginFinishReq{trackingData: delegatedTrackingData(c, client), ChallengeID: challengeID, MFAToken: mfaToken, Credential: credential}
+}
+
+func delegatedTrackingData(c *gin.Context, client *clients.Client) trackingData {
+	td := newTrackingData(c)
+	td.ClientID, td.ClientSecret = client.ID, ""
+	td.client = client
+	return td
+}
+
+func (ins *Handle) register(c *gin.Context) {
+	request := RegisterReq{
+		trackingData: newTrackingData(c),
+	}
+
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			RegisterResp{request.trackingData, -1, err.Error(), registerResult{}})
+		return
+	}
+	response, err := ins.service.Register(c.Request.Context(), &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, response, err.Error())
+	}
+	switch response.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, response)
+	case 50:
+		c.JSON(http.StatusUnauthorized, response)
+	case 45:
+		c.JSON(http.StatusConflict, response)
+	case 53:
+		c.JSON(http.StatusInternalServerError, response)
+	default:
+		c.JSON(http.StatusCreated, response)
+	}
 }
 
 func (ins *Handle) login(c *gin.Context) {
 	// request process block
 	request := LogInReq{
-		trackingData: trackingData{
-			ClientID:  c.DefaultQuery("cId", c.Request.UserAgent()),
-			RequestID: c.DefaultQuery("reqId", uuid.NewString()),
-		},
-		Username: "", Password: "",
+		trackingData: newTrackingData(c),
+		Username:     "", Password: "",
 	}
 
 	if err := c.BindJSON(&request); err != nil {
@@ -51,17 +152,57 @@ func (ins *Handle) login(c *gin.Context) {
 	if err != nil {
 		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, response, err.Error())
 	}
-	c.JSON(http.StatusOK, response)
+	switch response.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, response)
+	case 41, 50:
+		c.JSON(http.StatusUnauthorized, response)
+	case 48:
+		c.JSON(http.StatusForbidden, response)
+	case 49:
+		c.JSON(http.StatusTooManyRequests, response)
+	case 53:
+		c.JSON(http.StatusInternalServerError, response)
+	default:
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func (ins *Handle) loginMfa(c *gin.Context) {
+	request := LogInMFAReq{
+		trackingData: newTrackingData(c),
+	}
+
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			LogInResp{request.trackingData, -1, err.Error(), logInResult{}})
+		return
+	}
+	response, err := ins.service.LoginMFA(c.Request.Context(), &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, response, err.Error())
+	}
+	switch response.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, response)
+	case 41, 42, 50:
+		c.JSON(http.StatusUnauthorized, response)
+	case 48:
+		c.JSON(http.StatusForbidden, response)
+	case 49:
+		c.JSON(http.StatusTooManyRequests, response)
+	case 53:
+		c.JSON(http.StatusInternalServerError, response)
+	default:
+		c.JSON(http.StatusOK, response)
+	}
 }
 
 func (ins *Handle) logout(c *gin.Context) {
 	var (
 		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
 		request       = LogOutReq{
-			trackingData{
-				ClientID:  c.DefaultQuery("cId", c.Request.UserAgent()),
-				RequestID: c.DefaultQuery("reqId", uuid.NewString()),
-			},
+			newTrackingData(c),
 		}
 	)
 	uCtx := userAccess.(middlewares.UserCtx)
@@ -74,13 +215,102 @@ func (ins *Handle) logout(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
+func (ins *Handle) sessions(c *gin.Context) {
+	var (
+		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
+		request       = SessionReq{
+			trackingData: newTrackingData(c),
+		}
+	)
+	uCtx := userAccess.(middlewares.UserCtx)
+
+	resp, err := ins.service.Sessions(c.Request.Context(), uCtx, &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (ins *Handle) session(c *gin.Context) {
+	var (
+		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
+		request       = SessionReq{
+			trackingData: newTrackingData(c),
+			SessionID:    c.Param("id"),
+		}
+	)
+	uCtx := userAccess.(middlewares.UserCtx)
+
+	resp, err := ins.service.Session(c.Request.Context(), uCtx, &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+	}
+	switch resp.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, resp)
+	case 44:
+		c.JSON(http.StatusNotFound, resp)
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func (ins *Handle) revokeSession(c *gin.Context) {
+	var (
+		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
+		request       = SessionReq{
+			trackingData: newTrackingData(c),
+		}
+	)
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			SessionResp{request.trackingData, -1, err.Error(), nil})
+		return
+	}
+	uCtx := userAccess.(middlewares.UserCtx)
+
+	resp, err := ins.service.RevokeSession(c.Request.Context(), uCtx, &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+	}
+	switch resp.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, resp)
+	case 44:
+		c.JSON(http.StatusNotFound, resp)
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func (ins *Handle) revokeOtherSessions(c *gin.Context) {
+	var (
+		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
+		request       = SessionReq{
+			trackingData: newTrackingData(c),
+		}
+	)
+	uCtx := userAccess.(middlewares.UserCtx)
+
+	resp, err := ins.service.RevokeOtherSessions(c.Request.Context(), uCtx, &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
 func (ins *Handle) refreshToken(c *gin.Context) {
 	var (
 		request = RefreshTokenReq{
-			trackingData{
-				ClientID:  c.DefaultQuery("cId", c.Request.UserAgent()),
-				RequestID: c.DefaultQuery("reqId", uuid.NewString()),
-			},
+			newTrackingData(c),
 			"",
 		}
 	)
@@ -94,20 +324,50 @@ func (ins *Handle) refreshToken(c *gin.Context) {
 	if err != nil {
 		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
 	}
-	if resp.Code == 41 || resp.Code == 43 {
+	if resp.Code == 41 || resp.Code == 43 || resp.Code == 50 {
 		c.JSON(http.StatusUnauthorized, resp)
 	} else {
 		c.JSON(http.StatusOK, resp)
 	}
 }
 
+func (ins *Handle) changePassword(c *gin.Context) {
+	var (
+		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
+		request       = ChangePasswordReq{
+			trackingData: newTrackingData(c),
+		}
+	)
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			ChangePasswordResp{request.trackingData, -1, err.Error(), changePasswordResult{}})
+		return
+	}
+	uCtx := userAccess.(middlewares.UserCtx)
+
+	resp, err := ins.service.ChangePassword(c.Request.Context(), uCtx, &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+	}
+	switch resp.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, resp)
+	case 41, 42:
+		c.JSON(http.StatusForbidden, resp)
+	case 49:
+		c.JSON(http.StatusTooManyRequests, resp)
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
 func (ins *Handle) generateMfaSecret(c *gin.Context) {
 	var (
 		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
 		request       = GenSecretMFAReq{
-			trackingData{
-				c.DefaultQuery("cId", c.Request.UserAgent()),
-				c.DefaultQuery("reqId", uuid.NewString())},
+			newTrackingData(c),
 		}
 	)
 	uCtx := userAccess.(middlewares.UserCtx)
@@ -116,9 +376,14 @@ func (ins *Handle) generateMfaSecret(c *gin.Context) {
 	if err != nil {
 		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
 	}
-	if resp.Code == 41 || resp.Code == 43 {
+	switch resp.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, resp)
+	case 41, 43:
 		c.JSON(http.StatusUnauthorized, resp)
-	} else {
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
 		c.JSON(http.StatusOK, resp)
 	}
 }
@@ -127,9 +392,7 @@ func (ins *Handle) activeMfa(c *gin.Context) {
 	var (
 		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
 		request       = ActiveMFAReq{
-			trackingData: trackingData{
-				c.DefaultQuery("cId", c.Request.UserAgent()),
-				c.DefaultQuery("reqId", uuid.NewString())},
+			trackingData: newTrackingData(c),
 		}
 	)
 	uCtx := userAccess.(middlewares.UserCtx)
@@ -138,12 +401,20 @@ func (ins *Handle) activeMfa(c *gin.Context) {
 		return
 	}
 
-	err := ins.service.ActivateMFA(c.Request.Context(), &request, uCtx)
+	resp, err := ins.service.ActivateMFA(c.Request.Context(), &request, uCtx)
 	if err != nil {
-		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, err.Error())
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+	}
+	switch resp.Code {
+	case 42:
+		c.JSON(http.StatusForbidden, resp)
+	case 49:
+		c.JSON(http.StatusTooManyRequests, resp)
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
 	}
-
-	c.JSON(http.StatusOK, gin.H{"ok": "ok"})
 
 }
 
@@ -151,9 +422,7 @@ func (ins *Handle) validateOTP(c *gin.Context) {
 	var (
 		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
 		request       = ValidateOTPReq{
-			trackingData: trackingData{
-				c.DefaultQuery("cId", c.Request.UserAgent()),
-				c.DefaultQuery("reqId", uuid.NewString())},
+			trackingData: newTrackingData(c),
 		}
 	)
 	if err := c.BindJSON(&request); err != nil {
@@ -165,6 +434,10 @@ func (ins *Handle) validateOTP(c *gin.Context) {
 	resp, err := ins.service.ValidateOTP(c.Request.Context(), uCtx, &request)
 	if err != nil {
 		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+		if errors.Is(err, errTooManyAttempts) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
 	}
 	c.JSON(http.StatusOK, resp)
 }
@@ -172,20 +445,300 @@ func (ins *Handle) validateOTP(c *gin.Context) {
 func (ins *Handle) deactivateMfa(c *gin.Context) {
 	var (
 		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
-		_             = DeactivateMFAReq{
-			trackingData{
-				c.DefaultQuery("cId", c.Request.UserAgent()),
-				c.DefaultQuery("reqId", uuid.NewString())},
+		request       = DeactivateMFAReq{
+			trackingData: newTrackingData(c),
 		}
 	)
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			DeactivateMFAResp{request.trackingData, -1, err.Error()})
+		return
+	}
 	uCtx := userAccess.(middlewares.UserCtx)
 
-	response, err := ins.service.DeactivateMFA(c.Request.Context(), uCtx)
+	resp, err := ins.service.DeactivateMFA(c.Request.Context(), uCtx, &request)
 	if err != nil {
-		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, err.Error())
-		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
 	}
+	switch resp.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, resp)
+	case 42:
+		c.JSON(http.StatusForbidden, resp)
+	case 49:
+		c.JSON(http.StatusTooManyRequests, resp)
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
+}
 
-	c.JSON(http.StatusOK, response)
+func (ins *Handle) recoveryCodesStatus(c *gin.Context) {
+	var (
+		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
+		request       = RecoveryCodesReq{
+			trackingData: newTrackingData(c),
+		}
+	)
+	uCtx := userAccess.(middlewares.UserCtx)
 
+	resp, err := ins.service.RecoveryCodesStatus(c.Request.Context(), uCtx, &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (ins *Handle) regenerateRecoveryCodes(c *gin.Context) {
+	var (
+		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
+		request       = RecoveryCodesReq{
+			trackingData: newTrackingData(c),
+		}
+	)
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			RecoveryCodesResp{request.trackingData, -1, err.Error(), recoveryCodesResult{}})
+		return
+	}
+	uCtx := userAccess.(middlewares.UserCtx)
+
+	resp, err := ins.service.RecoveryCodes(c.Request.Context(), uCtx, &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+	}
+	switch resp.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, resp)
+	case 42:
+		c.JSON(http.StatusForbidden, resp)
+	case 49:
+		c.JSON(http.StatusTooManyRequests, resp)
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func (ins *Handle) beginPasskeyLogin(c *gin.Context) {
+	request := PasskeyLoginBeginReq{
+		trackingData: newTrackingData(c),
+	}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			PasskeyBeginResp{request.trackingData, -1, err.Error(), passkeyBeginResult{}})
+		return
+	}
+
+	resp, err := ins.service.BeginPasskeyLogin(c.Request.Context(), &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+	}
+	switch resp.Code {
+	case 40, 46:
+		c.JSON(http.StatusBadRequest, resp)
+	case 41, 50:
+		c.JSON(http.StatusUnauthorized, resp)
+	case 49:
+		c.JSON(http.StatusTooManyRequests, resp)
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func (ins *Handle) finishPasskeyLogin(c *gin.Context) {
+	request := PasskeyLoginFinishReq{
+		trackingData: newTrackingData(c),
+	}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			LogInResp{request.trackingData, -1, err.Error(), logInResult{}})
+		return
+	}
+
+	response, err := ins.service.FinishPasskeyLogin(c.Request.Context(), &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, response, err.Error())
+	}
+	if response == nil {
+		c.JSON(http.StatusInternalServerError,
+			LogInResp{request.trackingData, 53, "INTERNAL_ERROR", logInResult{}})
+		return
+	}
+	switch response.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, response)
+	case 41, 43, 46, 47, 50:
+		c.JSON(http.StatusUnauthorized, response)
+	case 48:
+		c.JSON(http.StatusForbidden, response)
+	case 53:
+		c.JSON(http.StatusInternalServerError, response)
+	default:
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func (ins *Handle) beginPasskeyRegistration(c *gin.Context) {
+	var (
+		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
+		request       = PasskeyRegisterBeginReq{
+			trackingData: newTrackingData(c),
+		}
+	)
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			PasskeyBeginResp{request.trackingData, -1, err.Error(), passkeyBeginResult{}})
+		return
+	}
+	uCtx := userAccess.(middlewares.UserCtx)
+
+	resp, err := ins.service.BeginPasskeyRegistration(c.Request.Context(), uCtx, &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+	}
+	switch resp.Code {
+	case 40, 46:
+		c.JSON(http.StatusBadRequest, resp)
+	case 41, 42:
+		c.JSON(http.StatusForbidden, resp)
+	case 49:
+		c.JSON(http.StatusTooManyRequests, resp)
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func (ins *Handle) finishPasskeyRegistration(c *gin.Context) {
+	var (
+		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
+		request       = PasskeyRegisterFinishReq{
+			trackingData: newTrackingData(c),
+		}
+	)
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			PasskeyResp{request.trackingData, -1, err.Error(), nil})
+		return
+	}
+	uCtx := userAccess.(middlewares.UserCtx)
+
+	resp, err := ins.service.FinishPasskeyRegistration(c.Request.Context(), uCtx, &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+	}
+	switch resp.Code {
+	case 40, 43, 46:
+		c.JSON(http.StatusBadRequest, resp)
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func (ins *Handle) passkeys(c *gin.Context) {
+	var (
+		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
+		request       = PasskeyReq{
+			trackingData: newTrackingData(c),
+		}
+	)
+	uCtx := userAccess.(middlewares.UserCtx)
+
+	resp, err := ins.service.Passkeys(c.Request.Context(), uCtx, &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (ins *Handle) removePasskey(c *gin.Context) {
+	var (
+		userAccess, _ = c.Get(middlewares.KeyUserContextAccess)
+		request       = PasskeyRemoveReq{
+			trackingData: newTrackingData(c),
+		}
+	)
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			PasskeyResp{request.trackingData, -1, err.Error(), nil})
+		return
+	}
+	uCtx := userAccess.(middlewares.UserCtx)
+
+	resp, err := ins.service.RemovePasskey(c.Request.Context(), uCtx, &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+	}
+	switch resp.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, resp)
+	case 41, 42:
+		c.JSON(http.StatusForbidden, resp)
+	case 49:
+		c.JSON(http.StatusTooManyRequests, resp)
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func (ins *Handle) unlock(c *gin.Context) {
+	request := UnlockReq{
+		trackingData: newTrackingData(c),
+	}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			UnlockResp{request.trackingData, -1, err.Error()})
+		return
+	}
+
+	resp, err := ins.service.Unlock(c.Request.Context(), &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+	}
+	switch resp.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, resp)
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func (ins *Handle) setSessionLimit(c *gin.Context) {
+	request := SessionLimitReq{
+		trackingData: newTrackingData(c),
+	}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest,
+			SessionLimitResp{request.trackingData, -1, err.Error()})
+		return
+	}
+
+	resp, err := ins.service.SetSessionLimit(c.Request.Context(), &request)
+	if err != nil {
+		log.Printf("Path: %s, Response: %+v, Error: %s", c.Request.RequestURI, resp, err.Error())
+	}
+	switch resp.Code {
+	case 40:
+		c.JSON(http.StatusBadRequest, resp)
+	case 53:
+		c.JSON(http.StatusInternalServerError, resp)
+	default:
+		c.JSON(http.StatusOK, resp)
+	}
 }
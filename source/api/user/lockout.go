@@ -0,0 +1,234 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"strings"
+	"time"
+)
+
+var errTooManyAttempts = errors.New("too many failed attempts, try again later")
+
+// LockoutPolicy : once a key reaches its failure limit it is locked for BaseDelay,
+// doubling with every further failure up to MaxDelay
+type LockoutPolicy struct {
+	MaxFailures   int // per username or user and factor
+	MaxIPFailures int // per client IP, higher since many users can share an address
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	// Window is how long a failure is remembered
+	Window time.Duration
+}
+
+var DefaultLockoutPolicy = LockoutPolicy{
+	MaxFailures:   5,
+	MaxIPFailures: 50,
+	BaseDelay:     30 * time.Second,
+	MaxDelay:      time.Hour,
+	Window:        time.Hour,
+}
+
+// Retention : how long a counter is kept after its last failure, past both the
+// window and the longest lock it can hold
+func (p LockoutPolicy) Retention() time.Duration {
+	if p.MaxDelay > p.Window {
+		return p.MaxDelay
+	}
+	return p.Window
+}
+
+// limit : the failures allowed on key before it is locked, none when zero
+func (p LockoutPolicy) limit(key string) int {
+	if strings.HasPrefix(key, keyPrefixIP) || strings.HasPrefix(key, keyPrefixChallenge) {
+		return p.MaxIPFailures
+	}
+	return p.MaxFailures
+}
+
+func (p LockoutPolicy) delay(key string, failures int) time.Duration {
+	limit := p.limit(key)
+	if limit <= 0 || failures < limit {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := limit; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+const (
+	keyPrefixIP       = "ip:"
+	keyPrefixPassword = "pwd:"
+	keyPrefixFactor   = "mfa:"
+	// keyPrefixReauth counts the credentials a signed in user is asked for again
+	// before a password or passkey change, so a stolen access token cannot lock
+	// the user out of login
+	keyPrefixReauth = "reauth:"
+	// keyPrefixChallenge counts the passkey ceremonies begun from an address,
+	// each one stores a challenge until it expires
+	keyPrefixChallenge = "wa:"
+)
+
+func ipKey(td trackingData) string {
+	return keyPrefixIP + td.ClientIP
+}
+
+func passwordKey(username string) string {
+	return keyPrefixPassword + username
+}
+
+func factorKey(uuid primitive.ObjectID) string {
+	return keyPrefixFactor + uuid.Hex()
+}
+
+func reauthKey(uuid primitive.ObjectID) string {
+	return keyPrefixReauth + uuid.Hex()
+}
+
+func challengeKey(td trackingData) string {
+	return keyPrefixChallenge + td.ClientIP
+}
+
+// throttleChallenge : count a passkey ceremony begun by the client address, it
+// is refused while the address is locked. The count is never reset, it only
+// ends with the lockout window.
+func (ins *Service) throttleChallenge(ctx context.Context, td trackingData) error {
+	until, err := ins.db.Attempt.LockedUntil(ctx, []string{ipKey(td), challengeKey(td)})
+	if err != nil {
+		return err
+	}
+	if !until.IsZero() {
+		return errTooManyAttempts
+	}
+	failures, err := ins.reserve(ctx, []string{challengeKey(td)})
+	if err != nil {
+		return err
+	}
+	ins.lock(ctx, failures)
+	return nil
+}
+
+// attempt : run verify unless one of keys is locked. The attempt is counted
+// against every key before verify runs, so concurrent guesses can not all pass
+// the lock check before the first failure is recorded, and a key at its limit
+// lets a single attempt through per lock period. A false result keeps the
+// count, success clears the keys except the IP counter, which would otherwise
+// be reset by an attacker owning any valid account; it is only given back.
+func (ins *Service) attempt(ctx context.Context, keys []string, verify func() (bool, error)) (bool, error) {
+	until, err := ins.db.Attempt.LockedUntil(ctx, keys)
+	if err != nil {
+		return false, err
+	}
+	if !until.IsZero() {
+		return false, errTooManyAttempts
+	}
+	failures, err := ins.reserve(ctx, keys)
+	if err != nil {
+		return false, err
+	}
+	ok, err := verify()
+	if err != nil {
+		ins.release(ctx, keys)
+		return false, err
+	}
+	if !ok {
+		ins.lock(ctx, failures)
+		return false, nil
+	}
+	var reset, release []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, keyPrefixIP) {
+			release = append(release, key)
+		} else {
+			reset = append(reset, key)
+		}
+	}
+	if err := ins.db.Attempt.Reset(ctx, reset); err != nil {
+		log.Printf("attempt reset err %s", err)
+	}
+	ins.release(ctx, release)
+	return true, nil
+}
+
+// reserve : count an attempt against every key, returning their failures. A key
+// at its limit is locked for the attempt, which is refused when another one
+// holds the lock already.
+func (ins *Service) reserve(ctx context.Context, keys []string) (map[string]int, error) {
+	var (
+		policy   = ins.cfg.LockoutPolicy
+		failures = make(map[string]int, len(keys))
+		counted  = make([]string, 0, len(keys))
+	)
+	for _, key := range keys {
+		n, err := ins.db.Attempt.Fail(ctx, key, policy.Window)
+		if err != nil {
+			ins.release(ctx, counted)
+			return nil, err
+		}
+		counted = append(counted, key)
+		failures[key] = n
+		if limit := policy.limit(key); limit <= 0 || n < limit {
+			continue
+		}
+		claimed, err := ins.db.Attempt.Claim(ctx, key, time.Now().Add(policy.delay(key, n)))
+		if err != nil {
+			ins.release(ctx, counted)
+			return nil, err
+		}
+		if !claimed {
+			ins.release(ctx, counted)
+			return nil, errTooManyAttempts
+		}
+	}
+	return failures, nil
+}
+
+// release : take back the attempt counted against keys
+func (ins *Service) release(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := ins.db.Attempt.Release(ctx, key); err != nil {
+			log.Printf("release err %s", err)
+		}
+	}
+}
+
+// lock : lock the keys whose failures reached their limit
+func (ins *Service) lock(ctx context.Context, failures map[string]int) {
+	policy := ins.cfg.LockoutPolicy
+	for key, n := range failures {
+		if delay := policy.delay(key, n); delay > 0 {
+			log.Printf("SECURITY: %s locked for %s after %d failures", key, delay, n)
+			if err := ins.db.Attempt.Lock(ctx, key, time.Now().Add(delay)); err != nil {
+				log.Printf("lock err %s", err)
+			}
+		}
+	}
+}
+
+// Unlock : admin operation clearing the password and second factor locks of a user
+func (ins *Service) Unlock(ctx context.Context, request *UnlockReq) (UnlockResp, error) {
+	request.Username = normalizeUsername(request.Username)
+	if err := request.validate(); err != nil {
+		return UnlockResp{request.trackingData,
+			40, err.Error()}, err
+	}
+	keys := []string{passwordKey(request.Username)}
+	if user, err := ins.db.User.FindByUsername(ctx, request.Username); err == nil {
+		keys = append(keys, factorKey(user.ID), reauthKey(user.ID))
+	}
+	if len(request.IP) > 0 {
+		keys = append(keys, keyPrefixIP+request.IP)
+	}
+	if err := ins.db.Attempt.Reset(ctx, keys); err != nil {
+		return UnlockResp{request.trackingData,
+			53, "DATABASE_ERROR"}, err
+	}
+	return UnlockResp{request.trackingData,
+		0, "SUCCEED"}, nil
+}
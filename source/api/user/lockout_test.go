@@ -0,0 +1,74 @@
+package user
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestLoginLockout(t *testing.T) {
+	api := newTestAPI(t, nil)
+	api.register("alice")
+	for i := 0; i < DefaultLockoutPolicy.MaxFailures; i++ {
+		if status, resp := api.login("alice", "wrong password"); status != http.StatusUnauthorized || resp.Code != 41 {
+			t.Fatalf("failure %d: %d %+v", i+1, status, resp)
+		}
+	}
+	// locked, the right password is not checked either
+	if status, resp := api.login("alice", testPassword); status != http.StatusTooManyRequests || resp.Code != 49 {
+		t.Fatalf("locked login: %d %+v", status, resp)
+	}
+	if _, err := api.service.Unlock(context.Background(), &UnlockReq{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if status, resp := api.login("alice", testPassword); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("unlocked login: %d %+v", status, resp)
+	}
+}
+
+// TestLoginLockoutConcurrent : guesses sent at once are counted before they are
+// checked, no more than the limit of them reach the password
+func TestLoginLockoutConcurrent(t *testing.T) {
+	api := newTestAPI(t, nil)
+	api.register("bob")
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		checked int
+	)
+	for i := 0; i < 4*DefaultLockoutPolicy.MaxFailures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, resp := api.login("bob", "wrong password")
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case status == http.StatusUnauthorized && resp.Code == 41:
+				checked++
+			case status == http.StatusTooManyRequests && resp.Code == 49:
+			default:
+				t.Errorf("login: %d %+v", status, resp)
+			}
+		}()
+	}
+	wg.Wait()
+	if checked > DefaultLockoutPolicy.MaxFailures {
+		t.Fatalf("%d guesses checked, the limit is %d", checked, DefaultLockoutPolicy.MaxFailures)
+	}
+}
+
+// TestLoginSuccessKeepsIPCount : a successful login gives its attempt back to
+// the IP counter instead of counting it as a failure
+func TestLoginSuccessKeepsIPCount(t *testing.T) {
+	api := newTestAPI(t, nil, func(cfg *Config) {
+		cfg.LockoutPolicy.MaxIPFailures = 2
+	})
+	api.register("carol")
+	for i := 0; i < 3; i++ {
+		if status, resp := api.login("carol", testPassword); status != http.StatusOK || resp.Code != 0 {
+			t.Fatalf("login %d: %d %+v", i+1, status, resp)
+		}
+	}
+}
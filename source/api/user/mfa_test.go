@@ -0,0 +1,168 @@
+package user
+
+import (
+	"app/internal/auth"
+	"context"
+	"fmt"
+	"github.com/dgryski/dgoogauth"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// otp : the code of the authenticator app at the given TOTP step
+func otp(secret string, step int64) string {
+	return fmt.Sprintf("%06d", dgoogauth.ComputeCode(secret, step))
+}
+
+func currentStep() int64 {
+	return time.Now().Unix() / otpPeriod
+}
+
+// enableMFA : enroll an authenticator with the code of the current step,
+// returning its secret and the recovery codes
+func (api *testAPI) enableMFA(token string) (string, []string) {
+	api.t.Helper()
+	var secretResp GenSecretMFAResp
+	if status := api.call(http.MethodPost, "/mfa/generate-secret", token, nil, &secretResp); status != http.StatusOK || secretResp.Code != 0 {
+		api.t.Fatalf("generate secret: %d %+v", status, secretResp)
+	}
+	link, err := url.Parse(secretResp.Result.URI)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	secret := link.Query().Get("secret")
+	var activeResp ActiveMFAResp
+	if status := api.call(http.MethodPost, "/mfa/active", token,
+		map[string]string{"otp": otp(secret, currentStep())}, &activeResp); status != http.StatusOK || activeResp.Code != 0 {
+		api.t.Fatalf("activate: %d %+v", status, activeResp)
+	}
+	return secret, activeResp.Result.Codes
+}
+
+func TestGenerateSecretMFA(t *testing.T) {
+	api := newTestAPI(t, nil, func(cfg *Config) {
+		cfg.TOTPIssuer = "Example Corp"
+	})
+	tokens := api.signIn("alice")
+	var resp GenSecretMFAResp
+	if status := api.call(http.MethodPost, "/mfa/generate-secret", tokens.AccessToken, nil, &resp); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("generate secret: %d %+v", status, resp)
+	}
+	if resp.Result.Issuer != "Example Corp" || len(resp.Result.QR) == 0 {
+		t.Fatalf("generate secret: %+v", resp.Result)
+	}
+	link, err := url.Parse(resp.Result.URI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Path != "/Example Corp:alice" || link.Query().Get("issuer") != "Example Corp" {
+		t.Fatalf("key uri %s", resp.Result.URI)
+	}
+}
+
+// TestGenerateSecretMFAWhileActive : a new secret would silently replace the
+// one of the enrolled authenticator
+func TestGenerateSecretMFAWhileActive(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	api.enableMFA(tokens.AccessToken)
+	var resp GenSecretMFAResp
+	if status := api.call(http.MethodPost, "/mfa/generate-secret", tokens.AccessToken, nil, &resp); status != http.StatusBadRequest || resp.Code != 40 {
+		t.Fatalf("generate secret: %d %+v", status, resp)
+	}
+}
+
+func (api *testAPI) deactivateMFA(token, code string) (int, DeactivateMFAResp) {
+	api.t.Helper()
+	var resp DeactivateMFAResp
+	status := api.call(http.MethodPost, "/mfa/deactivate", token, map[string]string{"otp": code}, &resp)
+	return status, resp
+}
+
+// TestDeactivateMFA : a stolen access token alone does not turn MFA off, a code
+// of the authenticator or a recovery code does
+func TestDeactivateMFA(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	secret, codes := api.enableMFA(tokens.AccessToken)
+	if status, resp := api.deactivateMFA(tokens.AccessToken, ""); status != http.StatusForbidden || resp.Code != 42 {
+		t.Fatalf("deactivate without a code: %d %+v", status, resp)
+	}
+	if status, resp := api.deactivateMFA(tokens.AccessToken, otp(secret, currentStep()-5)); status != http.StatusForbidden || resp.Code != 42 {
+		t.Fatalf("deactivate with an expired code: %d %+v", status, resp)
+	}
+	if status, resp := api.deactivateMFA(tokens.AccessToken, codes[0]); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("deactivate with a recovery code: %d %+v", status, resp)
+	}
+	if status, resp := api.login("alice", testPassword); status != http.StatusOK || resp.Code != 0 || len(resp.Result.AccessToken) == 0 {
+		t.Fatalf("login after deactivation: %d %+v", status, resp)
+	}
+	if status, resp := api.deactivateMFA(tokens.AccessToken, codes[1]); status != http.StatusBadRequest || resp.Code != 40 {
+		t.Fatalf("deactivate twice: %d %+v", status, resp)
+	}
+
+	secret, _ = api.enableMFA(tokens.AccessToken)
+	if status, resp := api.deactivateMFA(tokens.AccessToken, otp(secret, currentStep()+1)); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("deactivate with a code: %d %+v", status, resp)
+	}
+}
+
+// TestOTPReplay : once a step is accepted, its code and the codes of the steps
+// before it are refused on every route, even inside the drift window
+func TestOTPReplay(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	secret, _ := api.enableMFA(tokens.AccessToken)
+	// the enrollment used this step or the one before
+	step := currentStep()
+	if status, resp := api.loginMFA(api.mfaToken("alice"), otp(secret, step-1)); status != http.StatusUnauthorized || resp.Code != 42 {
+		t.Fatalf("login with a step before the enrollment: %d %+v", status, resp)
+	}
+	next := otp(secret, step+1)
+	if status, resp := api.loginMFA(api.mfaToken("alice"), next); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("login: %d %+v", status, resp)
+	}
+	if status, resp := api.deactivateMFA(tokens.AccessToken, next); status != http.StatusForbidden || resp.Code != 42 {
+		t.Fatalf("deactivate with the login code: %d %+v", status, resp)
+	}
+	if status, resp := api.deactivateMFA(tokens.AccessToken, otp(secret, step)); status != http.StatusForbidden || resp.Code != 42 {
+		t.Fatalf("deactivate with an older step: %d %+v", status, resp)
+	}
+}
+
+// TestDeactivateMFALegacyToken : a legacy token belongs to no session that a
+// logout or a password change could revoke, it can not turn MFA off
+func TestDeactivateMFALegacyToken(t *testing.T) {
+	secret := []byte("legacy-secret")
+	api := newTestAPI(t, nil, func(cfg *Config) {
+		keys, err := auth.NewKeySet(context.Background(), auth.NewMemoryKeyStore(), auth.DefaultKeyPolicy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Tokens = auth.NewIssuer(keys, auth.DefaultClaimsConfig)
+		cfg.Verifier = auth.NewVerifier(keys, auth.DefaultClaimsConfig,
+			auth.LegacyConfig{Secret: secret, Until: time.Now().Add(time.Hour)})
+	})
+	tokens := api.signIn("alice")
+	_, codes := api.enableMFA(tokens.AccessToken)
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"ID":       tokens.UUID.Hex(),
+		"Username": "alice",
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}).SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status RecoveryCodesResp
+	if code := api.call(http.MethodGet, "/mfa/recovery-codes", legacy, nil, &status); code != http.StatusOK || status.Result.Remaining != len(codes) {
+		t.Fatalf("recovery codes with a legacy token: %d %+v", code, status)
+	}
+	if status, resp := api.deactivateMFA(legacy, codes[0]); status != http.StatusUnauthorized {
+		t.Fatalf("deactivate with a legacy token: %d %+v", status, resp)
+	}
+	// the login still asks for the second factor
+	api.mfaToken("alice")
+}
@@ -1,13 +1,32 @@
 package user
 
 import (
+	"app/internal/clients"
+	"encoding/json"
 	"errors"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"regexp"
+	"strings"
+	"time"
 )
 
+var usernamePattern = regexp.MustCompile(`^[a-z0-9._-]{3,32}$`)
+
+// normalizeUsername : usernames are case-insensitive and stored lower-cased
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
 type trackingData struct {
 	ClientID  string `json:"cId"`
 	RequestID string `json:"reqId"`
+	ClientIP  string `json:"-"`
+	UserAgent string `json:"-"`
+	// ClientSecret authenticates a confidential client, sent with HTTP Basic
+	ClientSecret string `json:"-"`
+	Origin       string `json:"-"`
+	// client was authenticated by the caller, see NewLogInReq
+	client *clients.Client
 }
 
 type RegisterReq struct {
@@ -17,10 +36,27 @@ type RegisterReq struct {
 }
 
 func (r RegisterReq) validate() error {
-
+	if !usernamePattern.MatchString(r.Username) {
+		return errors.New("username must be 3-32 characters of a-z, 0-9, '.', '_' or '-'")
+	}
+	if len(r.Password) == 0 {
+		return errors.New("password cannot be blank")
+	}
 	return nil
 }
 
+type RegisterResp struct {
+	trackingData
+	Code    int            `json:"code"`
+	Message string         `json:"message"`
+	Result  registerResult `json:"result"`
+}
+
+type registerResult struct {
+	UUID     primitive.ObjectID `json:"uuid"`
+	Username string             `json:"username"`
+}
+
 type LogInReq struct {
 	trackingData
 	Username string `json:"username"`
@@ -34,6 +70,19 @@ func (r LogInReq) validate() error {
 	return nil
 }
 
+type LogInMFAReq struct {
+	trackingData
+	MFAToken string `json:"mfaToken"`
+	OTP      string `json:"otp"`
+}
+
+func (r LogInMFAReq) validate() error {
+	if len(r.MFAToken) == 0 || len(r.OTP) == 0 {
+		return errors.New("mfaToken or otp cannot be blank")
+	}
+	return nil
+}
+
 type LogInResp struct {
 	trackingData
 	Code    int         `json:"code"`
@@ -47,6 +96,9 @@ type logInResult struct {
 	AccessToken  string             `json:"accessToken"`
 	RefreshToken string             `json:"refreshToken"`
 	ExpiresIn    int64              `json:"expiresIn"`
+	MFARequired  bool               `json:"mfaRequired,omitempty"`
+	MFAToken     string             `json:"mfaToken,omitempty"`
+	MFAMethods   []string           `json:"mfaMethods,omitempty"`
 }
 
 type RefreshTokenReq struct {
@@ -82,6 +134,7 @@ type ChangePasswordReq struct {
 	trackingData
 	CurrentPassword string `json:"currentPassword"`
 	NewPassword     string `json:"newPassword"`
+	OTP             string `json:"otp"`
 }
 
 func (req *ChangePasswordReq) Validate() error {
@@ -93,8 +146,14 @@ func (req *ChangePasswordReq) Validate() error {
 
 type ChangePasswordResp struct {
 	trackingData
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int                  `json:"code"`
+	Message string               `json:"message"`
+	Result  changePasswordResult `json:"result"`
+}
+
+type changePasswordResult struct {
+	// Passkeys still sign in without the password
+	Passkeys []passkeyResult `json:"passkeys,omitempty"`
 }
 
 type GenSecretMFAReq struct {
@@ -123,9 +182,199 @@ type ActiveMFAReq struct {
 	trackingData
 	OTP string `json:"otp"`
 }
+
+type ActiveMFAResp struct {
+	trackingData
+	Code    int                 `json:"code"`
+	Message string              `json:"message"`
+	Result  recoveryCodesResult `json:"result"`
+}
+
+type RecoveryCodesReq struct {
+	trackingData
+	OTP string `json:"otp"`
+}
+
+type RecoveryCodesResp struct {
+	trackingData
+	Code    int                 `json:"code"`
+	Message string              `json:"message"`
+	Result  recoveryCodesResult `json:"result"`
+}
+
+type recoveryCodesResult struct {
+	// Codes is only filled when the codes are (re)generated
+	Codes     []string `json:"codes,omitempty"`
+	Remaining int      `json:"remaining"`
+}
 type DeactivateMFAReq struct {
 	trackingData
+	// OTP is a code of the authenticator or an unused recovery code
+	OTP string `json:"otp"`
 }
 
 type DeactivateMFAResp struct {
+	trackingData
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type PasskeyRegisterBeginReq struct {
+	trackingData
+	Password string `json:"password"`
+	OTP      string `json:"otp"`
+}
+
+func (r PasskeyRegisterBeginReq) validate() error {
+	if len(r.Password) == 0 {
+		return errors.New("password cannot be blank")
+	}
+	return nil
+}
+
+type PasskeyLoginBeginReq struct {
+	trackingData
+	MFAToken string `json:"mfaToken"`
+}
+
+type PasskeyBeginResp struct {
+	trackingData
+	Code    int                `json:"code"`
+	Message string             `json:"message"`
+	Result  passkeyBeginResult `json:"result"`
+}
+
+type passkeyBeginResult struct {
+	ChallengeID primitive.ObjectID `json:"challengeId"`
+	// Options is passed as is to navigator.credentials.create() or .get()
+	Options interface{} `json:"options"`
+}
+
+type PasskeyRegisterFinishReq struct {
+	trackingData
+	ChallengeID primitive.ObjectID `json:"challengeId"`
+	Name        string             `json:"name"`
+	Credential  json.RawMessage    `json:"credential"`
+}
+
+type PasskeyLoginFinishReq struct {
+	trackingData
+	ChallengeID primitive.ObjectID `json:"challengeId"`
+	MFAToken    string             `json:"mfaToken"`
+	Credential  json.RawMessage    `json:"credential"`
+}
+
+type PasskeyReq struct {
+	trackingData
+}
+
+type PasskeyRemoveReq struct {
+	trackingData
+	CredentialID string `json:"credentialId"`
+	Password     string `json:"password"`
+	OTP          string `json:"otp"`
+}
+
+func (r PasskeyRemoveReq) validate() error {
+	if len(r.CredentialID) == 0 || len(r.Password) == 0 {
+		return errors.New("credentialId or password cannot be blank")
+	}
+	return nil
+}
+
+type PasskeyResp struct {
+	trackingData
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Result  []passkeyResult `json:"result"`
+}
+
+type passkeyResult struct {
+	CredentialID string    `json:"credentialId"`
+	Name         string    `json:"name"`
+	Transports   []string  `json:"transports"`
+	CreatedAt    time.Time `json:"createdAt"`
+	LastUsedAt   time.Time `json:"lastUsedAt"`
+}
+
+type UnlockReq struct {
+	trackingData
+	Username string `json:"username"`
+	// IP optionally clears the lock of a client address as well
+	IP string `json:"ip"`
+}
+
+func (r UnlockReq) validate() error {
+	if len(r.Username) == 0 {
+		return errors.New("username cannot be blank")
+	}
+	return nil
+}
+
+type UnlockResp struct {
+	trackingData
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type SessionLimitReq struct {
+	trackingData
+	Username string `json:"username"`
+	// MaxSessions of 0 falls back to the deployment policy
+	MaxSessions int `json:"maxSessions"`
+}
+
+func (r SessionLimitReq) validate() error {
+	if len(r.Username) == 0 {
+		return errors.New("username cannot be blank")
+	}
+	if r.MaxSessions < 0 {
+		return errors.New("maxSessions cannot be negative")
+	}
+	return nil
+}
+
+type SessionLimitResp struct {
+	trackingData
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type SessionReq struct {
+	trackingData
+	SessionID string `json:"sessionId"`
+}
+
+type ResumeSessionReq struct {
+	trackingData
+	// UserID and SessionID are the user and the live session of the earlier login
+	UserID    primitive.ObjectID
+	SessionID primitive.ObjectID
+}
+
+type SessionResp struct {
+	trackingData
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Result  []sessionResult `json:"result"`
+}
+
+type SessionDetailResp struct {
+	trackingData
+	Code    int           `json:"code"`
+	Message string        `json:"message"`
+	Result  sessionResult `json:"result"`
+}
+
+type sessionResult struct {
+	ID         primitive.ObjectID `json:"id"`
+	ClientID   string             `json:"clientId"`
+	ClientIP   string             `json:"clientIp"`
+	UserAgent  string             `json:"userAgent"`
+	AMR        []string           `json:"amr"`
+	CreatedAt  time.Time          `json:"createdAt"`
+	LastUsedAt time.Time          `json:"lastUsedAt"`
+	ExpiresAt  time.Time          `json:"expiresAt"`
+	// Current marks the session the request was made with
+	Current bool `json:"current"`
 }
@@ -0,0 +1,62 @@
+package user
+
+import (
+	"net/http"
+	"testing"
+)
+
+const testNewPassword = "Batt3ry-Staple-Horse"
+
+func (api *testAPI) changePassword(token, current, next, code string) (int, ChangePasswordResp) {
+	api.t.Helper()
+	var resp ChangePasswordResp
+	status := api.call(http.MethodPost, "/password/change", token, map[string]string{
+		"currentPassword": current,
+		"newPassword":     next,
+		"otp":             code,
+	}, &resp)
+	return status, resp
+}
+
+// TestChangePassword : the caller's session survives, every other one and the
+// old password do not
+func TestChangePassword(t *testing.T) {
+	api := newTestAPI(t, nil)
+	current := api.signIn("alice")
+	_, other := api.login("alice", testPassword)
+	if status, resp := api.changePassword(current.AccessToken, "wrong password", testNewPassword, ""); status != http.StatusForbidden || resp.Code != 41 {
+		t.Fatalf("change with a wrong password: %d %+v", status, resp)
+	}
+	if status, resp := api.changePassword(current.AccessToken, testPassword, testPassword, ""); status != http.StatusBadRequest || resp.Code != 40 {
+		t.Fatalf("change to the same password: %d %+v", status, resp)
+	}
+	if status, resp := api.changePassword(current.AccessToken, testPassword, testNewPassword, ""); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("change: %d %+v", status, resp)
+	}
+	if !api.authorized(current.AccessToken) {
+		t.Fatal("session of the change revoked")
+	}
+	if api.authorized(other.Result.AccessToken) {
+		t.Fatal("other session kept")
+	}
+	if status, resp := api.login("alice", testPassword); status != http.StatusUnauthorized || resp.Code != 41 {
+		t.Fatalf("login with the old password: %d %+v", status, resp)
+	}
+	if status, resp := api.login("alice", testNewPassword); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("login with the new password: %d %+v", status, resp)
+	}
+}
+
+// TestChangePasswordRequiresOTP : with MFA active the password alone does not
+// change it
+func TestChangePasswordRequiresOTP(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	secret, _ := api.enableMFA(tokens.AccessToken)
+	if status, resp := api.changePassword(tokens.AccessToken, testPassword, testNewPassword, ""); status != http.StatusForbidden || resp.Code != 42 {
+		t.Fatalf("change without a code: %d %+v", status, resp)
+	}
+	if status, resp := api.changePassword(tokens.AccessToken, testPassword, testNewPassword, otp(secret, currentStep()+1)); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("change with a code: %d %+v", status, resp)
+	}
+}
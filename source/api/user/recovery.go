@@ -0,0 +1,120 @@
+package user
+
+import (
+	"app/internal/auth"
+	"app/internal/mongodb/db/models"
+	"app/source/middlewares"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	recoveryCodeCount = 10
+	recoveryCodeSize  = 10 // characters of base32, 50 bits of entropy
+)
+
+var (
+	otpPattern = regexp.MustCompile(`^[0-9]{6}$`)
+
+	errSecondFactorInvalid = errors.New("otp or recovery code invalid")
+)
+
+// RecoveryCodes : regenerate the recovery codes, the caller must prove possession
+// of the authenticator or an unused recovery code
+func (ins *Service) RecoveryCodes(ctx context.Context, uCtx middlewares.UserCtx, request *RecoveryCodesReq) (RecoveryCodesResp, error) {
+	user, err := ins.db.User.FindByID(ctx, uCtx.UUID)
+	if err != nil {
+		return RecoveryCodesResp{request.trackingData,
+			53, "DATABASE_ERROR", recoveryCodesResult{}}, err
+	}
+	if !user.MFAActive {
+		return RecoveryCodesResp{request.trackingData,
+			40, "MFA_NOT_ACTIVE", recoveryCodesResult{}}, errors.New("mfa is not active")
+	}
+	if _, err := ins.verifySecondFactor(ctx, request.trackingData, user, request.OTP); err != nil {
+		if errors.Is(err, errTooManyAttempts) {
+			return RecoveryCodesResp{request.trackingData,
+				49, "TOO_MANY_ATTEMPTS", recoveryCodesResult{}}, err
+		}
+		return RecoveryCodesResp{request.trackingData,
+			42, "OTP_INCORRECT", recoveryCodesResult{}}, err
+	}
+	codes, err := ins.resetRecoveryCodes(ctx, user)
+	if err != nil {
+		return RecoveryCodesResp{request.trackingData,
+			53, "DATABASE_ERROR", recoveryCodesResult{}}, err
+	}
+	return RecoveryCodesResp{request.trackingData,
+		0, "SUCCEED", recoveryCodesResult{Codes: codes, Remaining: len(codes)}}, nil
+}
+
+// RecoveryCodesStatus : number of unused recovery codes left
+func (ins *Service) RecoveryCodesStatus(ctx context.Context, uCtx middlewares.UserCtx, request *RecoveryCodesReq) (RecoveryCodesResp, error) {
+	user, err := ins.db.User.FindByID(ctx, uCtx.UUID)
+	if err != nil {
+		return RecoveryCodesResp{request.trackingData,
+			53, "DATABASE_ERROR", recoveryCodesResult{}}, err
+	}
+	return RecoveryCodesResp{request.trackingData,
+		0, "", recoveryCodesResult{Remaining: len(user.RecoveryCodes)}}, nil
+}
+
+// resetRecoveryCodes : replace every stored code, the plain codes are only ever returned here
+func (ins *Service) resetRecoveryCodes(ctx context.Context, user *models.UserModel) ([]string, error) {
+	var (
+		codes  = make([]string, recoveryCodeCount)
+		hashes = make([]string, recoveryCodeCount)
+	)
+	for i := range codes {
+		codes[i] = genRecoveryCode()
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	if err := ins.db.User.SetRecoveryCodes(ctx, user.ID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// verifySecondFactor : accept either a TOTP code or an unused recovery code and
+// return the authentication method that matched
+func (ins *Service) verifySecondFactor(ctx context.Context, td trackingData, user *models.UserModel, code string) (string, error) {
+	return ins.checkSecondFactor(ctx, []string{ipKey(td), factorKey(user.ID)}, user, code)
+}
+
+// checkSecondFactor : verifySecondFactor with the failures counted under keys
+func (ins *Service) checkSecondFactor(ctx context.Context, keys []string, user *models.UserModel, code string) (string, error) {
+	var amr string
+	ok, err := ins.attempt(ctx, keys, func() (bool, error) {
+		if otpPattern.MatchString(code) {
+			amr = auth.AmrOTP
+			return ins.verifyOTP(ctx, user, code)
+		}
+		amr = auth.AmrRecoveryCode
+		return ins.db.User.UseRecoveryCode(ctx, user.ID, hashRecoveryCode(code))
+	})
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errSecondFactorInvalid
+	}
+	return amr, nil
+}
+
+// genRecoveryCode : XXXXX-XXXXX
+func genRecoveryCode() string {
+	code := genSecret(recoveryCodeSize)[:recoveryCodeSize]
+	return code[:recoveryCodeSize/2] + "-" + code[recoveryCodeSize/2:]
+}
+
+// hashRecoveryCode : codes are random with enough entropy that a fast hash is
+// sufficient, which also lets the database consume a code atomically by value
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
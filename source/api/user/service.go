@@ -2,8 +2,10 @@ package user
 
 import (
 	"app/internal/auth"
-	"app/internal/mongodb"
+	"app/internal/clients"
 	"app/internal/mongodb/db/models"
+	"app/internal/password"
+	"app/internal/store"
 	"app/source/middlewares"
 	"context"
 	"crypto/rand"
@@ -11,79 +13,332 @@ import (
 	"errors"
 	"fmt"
 	"github.com/dgryski/dgoogauth"
-	"go.mongodb.org/mongo-driver/mongo"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"log"
+	"net/url"
 	"rsc.io/qr"
+	"strconv"
 	"time"
 )
 
 type Service struct {
-	db *mongodb.DB
+	db  *store.DB
+	cfg Config
 }
 
-func NewService() *Service {
-	return &Service{
-		db: mongodb.Conn,
+type Config struct {
+	PasswordPolicy password.Policy
+	LockoutPolicy  LockoutPolicy
+	SessionPolicy  SessionPolicy
+	// AdminAPIKey enables the admin endpoints when set
+	AdminAPIKey string
+	// WebAuthn is the passkey relying party, passkeys are disabled when nil
+	WebAuthn *webauthn.WebAuthn
+	// TOTPIssuer names the service in the authenticator apps, "MFA" when empty
+	TOTPIssuer string
+	// Tokens issues the access, refresh and MFA tokens
+	Tokens *auth.Issuer
+	// Verifier checks access tokens
+	Verifier *auth.Verifier
+	// Clients are the applications allowed to log users in
+	Clients *clients.Registry
+	// SecurityEvents receives security events, they are logged when nil
+	SecurityEvents func(SecurityEvent)
+	// Store persists users and sessions
+	Store *store.DB
+}
+
+// NewService : Store, Tokens and Verifier are required, Clients defaults to a
+// registry over Store
+func NewService(cfg Config) (*Service, error) {
+	switch {
+	case cfg.Store == nil:
+		return nil, errors.New("user: Config.Store is required")
+	case cfg.Tokens == nil:
+		return nil, errors.New("user: Config.Tokens is required")
+	case cfg.Verifier == nil:
+		return nil, errors.New("user: Config.Verifier is required")
 	}
+	if cfg.Clients == nil {
+		cfg.Clients = clients.NewRegistry(cfg.Store.Clients)
+	}
+	if len(cfg.TOTPIssuer) == 0 {
+		cfg.TOTPIssuer = "MFA"
+	}
+	return &Service{
+		db:  cfg.Store,
+		cfg: cfg,
+	}, nil
 }
 
 const (
 	tokenExpired        = 3600 * time.Second
 	refreshTokenExpired = 10 * 24 * time.Hour
+	mfaTokenExpired     = 5 * time.Minute
+	otpPeriod           = 30 // seconds per TOTP time step
+	otpWindow           = 1  // accepted steps before and after the current one
 	secretSize          = 10
 )
 
+func (ins *Service) Register(ctx context.Context, request *RegisterReq) (*RegisterResp, error) {
+	request.Username = normalizeUsername(request.Username)
+	if err := request.validate(); err != nil {
+		return &RegisterResp{request.trackingData,
+			40, err.Error(), registerResult{}}, err
+	}
+	if _, err := ins.authorizeClient(ctx, request.trackingData, clients.GrantPassword); err != nil {
+		code, message := clientFailure(err)
+		return &RegisterResp{request.trackingData,
+			code, message, registerResult{}}, err
+	}
+	if err := ins.cfg.PasswordPolicy.Validate(request.Password); err != nil {
+		return &RegisterResp{request.trackingData,
+			40, err.Error(), registerResult{}}, err
+	}
+	hash, err := password.Hash(request.Password)
+	if err != nil {
+		return &RegisterResp{request.trackingData,
+			53, "HASH_PASSWORD_FAILED", registerResult{}}, err
+	}
+	uuid, err := ins.db.User.CreateUser(ctx, request.Username, hash)
+	if err != nil {
+		if errors.Is(err, store.ErrUsernameTaken) {
+			return &RegisterResp{request.trackingData,
+				45, "USERNAME_TAKEN", registerResult{}}, err
+		}
+		return &RegisterResp{request.trackingData,
+			53, "DATABASE_ERROR", registerResult{}}, err
+	}
+	return &RegisterResp{request.trackingData,
+		0, "", registerResult{UUID: uuid, Username: request.Username}}, nil
+}
+
 func (ins *Service) Login(ctx context.Context, request *LogInReq) (*LogInResp, error) {
+	request.Username = normalizeUsername(request.Username)
 	err := request.validate()
 	if err != nil {
-		return nil, err
+		return &LogInResp{request.trackingData,
+			40, "INVALID", logInResult{}}, err
+	}
+	client, err := ins.authorizeClient(ctx, request.trackingData, clients.GrantPassword)
+	if err != nil {
+		code, message := clientFailure(err)
+		return &LogInResp{request.trackingData,
+			code, message, logInResult{}}, err
 	}
-	user, err := ins.db.User.Find(ctx, request.Username, request.Password)
+	user, err := ins.verifyPassword(ctx, request.trackingData, request.Username, request.Password)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, errTooManyAttempts) {
 			return &LogInResp{request.trackingData,
-				41, "USERNAME OR PASSWORD INCORRECT", logInResult{}}, err
+				49, "TOO_MANY_ATTEMPTS", logInResult{}}, err
 		}
-		return nil, err
+		return &LogInResp{request.trackingData,
+			53, "DATABASE_ERROR", logInResult{}}, err
+	}
+	if user == nil {
+		return &LogInResp{request.trackingData,
+			41, "USERNAME OR PASSWORD INCORRECT", logInResult{}}, errors.New("username or password incorrect")
+	}
+	// password is only the first factor, the client must finish the login at
+	// /login/mfa or /login/webauthn
+	if methods := mfaMethods(user); len(methods) > 0 {
+		mfaToken, err := ins.cfg.Tokens.GenerateMFAToken(user.ID, user.Username, mfaTokenExpired)
+		if err != nil {
+			return &LogInResp{request.trackingData,
+				53, "INTERNAL_ERROR", logInResult{}}, err
+		}
+		return &LogInResp{request.trackingData,
+			44, "MFA_REQUIRED", logInResult{
+				UUID:        user.ID,
+				MFARequired: true,
+				MFAToken:    mfaToken,
+				MFAMethods:  methods,
+				ExpiresIn:   int64(mfaTokenExpired / time.Second),
+			}}, nil
+	}
+
+	result, err := ins.createSession(ctx, request.trackingData, client, user, []string{auth.AmrPassword}, time.Now())
+	if err != nil {
+		if errors.Is(err, errSessionLimit) {
+			return &LogInResp{request.trackingData,
+				48, "SESSION_LIMIT_REACHED", logInResult{}}, err
+		}
+		return &LogInResp{request.trackingData,
+			53, "DATABASE_ERROR", logInResult{}}, err
+	}
+
+	return &LogInResp{
+		trackingData: request.trackingData,
+		Code:         0,
+		Message:      "",
+		Result:       *result,
+	}, nil
+}
+
+func (ins *Service) LoginMFA(ctx context.Context, request *LogInMFAReq) (*LogInResp, error) {
+	if err := request.validate(); err != nil {
+		return &LogInResp{request.trackingData,
+			40, "INVALID", logInResult{}}, err
+	}
+	client, err := ins.authorizeClient(ctx, request.trackingData, clients.GrantPassword)
+	if err != nil {
+		code, message := clientFailure(err)
+		return &LogInResp{request.trackingData,
+			code, message, logInResult{}}, err
+	}
+	uuid, _, err := ins.cfg.Tokens.ValidateMFAToken(request.MFAToken)
+	if err != nil {
+		return &LogInResp{request.trackingData,
+			41, "MFA_TOKEN_INVALID", logInResult{}}, err
 	}
-	accessToken, err := auth.GenerateAccessToken(user.ID, user.Username, tokenExpired)
+	user, err := ins.db.User.FindByID(ctx, uuid)
 	if err != nil {
+		return &LogInResp{request.trackingData,
+			53, "DATABASE_ERROR", logInResult{}}, err
+	}
+	if !user.MFAActive {
+		return &LogInResp{request.trackingData,
+			41, "MFA_TOKEN_INVALID", logInResult{}}, errors.New("otp is not active")
+	}
+	factor, err := ins.verifySecondFactor(ctx, request.trackingData, user, request.OTP)
+	if err != nil {
+		if errors.Is(err, errTooManyAttempts) {
+			return &LogInResp{request.trackingData,
+				49, "TOO_MANY_ATTEMPTS", logInResult{}}, err
+		}
+		return &LogInResp{request.trackingData,
+			42, "OTP_INCORRECT", logInResult{}}, err
+	}
+
+	result, err := ins.createSession(ctx, request.trackingData, client, user, []string{auth.AmrPassword, factor}, time.Now())
+	if err != nil {
+		if errors.Is(err, errSessionLimit) {
+			return &LogInResp{request.trackingData,
+				48, "SESSION_LIMIT_REACHED", logInResult{}}, err
+		}
+		return &LogInResp{request.trackingData,
+			53, "DATABASE_ERROR", logInResult{}}, err
+	}
+
+	return &LogInResp{
+		trackingData: request.trackingData,
+		Code:         0,
+		Message:      "",
+		Result:       *result,
+	}, nil
+}
+
+// verifyPassword : check pwd under brute-force protection, the user is nil when the
+// username is unknown or the password is wrong
+func (ins *Service) verifyPassword(ctx context.Context, td trackingData, username, pwd string) (*models.UserModel, error) {
+	return ins.checkPassword(ctx, []string{ipKey(td), passwordKey(username)}, username, pwd)
+}
+
+// checkPassword : verifyPassword with the failures counted under keys
+func (ins *Service) checkPassword(ctx context.Context, keys []string, username, pwd string) (*models.UserModel, error) {
+	var user *models.UserModel
+	ok, err := ins.attempt(ctx, keys, func() (bool, error) {
+		found, err := ins.db.User.FindByUsername(ctx, username)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				password.DummyVerify(pwd)
+				return false, nil
+			}
+			return false, err
+		}
+		ok, needsRehash, err := password.Verify(pwd, found.Password)
+		if err != nil {
+			// an unreadable hash cannot be matched, count it like a wrong password
+			log.Printf("verifyPassword user=%s err %s", found.ID.Hex(), err)
+			return false, nil
+		}
+		if ok && needsRehash {
+			ins.rehashPassword(ctx, found, pwd)
+		}
+		user = found
+		return ok, nil
+	})
+	if err != nil || !ok {
 		return nil, err
 	}
+	return user, nil
+}
+
+// rehashPassword : upgrade a stored hash to the current parameters, failures only cost the upgrade
+func (ins *Service) rehashPassword(ctx context.Context, user *models.UserModel, pwd string) {
+	hash, err := password.Hash(pwd)
+	if err != nil {
+		log.Printf("rehashPassword err %s", err)
+		return
+	}
+	if err := ins.db.User.ChangePassword(ctx, user.ID, hash); err != nil {
+		log.Printf("rehashPassword err %s", err)
+	}
+}
 
-	refreshToken, err := auth.GenerateRefreshToken(refreshTokenExpired)
+// createSession : issue a token pair recording the factors used at authTime and
+// link the session to the user
+func (ins *Service) createSession(ctx context.Context, td trackingData, client *clients.Client, user *models.UserModel, amr []string, authTime time.Time) (*logInResult, error) {
+	accessTTL, refreshTTL := tokenTTLs(client)
+	accessToken, err := ins.cfg.Tokens.GenerateAccessToken(user.ID, user.Username, amr, authTime, accessTTL)
 	if err != nil {
 		return nil, err
 	}
 
-	//gen new session
-	sessionID, err := ins.db.Session.CreateNewSession(ctx, user.ID, accessToken, refreshToken)
+	family := primitive.NewObjectID()
+	refreshToken, err := ins.cfg.Tokens.GenerateRefreshToken(family, 0, refreshTTL)
 	if err != nil {
 		return nil, err
 	}
-	//update session to user
-	if err := ins.db.User.PushSession(ctx, user.ID, sessionID); err != nil {
+
+	// the session and its link to the user are written together, a session
+	// that could not be linked must not stay valid
+	maxSessions, evict := ins.cfg.SessionPolicy.limit(user)
+	err = ins.db.InTransaction(ctx, func(ctx context.Context) error {
+		//gen new session
+		sessionID, err := ins.db.Session.CreateNewSession(ctx, &models.SessionModel{
+			UserID:       user.ID,
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
+			FamilyID:     family,
+			AMR:          amr,
+			AuthTime:     authTime,
+			ClientID:     client.ID,
+			ClientIP:     td.ClientIP,
+			UserAgent:    td.UserAgent,
+		}, ins.cfg.SessionPolicy.Lifetime())
+		if err != nil {
+			return err
+		}
+		//update session to user
+		if err := ins.db.User.PushSession(ctx, user.ID, sessionID, maxSessions, evict); err != nil {
+			// without a transaction nothing rolls the session back
+			if err := ins.db.Session.Delete(ctx, sessionID); err != nil {
+				log.Printf("createSession err %s", err)
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrSessionLimit) {
+			return nil, errSessionLimit
+		}
 		return nil, err
 	}
-	result := logInResult{
+	return &logInResult{
 		UUID:         user.ID,
 		TokenType:    "Bearer",
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
-		ExpiresIn:    int64(tokenExpired / time.Second),
-	}
-
-	return &LogInResp{
-		trackingData: request.trackingData,
-		Code:         0,
-		Message:      "",
-		Result:       result,
+		ExpiresIn:    int64(accessTTL / time.Second),
 	}, nil
 }
 
 func (ins *Service) LogOut(ctx context.Context, uCtx middlewares.UserCtx, request *LogOutReq) (LogOutResp, error) {
 	//remove sessionId from user
-	if err := ins.db.User.RevokeSession(ctx, uCtx.UUID, uCtx.SessionID); err != nil {
+	if err := ins.revokeSession(ctx, uCtx.UUID, uCtx.SessionID); err != nil {
 		return LogOutResp{request.trackingData,
 			53, "DATABASE_ERROR"}, err
 	}
@@ -91,13 +346,21 @@ func (ins *Service) LogOut(ctx context.Context, uCtx middlewares.UserCtx, reques
 		0, ""}, nil
 }
 
+// RefreshToken : rotate the refresh token on every use. Presenting a token that
+// was already rotated out means it leaked, so the whole family is revoked.
 func (ins *Service) RefreshToken(ctx context.Context, request *RefreshTokenReq) (RefreshTokenResp, error) {
 	if err := request.Validate(); err != nil {
 		return RefreshTokenResp{request.trackingData,
 			40, "INVALID", logInResult{}}, err
 	}
+	client, err := ins.authorizeClient(ctx, request.trackingData, clients.GrantRefreshToken)
+	if err != nil {
+		code, message := clientFailure(err)
+		return RefreshTokenResp{request.trackingData,
+			code, message, logInResult{}}, err
+	}
 	//verify refresh token
-	rt, err := auth.ValidateRefreshToken(request.RefreshToken)
+	rt, err := ins.cfg.Tokens.ValidateRefreshToken(request.RefreshToken)
 	if err != nil {
 		return RefreshTokenResp{request.trackingData,
 			41, "REFRESH_TOKEN_INVALID", logInResult{}}, err
@@ -107,48 +370,190 @@ func (ins *Service) RefreshToken(ctx context.Context, request *RefreshTokenReq)
 			43, "REFRESH_TOKEN_EXPIRED", logInResult{}}, err
 	}
 	//
-	session, err := ins.db.Session.GetByRT(ctx, request.RefreshToken)
+	sessions, err := ins.db.Session.GetByFamily(ctx, rt.Family)
+	if err != nil {
+		return RefreshTokenResp{request.trackingData,
+			53, "DATABASE_ERROR", logInResult{}}, err
+	}
+	if len(sessions) == 0 {
+		return RefreshTokenResp{request.trackingData,
+			41, "REFRESH_TOKEN_INVALID", logInResult{}}, errors.New("refresh token family not found")
+	}
+	session := sessions[0]
+	if session.ClientID != client.ID {
+		return RefreshTokenResp{request.trackingData,
+			41, "REFRESH_TOKEN_INVALID", logInResult{}}, errors.New("refresh token issued to another client")
+	}
+	if rt.Generation != session.Generation || session.RefreshToken != request.RefreshToken {
+		ins.revokeFamily(ctx, request.trackingData, sessions, rt)
+		return RefreshTokenResp{request.trackingData,
+			41, "REFRESH_TOKEN_REUSED", logInResult{}}, errRefreshTokenReused
+	}
+	active, err := ins.db.User.ValidateSession(ctx, session.ID)
 	if err != nil {
 		return RefreshTokenResp{request.trackingData,
 			53, "DATABASE_ERROR", logInResult{}}, err
 	}
+	if !active || !session.RevokedAt.IsZero() {
+		return RefreshTokenResp{request.trackingData,
+			41, "SESSION_REVOKED", logInResult{}}, errors.New("session revoked")
+	}
+	if ins.cfg.SessionPolicy.Lifetime().Ended(&session, time.Now()) {
+		return RefreshTokenResp{request.trackingData,
+			43, "SESSION_EXPIRED", logInResult{}}, errors.New("session expired")
+	}
 	user, err := ins.db.User.FindByID(ctx, session.UserID)
 	if err != nil {
 		return RefreshTokenResp{request.trackingData,
 			53, "DATABASE_ERROR", logInResult{}}, err
 	}
 	//gen new user token
-	accessToken, err := auth.GenerateAccessToken(user.ID, user.Username, tokenExpired)
+	accessTTL, refreshTTL := tokenTTLs(client)
+	accessToken, err := ins.cfg.Tokens.GenerateAccessToken(user.ID, user.Username, session.AMR, session.AuthTime, accessTTL)
 	if err != nil {
 		return RefreshTokenResp{request.trackingData,
 			53, "GEN_ACCESS_TOKEN_FAILED", logInResult{}}, err
 	}
-	//update access token
-	if err = ins.db.Session.UpdateAccessToken(ctx, session.ID, accessToken); err != nil {
+	refreshToken, err := ins.cfg.Tokens.GenerateRefreshToken(session.FamilyID, session.Generation+1, refreshTTL)
+	if err != nil {
+		return RefreshTokenResp{request.trackingData,
+			53, "GEN_REFRESH_TOKEN_FAILED", logInResult{}}, err
+	}
+	//rotate both tokens, losing the race to a concurrent refresh is a reuse as well
+	rotated, err := ins.db.Session.Rotate(ctx, &session, accessToken, refreshToken, ins.cfg.SessionPolicy.Lifetime())
+	if err != nil {
 		return RefreshTokenResp{request.trackingData,
 			53, "DATABASE_ERROR", logInResult{}}, err
 	}
+	if !rotated {
+		ins.revokeFamily(ctx, request.trackingData, sessions, rt)
+		return RefreshTokenResp{request.trackingData,
+			41, "REFRESH_TOKEN_REUSED", logInResult{}}, errRefreshTokenReused
+	}
 	result := logInResult{
 		UUID:         user.ID,
 		TokenType:    "Bearer",
 		AccessToken:  accessToken,
-		RefreshToken: request.RefreshToken,
-		ExpiresIn:    int64(tokenExpired / time.Second),
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTTL / time.Second),
 	}
 	return RefreshTokenResp{request.trackingData,
 		0, "SUCCEED", result}, nil
 }
 
+func (ins *Service) revokeFamily(ctx context.Context, td trackingData, sessions []models.SessionModel, rt *auth.RefreshClaims) {
+	for _, session := range sessions {
+		if err := ins.revokeSession(ctx, session.UserID, session.ID); err != nil {
+			log.Printf("revokeFamily err %s", err)
+		}
+		ins.securityEvent(SecurityEvent{
+			Type:      EventRefreshTokenReuse,
+			UserID:    session.UserID,
+			SessionID: session.ID,
+			ClientIP:  td.ClientIP,
+			Detail: fmt.Sprintf("family %s presented generation %d, current %d",
+				rt.Family.Hex(), rt.Generation, session.Generation),
+		})
+	}
+}
+
+// ChangePassword : every session except the caller's is revoked so a leaked password
+// cannot keep a stolen session alive. A passkey signs in without the password,
+// the response lists them so the user can remove any they do not recognize.
+func (ins *Service) ChangePassword(ctx context.Context, uCtx middlewares.UserCtx, request *ChangePasswordReq) (ChangePasswordResp, error) {
+	if err := request.Validate(); err != nil {
+		return ChangePasswordResp{request.trackingData,
+			40, "INVALID", changePasswordResult{}}, err
+	}
+	user, err := ins.db.User.FindByID(ctx, uCtx.UUID)
+	if err != nil {
+		return ChangePasswordResp{request.trackingData,
+			53, "DATABASE_ERROR", changePasswordResult{}}, err
+	}
+	if code, message, err := ins.reauthenticate(ctx, request.trackingData, user, request.CurrentPassword, request.OTP); err != nil {
+		return ChangePasswordResp{request.trackingData,
+			code, message, changePasswordResult{}}, err
+	}
+	if err := ins.cfg.PasswordPolicy.Validate(request.NewPassword); err != nil {
+		return ChangePasswordResp{request.trackingData,
+			40, err.Error(), changePasswordResult{}}, err
+	}
+	if same, _, _ := password.Verify(request.NewPassword, user.Password); same {
+		return ChangePasswordResp{request.trackingData,
+			40, "NEW_PASSWORD_SAME_AS_CURRENT", changePasswordResult{}}, errors.New("new password equals current password")
+	}
+	hash, err := password.Hash(request.NewPassword)
+	if err != nil {
+		return ChangePasswordResp{request.trackingData,
+			53, "HASH_PASSWORD_FAILED", changePasswordResult{}}, err
+	}
+	// the new password never applies while the other sessions stay alive
+	if err := ins.db.InTransaction(ctx, func(ctx context.Context) error {
+		if err := ins.db.User.ChangePassword(ctx, user.ID, hash); err != nil {
+			return err
+		}
+		return ins.revokeOtherSessions(ctx, user.ID, uCtx.SessionID)
+	}); err != nil {
+		return ChangePasswordResp{request.trackingData,
+			53, "DATABASE_ERROR", changePasswordResult{}}, err
+	}
+	return ChangePasswordResp{request.trackingData,
+		0, "SUCCEED", changePasswordResult{Passkeys: passkeyResults(user.Passkeys)}}, nil
+}
+
+// reauthenticate : ask a signed in user for the password again, and for the
+// second factor when MFA is active, before a change that would let a stolen
+// access token keep the account. Failures are counted apart from the login ones.
+func (ins *Service) reauthenticate(ctx context.Context, td trackingData, user *models.UserModel, pwd, otp string) (int, string, error) {
+	keys := []string{ipKey(td), reauthKey(user.ID)}
+	verified, err := ins.checkPassword(ctx, keys, user.Username, pwd)
+	if err != nil {
+		if errors.Is(err, errTooManyAttempts) {
+			return 49, "TOO_MANY_ATTEMPTS", err
+		}
+		return 53, "DATABASE_ERROR", err
+	}
+	if verified == nil {
+		return 41, "PASSWORD_INCORRECT", errors.New("password mismatch")
+	}
+	if user.MFAActive {
+		if _, err := ins.checkSecondFactor(ctx, keys, user, otp); err != nil {
+			if errors.Is(err, errTooManyAttempts) {
+				return 49, "TOO_MANY_ATTEMPTS", err
+			}
+			return 42, "OTP_INCORRECT", err
+		}
+	}
+	return 0, "", nil
+}
+
+// GenerateSecretMFA : a new TOTP secret for the authenticator app, refused while
+// MFA is active since it would replace the secret of the enrolled authenticator
 func (ins *Service) GenerateSecretMFA(ctx context.Context, request *GenSecretMFAReq, uCtx middlewares.UserCtx) (*GenSecretMFAResp, error) {
 
+	user, err := ins.db.User.FindByID(ctx, uCtx.UUID)
+	if err != nil {
+		return &GenSecretMFAResp{
+			request.trackingData, 53, "DATABASE_ERROR", GenSecret{},
+		}, err
+	}
+	if user.MFAActive {
+		return &GenSecretMFAResp{
+			request.trackingData, 40, "MFA_ALREADY_ACTIVE", GenSecret{},
+		}, errors.New("mfa is already active")
+	}
+
 	secret := genSecret(secretSize)
-	issuer := "WeeDigitalAhihi"
+	issuer := ins.cfg.TOTPIssuer
 	// authLink see more at https://github.com/google/google-authenticator/wiki/Key-Uri-Format
-	authLink := fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s", issuer, uCtx.Username, secret, issuer)
+	authLink := fmt.Sprintf("otpauth://totp/%s:%s?secret=%s&issuer=%s",
+		url.PathEscape(issuer), url.PathEscape(uCtx.Username), secret, url.QueryEscape(issuer))
 
 	code, err := qr.Encode(authLink, qr.H)
 	if err != nil {
-
+		return &GenSecretMFAResp{
+			request.trackingData, 53, "INTERNAL_ERROR", GenSecret{},
+		}, err
 	}
 
 	img := code.PNG()
@@ -156,7 +561,7 @@ func (ins *Service) GenerateSecretMFA(ctx context.Context, request *GenSecretMFA
 	err = ins.db.User.UpdateMfaSecret(ctx, uCtx.UUID, secret)
 	if err != nil {
 		return &GenSecretMFAResp{
-			request.trackingData, 1, "DB Err", GenSecret{},
+			request.trackingData, 53, "DATABASE_ERROR", GenSecret{},
 		}, err
 	}
 
@@ -173,29 +578,43 @@ func (ins *Service) GenerateSecretMFA(ctx context.Context, request *GenSecretMFA
 
 }
 
-func (ins *Service) ActivateMFA(ctx context.Context, req *ActiveMFAReq, uCtx middlewares.UserCtx) error {
+// ActivateMFA : enable MFA once the user proves the authenticator works, the
+// response carries the recovery codes which are never shown again
+func (ins *Service) ActivateMFA(ctx context.Context, req *ActiveMFAReq, uCtx middlewares.UserCtx) (ActiveMFAResp, error) {
 
 	user, err := ins.db.User.FindByID(ctx, uCtx.UUID)
 	if err != nil {
-		return err
-	}
-	// see more at https://github.com/dgryski/dgoogauth
-	otpConfig := dgoogauth.OTPConfig{
-		Secret:      user.MFASecret,
-		HotpCounter: 0,
-		WindowSize:  3,
+		return ActiveMFAResp{req.trackingData,
+			53, "DATABASE_ERROR", recoveryCodesResult{}}, err
 	}
-
-	valid, err := otpConfig.Authenticate(req.OTP)
+	valid, err := ins.attempt(ctx, []string{ipKey(req.trackingData), factorKey(user.ID)}, func() (bool, error) {
+		return ins.verifyOTP(ctx, user, req.OTP)
+	})
 	if err != nil || !valid {
-		log.Printf("ActivateMFA err %s", err)
-		return err
+		if errors.Is(err, errTooManyAttempts) {
+			return ActiveMFAResp{req.trackingData,
+				49, "TOO_MANY_ATTEMPTS", recoveryCodesResult{}}, err
+		}
+		if err == nil {
+			err = errSecondFactorInvalid
+		}
+		return ActiveMFAResp{req.trackingData,
+			42, "OTP_INCORRECT", recoveryCodesResult{}}, err
 	}
-	if err := ins.db.User.UpdateMfaActive(ctx, uCtx.UUID, true); err != nil {
-		log.Printf("ActivateMFA err %s", err)
-		return err
+	// MFA is never active without the recovery codes shown in the response
+	var codes []string
+	if err := ins.db.InTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		if codes, err = ins.resetRecoveryCodes(ctx, user); err != nil {
+			return err
+		}
+		return ins.db.User.UpdateMfaActive(ctx, uCtx.UUID, true)
+	}); err != nil {
+		return ActiveMFAResp{req.trackingData,
+			53, "DATABASE_ERROR", recoveryCodesResult{}}, err
 	}
-	return nil
+	return ActiveMFAResp{req.trackingData,
+		0, "SUCCEED", recoveryCodesResult{Codes: codes, Remaining: len(codes)}}, nil
 }
 
 func (ins *Service) ValidateOTP(ctx context.Context, uCtx middlewares.UserCtx, req *ValidateOTPReq) (bool, error) {
@@ -206,33 +625,51 @@ func (ins *Service) ValidateOTP(ctx context.Context, uCtx middlewares.UserCtx, r
 		return false, err
 	}
 
-	// see more at https://github.com/dgryski/dgoogauth
-	otpConfig := dgoogauth.OTPConfig{
-		Secret:      user.MFASecret,
-		HotpCounter: 0,
-		WindowSize:  3,
-	}
-
-	valid, err := otpConfig.Authenticate(req.OTP)
-	if err != nil {
+	if _, err := ins.verifySecondFactor(ctx, req.trackingData, user, req.OTP); err != nil {
+		if errors.Is(err, errSecondFactorInvalid) {
+			return false, nil
+		}
 		log.Printf("ValidateOTP err %s", err)
 		return false, err
 	}
-	return valid, nil
+	return true, nil
 }
 
-func (ins *Service) DeactivateMFA(ctx context.Context, uCtx middlewares.UserCtx) (*models.UserModel, error) {
-	if err := ins.db.User.UpdateMfaSecret(ctx, uCtx.UUID, ""); err != nil {
-		return nil, err
-	}
-	if err := ins.db.User.UpdateMfaActive(ctx, uCtx.UUID, false); err != nil {
-		return nil, err
-	}
+// DeactivateMFA : the secret, the flag and the recovery codes are cleared
+// together, the caller must prove possession of the authenticator or an unused
+// recovery code like for a login
+func (ins *Service) DeactivateMFA(ctx context.Context, uCtx middlewares.UserCtx, request *DeactivateMFAReq) (DeactivateMFAResp, error) {
 	user, err := ins.db.User.FindByID(ctx, uCtx.UUID)
 	if err != nil {
-		return nil, err
+		return DeactivateMFAResp{request.trackingData,
+			53, "DATABASE_ERROR"}, err
 	}
-	return user, nil
+	if !user.MFAActive {
+		return DeactivateMFAResp{request.trackingData,
+			40, "MFA_NOT_ACTIVE"}, errors.New("mfa is not active")
+	}
+	if _, err := ins.verifySecondFactor(ctx, request.trackingData, user, request.OTP); err != nil {
+		if errors.Is(err, errTooManyAttempts) {
+			return DeactivateMFAResp{request.trackingData,
+				49, "TOO_MANY_ATTEMPTS"}, err
+		}
+		return DeactivateMFAResp{request.trackingData,
+			42, "OTP_INCORRECT"}, err
+	}
+	if err := ins.db.InTransaction(ctx, func(ctx context.Context) error {
+		if err := ins.db.User.UpdateMfaSecret(ctx, user.ID, ""); err != nil {
+			return err
+		}
+		if err := ins.db.User.UpdateMfaActive(ctx, user.ID, false); err != nil {
+			return err
+		}
+		return ins.db.User.SetRecoveryCodes(ctx, user.ID, nil)
+	}); err != nil {
+		return DeactivateMFAResp{request.trackingData,
+			53, "DATABASE_ERROR"}, err
+	}
+	return DeactivateMFAResp{request.trackingData,
+		0, "SUCCEED"}, nil
 }
 
 func genSecret(size int) string {
@@ -240,3 +677,32 @@ func genSecret(size int) string {
 	rand.Read(data)
 	return base32.StdEncoding.EncodeToString(data)
 }
+
+// verifyOTP : check a TOTP code and consume its time step so it cannot be replayed
+func (ins *Service) verifyOTP(ctx context.Context, user *models.UserModel, otp string) (bool, error) {
+	step, ok := matchOTP(user.MFASecret, otp, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return ins.db.User.UseOTPStep(ctx, user.ID, user.MFASecret, step)
+}
+
+// matchOTP : find the time step the code was generated for, accepting one step
+// of clock drift either way
+func matchOTP(secret, otp string, now time.Time) (int64, bool) {
+	if len(secret) == 0 || !otpPattern.MatchString(otp) {
+		return 0, false
+	}
+	code, err := strconv.Atoi(otp)
+	if err != nil {
+		return 0, false
+	}
+	t0 := now.Unix() / otpPeriod
+	for step := t0 - otpWindow; step <= t0+otpWindow; step++ {
+		// see more at https://github.com/dgryski/dgoogauth
+		if dgoogauth.ComputeCode(secret, step) == code {
+			return step, true
+		}
+	}
+	return 0, false
+}
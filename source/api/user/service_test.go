@@ -0,0 +1,204 @@
+package user
+
+import (
+	"app/internal/password"
+	"context"
+	"net/http"
+	"testing"
+)
+
+func (api *testAPI) refresh(refreshToken string) (int, RefreshTokenResp) {
+	api.t.Helper()
+	var resp RefreshTokenResp
+	status := api.call(http.MethodPost, "/refresh-token", "",
+		map[string]string{"refreshToken": refreshToken}, &resp)
+	return status, resp
+}
+
+func (api *testAPI) loginMFA(mfaToken, code string) (int, LogInResp) {
+	api.t.Helper()
+	var resp LogInResp
+	status := api.call(http.MethodPost, "/login/mfa", "",
+		map[string]string{"mfaToken": mfaToken, "otp": code}, &resp)
+	return status, resp
+}
+
+// mfaToken : log in with the password of an account with MFA, returning the
+// token of the second step
+func (api *testAPI) mfaToken(username string) string {
+	api.t.Helper()
+	status, resp := api.login(username, testPassword)
+	if status != http.StatusOK || resp.Code != 44 || !resp.Result.MFARequired || len(resp.Result.AccessToken) > 0 {
+		api.t.Fatalf("login %s: %d %+v", username, status, resp)
+	}
+	return resp.Result.MFAToken
+}
+
+// authorized : the access token is accepted by the routes behind RequireAuth
+func (api *testAPI) authorized(accessToken string) bool {
+	api.t.Helper()
+	switch status := api.call(http.MethodGet, "/sessions", accessToken, nil, nil); status {
+	case http.StatusOK:
+		return true
+	case http.StatusUnauthorized:
+		return false
+	default:
+		api.t.Fatalf("sessions: %d", status)
+		return false
+	}
+}
+
+func TestLogin(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	if len(tokens.RefreshToken) == 0 || tokens.TokenType != "Bearer" || !api.authorized(tokens.AccessToken) {
+		t.Fatalf("login: %+v", tokens)
+	}
+	// an unknown account fails like a wrong password
+	for _, username := range []string{"alice", "bob"} {
+		if status, resp := api.login(username, "wrong password"); status != http.StatusUnauthorized || resp.Code != 41 {
+			t.Fatalf("login %s with a wrong password: %d %+v", username, status, resp)
+		}
+	}
+}
+
+func TestLogout(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	var resp LogOutResp
+	if status := api.call(http.MethodPost, "/logout", tokens.AccessToken, nil, &resp); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("logout: %d %+v", status, resp)
+	}
+	if api.authorized(tokens.AccessToken) {
+		t.Fatal("access token accepted after logout")
+	}
+	if status, resp := api.refresh(tokens.RefreshToken); status != http.StatusUnauthorized || resp.Code != 41 {
+		t.Fatalf("refresh after logout: %d %+v", status, resp)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	status, resp := api.refresh(tokens.RefreshToken)
+	if status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("refresh: %d %+v", status, resp)
+	}
+	if resp.Result.RefreshToken == tokens.RefreshToken || !api.authorized(resp.Result.AccessToken) {
+		t.Fatalf("refreshed tokens: %+v", resp.Result)
+	}
+	if status, resp := api.refresh(resp.Result.RefreshToken); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("second refresh: %d %+v", status, resp)
+	}
+}
+
+// TestRefreshTokenReuse : a refresh token presented after its rotation has
+// leaked, the session it belongs to is revoked for the thief and the owner alike
+func TestRefreshTokenReuse(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	status, rotated := api.refresh(tokens.RefreshToken)
+	if status != http.StatusOK || rotated.Code != 0 {
+		t.Fatalf("refresh: %d %+v", status, rotated)
+	}
+	if status, resp := api.refresh(tokens.RefreshToken); status != http.StatusUnauthorized || resp.Message != "REFRESH_TOKEN_REUSED" {
+		t.Fatalf("reused refresh token: %d %+v", status, resp)
+	}
+	if status, resp := api.refresh(rotated.Result.RefreshToken); status != http.StatusUnauthorized || resp.Code != 41 {
+		t.Fatalf("refresh after reuse: %d %+v", status, resp)
+	}
+	if api.authorized(rotated.Result.AccessToken) {
+		t.Fatal("access token accepted after reuse")
+	}
+}
+
+func TestLoginMFA(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	secret, _ := api.enableMFA(tokens.AccessToken)
+	// the enrollment used the current step
+	code := otp(secret, currentStep()+1)
+	status, resp := api.loginMFA(api.mfaToken("alice"), code)
+	if status != http.StatusOK || resp.Code != 0 || !api.authorized(resp.Result.AccessToken) {
+		t.Fatalf("login with otp: %d %+v", status, resp)
+	}
+	// a code seen once, e.g. over a shoulder, can not be played again
+	if status, resp := api.loginMFA(api.mfaToken("alice"), code); status != http.StatusUnauthorized || resp.Code != 42 {
+		t.Fatalf("replayed otp: %d %+v", status, resp)
+	}
+}
+
+func TestLoginMFALockout(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	api.enableMFA(tokens.AccessToken)
+	mfaToken := api.mfaToken("alice")
+	for i := 0; i < DefaultLockoutPolicy.MaxFailures; i++ {
+		if status, resp := api.loginMFA(mfaToken, "000000"); status != http.StatusUnauthorized || resp.Code != 42 {
+			t.Fatalf("failure %d: %d %+v", i+1, status, resp)
+		}
+	}
+	if status, resp := api.loginMFA(mfaToken, "000000"); status != http.StatusTooManyRequests || resp.Code != 49 {
+		t.Fatalf("locked second factor: %d %+v", status, resp)
+	}
+}
+
+func TestLoginRecoveryCode(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	_, codes := api.enableMFA(tokens.AccessToken)
+	if len(codes) == 0 {
+		t.Fatal("no recovery codes")
+	}
+	status, resp := api.loginMFA(api.mfaToken("alice"), codes[0])
+	if status != http.StatusOK || resp.Code != 0 || !api.authorized(resp.Result.AccessToken) {
+		t.Fatalf("login with a recovery code: %d %+v", status, resp)
+	}
+	if status, resp := api.loginMFA(api.mfaToken("alice"), codes[0]); status != http.StatusUnauthorized || resp.Code != 42 {
+		t.Fatalf("recovery code used twice: %d %+v", status, resp)
+	}
+	if status, resp := api.loginMFA(api.mfaToken("alice"), codes[1]); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("login with another recovery code: %d %+v", status, resp)
+	}
+}
+
+// TestLoginRequiresSecondFactor : with MFA active the password alone yields
+// only the MFA token, which opens no route and is refused in place of a code
+func TestLoginRequiresSecondFactor(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	api.enableMFA(tokens.AccessToken)
+	mfaToken := api.mfaToken("alice")
+	if api.authorized(mfaToken) {
+		t.Fatal("MFA token accepted as an access token")
+	}
+	if status, resp := api.loginMFA(mfaToken, "000000"); status != http.StatusUnauthorized || resp.Code != 42 || len(resp.Result.AccessToken) > 0 {
+		t.Fatalf("login with a wrong code: %d %+v", status, resp)
+	}
+	if status, resp := api.loginMFA(tokens.AccessToken, "000000"); status != http.StatusUnauthorized || resp.Code != 41 {
+		t.Fatalf("access token in place of the MFA token: %d %+v", status, resp)
+	}
+}
+
+// TestLoginPlaintextPassword : an account stored before passwords were hashed
+// logs in and has its password hashed on the way
+func TestLoginPlaintextPassword(t *testing.T) {
+	api := newTestAPI(t, nil)
+	id, err := api.db.User.CreateUser(context.Background(), "alice", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, resp := api.login("alice", testPassword); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("login: %d %+v", status, resp)
+	}
+	stored, err := api.db.User.FindByID(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !password.IsEncoded(stored.Password) {
+		t.Fatal("plaintext password kept after login")
+	}
+	if status, resp := api.login("alice", testPassword); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("login after the rehash: %d %+v", status, resp)
+	}
+}
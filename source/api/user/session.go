@@ -0,0 +1,268 @@
+package user
+
+import (
+	"app/internal/clients"
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"app/source/middlewares"
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+var (
+	errSessionLimit    = errors.New("maximum number of concurrent sessions reached")
+	errSessionNotFound = errors.New("session not found")
+)
+
+const (
+	// SessionLimitEvict drops the oldest session when a login exceeds the limit
+	SessionLimitEvict = "evict"
+	// SessionLimitRefuse rejects the login until another session is closed
+	SessionLimitRefuse = "refuse"
+)
+
+// SessionPolicy : how many devices a user can be logged in with at once, and
+// for how long
+type SessionPolicy struct {
+	MaxSessions int // 0 means unlimited
+	OnLimit     string
+	// IdleTimeout ends a session not used for that long, MaxLifetime ends it
+	// that long after the login however it is used; 0 means no limit
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+}
+
+var DefaultSessionPolicy = SessionPolicy{
+	MaxSessions: 5,
+	OnLimit:     SessionLimitEvict,
+	IdleTimeout: 7 * 24 * time.Hour,
+	MaxLifetime: 30 * 24 * time.Hour,
+}
+
+func (p SessionPolicy) Lifetime() store.SessionLifetime {
+	return store.SessionLifetime{
+		IdleTimeout: p.IdleTimeout,
+		MaxLifetime: p.MaxLifetime,
+	}
+}
+
+// limit : the user's own limit takes precedence over the deployment policy
+func (p SessionPolicy) limit(user *models.UserModel) (int, bool) {
+	maxSessions := p.MaxSessions
+	if user.MaxSessions > 0 {
+		maxSessions = user.MaxSessions
+	}
+	return maxSessions, p.OnLimit != SessionLimitRefuse
+}
+
+// SetSessionLimit : admin operation overriding the session limit of one user
+func (ins *Service) SetSessionLimit(ctx context.Context, request *SessionLimitReq) (SessionLimitResp, error) {
+	request.Username = normalizeUsername(request.Username)
+	if err := request.validate(); err != nil {
+		return SessionLimitResp{request.trackingData,
+			40, err.Error()}, err
+	}
+	user, err := ins.db.User.FindByUsername(ctx, request.Username)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return SessionLimitResp{request.trackingData,
+				40, "USER_NOT_FOUND"}, err
+		}
+		return SessionLimitResp{request.trackingData,
+			53, "DATABASE_ERROR"}, err
+	}
+	if err := ins.db.User.SetMaxSessions(ctx, user.ID, request.MaxSessions); err != nil {
+		return SessionLimitResp{request.trackingData,
+			53, "DATABASE_ERROR"}, err
+	}
+	return SessionLimitResp{request.trackingData,
+		0, "SUCCEED"}, nil
+}
+
+// Sessions : the caller's active sessions, i.e. the ones still linked to the user
+func (ins *Service) Sessions(ctx context.Context, uCtx middlewares.UserCtx, request *SessionReq) (SessionResp, error) {
+	user, err := ins.db.User.FindByID(ctx, uCtx.UUID)
+	if err != nil {
+		return SessionResp{request.trackingData,
+			53, "DATABASE_ERROR", nil}, err
+	}
+	sessions, err := ins.db.Session.FindByIDs(ctx, user.ID, user.Sessions)
+	if err != nil {
+		return SessionResp{request.trackingData,
+			53, "DATABASE_ERROR", nil}, err
+	}
+	var (
+		now      = time.Now()
+		lifetime = ins.cfg.SessionPolicy.Lifetime()
+		results  = make([]sessionResult, 0, len(sessions))
+	)
+	for i := range sessions {
+		if lifetime.Ended(&sessions[i], now) {
+			continue
+		}
+		results = append(results, newSessionResult(&sessions[i], uCtx.SessionID))
+	}
+	return SessionResp{request.trackingData,
+		0, "", results}, nil
+}
+
+func (ins *Service) Session(ctx context.Context, uCtx middlewares.UserCtx, request *SessionReq) (SessionDetailResp, error) {
+	session, code, message, err := ins.ownSession(ctx, uCtx, request.SessionID)
+	if err != nil {
+		return SessionDetailResp{request.trackingData,
+			code, message, sessionResult{}}, err
+	}
+	return SessionDetailResp{request.trackingData,
+		0, "", newSessionResult(session, uCtx.SessionID)}, nil
+}
+
+// RevokeSession : sign one of the caller's sessions out, revoking the current
+// session is the same as logging out
+func (ins *Service) RevokeSession(ctx context.Context, uCtx middlewares.UserCtx, request *SessionReq) (SessionResp, error) {
+	session, code, message, err := ins.ownSession(ctx, uCtx, request.SessionID)
+	if err != nil {
+		return SessionResp{request.trackingData,
+			code, message, nil}, err
+	}
+	if err := ins.revokeSession(ctx, uCtx.UUID, session.ID); err != nil {
+		return SessionResp{request.trackingData,
+			53, "DATABASE_ERROR", nil}, err
+	}
+	return ins.Sessions(ctx, uCtx, request)
+}
+
+// RevokeOtherSessions : sign out everywhere except the current session
+func (ins *Service) RevokeOtherSessions(ctx context.Context, uCtx middlewares.UserCtx, request *SessionReq) (SessionResp, error) {
+	if err := ins.revokeOtherSessions(ctx, uCtx.UUID, uCtx.SessionID); err != nil {
+		return SessionResp{request.trackingData,
+			53, "DATABASE_ERROR", nil}, err
+	}
+	return ins.Sessions(ctx, uCtx, request)
+}
+
+// SessionLifetime : the limits RequireAuth must enforce for this service's sessions
+func (ins *Service) SessionLifetime() store.SessionLifetime {
+	return ins.cfg.SessionPolicy.Lifetime()
+}
+
+// ResumeSession : open a session for another client on the strength of a live
+// session of the same user, the single sign-on of the OIDC provider. The
+// factors and the time of that login carry over, nothing is asked again.
+func (ins *Service) ResumeSession(ctx context.Context, request *ResumeSessionReq) (*LogInResp, error) {
+	client, err := ins.authorizeClient(ctx, request.trackingData, clients.GrantAuthorizationCode)
+	if err != nil {
+		code, message := clientFailure(err)
+		return &LogInResp{request.trackingData,
+			code, message, logInResult{}}, err
+	}
+	session, err := ins.db.Session.GetByID(ctx, request.SessionID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return &LogInResp{request.trackingData,
+				41, "SESSION_REVOKED", logInResult{}}, errSessionNotFound
+		}
+		return &LogInResp{request.trackingData,
+			53, "DATABASE_ERROR", logInResult{}}, err
+	}
+	live, err := ins.db.User.ValidateSession(ctx, session.ID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return &LogInResp{request.trackingData,
+			53, "DATABASE_ERROR", logInResult{}}, err
+	}
+	if !live || session.UserID != request.UserID || ins.cfg.SessionPolicy.Lifetime().Ended(session, time.Now()) {
+		return &LogInResp{request.trackingData,
+			41, "SESSION_REVOKED", logInResult{}}, errSessionNotFound
+	}
+	user, err := ins.db.User.FindByID(ctx, session.UserID)
+	if err != nil {
+		return &LogInResp{request.trackingData,
+			53, "DATABASE_ERROR", logInResult{}}, err
+	}
+	result, err := ins.createSession(ctx, request.trackingData, client, user, session.AMR, session.AuthTime)
+	if err != nil {
+		if errors.Is(err, errSessionLimit) {
+			return &LogInResp{request.trackingData,
+				48, "SESSION_LIMIT_REACHED", logInResult{}}, err
+		}
+		return &LogInResp{request.trackingData,
+			53, "DATABASE_ERROR", logInResult{}}, err
+	}
+	return &LogInResp{request.trackingData,
+		0, "", *result}, nil
+}
+
+// EndSession : revoke one session of a user like a logout would, for the
+// services ending sessions on their own terms such as the OAuth revocation
+func (ins *Service) EndSession(ctx context.Context, userID, sessionID primitive.ObjectID) error {
+	return ins.revokeSession(ctx, userID, sessionID)
+}
+
+// revokeSession : unlink the session from the user and mark it revoked in one
+// transaction, joining the caller's when there is one
+func (ins *Service) revokeSession(ctx context.Context, userID, sessionID primitive.ObjectID) error {
+	return ins.db.InTransaction(ctx, func(ctx context.Context) error {
+		if err := ins.db.User.RevokeSession(ctx, userID, sessionID); err != nil {
+			return err
+		}
+		return ins.db.Session.Revoke(ctx, sessionID)
+	})
+}
+
+func (ins *Service) revokeOtherSessions(ctx context.Context, userID, keep primitive.ObjectID) error {
+	return ins.db.InTransaction(ctx, func(ctx context.Context) error {
+		if err := ins.db.User.RevokeOtherSessions(ctx, userID, keep); err != nil {
+			return err
+		}
+		return ins.db.Session.RevokeOthers(ctx, userID, keep)
+	})
+}
+
+// ownSession : load an active session of the caller, anything else is reported
+// as not found so session ids of other users cannot be probed
+func (ins *Service) ownSession(ctx context.Context, uCtx middlewares.UserCtx, sessionID string) (*models.SessionModel, int, string, error) {
+	id, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return nil, 40, "INVALID", errors.New("sessionId invalid")
+	}
+	user, err := ins.db.User.FindByID(ctx, uCtx.UUID)
+	if err != nil {
+		return nil, 53, "DATABASE_ERROR", err
+	}
+	active := false
+	for _, s := range user.Sessions {
+		if s == id {
+			active = true
+			break
+		}
+	}
+	if !active {
+		return nil, 44, "SESSION_NOT_FOUND", errSessionNotFound
+	}
+	session, err := ins.db.Session.GetByID(ctx, id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, 44, "SESSION_NOT_FOUND", errSessionNotFound
+		}
+		return nil, 53, "DATABASE_ERROR", err
+	}
+	if session.UserID != uCtx.UUID || ins.cfg.SessionPolicy.Lifetime().Ended(session, time.Now()) {
+		return nil, 44, "SESSION_NOT_FOUND", errSessionNotFound
+	}
+	return session, 0, "", nil
+}
+
+func newSessionResult(session *models.SessionModel, current primitive.ObjectID) sessionResult {
+	return sessionResult{
+		ID:         session.ID,
+		ClientID:   session.ClientID,
+		ClientIP:   session.ClientIP,
+		UserAgent:  session.UserAgent,
+		AMR:        session.AMR,
+		CreatedAt:  session.CreatedAt,
+		LastUsedAt: session.LastUsedAt,
+		ExpiresAt:  session.ExpiresAt,
+		Current:    session.ID == current,
+	}
+}
@@ -0,0 +1,342 @@
+package user
+
+import (
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"app/internal/store/memory"
+	"app/internal/store/sqldb"
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// recordingSessions : the sessions store keeping the ids it created, with a
+// Delete that fails when brokenDelete is set
+type recordingSessions struct {
+	store.SessionStore
+	created      []primitive.ObjectID
+	brokenDelete bool
+}
+
+func (ins *recordingSessions) CreateNewSession(ctx context.Context, session *models.SessionModel, lifetime store.SessionLifetime) (primitive.ObjectID, error) {
+	id, err := ins.SessionStore.CreateNewSession(ctx, session, lifetime)
+	if err == nil {
+		ins.created = append(ins.created, id)
+	}
+	return id, err
+}
+
+func (ins *recordingSessions) Delete(ctx context.Context, id primitive.ObjectID) error {
+	if ins.brokenDelete {
+		return errors.New("delete failed")
+	}
+	return ins.SessionStore.Delete(ctx, id)
+}
+
+func newSQLiteStore(t *testing.T) *store.DB {
+	t.Helper()
+	db, err := sqldb.Open(context.Background(), sqldb.SQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db.Store()
+}
+
+func sessionLimit(maxSessions int, onLimit string) func(cfg *Config) {
+	return func(cfg *Config) {
+		cfg.SessionPolicy.MaxSessions = maxSessions
+		cfg.SessionPolicy.OnLimit = onLimit
+	}
+}
+
+// refusedLogin : log in past the session limit and check that the session
+// created before the refusal did not outlive it
+func refusedLogin(t *testing.T, api *testAPI, sessions *recordingSessions) {
+	t.Helper()
+	api.signIn("alice")
+	if status, resp := api.login("alice", testPassword); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("second login: %d %+v", status, resp)
+	}
+	if status, resp := api.login("alice", testPassword); status != http.StatusForbidden || resp.Code != 48 {
+		t.Fatalf("login past the limit: %d %+v", status, resp)
+	}
+	if len(sessions.created) != 3 {
+		t.Fatalf("%d sessions created", len(sessions.created))
+	}
+	if _, err := api.db.Session.GetByID(context.Background(), sessions.created[2]); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("session of the refused login: %v", err)
+	}
+}
+
+// TestSessionLimitRefuse : without transactions the session is deleted again
+// when it can not be linked to the user
+func TestSessionLimitRefuse(t *testing.T) {
+	db := memory.New()
+	sessions := &recordingSessions{SessionStore: db.Session}
+	db.Session = sessions
+	refusedLogin(t, newTestAPI(t, db, sessionLimit(2, SessionLimitRefuse)), sessions)
+}
+
+// TestSessionLimitRefuseTransaction : with transactions the session is rolled
+// back even when deleting it would fail
+func TestSessionLimitRefuseTransaction(t *testing.T) {
+	db := newSQLiteStore(t)
+	sessions := &recordingSessions{SessionStore: db.Session, brokenDelete: true}
+	db.Session = sessions
+	refusedLogin(t, newTestAPI(t, db, sessionLimit(2, SessionLimitRefuse)), sessions)
+}
+
+func TestSessionLimitEvict(t *testing.T) {
+	for name, db := range map[string]*store.DB{"memory": nil, "sqlite": newSQLiteStore(t)} {
+		t.Run(name, func(t *testing.T) {
+			api := newTestAPI(t, db, sessionLimit(2, SessionLimitEvict))
+			first := api.signIn("alice")
+			var last logInResult
+			for i := 0; i < 2; i++ {
+				status, resp := api.login("alice", testPassword)
+				if status != http.StatusOK || resp.Code != 0 {
+					t.Fatalf("login %d: %d %+v", i+2, status, resp)
+				}
+				last = resp.Result
+			}
+			if api.authorized(first.AccessToken) {
+				t.Fatal("oldest session not evicted")
+			}
+			if !api.authorized(last.AccessToken) {
+				t.Fatal("newest session refused")
+			}
+			if status, resp := api.refresh(first.RefreshToken); status != http.StatusUnauthorized || resp.Message != "SESSION_REVOKED" {
+				t.Fatalf("refresh of the evicted session: %d %+v", status, resp)
+			}
+		})
+	}
+}
+
+func (api *testAPI) sessions(accessToken string) []sessionResult {
+	api.t.Helper()
+	var resp SessionResp
+	if status := api.call(http.MethodGet, "/sessions", accessToken, nil, &resp); status != http.StatusOK || resp.Code != 0 {
+		api.t.Fatalf("sessions: %d %+v", status, resp)
+	}
+	return resp.Result
+}
+
+// TestConcurrentSessions : each login is a device of its own, they stay signed
+// in side by side up to the limit, and without limit past it
+func TestConcurrentSessions(t *testing.T) {
+	api := newTestAPI(t, nil, sessionLimit(0, SessionLimitRefuse))
+	devices := []logInResult{api.signIn("alice")}
+	for i := 0; i < DefaultSessionPolicy.MaxSessions; i++ {
+		status, resp := api.login("alice", testPassword)
+		if status != http.StatusOK || resp.Code != 0 {
+			t.Fatalf("login %d: %d %+v", i+2, status, resp)
+		}
+		devices = append(devices, resp.Result)
+	}
+	for i, device := range devices {
+		if !api.authorized(device.AccessToken) {
+			t.Fatalf("device %d signed out", i+1)
+		}
+	}
+	sessions := api.sessions(devices[0].AccessToken)
+	if len(sessions) != len(devices) {
+		t.Fatalf("%d sessions for %d devices", len(sessions), len(devices))
+	}
+	current := 0
+	for _, session := range sessions {
+		if session.Current {
+			current++
+		}
+	}
+	if current != 1 {
+		t.Fatalf("%d sessions marked current", current)
+	}
+}
+
+// TestSessionLimitPerUser : the limit an admin sets for one user takes
+// precedence over the deployment policy, 0 gives the policy back
+func TestSessionLimitPerUser(t *testing.T) {
+	api := newTestAPI(t, nil, sessionLimit(3, SessionLimitRefuse))
+	api.register("alice")
+	ctx := context.Background()
+	if _, err := api.service.SetSessionLimit(ctx, &SessionLimitReq{Username: "Alice", MaxSessions: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if status, resp := api.login("alice", testPassword); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("first login: %d %+v", status, resp)
+	}
+	if status, resp := api.login("alice", testPassword); status != http.StatusForbidden || resp.Code != 48 {
+		t.Fatalf("login past the user's limit: %d %+v", status, resp)
+	}
+	if _, err := api.service.SetSessionLimit(ctx, &SessionLimitReq{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if status, resp := api.login("alice", testPassword); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("login under the policy: %d %+v", status, resp)
+	}
+	if resp, err := api.service.SetSessionLimit(ctx, &SessionLimitReq{Username: "bob", MaxSessions: 1}); err == nil || resp.Code != 40 {
+		t.Fatalf("limit of an unknown user: %+v", resp)
+	}
+}
+
+// TestSessionManagement : a user lists, inspects and revokes their own
+// sessions, and can not reach the sessions of anyone else
+func TestSessionManagement(t *testing.T) {
+	api := newTestAPI(t, nil)
+	laptop := api.signIn("alice")
+	status, resp := api.login("alice", testPassword)
+	if status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("second login: %d %+v", status, resp)
+	}
+	phone := resp.Result
+	bob := api.signIn("bob")
+
+	sessions := api.sessions(laptop.AccessToken)
+	if len(sessions) != 2 {
+		t.Fatalf("sessions: %+v", sessions)
+	}
+	var other sessionResult
+	for _, session := range sessions {
+		if !session.Current {
+			other = session
+		}
+	}
+	var detail SessionDetailResp
+	if status := api.call(http.MethodGet, "/sessions/"+other.ID.Hex(), laptop.AccessToken, nil, &detail); status != http.StatusOK ||
+		detail.Result.ID != other.ID || detail.Result.ClientID != testClientID || detail.Result.Current {
+		t.Fatalf("session: %d %+v", status, detail)
+	}
+	if status := api.call(http.MethodGet, "/sessions/not-an-id", laptop.AccessToken, nil, &detail); status != http.StatusBadRequest || detail.Code != 40 {
+		t.Fatalf("invalid session id: %d %+v", status, detail)
+	}
+	// the sessions of another user look like they do not exist
+	bobSession := api.sessions(bob.AccessToken)[0].ID.Hex()
+	if status := api.call(http.MethodGet, "/sessions/"+bobSession, laptop.AccessToken, nil, &detail); status != http.StatusNotFound || detail.Code != 44 {
+		t.Fatalf("session of another user: %d %+v", status, detail)
+	}
+	var revoked SessionResp
+	if status := api.call(http.MethodPost, "/sessions/revoke", laptop.AccessToken,
+		map[string]string{"sessionId": bobSession}, &revoked); status != http.StatusNotFound || revoked.Code != 44 {
+		t.Fatalf("revoke the session of another user: %d %+v", status, revoked)
+	}
+	if !api.authorized(bob.AccessToken) {
+		t.Fatal("session of another user revoked")
+	}
+
+	if status := api.call(http.MethodPost, "/sessions/revoke", laptop.AccessToken,
+		map[string]string{"sessionId": other.ID.Hex()}, &revoked); status != http.StatusOK || len(revoked.Result) != 1 || !revoked.Result[0].Current {
+		t.Fatalf("revoke: %d %+v", status, revoked)
+	}
+	if api.authorized(phone.AccessToken) {
+		t.Fatal("access token of a revoked session accepted")
+	}
+	if status, resp := api.refresh(phone.RefreshToken); status != http.StatusUnauthorized || resp.Code != 41 {
+		t.Fatalf("refresh of a revoked session: %d %+v", status, resp)
+	}
+	if status := api.call(http.MethodGet, "/sessions/"+other.ID.Hex(), laptop.AccessToken, nil, &detail); status != http.StatusNotFound || detail.Code != 44 {
+		t.Fatalf("revoked session: %d %+v", status, detail)
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	api := newTestAPI(t, nil)
+	current := api.signIn("alice")
+	var others []logInResult
+	for i := 0; i < 2; i++ {
+		status, resp := api.login("alice", testPassword)
+		if status != http.StatusOK || resp.Code != 0 {
+			t.Fatalf("login %d: %d %+v", i+2, status, resp)
+		}
+		others = append(others, resp.Result)
+	}
+	var resp SessionResp
+	if status := api.call(http.MethodPost, "/sessions/revoke-others", current.AccessToken, nil, &resp); status != http.StatusOK ||
+		len(resp.Result) != 1 || !resp.Result[0].Current {
+		t.Fatalf("revoke others: %d %+v", status, resp)
+	}
+	for i, other := range others {
+		if api.authorized(other.AccessToken) {
+			t.Fatalf("session %d kept", i+2)
+		}
+	}
+	if !api.authorized(current.AccessToken) {
+		t.Fatal("current session revoked")
+	}
+}
+
+// withLifetime : sessions ending after idle without use, and max after the login
+func withLifetime(idle, max time.Duration) func(cfg *Config) {
+	return func(cfg *Config) {
+		cfg.SessionPolicy.IdleTimeout = idle
+		cfg.SessionPolicy.MaxLifetime = max
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	api := newTestAPI(t, nil, withLifetime(200*time.Millisecond, time.Hour))
+	tokens := api.signIn("alice")
+	if status := api.call(http.MethodGet, "/sessions", tokens.AccessToken, nil, nil); status != http.StatusOK {
+		t.Fatalf("sessions: %d", status)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if status := api.call(http.MethodGet, "/sessions", tokens.AccessToken, nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("idle access token: %d", status)
+	}
+	if status, resp := api.refresh(tokens.RefreshToken); status != http.StatusUnauthorized || resp.Code != 43 {
+		t.Fatalf("idle refresh: %d %+v", status, resp)
+	}
+}
+
+// TestSessionMaxLifetime : using the session slides the idle timeout, never
+// past the maximum lifetime
+func TestSessionMaxLifetime(t *testing.T) {
+	api := newTestAPI(t, nil, withLifetime(time.Hour, 300*time.Millisecond))
+	tokens := api.signIn("alice")
+	time.Sleep(150 * time.Millisecond)
+	status, resp := api.refresh(tokens.RefreshToken)
+	if status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("refresh: %d %+v", status, resp)
+	}
+	session, err := api.db.Session.GetByAT(context.Background(), resp.Result.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := session.CreatedAt.Add(300 * time.Millisecond); !session.ExpiresAt.Equal(want) {
+		t.Fatalf("session expires at %s, want %s", session.ExpiresAt, want)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if status := api.call(http.MethodGet, "/sessions", resp.Result.AccessToken, nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("access token past the lifetime: %d", status)
+	}
+	if status, resp := api.refresh(resp.Result.RefreshToken); status != http.StatusUnauthorized || resp.Code != 43 {
+		t.Fatalf("refresh past the lifetime: %d %+v", status, resp)
+	}
+}
+
+// TestLogoutRevokesSession : a signed out session is kept, marked revoked,
+// until the retention index deletes it
+func TestLogoutRevokesSession(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	session, err := api.db.Session.GetByAT(context.Background(), tokens.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.ExpiresAt.IsZero() || !session.RevokedAt.IsZero() {
+		t.Fatalf("new session %+v", session)
+	}
+	if status := api.call(http.MethodPost, "/logout", tokens.AccessToken, nil, nil); status != http.StatusOK {
+		t.Fatalf("logout: %d", status)
+	}
+	revoked, err := api.db.Session.GetByID(context.Background(), session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked.RevokedAt.IsZero() {
+		t.Fatalf("signed out session %+v", revoked)
+	}
+}
@@ -0,0 +1,431 @@
+package user
+
+import (
+	"app/internal/auth"
+	"app/internal/clients"
+	"app/internal/mongodb/db/models"
+	"app/internal/store"
+	"app/source/middlewares"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"time"
+)
+
+const (
+	webauthnChallengeExpired = 5 * time.Minute
+
+	purposeRegister = "register"
+	purposeMFA      = "mfa"
+	purposeLogin    = "login"
+)
+
+var errWebAuthnDisabled = errors.New("webauthn relying party is not configured")
+
+// webauthnUser : adapts a user document to the relying party library, the user
+// handle is the ObjectID so discoverable logins can find the account
+type webauthnUser struct {
+	*models.UserModel
+}
+
+func (u webauthnUser) WebAuthnID() []byte {
+	return u.ID[:]
+}
+
+func (u webauthnUser) WebAuthnName() string {
+	return u.Username
+}
+
+func (u webauthnUser) WebAuthnDisplayName() string {
+	return u.Username
+}
+
+func (u webauthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.Passkeys))
+	for _, p := range u.Passkeys {
+		transports := make([]protocol.AuthenticatorTransport, 0, len(p.Transports))
+		for _, t := range p.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(t))
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              p.CredentialID,
+			PublicKey:       p.PublicKey,
+			AttestationType: p.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: p.BackupEligible,
+				BackupState:    p.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    p.AAGUID,
+				SignCount: p.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+func (u webauthnUser) descriptors() []protocol.CredentialDescriptor {
+	var list []protocol.CredentialDescriptor
+	for _, c := range u.WebAuthnCredentials() {
+		list = append(list, c.Descriptor())
+	}
+	return list
+}
+
+// BeginPasskeyRegistration : start registering a new passkey for the caller. A
+// passkey signs in without the password or the TOTP code, so both are asked for
+// again, the challenge then binds the finish to this check.
+func (ins *Service) BeginPasskeyRegistration(ctx context.Context, uCtx middlewares.UserCtx, request *PasskeyRegisterBeginReq) (PasskeyBeginResp, error) {
+	if ins.cfg.WebAuthn == nil {
+		return PasskeyBeginResp{request.trackingData,
+			40, "WEBAUTHN_DISABLED", passkeyBeginResult{}}, errWebAuthnDisabled
+	}
+	if err := request.validate(); err != nil {
+		return PasskeyBeginResp{request.trackingData,
+			40, "INVALID", passkeyBeginResult{}}, err
+	}
+	user, err := ins.db.User.FindByID(ctx, uCtx.UUID)
+	if err != nil {
+		return PasskeyBeginResp{request.trackingData,
+			53, "DATABASE_ERROR", passkeyBeginResult{}}, err
+	}
+	if code, message, err := ins.reauthenticate(ctx, request.trackingData, user, request.Password, request.OTP); err != nil {
+		return PasskeyBeginResp{request.trackingData,
+			code, message, passkeyBeginResult{}}, err
+	}
+	wu := webauthnUser{user}
+	creation, session, err := ins.cfg.WebAuthn.BeginRegistration(wu,
+		webauthn.WithExclusions(wu.descriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return PasskeyBeginResp{request.trackingData,
+			46, "PASSKEY_BEGIN_FAILED", passkeyBeginResult{}}, err
+	}
+	challengeID, err := ins.saveChallenge(ctx, user.ID, purposeRegister, session)
+	if err != nil {
+		return PasskeyBeginResp{request.trackingData,
+			53, "DATABASE_ERROR", passkeyBeginResult{}}, err
+	}
+	return PasskeyBeginResp{request.trackingData,
+		0, "", passkeyBeginResult{ChallengeID: challengeID, Options: creation}}, nil
+}
+
+// FinishPasskeyRegistration : verify the attestation and store the credential
+func (ins *Service) FinishPasskeyRegistration(ctx context.Context, uCtx middlewares.UserCtx, request *PasskeyRegisterFinishReq) (PasskeyResp, error) {
+	if ins.cfg.WebAuthn == nil {
+		return PasskeyResp{request.trackingData,
+			40, "WEBAUTHN_DISABLED", nil}, errWebAuthnDisabled
+	}
+	challenge, err := ins.db.WebAuthn.Take(ctx, request.ChallengeID, purposeRegister)
+	if err != nil || challenge.UserID != uCtx.UUID {
+		if err == nil {
+			err = errors.New("challenge belongs to another user")
+		}
+		return PasskeyResp{request.trackingData,
+			43, "CHALLENGE_EXPIRED", nil}, err
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(request.Credential))
+	if err != nil {
+		return PasskeyResp{request.trackingData,
+			40, "INVALID", nil}, err
+	}
+	user, err := ins.db.User.FindByID(ctx, uCtx.UUID)
+	if err != nil {
+		return PasskeyResp{request.trackingData,
+			53, "DATABASE_ERROR", nil}, err
+	}
+	credential, err := ins.cfg.WebAuthn.CreateCredential(webauthnUser{user}, sessionData(challenge), parsed)
+	if err != nil {
+		return PasskeyResp{request.trackingData,
+			46, "PASSKEY_INVALID", nil}, err
+	}
+	name := request.Name
+	if len(name) == 0 {
+		name = fmt.Sprintf("Passkey %d", len(user.Passkeys)+1)
+	}
+	transports := make([]string, 0, len(credential.Transport))
+	for _, t := range credential.Transport {
+		transports = append(transports, string(t))
+	}
+	passkey := models.PasskeyModel{
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		Transports:      transports,
+		Name:            name,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+		CreatedAt:       time.Now(),
+	}
+	if err := ins.db.User.AddPasskey(ctx, user.ID, passkey); err != nil {
+		if errors.Is(err, store.ErrPasskeyExists) {
+			return PasskeyResp{request.trackingData,
+				46, "PASSKEY_EXISTS", nil}, err
+		}
+		return PasskeyResp{request.trackingData,
+			53, "DATABASE_ERROR", nil}, err
+	}
+	return PasskeyResp{request.trackingData,
+		0, "SUCCEED", passkeyResults(append(user.Passkeys, passkey))}, nil
+}
+
+func (ins *Service) Passkeys(ctx context.Context, uCtx middlewares.UserCtx, request *PasskeyReq) (PasskeyResp, error) {
+	user, err := ins.db.User.FindByID(ctx, uCtx.UUID)
+	if err != nil {
+		return PasskeyResp{request.trackingData,
+			53, "DATABASE_ERROR", nil}, err
+	}
+	return PasskeyResp{request.trackingData,
+		0, "", passkeyResults(user.Passkeys)}, nil
+}
+
+// RemovePasskey : asks for the password again like the registration, a stolen
+// access token must not remove the owner's passkeys either
+func (ins *Service) RemovePasskey(ctx context.Context, uCtx middlewares.UserCtx, request *PasskeyRemoveReq) (PasskeyResp, error) {
+	if err := request.validate(); err != nil {
+		return PasskeyResp{request.trackingData,
+			40, "INVALID", nil}, err
+	}
+	credentialID, err := base64.RawURLEncoding.DecodeString(request.CredentialID)
+	if err != nil || len(credentialID) == 0 {
+		return PasskeyResp{request.trackingData,
+			40, "INVALID", nil}, errors.New("credentialId invalid")
+	}
+	user, err := ins.db.User.FindByID(ctx, uCtx.UUID)
+	if err != nil {
+		return PasskeyResp{request.trackingData,
+			53, "DATABASE_ERROR", nil}, err
+	}
+	if code, message, err := ins.reauthenticate(ctx, request.trackingData, user, request.Password, request.OTP); err != nil {
+		return PasskeyResp{request.trackingData,
+			code, message, nil}, err
+	}
+	removed, err := ins.db.User.RemovePasskey(ctx, user.ID, credentialID)
+	if err != nil {
+		return PasskeyResp{request.trackingData,
+			53, "DATABASE_ERROR", nil}, err
+	}
+	if !removed {
+		return PasskeyResp{request.trackingData,
+			40, "PASSKEY_NOT_FOUND", nil}, errors.New("passkey not found")
+	}
+	return ins.Passkeys(ctx, uCtx, &PasskeyReq{trackingData: request.trackingData})
+}
+
+// BeginPasskeyLogin : with an mfaToken the passkey is the second factor of that
+// user, without one it is a passwordless login with a discoverable credential
+func (ins *Service) BeginPasskeyLogin(ctx context.Context, request *PasskeyLoginBeginReq) (PasskeyBeginResp, error) {
+	if ins.cfg.WebAuthn == nil {
+		return PasskeyBeginResp{request.trackingData,
+			40, "WEBAUTHN_DISABLED", passkeyBeginResult{}}, errWebAuthnDisabled
+	}
+	// anyone may begin a login, every call stores a challenge
+	if err := ins.throttleChallenge(ctx, request.trackingData); err != nil {
+		if errors.Is(err, errTooManyAttempts) {
+			return PasskeyBeginResp{request.trackingData,
+				49, "TOO_MANY_ATTEMPTS", passkeyBeginResult{}}, err
+		}
+		return PasskeyBeginResp{request.trackingData,
+			53, "DATABASE_ERROR", passkeyBeginResult{}}, err
+	}
+	var (
+		assertion *protocol.CredentialAssertion
+		session   *webauthn.SessionData
+		userID    = primitive.NilObjectID
+		purpose   = purposeLogin
+		err       error
+	)
+	if len(request.MFAToken) > 0 {
+		uuid, _, err := ins.cfg.Tokens.ValidateMFAToken(request.MFAToken)
+		if err != nil {
+			return PasskeyBeginResp{request.trackingData,
+				41, "MFA_TOKEN_INVALID", passkeyBeginResult{}}, err
+		}
+		user, err := ins.db.User.FindByID(ctx, uuid)
+		if err != nil {
+			return PasskeyBeginResp{request.trackingData,
+				53, "DATABASE_ERROR", passkeyBeginResult{}}, err
+		}
+		if assertion, session, err = ins.cfg.WebAuthn.BeginLogin(webauthnUser{user}); err != nil {
+			return PasskeyBeginResp{request.trackingData,
+				46, "PASSKEY_NOT_REGISTERED", passkeyBeginResult{}}, err
+		}
+		userID, purpose = user.ID, purposeMFA
+	} else {
+		assertion, session, err = ins.cfg.WebAuthn.BeginDiscoverableLogin(
+			webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			return PasskeyBeginResp{request.trackingData,
+				46, "PASSKEY_BEGIN_FAILED", passkeyBeginResult{}}, err
+		}
+	}
+	challengeID, err := ins.saveChallenge(ctx, userID, purpose, session)
+	if err != nil {
+		return PasskeyBeginResp{request.trackingData,
+			53, "DATABASE_ERROR", passkeyBeginResult{}}, err
+	}
+	return PasskeyBeginResp{request.trackingData,
+		0, "", passkeyBeginResult{ChallengeID: challengeID, Options: assertion}}, nil
+}
+
+// FinishPasskeyLogin : verify the assertion and open a session
+func (ins *Service) FinishPasskeyLogin(ctx context.Context, request *PasskeyLoginFinishReq) (*LogInResp, error) {
+	if ins.cfg.WebAuthn == nil {
+		return &LogInResp{request.trackingData,
+			40, "WEBAUTHN_DISABLED", logInResult{}}, errWebAuthnDisabled
+	}
+	client, err := ins.authorizeClient(ctx, request.trackingData, clients.GrantPassword)
+	if err != nil {
+		code, message := clientFailure(err)
+		return &LogInResp{request.trackingData,
+			code, message, logInResult{}}, err
+	}
+	var (
+		purpose = purposeLogin
+		mfaUser = primitive.NilObjectID
+	)
+	if len(request.MFAToken) > 0 {
+		uuid, _, err := ins.cfg.Tokens.ValidateMFAToken(request.MFAToken)
+		if err != nil {
+			return &LogInResp{request.trackingData,
+				41, "MFA_TOKEN_INVALID", logInResult{}}, err
+		}
+		purpose, mfaUser = purposeMFA, uuid
+	}
+	challenge, err := ins.db.WebAuthn.Take(ctx, request.ChallengeID, purpose)
+	if err != nil || challenge.UserID != mfaUser {
+		if err == nil {
+			err = errors.New("challenge belongs to another user")
+		}
+		return &LogInResp{request.trackingData,
+			43, "CHALLENGE_EXPIRED", logInResult{}}, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(request.Credential))
+	if err != nil {
+		return &LogInResp{request.trackingData,
+			40, "INVALID", logInResult{}}, err
+	}
+
+	var (
+		user       *models.UserModel
+		credential *webauthn.Credential
+		amr        []string
+	)
+	if purpose == purposeMFA {
+		if user, err = ins.db.User.FindByID(ctx, mfaUser); err != nil {
+			return &LogInResp{request.trackingData,
+				53, "DATABASE_ERROR", logInResult{}}, err
+		}
+		credential, err = ins.cfg.WebAuthn.ValidateLogin(webauthnUser{user}, sessionData(challenge), parsed)
+		amr = []string{auth.AmrPassword, auth.AmrHardwareKey}
+	} else {
+		credential, err = ins.cfg.WebAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			found, err := ins.db.User.FindByPasskey(ctx, rawID)
+			if err != nil {
+				return nil, err
+			}
+			user = found
+			return webauthnUser{found}, nil
+		}, sessionData(challenge), parsed)
+		amr = []string{auth.AmrHardwareKey, auth.AmrUserPresence}
+	}
+	if err != nil {
+		return &LogInResp{request.trackingData,
+			46, "PASSKEY_INVALID", logInResult{}}, err
+	}
+	if credential.Authenticator.CloneWarning {
+		log.Printf("SECURITY: passkey sign count regression user=%s credential=%s",
+			user.ID.Hex(), base64.RawURLEncoding.EncodeToString(credential.ID))
+		return &LogInResp{request.trackingData,
+			47, "PASSKEY_SIGN_COUNT_INVALID", logInResult{}}, errors.New("passkey sign count regression")
+	}
+	updated, err := ins.db.User.UpdatePasskeySignCount(ctx, user.ID, credential.ID, credential.Authenticator.SignCount)
+	if err != nil {
+		return &LogInResp{request.trackingData,
+			53, "DATABASE_ERROR", logInResult{}}, err
+	}
+	if !updated {
+		// another login stored an equal or higher counter in the meantime
+		log.Printf("SECURITY: passkey sign count regression user=%s credential=%s",
+			user.ID.Hex(), base64.RawURLEncoding.EncodeToString(credential.ID))
+		return &LogInResp{request.trackingData,
+			47, "PASSKEY_SIGN_COUNT_INVALID", logInResult{}}, errors.New("passkey sign count regression")
+	}
+
+	result, err := ins.createSession(ctx, request.trackingData, client, user, amr, time.Now())
+	if err != nil {
+		if errors.Is(err, errSessionLimit) {
+			return &LogInResp{request.trackingData,
+				48, "SESSION_LIMIT_REACHED", logInResult{}}, err
+		}
+		return nil, err
+	}
+	return &LogInResp{
+		trackingData: request.trackingData,
+		Code:         0,
+		Message:      "",
+		Result:       *result,
+	}, nil
+}
+
+func (ins *Service) saveChallenge(ctx context.Context, userID primitive.ObjectID, purpose string, session *webauthn.SessionData) (primitive.ObjectID, error) {
+	return ins.db.WebAuthn.Create(ctx, &models.WebAuthnChallengeModel{
+		UserID:               userID,
+		Purpose:              purpose,
+		Challenge:            session.Challenge,
+		UserHandle:           session.UserID,
+		AllowedCredentialIDs: session.AllowedCredentialIDs,
+		UserVerification:     string(session.UserVerification),
+		ExpiresAt:            time.Now().Add(webauthnChallengeExpired),
+	})
+}
+
+func sessionData(challenge *models.WebAuthnChallengeModel) webauthn.SessionData {
+	return webauthn.SessionData{
+		Challenge:            challenge.Challenge,
+		UserID:               challenge.UserHandle,
+		AllowedCredentialIDs: challenge.AllowedCredentialIDs,
+		Expires:              challenge.ExpiresAt,
+		UserVerification:     protocol.UserVerificationRequirement(challenge.UserVerification),
+	}
+}
+
+func passkeyResults(passkeys []models.PasskeyModel) []passkeyResult {
+	results := make([]passkeyResult, 0, len(passkeys))
+	for _, p := range passkeys {
+		results = append(results, passkeyResult{
+			CredentialID: base64.RawURLEncoding.EncodeToString(p.CredentialID),
+			Name:         p.Name,
+			Transports:   p.Transports,
+			CreatedAt:    p.CreatedAt,
+			LastUsedAt:   p.LastUsedAt,
+		})
+	}
+	return results
+}
+
+// mfaMethods : second factors the user can complete /login/mfa or /login/webauthn with
+func mfaMethods(user *models.UserModel) []string {
+	var methods []string
+	if user.MFAActive {
+		methods = append(methods, auth.AmrOTP)
+	}
+	if len(user.Passkeys) > 0 {
+		methods = append(methods, "webauthn")
+	}
+	return methods
+}
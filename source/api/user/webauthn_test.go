@@ -0,0 +1,208 @@
+package user
+
+import (
+	"app/internal/passkey"
+	"context"
+	"encoding/json"
+	"github.com/go-webauthn/webauthn/protocol"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"testing"
+)
+
+// passkeyBegin : the begin response with the options typed for the authenticator
+type passkeyBegin[T any] struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Result  struct {
+		ChallengeID primitive.ObjectID `json:"challengeId"`
+		Options     T                  `json:"options"`
+	} `json:"result"`
+}
+
+type passkeyFinish struct {
+	ChallengeID primitive.ObjectID `json:"challengeId"`
+	Credential  json.RawMessage    `json:"credential"`
+}
+
+// registerPasskey : run the registration ceremony of a signed in user with key
+func registerPasskey(t *testing.T, api *testAPI, accessToken string, key *passkey.SoftAuthenticator) {
+	t.Helper()
+	var begin passkeyBegin[protocol.CredentialCreation]
+	if status := api.call(http.MethodPost, "/webauthn/register/begin", accessToken,
+		map[string]string{"password": testPassword}, &begin); status != http.StatusOK || begin.Code != 0 {
+		t.Fatalf("register begin: %d %+v", status, begin)
+	}
+	credential, err := key.Register(&begin.Result.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp PasskeyResp
+	if status := api.call(http.MethodPost, "/webauthn/register/finish", accessToken,
+		passkeyFinish{begin.Result.ChallengeID, marshal(t, credential)}, &resp); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("register finish: %d %+v", status, resp)
+	}
+}
+
+// beginPasskeyLogin : start a passwordless login and answer it with key
+func beginPasskeyLogin(t *testing.T, api *testAPI, key *passkey.SoftAuthenticator) passkeyFinish {
+	t.Helper()
+	var begin passkeyBegin[protocol.CredentialAssertion]
+	if status := api.call(http.MethodPost, "/login/webauthn/begin", "", struct{}{}, &begin); status != http.StatusOK || begin.Code != 0 {
+		t.Fatalf("login begin: %d %+v", status, begin)
+	}
+	assertion, err := key.Assert(&begin.Result.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return passkeyFinish{begin.Result.ChallengeID, marshal(t, assertion)}
+}
+
+func finishPasskeyLogin(api *testAPI, finish passkeyFinish) (int, LogInResp) {
+	var resp LogInResp
+	status := api.call(http.MethodPost, "/login/webauthn/finish", "", finish, &resp)
+	return status, resp
+}
+
+func marshal(t *testing.T, v interface{}) json.RawMessage {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newPasskeyUser(t *testing.T) (*testAPI, *passkey.SoftAuthenticator) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	key := passkey.NewSoftAuthenticator(testOrigin)
+	registerPasskey(t, api, tokens.AccessToken, key)
+	return api, key
+}
+
+func TestPasskeyRoundTrip(t *testing.T) {
+	api, key := newPasskeyUser(t)
+	for i := 0; i < 2; i++ {
+		status, resp := finishPasskeyLogin(api, beginPasskeyLogin(t, api, key))
+		if status != http.StatusOK || resp.Code != 0 || len(resp.Result.AccessToken) == 0 {
+			t.Fatalf("login %d: %d %+v", i, status, resp)
+		}
+		// the passkey session opens the authenticated routes
+		var sessions SessionResp
+		if status := api.call(http.MethodGet, "/sessions", resp.Result.AccessToken, nil, &sessions); status != http.StatusOK {
+			t.Fatalf("sessions: %d %+v", status, sessions)
+		}
+	}
+}
+
+func TestPasskeySignCountRegression(t *testing.T) {
+	api, key := newPasskeyUser(t)
+	finish := beginPasskeyLogin(t, api, key)
+	if status, resp := finishPasskeyLogin(api, finish); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("login: %d %+v", status, resp)
+	}
+	user, err := api.db.User.FindByUsername(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a clone answers with the counter the original had before the login
+	if err := key.SetSignCount(user.Passkeys[0].CredentialID, 0); err != nil {
+		t.Fatal(err)
+	}
+	status, resp := finishPasskeyLogin(api, beginPasskeyLogin(t, api, key))
+	if status != http.StatusUnauthorized || resp.Code != 47 {
+		t.Fatalf("cloned login: %d %+v", status, resp)
+	}
+}
+
+func TestPasskeyChallengeReplay(t *testing.T) {
+	api, key := newPasskeyUser(t)
+	finish := beginPasskeyLogin(t, api, key)
+	if status, resp := finishPasskeyLogin(api, finish); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("login: %d %+v", status, resp)
+	}
+	status, resp := finishPasskeyLogin(api, finish)
+	if status != http.StatusUnauthorized || resp.Code != 43 {
+		t.Fatalf("replayed login: %d %+v", status, resp)
+	}
+}
+
+func TestPasskeyWrongOrigin(t *testing.T) {
+	api, key := newPasskeyUser(t)
+	key.Origin = "https://phishing.example"
+	status, resp := finishPasskeyLogin(api, beginPasskeyLogin(t, api, key))
+	if status != http.StatusUnauthorized || resp.Code != 46 {
+		t.Fatalf("login from another origin: %d %+v", status, resp)
+	}
+}
+
+func (api *testAPI) removePasskey(accessToken, credentialID, pwd, code string) (int, PasskeyResp) {
+	api.t.Helper()
+	var resp PasskeyResp
+	status := api.call(http.MethodPost, "/webauthn/credentials/remove", accessToken, map[string]string{
+		"credentialId": credentialID,
+		"password":     pwd,
+		"otp":          code,
+	}, &resp)
+	return status, resp
+}
+
+// TestPasskeyRegistrationReauth : a stolen access token alone can not add a
+// passkey, the password and the TOTP code are asked for again
+func TestPasskeyRegistrationReauth(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	begin := func(body map[string]string) (int, PasskeyBeginResp) {
+		var resp PasskeyBeginResp
+		status := api.call(http.MethodPost, "/webauthn/register/begin", tokens.AccessToken, body, &resp)
+		return status, resp
+	}
+	if status, resp := begin(map[string]string{}); status != http.StatusBadRequest || resp.Code != 40 {
+		t.Fatalf("begin without the password: %d %+v", status, resp)
+	}
+	if status, resp := begin(map[string]string{"password": "wrong password"}); status != http.StatusForbidden || resp.Code != 41 {
+		t.Fatalf("begin with a wrong password: %d %+v", status, resp)
+	}
+	secret, _ := api.enableMFA(tokens.AccessToken)
+	if status, resp := begin(map[string]string{"password": testPassword}); status != http.StatusForbidden || resp.Code != 42 {
+		t.Fatalf("begin without the otp: %d %+v", status, resp)
+	}
+	// the enrollment used the current step
+	code := otp(secret, currentStep()+1)
+	if status, resp := begin(map[string]string{"password": testPassword, "otp": code}); status != http.StatusOK || resp.Code != 0 {
+		t.Fatalf("begin with the otp: %d %+v", status, resp)
+	}
+}
+
+func TestPasskeyRemoveReauth(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	registerPasskey(t, api, tokens.AccessToken, passkey.NewSoftAuthenticator(testOrigin))
+	var list PasskeyResp
+	if status := api.call(http.MethodGet, "/webauthn/credentials", tokens.AccessToken, nil, &list); status != http.StatusOK || len(list.Result) != 1 {
+		t.Fatalf("passkeys: %d %+v", status, list)
+	}
+	credentialID := list.Result[0].CredentialID
+	if status, resp := api.removePasskey(tokens.AccessToken, credentialID, "", ""); status != http.StatusBadRequest || resp.Code != 40 {
+		t.Fatalf("remove without the password: %d %+v", status, resp)
+	}
+	if status, resp := api.removePasskey(tokens.AccessToken, credentialID, "wrong password", ""); status != http.StatusForbidden || resp.Code != 41 {
+		t.Fatalf("remove with a wrong password: %d %+v", status, resp)
+	}
+	if status, resp := api.removePasskey(tokens.AccessToken, credentialID, testPassword, ""); status != http.StatusOK || resp.Code != 0 || len(resp.Result) != 0 {
+		t.Fatalf("remove: %d %+v", status, resp)
+	}
+}
+
+// TestChangePasswordListsPasskeys : a passkey keeps signing in after the
+// password changed, the user is shown the ones left
+func TestChangePasswordListsPasskeys(t *testing.T) {
+	api := newTestAPI(t, nil)
+	tokens := api.signIn("alice")
+	registerPasskey(t, api, tokens.AccessToken, passkey.NewSoftAuthenticator(testOrigin))
+	status, resp := api.changePassword(tokens.AccessToken, testPassword, testNewPassword, "")
+	if status != http.StatusOK || resp.Code != 0 || len(resp.Result.Passkeys) != 1 {
+		t.Fatalf("change password: %d %+v", status, resp)
+	}
+}
@@ -0,0 +1,28 @@
+package wellknown
+
+import (
+	"app/internal/auth"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// Handle : documents other services fetch to trust our tokens
+type Handle struct {
+	keys *auth.KeySet
+}
+
+func New(keys *auth.KeySet) *Handle {
+	return &Handle{
+		keys: keys,
+	}
+}
+
+func (ins *Handle) Apply(r *gin.Engine) {
+	r.GET("/.well-known/jwks.json", ins.jwks)
+}
+
+func (ins *Handle) jwks(c *gin.Context) {
+	// short enough for verifiers to see a new key well within the rotation overlap
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, ins.keys.JWKS())
+}
@@ -0,0 +1,23 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+const (
+	HeaderAdminKey = "X-Admin-Key"
+)
+
+// RequireAdminKey : guard operator endpoints with a shared key sent in X-Admin-Key
+func RequireAdminKey(key string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		given := c.Request.Header.Get(HeaderAdminKey)
+		if len(key) == 0 || subtle.ConstantTimeCompare([]byte(given), []byte(key)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
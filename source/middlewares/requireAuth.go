@@ -2,12 +2,11 @@ package middlewares
 
 import (
 	"app/internal/auth"
-	"app/internal/mongodb"
+	"app/internal/store"
 	"app/source/utils"
 	"errors"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
 	"log"
 	"net/http"
 	"time"
@@ -19,66 +18,104 @@ type UserCtx struct {
 	Username     string             `json:"-"`
 	AccessToken  string             `json:"-"`
 	RefreshToken string             `json:"-"`
+	Claims       *auth.Claims       `json:"-"`
 }
 
 const (
 	KeyUserContextAccess = "ACCESS-INFO"
+
+	// sessionTouchInterval limits how often last use of a session is written
+	sessionTouchInterval = time.Minute
 )
 
-func RequireAuth(c *gin.Context) {
+// RequireAuth : the bearer token must pass verifier and belong to a live
+// session of db, one that is neither revoked nor past its lifetime. Legacy
+// tokens were never stored with a session, the verifier bounds them instead
+// and they only read: a token that no logout or password change can revoke
+// must not change the account.
+func RequireAuth(verifier *auth.Verifier, db *store.DB, lifetime store.SessionLifetime) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bearerToken := c.Request.Header.Get("Authorization")
+		accessToken := utils.ExtractToken(bearerToken)
+		if accessToken == "" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
 
-	bearerToken := c.Request.Header.Get("Authorization")
-	accessToken := utils.ExtractToken(bearerToken)
-	if accessToken == "" {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
+		claims, err := verifier.Verify(accessToken)
+		if err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if claims.Legacy {
+			if !readOnly(c.Request.Method) {
+				log.Println("legacy token on a state changing route")
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			c.Set(KeyUserContextAccess,
+				UserCtx{primitive.NilObjectID,
+					claims.UserID,
+					claims.Username,
+					accessToken,
+					"",
+					claims})
+			c.Next()
+			return
+		}
+
+		session, err := db.Session.GetByAT(c.Request.Context(), accessToken)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		ready, err := db.User.ValidateSession(c.Request.Context(), session.ID)
+		if !ready || errors.Is(err, store.ErrNotFound) {
+			log.Println("session expired")
 
-	session, err := mongodb.Conn.Session.GetByAT(c.Request.Context(), accessToken)
-	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
-		c.AbortWithStatus(http.StatusForbidden)
-		return
-	}
-	ready, err := mongodb.Conn.User.ValidateSession(c.Request.Context(), session.ID)
-	if !ready || errors.Is(err, mongo.ErrNoDocuments) {
-		log.Println("session expired")
+		if err != nil {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		if session.UserID != claims.UserID {
+			log.Println("bad token")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if lifetime.Ended(session, time.Now()) {
+			log.Println("session expired")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
 
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
-	if err != nil {
-		c.AbortWithStatus(http.StatusForbidden)
-		return
-	}
+		if err := db.Session.Touch(c.Request.Context(), session, sessionTouchInterval, lifetime); err != nil {
+			log.Printf("RequireAuth touch session err %s", err)
+		}
 
-	uuid, username, claims, err := auth.ValidateAccessToken(accessToken)
-	if err != nil {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
+		c.Set(KeyUserContextAccess,
+			UserCtx{session.ID,
+				claims.UserID,
+				claims.Username,
+				session.AccessToken,
+				session.RefreshToken,
+				claims})
 
-	if claims.ExpiresAt.Before(time.Now()) || claims.IssuedAt.After(time.Now()) {
-		// Token expired
-		log.Println("this token has expired")
-		c.AbortWithStatus(http.StatusForbidden)
-		return
-	}
-	if session.UserID != uuid {
-		log.Println("bad token")
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
+		c.Next()
 	}
+}
 
-	c.Set(KeyUserContextAccess,
-		UserCtx{session.ID,
-			uuid,
-			username,
-			session.AccessToken,
-			session.RefreshToken})
-
-	c.Next()
+// readOnly : the methods that do not change state, RFC 9110 safe methods
+func readOnly(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
 }
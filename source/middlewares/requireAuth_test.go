@@ -0,0 +1,95 @@
+package middlewares
+
+import (
+	"app/internal/auth"
+	"app/internal/store"
+	"app/internal/store/memory"
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var legacySecret = []byte("legacy-secret")
+
+// serve : /me behind RequireAuth, answering with the user it resolved
+func serve(t *testing.T, legacy auth.LegacyConfig, method, token string) (int, UserCtx) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	keys, err := auth.NewKeySet(context.Background(), auth.NewMemoryKeyStore(), auth.DefaultKeyPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		verifier = auth.NewVerifier(keys, auth.DefaultClaimsConfig, legacy)
+		engine   = gin.New()
+		uCtx     UserCtx
+	)
+	engine.Any("/me", RequireAuth(verifier, memory.New(), store.SessionLifetime{}), func(c *gin.Context) {
+		value, _ := c.Get(KeyUserContextAccess)
+		uCtx = value.(UserCtx)
+		c.Status(http.StatusOK)
+	})
+	req := httptest.NewRequest(method, "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+	return rec.Code, uCtx
+}
+
+// legacyToken : an HS256 token as the previous issuer signed them
+func legacyToken(t *testing.T, uuid primitive.ObjectID) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"ID":       uuid.Hex(),
+		"Username": "alice",
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}).SignedString(legacySecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// TestRequireAuthLegacyToken : a legacy token has no session, it is accepted
+// during the grace period only
+func TestRequireAuthLegacyToken(t *testing.T) {
+	uuid := primitive.NewObjectID()
+	token := legacyToken(t, uuid)
+
+	status, uCtx := serve(t, auth.LegacyConfig{Secret: legacySecret, Until: time.Now().Add(time.Hour)}, http.MethodGet, token)
+	if status != http.StatusOK {
+		t.Fatalf("within the grace period: %d", status)
+	}
+	if uCtx.UUID != uuid || uCtx.Username != "alice" || !uCtx.Claims.Legacy || !uCtx.SessionID.IsZero() {
+		t.Fatalf("user context %+v", uCtx)
+	}
+
+	if status, _ := serve(t, auth.LegacyConfig{Secret: legacySecret, Until: time.Now().Add(-time.Minute)}, http.MethodGet, token); status != http.StatusUnauthorized {
+		t.Fatalf("after the grace period: %d", status)
+	}
+	if status, _ := serve(t, auth.LegacyConfig{}, http.MethodGet, token); status != http.StatusUnauthorized {
+		t.Fatalf("without a legacy secret: %d", status)
+	}
+}
+
+// TestRequireAuthLegacyTokenReadOnly : no session backs a legacy token, so
+// nothing could revoke it, it is refused on the methods that change state
+func TestRequireAuthLegacyTokenReadOnly(t *testing.T) {
+	var (
+		token  = legacyToken(t, primitive.NewObjectID())
+		legacy = auth.LegacyConfig{Secret: legacySecret, Until: time.Now().Add(time.Hour)}
+	)
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		if status, _ := serve(t, legacy, method, token); status != http.StatusUnauthorized {
+			t.Fatalf("%s: %d", method, status)
+		}
+	}
+	if status, _ := serve(t, legacy, http.MethodHead, token); status != http.StatusOK {
+		t.Fatalf("HEAD: %d", status)
+	}
+}